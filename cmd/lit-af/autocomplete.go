@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/mit-dci/lit/litrpc"
+	"github.com/mit-dci/lit/qln"
 	"github.com/chzyer/readline"
 )
 
@@ -15,6 +16,9 @@ func (lc *litAfClient) completePeers(line string) []string {
 	}
 	if len(pReply.Connections) > 0 {
 		for _, peer := range pReply.Connections {
+			if peer.State != qln.PeerConnected {
+				continue
+			}
 			var peerStr = fmt.Sprint(peer.PeerNumber)
 			names = append(names, peerStr)
 		}
@@ -37,6 +41,9 @@ func (lc *litAfClient) completeClosedPeers(line string) []string {
 	}
 	if len(pReply.Connections) > 0 {
 		for _, peer := range pReply.Connections {
+			if peer.State != qln.PeerConnected {
+				continue
+			}
 			var peerStr = fmt.Sprint(peer.PeerNumber)
 			connectedpeers = append(connectedpeers, peerStr)
 		}
@@ -81,14 +88,24 @@ func (lc *litAfClient) NewAutoCompleter() readline.AutoCompleter {
 			readline.PcItem("ls"),
 			readline.PcItem("con"),
 			readline.PcItem("lis"),
+			readline.PcItem("policy"),
+			readline.PcItem("announce"),
+			readline.PcItem("graph"),
 			readline.PcItem("adr"),
 			readline.PcItem("send"),
+			readline.PcItem("unsigned"),
+			readline.PcItem("signtx"),
+			readline.PcItem("pushtx"),
+			readline.PcItem("rescan"),
+			readline.PcItem("xpub"),
+			readline.PcItem("chainpeers"),
 			readline.PcItem("fan"),
 			readline.PcItem("sweep"),
 			readline.PcItem("fund"),
 			readline.PcItem("push"),
 			readline.PcItem("close"),
 			readline.PcItem("break"),
+			readline.PcItem("route"),
 			readline.PcItem("stop"),
 			readline.PcItem("exit"),
 		),
@@ -98,8 +115,24 @@ func (lc *litAfClient) NewAutoCompleter() readline.AutoCompleter {
 		readline.PcItem("con",
 			readline.PcItemDynamic(lc.completeClosedPeers)),
 		readline.PcItem("lis"),
+		readline.PcItem("policy",
+			readline.PcItem("allow"),
+			readline.PcItem("unallow"),
+			readline.PcItem("deny"),
+			readline.PcItem("undeny"),
+			readline.PcItem("maxin"),
+			readline.PcItem("iprate"),
+			readline.PcItem("nopersist")),
+		readline.PcItem("announce"),
+		readline.PcItem("graph"),
 		readline.PcItem("adr"),
 		readline.PcItem("send"),
+		readline.PcItem("unsigned"),
+		readline.PcItem("signtx"),
+		readline.PcItem("pushtx"),
+		readline.PcItem("rescan"),
+		readline.PcItem("xpub"),
+		readline.PcItem("chainpeers"),
 		readline.PcItem("fan"),
 		readline.PcItem("sweep"),
 		readline.PcItem("fund",
@@ -110,6 +143,7 @@ func (lc *litAfClient) NewAutoCompleter() readline.AutoCompleter {
 			readline.PcItemDynamic(lc.completeChannelIdx)),
 		readline.PcItem("break",
 			readline.PcItemDynamic(lc.completeChannelIdx)),
+		readline.PcItem("route"),
 		readline.PcItem("stop"),
 		readline.PcItem("exit"),
 	)
@@ -11,11 +11,13 @@ import (
 
 var fundCommand = &Command{
 	Format: fmt.Sprintf("%s%s\n", lnutil.White("fund"),
-		lnutil.ReqColor("peer", "coinType", "capacity", "initialSend")),
-	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		lnutil.ReqColor("peer", "coinType", "capacity", "initialSend")+
+			lnutil.OptColor("account")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n%s\n",
 		"Establish and fund a new lightning channel with the given peer.",
 		"The capacity is the amount of satoshi we insert into the channel,",
-		"and initialSend is the amount we initially hand over to the other party."),
+		"and initialSend is the amount we initially hand over to the other party.",
+		"Funds come from the given wallet account, or account 0 if omitted."),
 	ShortDescription: "Establish and fund a new lightning channel with the given peer.\n",
 }
 
@@ -45,6 +47,16 @@ var breakCommand = &Command{
 	ShortDescription: "Forcibly break the given channel.\n",
 }
 
+var routeCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s\n", lnutil.White("route"),
+		lnutil.ReqColor("node", "coinType", "amount"), lnutil.OptColor("routes")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n",
+		"Find ways to pay the given amount (in satoshis) to a node, through the",
+		"channels we've heard about.  The node is a lit address or pubkey.",
+		"Shows up to <routes> candidates, best first, or just the best one if omitted."),
+	ShortDescription: "Find ways to pay a node through other nodes' channels.\n",
+}
+
 func (lc *litAfClient) FundChannel(textArgs []string) error {
 	if len(textArgs) > 0 && textArgs[0] == "-h" {
 		fmt.Fprintf(color.Output, fundCommand.Format)
@@ -81,6 +93,14 @@ func (lc *litAfClient) FundChannel(textArgs []string) error {
 	args.Capacity = int64(cCap)
 	args.InitialSend = int64(iSend)
 
+	if len(textArgs) > 4 {
+		account, err := strconv.Atoi(textArgs[4])
+		if err != nil {
+			return err
+		}
+		args.Account = uint32(account)
+	}
+
 	err = lc.rpccon.Call("LitRPC.FundChannel", args, reply)
 	if err != nil {
 		return err
@@ -201,3 +221,55 @@ func (lc *litAfClient) Push(textArgs []string) error {
 
 	return nil
 }
+
+// Route shows candidate routes to pay a node
+func (lc *litAfClient) Route(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, routeCommand.Format)
+		fmt.Fprintf(color.Output, routeCommand.Description)
+		return nil
+	}
+	if len(textArgs) < 3 {
+		return fmt.Errorf(routeCommand.Format)
+	}
+
+	args := new(litrpc.QueryRoutesArgs)
+	reply := new(litrpc.QueryRoutesReply)
+
+	args.Dest = textArgs[0]
+	coinType, err := strconv.Atoi(textArgs[1])
+	if err != nil {
+		return err
+	}
+	amt, err := strconv.Atoi(textArgs[2])
+	if err != nil {
+		return err
+	}
+	args.CoinType = uint32(coinType)
+	args.Amt = int64(amt)
+	if len(textArgs) > 3 {
+		n, err := strconv.Atoi(textArgs[3])
+		if err != nil {
+			return err
+		}
+		args.NumRoutes = uint32(n)
+	}
+
+	err = lc.rpccon.Call("LitRPC.QueryRoutes", args, reply)
+	if err != nil {
+		return err
+	}
+
+	for i, rt := range reply.Routes {
+		fmt.Fprintf(color.Output, "%s %d: send %s fee %s delta %d\n",
+			lnutil.Header("Route"), i, lnutil.SatoshiColor(rt.Amt),
+			lnutil.SatoshiColor(rt.Fee), rt.Delta)
+		for _, h := range rt.Hops {
+			fmt.Fprintf(color.Output, "\t%s %s -> %s amt %s fee %s delta %d\n",
+				lnutil.OutPoint(h.Outpoint), lnutil.Address(h.From),
+				lnutil.Address(h.To), lnutil.SatoshiColor(h.Amt),
+				lnutil.SatoshiColor(h.Fee), h.Delta)
+		}
+	}
+	return nil
+}
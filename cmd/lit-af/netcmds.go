@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/mit-dci/lit/litrpc"
@@ -17,8 +18,10 @@ var sayCommand = &Command{
 }
 
 var lisCommand = &Command{
-	Format:           fmt.Sprintf("%s%s\n", lnutil.White("lis"), lnutil.OptColor("port")),
-	Description:      fmt.Sprintf("Start listening for incoming connections. The port number, if omitted, defaults to 2448.\n"),
+	Format: fmt.Sprintf("%s%s\n", lnutil.White("lis"), lnutil.OptColor("port")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Start listening for incoming connections. The port number, if omitted, defaults to 2448.",
+		"Give a Tor hidden service (name.onion[:port]) to listen on that port on localhost for it."),
 	ShortDescription: "Start listening for incoming connections.\n",
 }
 
@@ -31,6 +34,36 @@ var conCommand = &Command{
 	ShortDescription: "Make a connection to another host by connecting to their pubkeyhash\n",
 }
 
+var policyCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s\n", lnutil.White("policy"),
+		lnutil.OptColor("subcommand"), lnutil.OptColor("arg")),
+	Description: fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\n%s\n",
+		"Show or change who can connect to us.  With no subcommand, shows the policy.",
+		"allow / unallow <peer>: add or remove a lit address or pubkey on the allow list.",
+		"  Once anything is on it, only peers on it can connect to us.",
+		"deny / undeny <peer>: add or remove a peer on the deny list.  Denying drops it.",
+		"maxin <n>: at most n incoming peers, not counting allowed ones or ones with channels.",
+		"iprate <n>: at most n connections a minute from each IP.  0 for no limit.",
+		"nopersist <on|off>: don't save incoming peers until they make a channel."),
+	ShortDescription: "Show or change who can connect to us.\n",
+}
+
+var announceCommand = &Command{
+	Format: fmt.Sprintf("%s%s%s\n", lnutil.White("announce"),
+		lnutil.ReqColor("nickname"), lnutil.OptColor("host:port...")),
+	Description: fmt.Sprintf("%s\n%s\n",
+		"Tell the network our nickname, and where to connect to us.",
+		"Nodes only pass it on once we have an announced channel."),
+	ShortDescription: "Tell the network our nickname and addresses.\n",
+}
+
+var graphCommand = &Command{
+	Format: fmt.Sprintf("%s\n", lnutil.White("graph")),
+	Description: fmt.Sprintf("%s\n",
+		"Show the channels and nodes we've heard about from other nodes."),
+	ShortDescription: "Show the network's channels and nodes.\n",
+}
+
 // RequestAsync keeps requesting messages from the server.  The server blocks
 // and will send a response once it gets one.  Once the rpc client receives a
 // response, it will immediately request another.
@@ -65,6 +98,8 @@ func (lc *litAfClient) Lis(textArgs []string) error {
 	if len(textArgs) > 0 {
 		if strings.Contains(textArgs[0], ":") {
 			args.Port = textArgs[0]
+		} else if lnutil.IsOnion(textArgs[0]) {
+			args.Port = textArgs[0] + ":2448"
 		} else {
 			args.Port = ":" + textArgs[0]
 		}
@@ -142,3 +177,126 @@ func (lc *litAfClient) Say(textArgs []string) error {
 	fmt.Fprintf(color.Output, "%s\n", reply.Status)
 	return nil
 }
+
+// Policy shows or changes the peer policy.
+func (lc *litAfClient) Policy(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, policyCommand.Format)
+		fmt.Fprintf(color.Output, policyCommand.Description)
+		return nil
+	}
+
+	pReply := new(litrpc.PeerPolicyReply)
+	err := lc.rpccon.Call("LitRPC.GetPeerPolicy", nil, pReply)
+	if err != nil {
+		return err
+	}
+	p := pReply.Policy
+
+	if len(textArgs) == 0 {
+		fmt.Fprintf(color.Output, "%s %v\n", lnutil.Header("Allow:"), p.Allow)
+		fmt.Fprintf(color.Output, "%s %v\n", lnutil.Header("Deny:"), p.Deny)
+		fmt.Fprintf(color.Output, "max inbound %d, %d connections/min per IP, no persist %v\n",
+			p.MaxInbound, p.IPRateLimit, p.NoPersist)
+		return nil
+	}
+	if len(textArgs) < 2 {
+		return fmt.Errorf(policyCommand.Format)
+	}
+
+	reply := new(litrpc.StatusReply)
+	switch textArgs[0] {
+	case "allow", "unallow", "deny", "undeny":
+		args := new(litrpc.PolicyPeerArgs)
+		args.Peer = textArgs[1]
+		args.Remove = strings.HasPrefix(textArgs[0], "un")
+		method := "LitRPC.AllowPeer"
+		if strings.HasSuffix(textArgs[0], "deny") {
+			method = "LitRPC.DenyPeer"
+		}
+		err = lc.rpccon.Call(method, args, reply)
+
+	case "maxin", "iprate", "nopersist":
+		args := new(litrpc.PeerLimitsArgs)
+		args.MaxInbound = p.MaxInbound
+		args.IPRateLimit = p.IPRateLimit
+		args.NoPersist = p.NoPersist
+		switch textArgs[0] {
+		case "maxin":
+			args.MaxInbound, err = strconv.Atoi(textArgs[1])
+		case "iprate":
+			args.IPRateLimit, err = strconv.Atoi(textArgs[1])
+		case "nopersist":
+			if textArgs[1] != "on" && textArgs[1] != "off" {
+				return fmt.Errorf("nopersist takes on or off")
+			}
+			args.NoPersist = textArgs[1] == "on"
+		}
+		if err != nil {
+			return err
+		}
+		err = lc.rpccon.Call("LitRPC.SetPeerLimits", args, reply)
+
+	default:
+		return fmt.Errorf("unknown policy subcommand %s", textArgs[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(color.Output, "%s\n", reply.Status)
+	return nil
+}
+
+// Announce sends out a node announcement.
+func (lc *litAfClient) Announce(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, announceCommand.Format)
+		fmt.Fprintf(color.Output, announceCommand.Description)
+		return nil
+	}
+	if len(textArgs) < 1 {
+		return fmt.Errorf(announceCommand.Format)
+	}
+
+	args := new(litrpc.AnnounceNodeArgs)
+	reply := new(litrpc.StatusReply)
+	args.Nickname = textArgs[0]
+	args.Addrs = textArgs[1:]
+
+	err := lc.rpccon.Call("LitRPC.AnnounceNode", args, reply)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(color.Output, "%s\n", reply.Status)
+	return nil
+}
+
+// Graph shows the network graph.
+func (lc *litAfClient) Graph(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, graphCommand.Format)
+		fmt.Fprintf(color.Output, graphCommand.Description)
+		return nil
+	}
+
+	reply := new(litrpc.GraphReply)
+	err := lc.rpccon.Call("LitRPC.GetGraph", nil, reply)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(color.Output, "%s\n", lnutil.Header("Channels:"))
+	for _, c := range reply.Chans {
+		fmt.Fprintf(color.Output, "%s %s type %d cap %s height %d\n\t%s - %s\n",
+			lnutil.White("chan"), lnutil.OutPoint(c.Outpoint), c.Coin,
+			lnutil.SatoshiColor(c.Capacity), c.Height,
+			lnutil.Address(c.Nodes[0]), lnutil.Address(c.Nodes[1]))
+	}
+	fmt.Fprintf(color.Output, "%s\n", lnutil.Header("Nodes:"))
+	for _, n := range reply.Nodes {
+		fmt.Fprintf(color.Output, "%s %s %v (%s)\n",
+			lnutil.Address(n.LitAdr), lnutil.White(n.Nickname), n.Addrs,
+			time.Unix(n.Timestamp, 0).String())
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/fatih/color"
 	"github.com/mit-dci/lit/litrpc"
 	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/qln"
 )
 
 var lsCommand = &Command{
@@ -82,6 +83,54 @@ func (lc *litAfClient) Shellparse(cmdslice []string) error {
 		return nil
 	}
 
+	if cmd == "unsigned" { // build a tx to sign elsewhere
+		err = lc.Unsigned(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "unsigned error: %s\n", err)
+		}
+		return nil
+	}
+
+	if cmd == "signtx" { // sign a partial tx
+		err = lc.SignTx(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "signtx error: %s\n", err)
+		}
+		return nil
+	}
+
+	if cmd == "pushtx" { // broadcast a signed partial tx
+		err = lc.PushTx(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "pushtx error: %s\n", err)
+		}
+		return nil
+	}
+
+	if cmd == "rescan" { // look through old blocks again
+		err = lc.Rescan(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "rescan error: %s\n", err)
+		}
+		return nil
+	}
+
+	if cmd == "xpub" { // show an account's extended public key
+		err = lc.Xpub(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "xpub error: %s\n", err)
+		}
+		return nil
+	}
+
+	if cmd == "chainpeers" { // list full nodes the wallet is connected to
+		err = lc.ChainPeers(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "chainpeers error: %s\n", err)
+		}
+		return nil
+	}
+
 	if cmd == "lis" { // listen for lnd peers
 		err = lc.Lis(args)
 		if err != nil {
@@ -143,6 +192,34 @@ func (lc *litAfClient) Shellparse(cmdslice []string) error {
 		}
 		return nil
 	}
+	if cmd == "route" {
+		err = lc.Route(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "route error: %s\n", err)
+		}
+		return nil
+	}
+	if cmd == "policy" {
+		err = lc.Policy(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "policy error: %s\n", err)
+		}
+		return nil
+	}
+	if cmd == "announce" {
+		err = lc.Announce(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "announce error: %s\n", err)
+		}
+		return nil
+	}
+	if cmd == "graph" {
+		err = lc.Graph(args)
+		if err != nil {
+			fmt.Fprintf(color.Output, "graph error: %s\n", err)
+		}
+		return nil
+	}
 	if cmd == "say" {
 		err = lc.Say(args)
 		if err != nil {
@@ -214,8 +291,16 @@ func (lc *litAfClient) Ls(textArgs []string) error {
 	if len(pReply.Connections) > 0 {
 		fmt.Fprintf(color.Output, "\t%s\n", lnutil.Header("Peers:"))
 		for _, peer := range pReply.Connections {
-			fmt.Fprintf(color.Output, "%s %s\n",
+			fmt.Fprintf(color.Output, "%s %s",
 				lnutil.White(peer.PeerNumber), peer.RemoteHost)
+			if peer.State != qln.PeerConnected {
+				fmt.Fprintf(color.Output, " %s", lnutil.Red(peer.State))
+				if peer.Tries != 0 {
+					fmt.Fprintf(color.Output, " (%d tries, %s)",
+						peer.Tries, peer.LastError)
+				}
+			}
+			fmt.Fprintf(color.Output, "\n")
 		}
 	}
 
@@ -279,8 +364,7 @@ func (lc *litAfClient) Ls(textArgs []string) error {
 	}
 	fmt.Fprintf(color.Output, lnutil.Header("\tAddresses:\n"))
 	for i, a := range aReply.WitAddresses {
-		fmt.Fprintf(color.Output, "%d %s (%s)\n", i,
-			lnutil.Address(a), lnutil.Address(aReply.LegacyAddresses[i]))
+		fmt.Fprintf(color.Output, "%d %s\n", i, lnutil.Address(a))
 	}
 	err = lc.rpccon.Call("LitRPC.Balance", nil, bReply)
 	if err != nil {
@@ -296,6 +380,14 @@ func (lc *litAfClient) Ls(textArgs []string) error {
 			lnutil.Header("WitConf:"), lnutil.SatoshiColor(walBal.MatureWitty),
 			lnutil.Header("Channel:"), lnutil.SatoshiColor(walBal.ChanTotal),
 		)
+		if walBal.Unconfirmed != 0 {
+			fmt.Fprintf(color.Output, "\t%s %s\n", lnutil.Header("Pending:"),
+				lnutil.SatoshiColor(walBal.Unconfirmed))
+		}
+		if !walBal.ChainConnected {
+			fmt.Fprintf(color.Output, "\t%s\n",
+				lnutil.Red("chain backend disconnected"))
+		}
 	}
 
 	return nil
@@ -329,14 +421,24 @@ func (lc *litAfClient) Help(textArgs []string) error {
 		fmt.Fprintf(color.Output, "%s\t%s", lsCommand.Format, lsCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", addressCommand.Format, addressCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", sendCommand.Format, sendCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", unsignedCommand.Format, unsignedCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", signTxCommand.Format, signTxCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", pushTxCommand.Format, pushTxCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", rescanCommand.Format, rescanCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", xpubCommand.Format, xpubCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", chainPeersCommand.Format, chainPeersCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", fanCommand.Format, fanCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", sweepCommand.Format, sweepCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", lisCommand.Format, lisCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", conCommand.Format, conCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", policyCommand.Format, policyCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", announceCommand.Format, announceCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", graphCommand.Format, graphCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", fundCommand.Format, fundCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", pushCommand.Format, pushCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", closeCommand.Format, closeCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", breakCommand.Format, breakCommand.ShortDescription)
+		fmt.Fprintf(color.Output, "%s\t%s", routeCommand.Format, routeCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", offCommand.Format, offCommand.ShortDescription)
 		fmt.Fprintf(color.Output, "%s\t%s", exitCommand.Format, exitCommand.ShortDescription)
 		return nil
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/mit-dci/lit/litrpc"
@@ -11,15 +12,19 @@ import (
 
 var sendCommand = &Command{
 	Format: fmt.Sprintf(
-		"%s%s\n", lnutil.White("send"), lnutil.ReqColor("address", "amount")),
-	Description:      "Send the given amount of satoshis to the given address.\n",
+		"%s%s%s\n", lnutil.White("send"), lnutil.ReqColor("address", "amount"),
+		lnutil.OptColor("account")),
+	Description: "Send the given amount of satoshis to the given address.\n" +
+		"Spends from the given wallet account, or account 0 if omitted.\n",
 	ShortDescription: "Send the given amount of satoshis to the given address.\n",
 }
 
 var addressCommand = &Command{
 	Format: fmt.Sprintf(
-		"%s%s\n", lnutil.White("address"), lnutil.ReqColor("?amount", "?cointype")),
-	Description:      "Makes new addresses in a specified wallet.\n",
+		"%s%s%s\n", lnutil.White("address"),
+		lnutil.ReqColor("?amount", "?cointype", "?account"), lnutil.OptColor("legacy")),
+	Description: "Makes new bech32 addresses in a specified wallet and account.\n" +
+		"Add legacy to also show the old base58 versions.\n",
 	ShortDescription: "Makes new addresses.\n",
 }
 
@@ -40,6 +45,58 @@ var sweepCommand = &Command{
 	ShortDescription: "Move UTXOs with many 1-in-1-out txs.\n",
 }
 
+var unsignedCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s%s\n", lnutil.White("unsigned"), lnutil.ReqColor("address", "amount"),
+		lnutil.OptColor("account")),
+	Description: "Build a tx sending the given amount of satoshis to the given address, " +
+		"but don't sign it.\nPrints a hex partial tx which can be signed with signtx " +
+		"on a node with the same keys.\nThe inputs stay frozen until pushtx or restart.\n",
+	ShortDescription: "Build an unsigned tx for signing elsewhere.\n",
+}
+
+var signTxCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s\n", lnutil.White("signtx"), lnutil.ReqColor("partialtx")),
+	Description: "Sign whatever inputs of a hex partial tx this node has keys for, " +
+		"and print the result.\nCheck the outputs and fee it shows before " +
+		"pushing it.  Non-witness inputs need their previous txs in the partial tx.\n",
+	ShortDescription: "Sign a partial tx.\n",
+}
+
+var pushTxCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s\n", lnutil.White("pushtx"), lnutil.ReqColor("partialtx")),
+	Description:      "Broadcast a fully signed hex partial tx.\n",
+	ShortDescription: "Broadcast a signed partial tx.\n",
+}
+
+var rescanCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s%s\n", lnutil.White("rescan"),
+		lnutil.ReqColor("height"), lnutil.OptColor("cointype")),
+	Description: "Go back and look through the blocks again, starting at height.\n" +
+		"Use this to find funds after restoring a wallet from its key.\n",
+	ShortDescription: "Rescan blocks from the given height.\n",
+}
+
+var xpubCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s%s\n", lnutil.White("xpub"),
+		lnutil.OptColor("account"), lnutil.OptColor("cointype")),
+	Description: "Show the extended public key of a wallet account.\n" +
+		"Run lit with -xpub set to it to watch the account with no keys on the box.\n",
+	ShortDescription: "Show the xpub of a wallet account.\n",
+}
+
+var chainPeersCommand = &Command{
+	Format: fmt.Sprintf(
+		"%s%s\n", lnutil.White("chainpeers"), lnutil.OptColor("cointype")),
+	Description: "List the full nodes a wallet is connected to.\n" +
+		"The one marked sync is where headers and blocks come from.\n",
+	ShortDescription: "List the full nodes a wallet is connected to.\n",
+}
+
 // Send sends coins somewhere
 func (lc *litAfClient) Send(textArgs []string) error {
 	if len(textArgs) > 0 && textArgs[0] == "-h" {
@@ -67,6 +124,14 @@ func (lc *litAfClient) Send(textArgs []string) error {
 		return err
 	}
 
+	if len(textArgs) > 2 {
+		account, err := strconv.Atoi(textArgs[2])
+		if err != nil {
+			return err
+		}
+		args.Account = uint32(account)
+	}
+
 	fmt.Fprintf(color.Output, "send %d to address: %s \n", amt, textArgs[0])
 
 	args.DestAddrs = []string{textArgs[0]}
@@ -83,6 +148,232 @@ func (lc *litAfClient) Send(textArgs []string) error {
 	return nil
 }
 
+// Unsigned builds a tx but gives it back unsigned
+func (lc *litAfClient) Unsigned(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, unsignedCommand.Format)
+		fmt.Fprintf(color.Output, unsignedCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.SendArgs)
+	reply := new(litrpc.PartialTxReply)
+
+	if len(textArgs) < 2 {
+		return fmt.Errorf(unsignedCommand.Format)
+	}
+
+	amt, err := strconv.Atoi(textArgs[1])
+	if err != nil {
+		return err
+	}
+
+	if len(textArgs) > 2 {
+		account, err := strconv.Atoi(textArgs[2])
+		if err != nil {
+			return err
+		}
+		args.Account = uint32(account)
+	}
+
+	args.DestAddrs = []string{textArgs[0]}
+	args.Amts = []int64{int64(amt)}
+
+	err = lc.rpccon.Call("LitRPC.ExportUnsigned", args, reply)
+	if err != nil {
+		return err
+	}
+	printPartialTx(reply)
+	return nil
+}
+
+// SignTx signs a partial tx
+func (lc *litAfClient) SignTx(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, signTxCommand.Format)
+		fmt.Fprintf(color.Output, signTxCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.PartialTxArgs)
+	reply := new(litrpc.PartialTxReply)
+
+	if len(textArgs) < 1 {
+		return fmt.Errorf(signTxCommand.Format)
+	}
+	args.PartialTx = textArgs[0]
+
+	err := lc.rpccon.Call("LitRPC.SignPartial", args, reply)
+	if err != nil {
+		return err
+	}
+	printPartialTx(reply)
+	return nil
+}
+
+// PushTx broadcasts a signed partial tx
+func (lc *litAfClient) PushTx(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, pushTxCommand.Format)
+		fmt.Fprintf(color.Output, pushTxCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.PartialTxArgs)
+	reply := new(litrpc.TxidsReply)
+
+	if len(textArgs) < 1 {
+		return fmt.Errorf(pushTxCommand.Format)
+	}
+	args.PartialTx = textArgs[0]
+
+	err := lc.rpccon.Call("LitRPC.BroadcastPartial", args, reply)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(color.Output, "sent txid(s):\n")
+	for i, t := range reply.Txids {
+		fmt.Fprintf(color.Output, "\t%d %s\n", i, t)
+	}
+	return nil
+}
+
+func printPartialTx(reply *litrpc.PartialTxReply) {
+	fmt.Fprintf(color.Output, "txid %s, %d of %d inputs signed\n",
+		reply.Txid, reply.Signed, reply.Total)
+	for i, out := range reply.Outs {
+		fmt.Fprintf(color.Output, "\tout %d: %s %s\n",
+			i, out.Address, lnutil.SatoshiColor(out.Amt))
+	}
+	fmt.Fprintf(color.Output, "\tfee %s\n", lnutil.SatoshiColor(reply.Fee))
+	fmt.Fprintf(color.Output, "%s\n", reply.PartialTx)
+}
+
+// Rescan has the wallet look through old blocks again
+func (lc *litAfClient) Rescan(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, rescanCommand.Format)
+		fmt.Fprintf(color.Output, rescanCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.RescanArgs)
+	reply := new(litrpc.StatusReply)
+
+	if len(textArgs) < 1 {
+		return fmt.Errorf(rescanCommand.Format)
+	}
+
+	height, err := strconv.Atoi(textArgs[0])
+	if err != nil {
+		return err
+	}
+	args.FromHeight = int32(height)
+
+	if len(textArgs) > 1 {
+		coinType, err := strconv.Atoi(textArgs[1])
+		if err != nil {
+			return err
+		}
+		args.CoinType = uint32(coinType)
+	}
+
+	err = lc.rpccon.Call("LitRPC.Rescan", args, reply)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(color.Output, "%s\n", reply.Status)
+	return nil
+}
+
+// Xpub shows the extended public key of a wallet account
+func (lc *litAfClient) Xpub(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, xpubCommand.Format)
+		fmt.Fprintf(color.Output, xpubCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.XpubArgs)
+	reply := new(litrpc.XpubReply)
+
+	if len(textArgs) > 0 {
+		account, err := strconv.Atoi(textArgs[0])
+		if err != nil {
+			return err
+		}
+		args.Account = uint32(account)
+	}
+	if len(textArgs) > 1 {
+		coinType, err := strconv.Atoi(textArgs[1])
+		if err != nil {
+			return err
+		}
+		args.CoinType = uint32(coinType)
+	}
+
+	err := lc.rpccon.Call("LitRPC.Xpub", args, reply)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(color.Output, "%s\n", reply.Xpub)
+	return nil
+}
+
+// ChainPeers lists the full nodes a wallet is connected to
+func (lc *litAfClient) ChainPeers(textArgs []string) error {
+	if len(textArgs) > 0 && textArgs[0] == "-h" {
+		fmt.Fprintf(color.Output, chainPeersCommand.Format)
+		fmt.Fprintf(color.Output, chainPeersCommand.Description)
+		return nil
+	}
+
+	args := new(litrpc.CoinArgs)
+	reply := new(litrpc.ChainPeersReply)
+
+	if len(textArgs) > 0 {
+		coinType, err := strconv.Atoi(textArgs[0])
+		if err != nil {
+			return err
+		}
+		args.CoinType = uint32(coinType)
+	}
+
+	err := lc.rpccon.Call("LitRPC.ListChainPeers", args, reply)
+	if err != nil {
+		return err
+	}
+	if !reply.State.Connected {
+		fmt.Fprintf(color.Output, "%s since %s",
+			lnutil.Red("chain backend disconnected"),
+			time.Unix(reply.State.Since, 0).Format(time.Stamp))
+		if reply.State.LastError != "" {
+			fmt.Fprintf(color.Output, " (%s)", reply.State.LastError)
+		}
+		if reply.State.NextTry != 0 {
+			fmt.Fprintf(color.Output, ", retrying at %s",
+				time.Unix(reply.State.NextTry, 0).Format(time.Stamp))
+		}
+		fmt.Fprintf(color.Output, "\n")
+		return nil
+	}
+	if len(reply.Peers) == 0 {
+		fmt.Fprintf(color.Output, "coin type %d not connected to any nodes\n",
+			reply.CoinType)
+		return nil
+	}
+	for _, p := range reply.Peers {
+		sync := ""
+		if p.Sync {
+			sync = lnutil.Green(" sync")
+		}
+		fmt.Fprintf(color.Output, "%s%s %s ver %d height %d ban %d sent %d recv %d\n",
+			lnutil.White(p.Addr), sync, p.UserAgent, p.Version, p.Height,
+			p.BanScore, p.BytesSent, p.BytesRecv)
+	}
+	return nil
+}
+
 // Sweep moves utxos with many 1-in-1-out txs
 func (lc *litAfClient) Sweep(textArgs []string) error {
 	if len(textArgs) > 0 && textArgs[0] == "-h" {
@@ -176,12 +467,26 @@ func (lc *litAfClient) Address(textArgs []string) error {
 		return nil
 	}
 
-	var cointype, numadrs uint32
+	var cointype, numadrs, account uint32
+	var legacy bool
+
+	// "legacy" can go at the end of the args
+	if len(textArgs) > 0 && textArgs[len(textArgs)-1] == "legacy" {
+		legacy = true
+		textArgs = textArgs[:len(textArgs)-1]
+	}
 
 	// if no arguments given, generate 1 new address.
 	// if no cointype given, assume type 1 (testnet)
 	switch len(textArgs) {
-	default: // meaning 2 or more args.  args 3+ are ignored
+	default: // meaning 3 or more args.  args 4+ are ignored
+		anum, err := strconv.Atoi(textArgs[2])
+		if err != nil {
+			return err
+		}
+		account = uint32(anum)
+		fallthrough
+	case 2:
 		cnum, err := strconv.Atoi(textArgs[1])
 		if err != nil {
 			return err
@@ -206,6 +511,8 @@ func (lc *litAfClient) Address(textArgs []string) error {
 	args := new(litrpc.AddressArgs)
 	args.CoinType = cointype
 	args.NumToMake = numadrs
+	args.Account = account
+	args.Legacy = legacy
 
 	fmt.Printf("args: %v\n", args)
 	err := lc.rpccon.Call("LitRPC.Address", args, reply)
@@ -213,8 +520,12 @@ func (lc *litAfClient) Address(textArgs []string) error {
 		return err
 	}
 
-	fmt.Fprintf(color.Output, "new adr(s): %s\nold: %s\n",
-		lnutil.Address(reply.WitAddresses), lnutil.Address(reply.LegacyAddresses))
+	fmt.Fprintf(color.Output, "new adr(s): %s\n",
+		lnutil.Address(reply.WitAddresses))
+	if legacy {
+		fmt.Fprintf(color.Output, "old: %s\n",
+			lnutil.Address(reply.LegacyAddresses))
+	}
 	return nil
 
 }
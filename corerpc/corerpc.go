@@ -0,0 +1,284 @@
+package corerpc
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+corerpc is a ChainHook which gets everything from a full node (bitcoind,
+litecoind, ...) over its JSON-RPC interface, instead of from the p2p network
+like uspv.  If you already run a full node this is the simplest and most
+trusted way to hook up a wallit.
+
+Blocks are fetched in full with getblockhash / getblock, and unconfirmed txs
+with getrawmempool / getrawtransaction.  New blocks are found by polling
+getblockcount.  ZMQ would get them a bit faster but needs libzmq; polling a
+local node every few seconds is cheap enough.
+
+Nothing needs to be indexed on the node side (no -txindex), since every
+block above the wallit's sync height gets looked through.  Hashes of the
+last few blocks synced are kept, and if the node's chain doesn't have them
+any more, the wallit gets told those blocks are gone and syncing carries on
+from where the chains fork.
+
+implements this:
+
+ChainHook interface
+
+	Start(height int32, host, path string, params *chaincfg.Params) (
+		chan lnutil.TxAndHeight, chan int32, error)
+
+	RegisterAddress(address [20]byte) error
+	RegisterScriptHash(scriptHash [32]byte) error
+	RegisterOutPoint(wire.OutPoint) error
+	Rescan(fromHeight int32) error
+
+	PushTx(tx *wire.MsgTx) error
+
+	RawBlocks() chan *wire.MsgBlock
+*/
+
+// DefaultPollInterval is how often to ask the node about new blocks and
+// mempool txs, if PollInterval isn't set.
+const DefaultPollInterval = time.Second * 5
+
+// maxReorgDepth is how many block hashes to keep for noticing reorgs
+const maxReorgDepth = 100
+
+// CoreLink is a link to a full node's JSON-RPC interface.
+type CoreLink struct {
+	// url of the node, without the user / password
+	nodeURL    string
+	user, pass string
+	client     *http.Client
+	rpcID      uint64
+	rpcMtx     sync.Mutex
+
+	// TrackingAdrs and OPs are maps of addresses and outpoints to watch for.
+	TrackingAdrs    map[[20]byte]bool
+	TrackingAdrsMtx sync.Mutex
+
+	// TrackingScripts are p2wsh script hashes.  Also uses TrackingAdrsMtx.
+	TrackingScripts map[[32]byte]bool
+
+	TrackingOPs    map[wire.OutPoint]bool
+	TrackingOPsMtx sync.Mutex
+
+	TxUpToWallit chan lnutil.TxAndHeight
+
+	CurrentHeightChan chan int32
+
+	DisconnectChan chan lnutil.BlockDisconnect
+
+	// RawBlockSender is a channel to send full blocks up to the qln /
+	// watchtower.  Blocks only get sent if it's made before Start().
+	RawBlockSender chan *wire.MsgBlock
+
+	// PollInterval is how often to check for new blocks.  Can be set
+	// before calling Start().
+	PollInterval time.Duration
+
+	// Dialer connects to the node, maybe through a proxy.  nil dials directly.
+	Dialer lnutil.Dialer
+
+	// we've synced up to this height
+	height    int32
+	heightMtx sync.Mutex
+
+	// hashes of the blocks we've synced, for noticing reorgs.  Uses heightMtx.
+	hashes map[int32]chainhash.Hash
+
+	// mempool txids already looked at
+	mempoolSeen map[chainhash.Hash]bool
+
+	// wake up the poll loop early (after a rescan)
+	wake chan bool
+
+	p *chaincfg.Params
+}
+
+// IsNodeURL is true for hosts which should use a CoreLink rather than
+// connecting over p2p.
+func IsNodeURL(host string) bool {
+	return strings.HasPrefix(host, "http://") ||
+		strings.HasPrefix(host, "https://")
+}
+
+// p2p ports to RPC ports, for when the RPC port isn't given
+var rpcPorts = map[string]string{
+	"8333":  "8332",  // bitcoin
+	"18333": "18332", // bitcoin testnet3
+	"18444": "18443", // bitcoin regtest
+	"9333":  "9332",  // litecoin
+	"19335": "19332", // litecoin testnet4
+	"19444": "19443", // litecoin regtest
+}
+
+// NodeURL makes a url for a full node's RPC interface from a hostname
+// (port optional) and "user:password" credentials.
+func NodeURL(host, userpass string, p *chaincfg.Params) string {
+	if IsNodeURL(host) {
+		return host
+	}
+	if !strings.Contains(host, ":") {
+		port, ok := rpcPorts[p.DefaultPort]
+		if !ok {
+			port = p.DefaultPort
+		}
+		host = host + ":" + port
+	}
+	return "http://" + userpass + "@" + host
+}
+
+// Start connects to the node and starts polling it for blocks above
+// startHeight.  The first poll happens after PollInterval, by which time the
+// wallit has registered its addresses and outpoints.
+func (c *CoreLink) Start(
+	startHeight int32, host, path string, params *chaincfg.Params) (
+	chan lnutil.TxAndHeight, chan int32, error) {
+
+	c.p = params
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.pass, _ = u.User.Password()
+		u.User = nil
+	}
+	c.nodeURL = u.String()
+	c.client = lnutil.HTTPClient(c.Dialer, time.Minute)
+
+	if c.PollInterval == 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+
+	c.TrackingAdrs = make(map[[20]byte]bool)
+	c.TrackingScripts = make(map[[32]byte]bool)
+	c.TrackingOPs = make(map[wire.OutPoint]bool)
+	c.mempoolSeen = make(map[chainhash.Hash]bool)
+	c.hashes = make(map[int32]chainhash.Hash)
+
+	c.TxUpToWallit = make(chan lnutil.TxAndHeight, 1)
+	c.CurrentHeightChan = make(chan int32, 1)
+	c.DisconnectChan = make(chan lnutil.BlockDisconnect)
+	c.wake = make(chan bool, 1)
+
+	c.height = startHeight
+
+	// make sure the node is there before saying we're started
+	tip, err := c.GetBlockCount()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't reach full node at %s: %s",
+			c.nodeURL, err.Error())
+	}
+	log.Printf("full node %s at height %d, synced to %d\n",
+		c.nodeURL, tip, startHeight)
+
+	go c.PollLoop()
+
+	return c.TxUpToWallit, c.CurrentHeightChan, nil
+}
+
+// PollLoop checks for new blocks and mempool txs every PollInterval,
+// or right away when woken up.
+func (c *CoreLink) PollLoop() {
+	for {
+		select {
+		case <-c.wake:
+		case <-time.After(c.PollInterval):
+		}
+
+		err := c.SyncBlocks()
+		if err != nil {
+			log.Printf("corerpc SyncBlocks error: %s\n", err.Error())
+			continue
+		}
+		err = c.CheckMempool()
+		if err != nil {
+			log.Printf("corerpc CheckMempool error: %s\n", err.Error())
+		}
+	}
+}
+
+func (c *CoreLink) RegisterAddress(adr160 [20]byte) error {
+	c.TrackingAdrsMtx.Lock()
+	c.TrackingAdrs[adr160] = true
+	c.TrackingAdrsMtx.Unlock()
+	return nil
+}
+
+func (c *CoreLink) RegisterScriptHash(sh [32]byte) error {
+	c.TrackingAdrsMtx.Lock()
+	c.TrackingScripts[sh] = true
+	c.TrackingAdrsMtx.Unlock()
+	return nil
+}
+
+func (c *CoreLink) RegisterOutPoint(op wire.OutPoint) error {
+	c.TrackingOPsMtx.Lock()
+	c.TrackingOPs[op] = true
+	c.TrackingOPsMtx.Unlock()
+	return nil
+}
+
+// Rescan sets the height back, and wakes up the poll loop to go through
+// the blocks from fromHeight up again.
+func (c *CoreLink) Rescan(fromHeight int32) error {
+	if fromHeight < 1 {
+		return fmt.Errorf("Can't rescan from height %d", fromHeight)
+	}
+	log.Printf("rescanning from height %d\n", fromHeight)
+
+	c.heightMtx.Lock()
+	c.height = fromHeight - 1
+	c.heightMtx.Unlock()
+
+	select {
+	case c.wake <- true:
+	default: // already awake
+	}
+	return nil
+}
+
+// PushTx sends a tx to the full node with sendrawtransaction.
+func (c *CoreLink) PushTx(tx *wire.MsgTx) error {
+	if tx == nil {
+		return fmt.Errorf("tx is nil")
+	}
+	var buf bytes.Buffer
+	err := tx.Serialize(&buf)
+	if err != nil {
+		return err
+	}
+
+	var txid string
+	err = c.call("sendrawtransaction", &txid, fmt.Sprintf("%x", buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	log.Printf("pushed tx %s\n", txid)
+	return nil
+}
+
+func (c *CoreLink) BlockDisconnects() chan lnutil.BlockDisconnect {
+	return c.DisconnectChan
+}
+
+func (c *CoreLink) RawBlocks() chan *wire.MsgBlock {
+	return c.RawBlockSender
+}
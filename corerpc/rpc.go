@@ -0,0 +1,181 @@
+package corerpc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// JSON-RPC 1.0, the way bitcoind does it
+
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     uint64          `json:"id"`
+}
+
+// call does a JSON-RPC call to the node and puts the result in result.
+func (c *CoreLink) call(
+	method string, result interface{}, params ...interface{}) error {
+
+	c.rpcMtx.Lock()
+	c.rpcID++
+	req := rpcRequest{
+		JSONRPC: "1.0",
+		ID:      c.rpcID,
+		Method:  method,
+		Params:  params,
+	}
+	c.rpcMtx.Unlock()
+	if req.Params == nil {
+		req.Params = []interface{}{}
+	}
+
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest(
+		"POST", c.nodeURL, bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.user != "" {
+		httpReq.SetBasicAuth(c.user, c.pass)
+	}
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	// bitcoind gives a 500 with the error in the json body for rpc errors,
+	// but 401 / 403 / 404 have no json
+	if httpResp.StatusCode == http.StatusUnauthorized ||
+		httpResp.StatusCode == http.StatusForbidden ||
+		httpResp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: http %s", method, httpResp.Status)
+	}
+
+	var resp rpcResponse
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return fmt.Errorf("%s: %s (http %s)", method, err.Error(), httpResp.Status)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s error %d: %s",
+			method, resp.Error.Code, resp.Error.Message)
+	}
+	if resp.ID != req.ID {
+		return fmt.Errorf("%s: response id %d, expect %d", method, resp.ID, req.ID)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// GetBlockCount returns the height of the node's best block.
+func (c *CoreLink) GetBlockCount() (int32, error) {
+	var height int32
+	err := c.call("getblockcount", &height)
+	return height, err
+}
+
+// GetBlockHash returns the hash of the block at a height.
+func (c *CoreLink) GetBlockHash(height int32) (*chainhash.Hash, error) {
+	var hashString string
+	err := c.call("getblockhash", &hashString, height)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(hashString)
+}
+
+// GetBlock gets a full block, with witnesses, by hash.
+func (c *CoreLink) GetBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	var blockHex string
+	// verbosity 0 gives back the serialized block in hex
+	err := c.call("getblock", &blockHex, hash.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	blockBytes, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return nil, err
+	}
+	block := new(wire.MsgBlock)
+	err = block.Deserialize(bytes.NewReader(blockBytes))
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetRawTx gets a tx by txid.  Without -txindex on the node, this only works
+// for mempool txs.
+func (c *CoreLink) GetRawTx(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	var txHex string
+	err := c.call("getrawtransaction", &txHex, txid.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx()
+	err = tx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// IsUnspent asks the node if an outpoint is in its utxo set, mempool
+// spends included.  Spent and never-existed look the same.
+func (c *CoreLink) IsUnspent(op wire.OutPoint) (bool, error) {
+	var txOut json.RawMessage
+	err := c.call("gettxout", &txOut, op.Hash.String(), op.Index, true)
+	if err != nil {
+		return false, err
+	}
+	return len(txOut) != 0 && string(txOut) != "null", nil
+}
+
+// GetRawMempool returns the txids of everything in the node's mempool.
+func (c *CoreLink) GetRawMempool() ([]*chainhash.Hash, error) {
+	var txidStrings []string
+	err := c.call("getrawmempool", &txidStrings)
+	if err != nil {
+		return nil, err
+	}
+	txids := make([]*chainhash.Hash, len(txidStrings))
+	for i, s := range txidStrings {
+		txids[i], err = chainhash.NewHashFromStr(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return txids, nil
+}
@@ -0,0 +1,212 @@
+package corerpc
+
+import (
+	"log"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// SyncBlocks goes through every block above the synced height, up to the
+// node's tip, and sends matching txs up to the wallit.
+func (c *CoreLink) SyncBlocks() error {
+	tip, err := c.GetBlockCount()
+	if err != nil {
+		return err
+	}
+	err = c.CheckReorg(tip)
+	if err != nil {
+		return err
+	}
+
+	for {
+		c.heightMtx.Lock()
+		height := c.height + 1
+		c.heightMtx.Unlock()
+		if height > tip {
+			return nil
+		}
+
+		hash, err := c.ScanBlock(height)
+		if err != nil {
+			return err
+		}
+
+		c.heightMtx.Lock()
+		// if there was a rescan while we were in this block, don't move up
+		moved := c.height == height-1
+		if moved {
+			c.height = height
+			c.hashes[height] = *hash
+			delete(c.hashes, height-maxReorgDepth)
+		}
+		c.heightMtx.Unlock()
+
+		if moved {
+			c.CurrentHeightChan <- height
+		}
+	}
+}
+
+// CheckReorg goes back from the synced height until the node agrees with
+// the block hashes we saw, and tells the wallit about each block that's gone,
+// tip first.  Syncing then carries on from the fork.
+func (c *CoreLink) CheckReorg(tip int32) error {
+	c.heightMtx.Lock()
+	synced := c.height
+	c.heightMtx.Unlock()
+
+	var gone []lnutil.BlockDisconnect
+	fork := synced
+	for ; fork > 0; fork-- {
+		c.heightMtx.Lock()
+		known, ok := c.hashes[fork]
+		c.heightMtx.Unlock()
+		if !ok {
+			break // too old, or from before we started; assume it's fine
+		}
+		// blocks above the node's tip are gone too
+		if fork <= tip {
+			remote, err := c.GetBlockHash(fork)
+			if err != nil {
+				return err
+			}
+			if remote.IsEqual(&known) {
+				break
+			}
+		}
+		gone = append(gone, lnutil.BlockDisconnect{Height: fork, Hash: known})
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	log.Printf("reorg: block at %d changed, going back to %d\n", synced, fork)
+
+	c.heightMtx.Lock()
+	c.height = fork
+	for _, d := range gone {
+		delete(c.hashes, d.Height)
+	}
+	c.heightMtx.Unlock()
+
+	for _, d := range gone {
+		c.DisconnectChan <- d
+	}
+	return nil
+}
+
+// ScanBlock gets the block at a height and sends matching txs up to the
+// wallit, and the whole block up to the watchtower if it wants it.
+// Returns the block's hash.
+func (c *CoreLink) ScanBlock(height int32) (*chainhash.Hash, error) {
+	hash, err := c.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var hits int
+	for _, tx := range block.Transactions {
+		// confirmed now; no need to remember it from the mempool
+		delete(c.mempoolSeen, tx.TxHash())
+
+		if c.MatchTx(tx) {
+			c.TxUpToWallit <- lnutil.TxAndHeight{Tx: tx, Height: height}
+			hits++
+		}
+	}
+	if hits != 0 {
+		log.Printf("block %d %s had %d txs of interest\n",
+			height, hash.String(), hits)
+	}
+
+	// hand block over to the watchtower via the RawBlockSender chan
+	if cap(c.RawBlockSender) != 0 {
+		c.RawBlockSender <- block
+	}
+	return hash, nil
+}
+
+// CheckMempool looks at new txs in the node's mempool, and sends matching
+// ones up to the wallit at height 0.
+func (c *CoreLink) CheckMempool() error {
+	txids, err := c.GetRawMempool()
+	if err != nil {
+		return err
+	}
+
+	inPool := make(map[chainhash.Hash]bool, len(txids))
+	for _, txid := range txids {
+		inPool[*txid] = true
+		if c.mempoolSeen[*txid] {
+			continue
+		}
+		tx, err := c.GetRawTx(txid)
+		if err != nil {
+			// may have left the mempool since getrawmempool; try next time
+			log.Printf("CheckMempool %s: %s\n", txid.String(), err.Error())
+			delete(inPool, *txid)
+			continue
+		}
+		if c.MatchTx(tx) {
+			c.TxUpToWallit <- lnutil.TxAndHeight{Tx: tx, Height: 0}
+		}
+	}
+	// forget about txs which aren't in the mempool anymore
+	c.mempoolSeen = inPool
+	return nil
+}
+
+// MatchTx returns true if the tx gains or loses money for us.  Outputs to
+// tracked addresses get added to the tracked outpoints, so that txs spending
+// them later in the same block get matched.  Same as uspv's MatchTx.
+func (c *CoreLink) MatchTx(tx *wire.MsgTx) bool {
+	gain := false
+	txid := tx.TxHash()
+
+	c.TrackingAdrsMtx.Lock()
+	defer c.TrackingAdrsMtx.Unlock()
+	c.TrackingOPsMtx.Lock()
+	defer c.TrackingOPsMtx.Unlock()
+
+	for i, out := range tx.TxOut {
+		op := wire.NewOutPoint(&txid, uint32(i))
+
+		// 20 byte pubkey hash or 32 byte script hash of this txout (if any)
+		var tracked bool
+		hash := lnutil.KeyHashFromPkScript(out.PkScript)
+		switch len(hash) {
+		case 20:
+			var adr20 [20]byte
+			copy(adr20[:], hash)
+			tracked = c.TrackingAdrs[adr20]
+		case 32:
+			var sh [32]byte
+			copy(sh[:], hash)
+			tracked = c.TrackingScripts[sh]
+		}
+
+		if tracked {
+			gain = true
+			c.TrackingOPs[*op] = true
+		}
+		// this outpoint may confirm an outpoint we're watching
+		if c.TrackingOPs[*op] {
+			gain = true
+		}
+	}
+	if gain {
+		return true
+	}
+
+	for _, in := range tx.TxIn {
+		if c.TrackingOPs[in.PreviousOutPoint] {
+			return true
+		}
+	}
+	return false
+}
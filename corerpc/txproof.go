@@ -0,0 +1,39 @@
+package corerpc
+
+import (
+	"fmt"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// TxProof gets the block at height from the node, and proves txid is in it.
+func (c *CoreLink) TxProof(txid chainhash.Hash, height int32) (
+	*wire.MsgTx, lnutil.TxProof, error) {
+	hash, err := c.GetBlockHash(height)
+	if err != nil {
+		return nil, lnutil.TxProof{}, err
+	}
+	block, err := c.GetBlock(hash)
+	if err != nil {
+		return nil, lnutil.TxProof{}, err
+	}
+	return lnutil.BlockTxProof(block, txid, height)
+}
+
+// CheckTxProof checks a proof against the node's block at its height.
+func (c *CoreLink) CheckTxProof(txid chainhash.Hash, p lnutil.TxProof) error {
+	hash, err := c.GetBlockHash(p.Height)
+	if err != nil {
+		return err
+	}
+	block, err := c.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+	if p.Root(txid) != block.Header.MerkleRoot {
+		return fmt.Errorf("tx %s not in block %d", txid.String(), p.Height)
+	}
+	return nil
+}
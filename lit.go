@@ -11,21 +11,20 @@ import (
 	"time"
 
 	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcutil/hdkeychain"
+	"github.com/mit-dci/lit/corerpc"
 	"github.com/mit-dci/lit/litbamf"
 	"github.com/mit-dci/lit/litrpc"
 	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/powless"
 	"github.com/mit-dci/lit/qln"
+	"github.com/mit-dci/lit/uspv"
 )
 
 const (
 	litHomeDirName = ".lit"
 
 	keyFileName = "privkey.hex"
-
-	// this is my local testnet node, replace it with your own close by.
-	// Random internet testnet nodes usually work but sometimes don't, so
-	// maybe I should test against different versions out there.
-	hardHeight = 1111111 // height to start at if not specified
 )
 
 // variables for a lit node & lower layers
@@ -35,6 +34,30 @@ type LitConfig struct {
 	// hostnames to connect to for different networks
 	tn3host, bc2host, lt4host, reghost, litereghost string
 
+	// "user:password" for full node RPC.  If set, hosts are full nodes' RPC
+	// interfaces instead of p2p nodes.
+	coreRPC string
+
+	// block explorer API flavour (insight or esplora).  If set, hosts are
+	// explorer base urls, or the network's default explorer if not urls.
+	explorer string
+
+	// use compact block filters, checking filter headers with cfPeers
+	cfilters bool
+	cfPeers  []string
+
+	// account xpub for watch-only wallets; no wallet private keys get used
+	// for networks it's valid for
+	watchXpub string
+
+	// SOCKS5 proxy (like Tor) for full node, explorer and peer connections, and
+	// whether each destination gets its own circuit
+	proxy   string
+	isolate bool
+
+	// use the old peer handshake, for nodes without Noise_XK
+	legacyConn bool
+
 	verbose    bool
 	birthblock int32
 	rpcport    uint16
@@ -44,20 +67,43 @@ type LitConfig struct {
 }
 
 func setConfig(lc *LitConfig) {
-	birthptr := flag.Int("tip", hardHeight, "height to begin db sync")
+	birthptr := flag.Int("tip", 0,
+		"height to begin db sync; 0 for the network's newest checkpoint")
 
 	easyptr := flag.Bool("ez", false, "use easy mode (bloom filters)")
 
 	verbptr := flag.Bool("v", false, "verbose; print all logs to stdout")
 
-	tn3ptr := flag.String("tn3", "testnet3.lit3.co", "testnet3 full node")
-	regptr := flag.String("reg", "", "regtest full node")
-	literegptr := flag.String("ltr", "", "litecoin regtest full node")
-	bc2ptr := flag.String("bc2", "", "bc2 full node")
-	lt4ptr := flag.String("lt4", "litetest4.lit3.co", "litecoin testnet4 full node")
+	// more nodes get found from these, and DNS seeds for some networks
+	tn3ptr := flag.String("tn3", "testnet3.lit3.co", "testnet3 full nodes, comma separated")
+	regptr := flag.String("reg", "", "regtest full nodes, comma separated")
+	literegptr := flag.String("ltr", "", "litecoin regtest full nodes, comma separated")
+	bc2ptr := flag.String("bc2", "", "bc2 full nodes, comma separated")
+	lt4ptr := flag.String("lt4", "litetest4.lit3.co",
+		"litecoin testnet4 full nodes, comma separated")
 
 	resyncprt := flag.Bool("resync", false, "force resync from given tip")
 
+	corerpcptr := flag.String("corerpc", "",
+		"user:password; connect to the full nodes' RPC interface instead of p2p")
+
+	cfptr := flag.Bool("cf", false, "use compact block filters (BIP157/158)")
+	cfpeersptr := flag.String("cfpeers", "",
+		"comma separated nodes to check compact filter headers with")
+
+	explorerptr := flag.String("explorer", "",
+		"insight or esplora; use a block explorer web API instead of a node")
+
+	xpubptr := flag.String("xpub", "",
+		"account xpub (m/44'/coin'/account') for watch-only wallets on its network")
+
+	proxyptr := flag.String("proxy", "",
+		"host:port of a SOCKS5 proxy (Tor is 127.0.0.1:9050) for nodes, explorers and peers")
+	isolateptr := flag.Bool("isolate", false,
+		"with -proxy, use a separate Tor circuit for each node and peer")
+	legacyconnptr := flag.Bool("legacyconn", false,
+		"dial peers with the old handshake (no forward secrecy) and accept it too")
+
 	rpcportptr := flag.Int("rpcport", 8001, "port to listen for RPC")
 
 	litHomeDir := flag.String("dir",
@@ -73,6 +119,16 @@ func setConfig(lc *LitConfig) {
 	lc.litereghost = *literegptr
 
 	lc.reSync = *resyncprt
+	lc.watchXpub = *xpubptr
+	lc.proxy = *proxyptr
+	lc.isolate = *isolateptr
+	lc.legacyConn = *legacyconnptr
+	lc.coreRPC = *corerpcptr
+	lc.explorer = *explorerptr
+	lc.cfilters = *cfptr
+	if *cfpeersptr != "" {
+		lc.cfPeers = strings.Split(*cfpeersptr, ",")
+	}
 	lc.hard = !*easyptr
 	lc.verbose = *verbptr
 
@@ -93,11 +149,8 @@ func linkWallets(node *qln.LitNode, key *[32]byte, conf *LitConfig) error {
 	// try regtest
 	if conf.reghost != "" {
 		p := &chaincfg.RegressionNetParams
-		if !strings.Contains(conf.reghost, ":") {
-			conf.reghost = conf.reghost + ":" + p.DefaultPort
-		}
 		fmt.Printf("reg: %s\n", conf.reghost)
-		err = node.LinkBaseWallet(key, 120, conf.reSync, conf.reghost, p)
+		err = linkWallet(node, key, conf, conf.reghost, p)
 		if err != nil {
 			return err
 		}
@@ -105,11 +158,7 @@ func linkWallets(node *qln.LitNode, key *[32]byte, conf *LitConfig) error {
 	// try testnet3
 	if conf.tn3host != "" {
 		p := &chaincfg.TestNet3Params
-		if !strings.Contains(conf.tn3host, ":") {
-			conf.tn3host = conf.tn3host + ":" + p.DefaultPort
-		}
-		err = node.LinkBaseWallet(
-			key, conf.birthblock, conf.reSync, conf.tn3host, p)
+		err = linkWallet(node, key, conf, conf.tn3host, p)
 		if err != nil {
 			return err
 		}
@@ -117,10 +166,7 @@ func linkWallets(node *qln.LitNode, key *[32]byte, conf *LitConfig) error {
 	// try litecoin regtest
 	if conf.litereghost != "" {
 		p := &chaincfg.LiteRegNetParams
-		if !strings.Contains(conf.litereghost, ":") {
-			conf.litereghost = conf.litereghost + ":" + p.DefaultPort
-		}
-		err = node.LinkBaseWallet(key, 120, conf.reSync, conf.litereghost, p)
+		err = linkWallet(node, key, conf, conf.litereghost, p)
 		if err != nil {
 			return err
 		}
@@ -129,10 +175,7 @@ func linkWallets(node *qln.LitNode, key *[32]byte, conf *LitConfig) error {
 	// try litecoin testnet4
 	if conf.lt4host != "" {
 		p := &chaincfg.LiteCoinTestNet4Params
-		if !strings.Contains(conf.lt4host, ":") {
-			conf.lt4host = conf.lt4host + ":" + p.DefaultPort
-		}
-		err = node.LinkBaseWallet(key, 47295, conf.reSync, conf.lt4host, p)
+		err = linkWallet(node, key, conf, conf.lt4host, p)
 		if err != nil {
 			return err
 		}
@@ -140,6 +183,46 @@ func linkWallets(node *qln.LitNode, key *[32]byte, conf *LitConfig) error {
 	return nil
 }
 
+// linkWallet links a single wallet.  If there's a watch-only xpub for
+// this network, it uses that instead of the key.
+func linkWallet(node *qln.LitNode, key *[32]byte, conf *LitConfig,
+	host string, p *chaincfg.Params) error {
+
+	// without a height to start from, start at the newest checkpoint
+	birth := conf.birthblock
+	if birth == 0 {
+		birth = uspv.CheckpointHeight(p)
+	}
+
+	// with corerpc or explorer, the host becomes a url which picks that
+	// chainhook
+	if conf.explorer != "" {
+		var err error
+		host, err = powless.ExplorerURL(conf.explorer, host, p)
+		if err != nil {
+			return err
+		}
+	} else if conf.coreRPC != "" {
+		host = corerpc.NodeURL(host, conf.coreRPC, p)
+	} else if conf.cfilters {
+		// checkers on other networks fail the handshake and get skipped
+		host = uspv.CFilterHost(append([]string{host}, conf.cfPeers...), p)
+	}
+
+	if conf.watchXpub != "" {
+		acctPub, err := hdkeychain.NewKeyFromString(conf.watchXpub)
+		if err != nil {
+			return err
+		}
+		if acctPub.IsForNet(p) {
+			fmt.Printf("%s wallet is watch-only\n", p.Name)
+			return node.LinkWatchOnlyWallet(
+				conf.watchXpub, birth, conf.reSync, host, p)
+		}
+	}
+	return node.LinkBaseWallet(key, birth, conf.reSync, host, p)
+}
+
 func main() {
 
 	log.Printf("lit v0.1\n")
@@ -190,6 +273,12 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if conf.proxy != "" {
+		node.Dialer = &lnutil.Socks5Dialer{Proxy: conf.proxy,
+			Isolate: conf.isolate, Timeout: time.Minute}
+		log.Printf("connecting out through proxy %s\n", conf.proxy)
+	}
+	node.LegacyConn = conf.legacyConn
 
 	// node is up; link wallets based on args
 	err = linkWallets(node, key, conf)
@@ -43,7 +43,7 @@ class ActionList extends Reflux.Component {
   update () {
     Q.spread([
       lc.send('LitRPC.TxoList'),
-      lc.send('LitRPC.Address', {'NumToMake': 0}),
+      lc.send('LitRPC.Address', {'NumToMake': 0, 'Legacy': true}),
     ], (txs, addrs) => {
       let transactions = txs.Txos.map(tx => {
         return tx.OutPoint.split(';')[0];
@@ -125,7 +125,7 @@ class Legacy extends Reflux.Component {
     });
   }
   address () {
-    lc.send('LitRPC.Address', {'NumToMake': 1}).then(addrs => {
+    lc.send('LitRPC.Address', {'NumToMake': 1, 'Legacy': true}).then(addrs => {
       Actions.setAddresses([
         ...addrs.LegacyAddresses,
         ...this.state.addresses.legacy,
@@ -1,6 +1,7 @@
 package litrpc
 
 import (
+	"fmt"
 	"log"
 	"strings"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/adiabat/btcd/chaincfg"
 	"github.com/adiabat/btcd/txscript"
 	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
 )
 
 /*
@@ -18,14 +20,20 @@ Multi-wallet address functions that maybe should be in another package
 
 // AdrStringToOutscript converts an address string into an output script byte slice
 // note that this ignores the prefix! Be careful not to mix networks.
-// currently only works for testnet legacy addresses
+// bech32 addresses can be p2wpkh (20 byte) or p2wsh (32 byte); base58
+// addresses currently only work for testnet.
 func AdrStringToOutscript(adr string) ([]byte, error) {
 	var err error
 	var outScript []byte
 
 	// use HRP to determine network / wallet to use
 	outScript, err = bech32.SegWitAddressDecode(adr)
-	if err != nil { // valid bech32 string
+	if err == nil {
+		// valid bech32 string; make sure it's a witness v0 program we know
+		if !lnutil.IsWitnessV0Script(outScript) {
+			return nil, fmt.Errorf("%s is not a p2wpkh or p2wsh address", adr)
+		}
+	} else {
 		// try for base58 address
 		// btcutil addresses don't really work as they won't tell you the
 		// network; you have to tell THEM the network, which defeats the point
@@ -46,6 +54,22 @@ func AdrStringToOutscript(adr string) ([]byte, error) {
 	return outScript, nil
 }
 
+// OutscriptToAdrString gives the address an output script pays to, for
+// showing to the user.  Scripts with no address come back as hex.
+func OutscriptToAdrString(script []byte, param *chaincfg.Params) string {
+	if lnutil.IsWitnessV0Script(script) {
+		adr, err := bech32.SegWitV0Encode(param.Bech32Prefix, script[2:])
+		if err == nil {
+			return adr
+		}
+	}
+	_, adrs, _, err := txscript.ExtractPkScriptAddrs(script, param)
+	if err == nil && len(adrs) == 1 {
+		return adrs[0].String()
+	}
+	return fmt.Sprintf("script %x", script)
+}
+
 // Default to testnet for unknown / bad addrs.
 func CoinTypeFromAdr(adr string) uint32 {
 	ct, err := CoinTypeFromBechAdr(adr)
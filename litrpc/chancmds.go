@@ -3,6 +3,7 @@ package litrpc
 import (
 	"fmt"
 
+	"github.com/mit-dci/lit/lnutil"
 	"github.com/mit-dci/lit/portxo"
 	"github.com/mit-dci/lit/qln"
 )
@@ -61,6 +62,7 @@ func (r *LitRPC) ChannelList(args ChanArgs, reply *ChannelListReply) error {
 type FundArgs struct {
 	Peer        uint32 // who to make the channel with
 	CoinType    uint32 // what coin to use
+	Account     uint32 // wallet account to fund from
 	Capacity    int64  // later can be minimum capacity
 	Roundup     int64  // ignore for now; can be used to round-up capacity
 	InitialSend int64  // Initial send of -1 means "ALL"
@@ -94,7 +96,7 @@ func (r *LitRPC) FundChannel(args FundArgs, reply *StatusReply) error {
 	// strictly required but it's better to fail here instead of after net traffic.
 	// also assume a fee of like 50K sat just to be safe
 	var allPorTxos portxo.TxoSliceByAmt
-	allPorTxos, err = wal.UtxoDump()
+	allPorTxos, err = wal.AccountUtxoDump(args.Account)
 	if err != nil {
 		return err
 	}
@@ -107,7 +109,7 @@ func (r *LitRPC) FundChannel(args FundArgs, reply *StatusReply) error {
 	}
 
 	idx, err := r.Node.FundChannel(
-		args.Peer, args.CoinType, args.Capacity, args.InitialSend)
+		args.Peer, args.CoinType, args.Account, args.Capacity, args.InitialSend)
 	if err != nil {
 		return err
 	}
@@ -215,3 +217,65 @@ func (r *LitRPC) BreakChannel(args ChanArgs, reply *StatusReply) error {
 	}
 	return r.Node.BreakChannel(qc)
 }
+
+// ------------------------- routes
+type QueryRoutesArgs struct {
+	Dest      string // lit address or pubkey
+	CoinType  uint32
+	Amt       int64
+	NumRoutes uint32 // 1 if 0
+}
+
+type RouteHop struct {
+	Outpoint string
+	From     string // lit addresses
+	To       string
+	Amt      int64 // what goes to To
+	Fee      int64 // what From gets
+	Delta    uint16
+}
+
+type RouteInfo struct {
+	Hops  []RouteHop
+	Amt   int64 // what we'd send, with fees
+	Fee   int64
+	Delta uint32
+}
+
+type QueryRoutesReply struct {
+	Routes []RouteInfo
+}
+
+// QueryRoutes finds ways to pay a node through the channel graph
+func (r *LitRPC) QueryRoutes(args QueryRoutesArgs, reply *QueryRoutesReply) error {
+	dst, err := r.Node.GraphNodePub(args.Dest)
+	if err != nil {
+		return err
+	}
+	if args.NumRoutes == 0 {
+		args.NumRoutes = 1
+	}
+	routes, err := r.Node.QueryRoutes(dst, args.CoinType, args.Amt, int(args.NumRoutes))
+	if err != nil {
+		return err
+	}
+
+	for _, rt := range routes {
+		var ri RouteInfo
+		ri.Amt = rt.Amt
+		ri.Fee = rt.Fee
+		ri.Delta = rt.Delta
+		for _, h := range rt.Hops {
+			ri.Hops = append(ri.Hops, RouteHop{
+				Outpoint: h.Outpoint.String(),
+				From:     lnutil.LitAdrFromPubkey(h.From),
+				To:       lnutil.LitAdrFromPubkey(h.To),
+				Amt:      h.Amt,
+				Fee:      h.Fee,
+				Delta:    h.Delta,
+			})
+		}
+		reply.Routes = append(reply.Routes, ri)
+	}
+	return nil
+}
@@ -136,3 +136,130 @@ func (r *LitRPC) Stop(args NoArgs, reply *StatusReply) error {
 	r.OffButton <- true
 	return nil
 }
+
+// ------------------------- peer policy
+
+type PeerPolicyReply struct {
+	Policy qln.PeerPolicy
+}
+
+func (r *LitRPC) GetPeerPolicy(args NoArgs, reply *PeerPolicyReply) error {
+	reply.Policy = r.Node.GetPeerPolicy()
+	return nil
+}
+
+type PolicyPeerArgs struct {
+	Peer   string // lit address or pubkey
+	Remove bool
+}
+
+func (r *LitRPC) AllowPeer(args PolicyPeerArgs, reply *StatusReply) error {
+	err := r.Node.AllowPeer(args.Peer, args.Remove)
+	if err != nil {
+		return err
+	}
+	if args.Remove {
+		reply.Status = fmt.Sprintf("removed %s from allow list", args.Peer)
+	} else {
+		reply.Status = fmt.Sprintf("allowed %s", args.Peer)
+	}
+	return nil
+}
+
+func (r *LitRPC) DenyPeer(args PolicyPeerArgs, reply *StatusReply) error {
+	err := r.Node.DenyPeer(args.Peer, args.Remove)
+	if err != nil {
+		return err
+	}
+	if args.Remove {
+		reply.Status = fmt.Sprintf("removed %s from deny list", args.Peer)
+	} else {
+		reply.Status = fmt.Sprintf("denied %s", args.Peer)
+	}
+	return nil
+}
+
+type PeerLimitsArgs struct {
+	MaxInbound  int
+	IPRateLimit int
+	NoPersist   bool
+}
+
+func (r *LitRPC) SetPeerLimits(args PeerLimitsArgs, reply *StatusReply) error {
+	err := r.Node.SetPeerLimits(args.MaxInbound, args.IPRateLimit, args.NoPersist)
+	if err != nil {
+		return err
+	}
+	reply.Status = fmt.Sprintf("max inbound %d, %d connections/min per IP, no persist %v",
+		args.MaxInbound, args.IPRateLimit, args.NoPersist)
+	return nil
+}
+
+// ------------------------- gossip
+
+type AnnounceNodeArgs struct {
+	Nickname string
+	Addrs    []string // host:port
+}
+
+func (r *LitRPC) AnnounceNode(args AnnounceNodeArgs, reply *StatusReply) error {
+	err := r.Node.AnnounceNode(args.Nickname, args.Addrs)
+	if err != nil {
+		return err
+	}
+	reply.Status = fmt.Sprintf("announced %s at %v", args.Nickname, args.Addrs)
+	return nil
+}
+
+type GraphNode struct {
+	LitAdr    string
+	Nickname  string
+	Addrs     []string
+	Timestamp int64
+}
+
+type GraphChan struct {
+	Coin     uint32
+	Outpoint string
+	Capacity int64
+	Height   int32
+	Nodes    [2]string // lit addresses
+}
+
+type GraphReply struct {
+	Nodes []GraphNode
+	Chans []GraphChan
+}
+
+// GetGraph returns the channels and nodes we've heard about through gossip
+func (r *LitRPC) GetGraph(args NoArgs, reply *GraphReply) error {
+	chans, err := r.Node.GraphChans()
+	if err != nil {
+		return err
+	}
+	for _, c := range chans {
+		var gc GraphChan
+		gc.Coin = c.Coin
+		gc.Outpoint = c.Outpoint.String()
+		gc.Capacity = c.Capacity
+		gc.Height = c.Proof.Height
+		for i, pub := range c.NodePub {
+			gc.Nodes[i] = lnutil.LitAdrFromPubkey(pub)
+		}
+		reply.Chans = append(reply.Chans, gc)
+	}
+
+	nodes, err := r.Node.GraphNodes()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		reply.Nodes = append(reply.Nodes, GraphNode{
+			LitAdr:    lnutil.LitAdrFromPubkey(n.Pub),
+			Nickname:  n.Nickname,
+			Addrs:     n.Addrs,
+			Timestamp: n.Timestamp,
+		})
+	}
+	return nil
+}
@@ -1,12 +1,15 @@
 package litrpc
 
 import (
+	"encoding/hex"
 	"fmt"
 
 	"github.com/adiabat/bech32"
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
 	"github.com/mit-dci/lit/portxo"
+	"github.com/mit-dci/lit/qln"
 )
 
 type TxidsReply struct {
@@ -31,14 +34,23 @@ type CoinBalReply struct {
 	SyncHeight  int32 // height this wallet is synced to
 	ChanTotal   int64 // total balance in channels
 	TxoTotal    int64 // all utxos
+	Unconfirmed int64 // part of TxoTotal that isn't confirmed yet
 	MatureWitty int64 // confirmed, spendable and witness
+	// false if the wallet can't reach the blockchain right now, so
+	// SyncHeight might be behind
+	ChainConnected bool
 }
 
 type BalanceReply struct {
 	Balances []CoinBalReply
 }
 
-func (r *LitRPC) Balance(args *NoArgs, reply *BalanceReply) error {
+type BalanceArgs struct {
+	// if set, only count that wallet account.  Channels count as account 0.
+	Account *uint32
+}
+
+func (r *LitRPC) Balance(args *BalanceArgs, reply *BalanceReply) error {
 
 	var allTxos portxo.TxoSliceByAmt
 
@@ -48,6 +60,10 @@ func (r *LitRPC) Balance(args *NoArgs, reply *BalanceReply) error {
 		return err
 	}
 
+	// channel balances are counted as part of account 0
+	oneAccount := args != nil && args.Account != nil
+	withChans := !oneAccount || *args.Account == 0
+
 	for cointype, wal := range r.Node.SubWallet {
 		// will add the balance for this wallet to the full reply
 		var cbr CoinBalReply
@@ -55,19 +71,25 @@ func (r *LitRPC) Balance(args *NoArgs, reply *BalanceReply) error {
 		cbr.CoinType = cointype
 
 		cbr.SyncHeight = wal.CurrentHeight()
+		cbr.ChainConnected = wal.ChainConnState().Connected
 
-		allTxos, err = wal.UtxoDump()
+		if oneAccount {
+			allTxos, err = wal.AccountUtxoDump(*args.Account)
+		} else {
+			allTxos, err = wal.UtxoDump()
+		}
 		if err != nil {
 			return err
 		}
 
 		// ask sub-wallet for balance
 		cbr.TxoTotal = allTxos.Sum()
+		cbr.Unconfirmed = allTxos.SumUnconfirmed()
 		cbr.MatureWitty = allTxos.SumWitness(cbr.SyncHeight)
 
 		// iterate through channels to figure out how much we have
 		for _, q := range qcs {
-			if q.Coin() == cointype {
+			if q.Coin() == cointype && withChans {
 				cbr.ChanTotal += q.State.MyAmt
 			}
 		}
@@ -123,21 +145,105 @@ func (r *LitRPC) TxoList(args *NoArgs, reply *TxoListReply) error {
 	return nil
 }
 
+// ------------------------- rescan
+type RescanArgs struct {
+	CoinType   uint32 // 0 for default coin
+	FromHeight int32
+}
+
+// Rescan has the wallet go back and look through blocks again, starting at
+// FromHeight.  Useful after restoring a wallet from a key.
+func (r *LitRPC) Rescan(args RescanArgs, reply *StatusReply) error {
+	if args.CoinType == 0 {
+		args.CoinType = r.Node.DefaultCoin
+	}
+	wal, ok := r.Node.SubWallet[args.CoinType]
+	if !ok {
+		return fmt.Errorf("no connnected wallet for coin type %d", args.CoinType)
+	}
+
+	err := wal.Rescan(args.FromHeight)
+	if err != nil {
+		return err
+	}
+
+	reply.Status = fmt.Sprintf("rescanning coin type %d from height %d",
+		args.CoinType, args.FromHeight)
+	return nil
+}
+
+// ------------------------- xpub
+type XpubArgs struct {
+	CoinType uint32 // 0 for default coin
+	Account  uint32
+}
+
+type XpubReply struct {
+	Xpub string
+}
+
+// Xpub returns the extended public key of a wallet account.  Give it to
+// lit -xpub to run a watch-only node that sees the account's addresses.
+func (r *LitRPC) Xpub(args XpubArgs, reply *XpubReply) error {
+	if args.CoinType == 0 {
+		args.CoinType = r.Node.DefaultCoin
+	}
+	wal, ok := r.Node.SubWallet[args.CoinType]
+	if !ok {
+		return fmt.Errorf("no connnected wallet for coin type %d", args.CoinType)
+	}
+
+	xpub, err := wal.AccountXpub(args.Account)
+	if err != nil {
+		return err
+	}
+	reply.Xpub = xpub
+	return nil
+}
+
+// ------------------------- chain peers
+type ChainPeersReply struct {
+	CoinType uint32
+	State    lnutil.ChainConnState
+	Peers    []lnutil.ChainPeerInfo
+}
+
+// ListChainPeers lists the full nodes a wallet is connected to.  Empty if
+// the wallet doesn't connect to nodes over p2p.  State says whether it's
+// connected at all, and if not, when it'll try again.
+func (r *LitRPC) ListChainPeers(args CoinArgs, reply *ChainPeersReply) error {
+	if args.CoinType == 0 {
+		args.CoinType = r.Node.DefaultCoin
+	}
+	wal, ok := r.Node.SubWallet[args.CoinType]
+	if !ok {
+		return fmt.Errorf("no connnected wallet for coin type %d", args.CoinType)
+	}
+
+	reply.CoinType = args.CoinType
+	reply.State = wal.ChainConnState()
+	reply.Peers = wal.ChainPeers()
+	return nil
+}
+
 // ------------------------- send
 type SendArgs struct {
 	DestAddrs []string
 	Amts      []int64
+	Account   uint32 // wallet account to spend from
 }
 
-func (r *LitRPC) Send(args SendArgs, reply *TxidsReply) error {
-	var err error
+// sendArgsToTxOuts checks the addresses and amounts in SendArgs, and returns
+// the wallet to send from along with the txouts to make.
+func (r *LitRPC) sendArgsToTxOuts(
+	args SendArgs) (qln.UWallet, []*wire.TxOut, error) {
 
 	nOutputs := len(args.DestAddrs)
 	if nOutputs < 1 {
-		return fmt.Errorf("No destination address specified")
+		return nil, nil, fmt.Errorf("No destination address specified")
 	}
 	if nOutputs != len(args.Amts) {
-		return fmt.Errorf("%d addresses but %d amounts specified",
+		return nil, nil, fmt.Errorf("%d addresses but %d amounts specified",
 			nOutputs, len(args.Amts))
 	}
 	// get cointype for first address.
@@ -145,14 +251,14 @@ func (r *LitRPC) Send(args SendArgs, reply *TxidsReply) error {
 	// make sure we support that coin type
 	wal, ok := r.Node.SubWallet[coinType]
 	if !ok {
-		return fmt.Errorf("no connnected wallet for address %s type %d",
+		return nil, nil, fmt.Errorf("no connnected wallet for address %s type %d",
 			args.DestAddrs[0], coinType)
 	}
 	// All addresses must have the same cointype as they all
 	// must to be in the same tx.
 	for _, a := range args.DestAddrs {
 		if CoinTypeFromAdr(a) != coinType {
-			return fmt.Errorf("Coin type mismatch for address %s, %s",
+			return nil, nil, fmt.Errorf("Coin type mismatch for address %s, %s",
 				a, args.DestAddrs[0])
 		}
 	}
@@ -160,19 +266,27 @@ func (r *LitRPC) Send(args SendArgs, reply *TxidsReply) error {
 	txOuts := make([]*wire.TxOut, nOutputs)
 	for i, s := range args.DestAddrs {
 		if args.Amts[i] < 10000 {
-			return fmt.Errorf("Amt %d less than min 10000", args.Amts[i])
+			return nil, nil, fmt.Errorf("Amt %d less than min 10000", args.Amts[i])
 		}
 
 		outScript, err := AdrStringToOutscript(s)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		txOuts[i] = wire.NewTxOut(args.Amts[i], outScript)
 	}
+	return wal, txOuts, nil
+}
+
+func (r *LitRPC) Send(args SendArgs, reply *TxidsReply) error {
+	wal, txOuts, err := r.sendArgsToTxOuts(args)
+	if err != nil {
+		return err
+	}
 
 	// we don't care if it's witness or not
-	ops, err := wal.MaybeSend(txOuts, false)
+	ops, err := wal.MaybeSendFrom(args.Account, txOuts, false)
 	if err != nil {
 		return err
 	}
@@ -186,6 +300,121 @@ func (r *LitRPC) Send(args SendArgs, reply *TxidsReply) error {
 	return nil
 }
 
+// ------------------------- unsigned / partially signed txs
+// PartialTxArgs has a hex encoded portxo.PartialTx
+type PartialTxArgs struct {
+	PartialTx string
+}
+
+type PartialTxReply struct {
+	PartialTx string // hex encoded portxo.PartialTx
+	Txid      string
+	Signed    uint32 // how many inputs have signatures
+	Total     uint32 // how many inputs there are
+	Outs      []TxOutInfo
+	Fee       int64 // inputs minus outputs
+}
+
+// TxOutInfo is an output of a tx, for looking over before signing
+type TxOutInfo struct {
+	Address string
+	Amt     int64
+}
+
+// ExportUnsigned builds a tx like Send, but returns it unsigned, along with
+// what's needed to sign it somewhere else.  The inputs stay frozen.
+func (r *LitRPC) ExportUnsigned(args SendArgs, reply *PartialTxReply) error {
+	wal, txOuts, err := r.sendArgsToTxOuts(args)
+	if err != nil {
+		return err
+	}
+
+	p, err := wal.ExportUnsigned(args.Account, txOuts)
+	if err != nil {
+		return err
+	}
+
+	return fillPartialTxReply(p, wal, reply)
+}
+
+// SignPartial signs whatever inputs of the partial tx this node can.
+func (r *LitRPC) SignPartial(args PartialTxArgs, reply *PartialTxReply) error {
+	p, wal, err := r.partialTxFromHex(args.PartialTx)
+	if err != nil {
+		return err
+	}
+
+	_, err = wal.SignPartial(p)
+	if err != nil {
+		return err
+	}
+
+	return fillPartialTxReply(p, wal, reply)
+}
+
+// BroadcastPartial sends out a partial tx which has all its signatures.
+func (r *LitRPC) BroadcastPartial(args PartialTxArgs, reply *TxidsReply) error {
+	p, wal, err := r.partialTxFromHex(args.PartialTx)
+	if err != nil {
+		return err
+	}
+
+	err = wal.BroadcastPartial(p)
+	if err != nil {
+		return err
+	}
+
+	reply.Txids = append(reply.Txids, p.Tx.TxHash().String())
+	return nil
+}
+
+// partialTxFromHex decodes a hex partial tx and finds the wallet for it.
+func (r *LitRPC) partialTxFromHex(
+	s string) (*portxo.PartialTx, qln.UWallet, error) {
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := portxo.PartialTxFromBytes(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(p.Ins) == 0 {
+		return nil, nil, fmt.Errorf("partial tx has no inputs")
+	}
+	wal, ok := r.Node.SubWallet[p.CoinType()]
+	if !ok {
+		return nil, nil, fmt.Errorf("no connnected wallet for coin type %d",
+			p.CoinType())
+	}
+	return p, wal, nil
+}
+
+// fillPartialTxReply puts the partial tx in the reply, along with its outputs
+// and fee so they can be looked over before signing.
+func fillPartialTxReply(
+	p *portxo.PartialTx, wal qln.UWallet, reply *PartialTxReply) error {
+	b, err := p.Bytes()
+	if err != nil {
+		return err
+	}
+	reply.PartialTx = hex.EncodeToString(b)
+	reply.Txid = p.Tx.TxHash().String()
+	reply.Signed = uint32(p.NumSigned())
+	reply.Total = uint32(len(p.Tx.TxIn))
+
+	for _, u := range p.Ins {
+		reply.Fee += u.Value
+	}
+	for _, out := range p.Tx.TxOut {
+		reply.Outs = append(reply.Outs,
+			TxOutInfo{OutscriptToAdrString(out.PkScript, wal.Params()), out.Value})
+		reply.Fee -= out.Value
+	}
+	return nil
+}
+
 // ------------------------- sweep
 type SweepArgs struct {
 	DestAdr string
@@ -280,10 +509,12 @@ func (r *LitRPC) Fanout(args FanArgs, reply *TxidsReply) error {
 type AddressArgs struct {
 	NumToMake uint32
 	CoinType  uint32
+	Account   uint32 // wallet account to make new addresses in
+	Legacy    bool   // also give base58 p2pkh versions of the addresses
 }
 type AddressReply struct {
-	WitAddresses    []string
-	LegacyAddresses []string
+	WitAddresses    []string // bech32 p2wpkh
+	LegacyAddresses []string // only filled in if Legacy is set
 }
 
 func (r *LitRPC) Address(args *AddressArgs, reply *AddressReply) error {
@@ -321,7 +552,7 @@ func (r *LitRPC) Address(args *AddressArgs, reply *AddressReply) error {
 		// call NewAdr a bunch of times
 		remaining := args.NumToMake
 		for remaining > 0 {
-			adr, err := wal.NewAdr()
+			adr, err := wal.NewAccountAdr(args.Account)
 			if err != nil {
 				return err
 			}
@@ -332,18 +563,21 @@ func (r *LitRPC) Address(args *AddressArgs, reply *AddressReply) error {
 	}
 
 	reply.WitAddresses = make([]string, len(allAdr))
-	reply.LegacyAddresses = make([]string, len(allAdr))
+	if args.Legacy {
+		reply.LegacyAddresses = make([]string, len(allAdr))
+	}
 
 	for i, a := range allAdr {
-		// convert 20 byte array to old address
-
 		param := r.Node.SubWallet[ctypesPerAdr[i]].Params()
 
-		oldadr, err := btcutil.NewAddressPubKeyHash(a[:], param)
-		if err != nil {
-			return err
+		if args.Legacy {
+			// convert 20 byte array to old address
+			oldadr, err := btcutil.NewAddressPubKeyHash(a[:], param)
+			if err != nil {
+				return err
+			}
+			reply.LegacyAddresses[i] = oldadr.String()
 		}
-		reply.LegacyAddresses[i] = oldadr.String()
 
 		// convert 20-byte PKH to a bech32 segwit v0 address
 		bech32adr, err := bech32.SegWitV0Encode(param.Bech32Prefix, a[:])
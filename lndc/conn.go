@@ -38,11 +38,25 @@ type LNDConn struct {
 	PbxIncoming chan []byte
 	PbxOutgoing chan []byte
 
+	// version is the handshake used; 0 for the old one, noiseVersion for
+	// Noise_XK
 	version uint8
 
+	// per direction ciphers, with Noise_XK
+	sendCipher *noiseCipher
+	recvCipher *noiseCipher
+
 	readBuf bytes.Buffer
 
 	Conn net.Conn
+
+	// Dialer is used by Dial to connect, if it's not nil; to go through
+	// Tor, say.
+	Dialer lnutil.Dialer
+
+	// Legacy makes Dial use the old handshake (see netio.go), for nodes
+	// that don't know Noise_XK yet.  It has no forward secrecy or rekeying.
+	Legacy bool
 }
 
 // NewConn...
@@ -64,8 +78,13 @@ func (c *LNDConn) Dial(
 			return fmt.Errorf("connection already established")
 		}
 
+		if lnutil.IsOnion(netAddress) && c.Dialer == nil {
+			return fmt.Errorf("%s is a hidden service; need a proxy like Tor",
+				netAddress)
+		}
+
 		// First, open the TCP connection itself.
-		c.Conn, err = net.Dial("tcp", netAddress)
+		c.Conn, err = lnutil.DialTimeout(c.Dialer, netAddress, 0)
 		if err != nil {
 			return err
 		}
@@ -76,6 +95,14 @@ func (c *LNDConn) Dial(
 		return fmt.Errorf("invalid ln address %s", remotePKH)
 	}
 
+	if !c.Legacy {
+		theirPKH, err := lnutil.LitAdrBytes(remotePKH)
+		if err != nil {
+			return err
+		}
+		return c.dialNoise(myId, theirPKH)
+	}
+
 	// Calc remote LNId; need this for creating pbx connections just because
 	// LNid is in the struct does not mean it's authed!
 	/*
@@ -122,9 +149,6 @@ func (c *LNDConn) Dial(
 		return err
 	}
 
-	// display private key for debug only
-	fmt.Printf("made session key %x\n", sessionKey)
-
 	c.myNonceInt = 1 << 63
 	c.remoteNonceInt = 0
 
@@ -223,7 +247,6 @@ func (c *LNDConn) authPKH(
 		return err
 	}
 	idDH := fastsha256.Sum256(btcec.GenerateSharedSecret(myId, theirPub))
-	fmt.Printf("made idDH %x\n", idDH)
 	theirDHproof := fastsha256.Sum256(append(localEphPubBytes, idDH[:]...))
 
 	// Verify that their DH proof matches the one we just generated.
@@ -263,6 +286,15 @@ func (c *LNDConn) Read(b []byte) (n int, err error) {
 			return 0, err
 		}
 
+		if c.version == noiseVersion {
+			msg, err := c.recvCipher.open(ctext)
+			if err != nil {
+				return 0, err
+			}
+			c.readBuf.Write(msg)
+			return c.readBuf.Read(b)
+		}
+
 		// Encode the current remote nonce, so we can use it to decrypt
 		// the cipher text.
 		var nonceBuf [8]byte
@@ -287,7 +319,12 @@ func (c *LNDConn) Read(b []byte) (n int, err error) {
 	return c.readBuf.Read(b)
 }
 
-// Write writes data to the connection.
+// MaxRecordLen is the most plaintext that fits in one record.  Write splits
+// anything longer into several.
+const MaxRecordLen = 65530 - 16
+
+// Write writes data to the connection, in as many records as it takes.
+// The other side's Read gets at most one record's worth at a time.
 // Write can be made to time out and return a Error with Timeout() == true
 // after a fixed time limit; see SetDeadline and SetWriteDeadline.
 // Part of the net.Conn interface.
@@ -295,35 +332,58 @@ func (c *LNDConn) Write(b []byte) (n int, err error) {
 	if b == nil {
 		return 0, fmt.Errorf("write to %x nil", c.RemotePub.SerializeCompressed())
 	}
+	for {
+		rec := b
+		if len(rec) > MaxRecordLen {
+			rec = rec[:MaxRecordLen]
+		}
+		err = c.writeRecord(rec)
+		if err != nil {
+			return n, err
+		}
+		n += len(rec)
+		b = b[len(rec):]
+		if len(b) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// writeRecord encrypts and sends one record
+func (c *LNDConn) writeRecord(b []byte) (err error) {
 	//	fmt.Printf("Encrypt %d byte plaintext to %x nonce %d\n",
 	//		len(b), c.RemoteLNId, c.myNonceInt)
 
-	// first encrypt message with shared key
-	var nonceBuf [8]byte
-	binary.BigEndian.PutUint64(nonceBuf[:], c.myNonceInt)
-	c.myNonceInt++ // increment mine
+	var ctext []byte
+	if c.version == noiseVersion {
+		ctext, err = c.sendCipher.seal(b)
+		if err != nil {
+			return err
+		}
+	} else {
+		// first encrypt message with shared key
+		var nonceBuf [8]byte
+		binary.BigEndian.PutUint64(nonceBuf[:], c.myNonceInt)
+		c.myNonceInt++ // increment mine
 
-	ctext := c.chachaStream.Seal(nil, nonceBuf[:], b, nil)
-	if err != nil {
-		return 0, err
-	}
-	if len(ctext) > 65530 {
-		return 0, fmt.Errorf("Write to %x too long, %d bytes",
-			c.RemotePub.SerializeCompressed(), len(ctext))
+		ctext = c.chachaStream.Seal(nil, nonceBuf[:], b, nil)
 	}
 
 	// use writeClear to prepend length / destination header
-	return writeClear(c.Conn, ctext)
+	_, err = writeClear(c.Conn, ctext)
+	return err
+}
+
+// Version returns the handshake the connection used; 0 for the old one.
+func (c *LNDConn) Version() uint8 {
+	return c.version
 }
 
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
-// Part of the net.Conn interface.
+// Part of the net.Conn interface.  Only the socket's closed; reads and
+// writes going on in other goroutines still use the keys and RemotePub.
 func (c *LNDConn) Close() error {
-	c.myNonceInt = 0
-	c.remoteNonceInt = 0
-	c.RemotePub = nil
-
 	return c.Conn.Close()
 }
 
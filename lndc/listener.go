@@ -4,10 +4,12 @@ import (
 	"crypto/hmac"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/adiabat/btcd/btcec"
 	"github.com/btcsuite/fastsha256"
 	"github.com/codahale/chacha20poly1305"
+	"github.com/mit-dci/lit/lnutil"
 )
 
 // Listener...
@@ -15,15 +17,34 @@ type Listener struct {
 	longTermPriv *btcec.PrivateKey
 
 	tcp *net.TCPListener
+
+	// Legacy lets in connections using the old handshake.  Otherwise
+	// only Noise_XK connections are accepted.
+	Legacy bool
+
+	// Allow, if it's set, is called with each connection's address before
+	// the handshake.  If it returns an error, the connection's closed and
+	// Accept returns the error.
+	Allow func(addr net.Addr) error
 }
 
 var _ net.Listener = (*Listener)(nil)
 
 // NewListener...
+// If listenAddr is a .onion address, it listens on that port on localhost,
+// where Tor sends the hidden service's connections.  The hidden service
+// needs to be set up in torrc like "HiddenServicePort 2448 127.0.0.1:2448".
 func NewListener(localPriv *btcec.PrivateKey, listenAddr string) (*Listener, error) {
 	if localPriv == nil {
 		return nil, fmt.Errorf("NewListener: nil private key")
 	}
+	if lnutil.IsOnion(listenAddr) {
+		_, port, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			return nil, err
+		}
+		listenAddr = net.JoinHostPort("127.0.0.1", port)
+	}
 	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
 		return nil, err
@@ -34,24 +55,96 @@ func NewListener(localPriv *btcec.PrivateKey, listenAddr string) (*Listener, err
 		return nil, err
 	}
 
-	return &Listener{localPriv, l}, nil
+	return &Listener{longTermPriv: localPriv, tcp: l}, nil
 }
 
-// Accept waits for and returns the next connection to the listener.
+// HandshakeTimeout is how long a new connection has to get through the
+// handshake before it's dropped.
+const HandshakeTimeout = time.Second * 10
+
+// Accept waits for and returns the next connection to the listener, once
+// it's through the handshake.
 // Part of the net.Listener interface.
 func (l *Listener) Accept() (c net.Conn, err error) {
+	conn, err := l.AcceptRaw()
+	if err != nil {
+		return nil, err
+	}
+	return l.Handshake(conn)
+}
+
+// AcceptRaw waits for the next tcp connection, and checks it with Allow.
+// The handshake hasn't happened yet; call Handshake on it, which can be
+// done in another goroutine so a slow peer doesn't hold up the others.
+func (l *Listener) AcceptRaw() (net.Conn, error) {
 	conn, err := l.tcp.Accept()
 	if err != nil {
 		return nil, err
 	}
+	if l.Allow != nil {
+		err = l.Allow(conn.RemoteAddr())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Handshake does the responder's side of the handshake on a connection from
+// AcceptRaw.  If it's not done within HandshakeTimeout, or fails, the
+// connection's closed.
+func (l *Listener) Handshake(conn net.Conn) (*LNDConn, error) {
+	err := conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	nLndc, err := l.handshake(conn)
+	if err != nil {
+		return nil, err
+	}
 
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		nLndc.Close()
+		return nil, err
+	}
+	return nLndc, nil
+}
+
+// handshake figures out which handshake the remote side is doing, and does it.
+func (l *Listener) handshake(conn net.Conn) (*LNDConn, error) {
 	nLndc := NewConn(conn)
 
+	// The first message says which handshake this is: Noise_XK starts with
+	// the version byte, the old one with an ephemeral pubkey.
+	first, err := readClear(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(first) > 0 && first[0] == noiseVersion {
+		err = l.acceptNoise(nLndc, first)
+		if err != nil {
+			nLndc.Close()
+			return nil, err
+		}
+		return nLndc, nil
+	}
+	if !l.Legacy {
+		conn.Close()
+		return nil, fmt.Errorf("%s tried old handshake, not allowed",
+			conn.RemoteAddr().String())
+	}
+
 	// Exchange an ephemeral public key with the remote connection in order
 	// to establish a confidential connection before we attempt to
 	// authenticated.
-	ephPubBytes, err := l.createCipherConn(nLndc)
+	ephPubBytes, err := l.createCipherConn(nLndc, first)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -67,15 +160,12 @@ func (l *Listener) Accept() (c net.Conn, err error) {
 }
 
 // createCipherConn....
-func (l *Listener) createCipherConn(lnConn *LNDConn) ([]byte, error) {
+// theirEphPubBytes is the first message, which Accept already read.
+func (l *Listener) createCipherConn(
+	lnConn *LNDConn, theirEphPubBytes []byte) ([]byte, error) {
 	var err error
-	var theirEphPubBytes []byte
 
-	// First, read and deserialize their ephemeral public key.
-	theirEphPubBytes, err = readClear(lnConn.Conn)
-	if err != nil {
-		return nil, err
-	}
+	// First, deserialize their ephemeral public key.
 	if len(theirEphPubBytes) != 33 {
 		return nil, fmt.Errorf("Got invalid %d byte eph pubkey %x\n",
 			len(theirEphPubBytes), theirEphPubBytes)
@@ -100,9 +190,9 @@ func (l *Listener) createCipherConn(lnConn *LNDConn) ([]byte, error) {
 	sessionKey := fastsha256.Sum256(btcec.GenerateSharedSecret(myEph, theirEphPub))
 
 	lnConn.chachaStream, err = chacha20poly1305.New(sessionKey[:])
-
-	// display private key for debug only
-	fmt.Printf("made session key %x\n", sessionKey)
+	if err != nil {
+		return nil, err
+	}
 
 	lnConn.remoteNonceInt = 1 << 63
 	lnConn.myNonceInt = 0
@@ -159,7 +249,6 @@ func (l *Listener) authenticateConnection(
 	}
 	idDH :=
 		fastsha256.Sum256(btcec.GenerateSharedSecret(l.longTermPriv, theirPub))
-	fmt.Printf("made idDH %x\n", idDH)
 	myDHproof := fastsha256.Sum256(
 		append(lnConn.RemotePub.SerializeCompressed(), idDH[:]...))
 	theirDHproof := fastsha256.Sum256(
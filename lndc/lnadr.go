@@ -11,6 +11,7 @@ import (
 	"github.com/adiabat/btcd/btcec"
 	"github.com/adiabat/btcd/chaincfg"
 	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
 )
 
 // lnAddr...
@@ -19,10 +20,10 @@ type LNAdr struct {
 	PubKey *btcec.PublicKey
 
 	Base58Adr btcutil.Address // Base58 encoded address (1XXX...)
-	NetAddr   *net.TCPAddr    // IP address
+	NetAddr   *net.TCPAddr    // IP address; nil if not resolved here
 
 	name        string // human readable name?  Not a thing yet.
-	host        string // internet host this ID is reachable at. also not a thing
+	host        string // internet host this ID is reachable at, unresolved
 	endorsement []byte // a sig confirming the name?  Not implemented
 }
 
@@ -35,6 +36,9 @@ func (l *LNAdr) String() string {
 		encodedId = l.PubKey.SerializeCompressed()
 	}
 
+	if l.NetAddr == nil {
+		return fmt.Sprintf("%v@%v", encodedId, l.host)
+	}
 	return fmt.Sprintf("%v@%v", encodedId, l.NetAddr)
 }
 
@@ -55,8 +59,11 @@ func SplitAdrString(adr string) (string, string) {
 	return idHost[0], idHost[1]
 }
 
-// newLnAddr...
-func LnAddrFromString(encodedAddr string, param *chaincfg.Params) (*LNAdr, error) {
+// LnAddrFromString parses an lnaddr.  With a proxy dialer d, the host isn't
+// looked up here, since the lookup would go around the proxy; the proxy
+// resolves it when dialing.  .onion hosts never get looked up.
+func LnAddrFromString(encodedAddr string, param *chaincfg.Params,
+	d lnutil.Dialer) (*LNAdr, error) {
 	// The format of an lnaddr is "<pubkey or pkh>@host:port"
 
 	if !strings.ContainsRune(encodedAddr, '@') {
@@ -73,16 +80,25 @@ func LnAddrFromString(encodedAddr string, param *chaincfg.Params) (*LNAdr, error
 	//	}
 
 	idHost := strings.Split(encodedAddr, "@")
-	// Attempt to resolve the IP address, this handles parsing IPv6 zones,
-	// and such.
 	fmt.Println("host: ", idHost[1])
-	ipAddr, err := net.ResolveTCPAddr("tcp", idHost[1])
-	if err != nil {
-		return nil, err
+	addr := new(LNAdr)
+	var err error
+	if lnutil.IsOnion(idHost[1]) || d != nil {
+		// hidden services don't resolve; Tor finds them when dialing
+		_, _, err = net.SplitHostPort(idHost[1])
+		if err != nil {
+			return nil, err
+		}
+		addr.host = idHost[1]
+	} else {
+		// Attempt to resolve the IP address, this handles parsing IPv6
+		// zones, and such.
+		addr.NetAddr, err = net.ResolveTCPAddr("tcp", idHost[1])
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	addr := &LNAdr{NetAddr: ipAddr}
-
 	idLen := len(idHost[0])
 	switch {
 	// Is the ID a hex-encoded compressed public key?
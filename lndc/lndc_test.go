@@ -2,11 +2,17 @@ package lndc
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/btcsuite/fastsha256"
 	"github.com/mit-dci/lit/lnutil"
 )
 
@@ -98,3 +104,436 @@ func TestConnectionCorrectness(t *testing.T) {
 			string(readBuf), string(outMsg))
 	}
 }
+
+// onionDialer stands in for Tor: it sends .onion hosts to a local address
+type onionDialer struct {
+	to     string
+	dialed []string
+}
+
+func (d *onionDialer) Dial(network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	return net.Dial(network, d.to)
+}
+
+// TestOnion listens for a hidden service and connects to it through a
+// dialer standing in for Tor.
+func TestOnion(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotePriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var myPub [33]byte
+	copy(myPub[:], localPriv.PubKey().SerializeCompressed())
+	myAddress := lnutil.LitAdrFromPubkey(myPub)
+
+	// port 0 so the test can run anywhere; Tor would need a real one
+	onion := "expyuzz4wqqyqhjn.onion"
+	listener, err := NewListener(localPriv, onion+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, _, _ := net.SplitHostPort(listener.Addr().String())
+	if host != "127.0.0.1" {
+		t.Fatalf("hidden service listener on %s, not localhost", host)
+	}
+
+	// can't get there without a proxy
+	err = NewConn(nil).Dial(remotePriv, onion+":2448", myAddress)
+	if err == nil {
+		t.Fatalf("dialed hidden service directly")
+	}
+
+	d := &onionDialer{to: listener.Addr().String()}
+	conn := NewConn(nil)
+	conn.Dialer = d
+	var wg sync.WaitGroup
+	var dialErr error
+	wg.Add(1)
+	go func() {
+		dialErr = conn.Dial(remotePriv, onion+":2448", myAddress)
+		wg.Done()
+	}()
+	localConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if dialErr != nil {
+		t.Fatal(dialErr)
+	}
+	if len(d.dialed) != 1 || d.dialed[0] != onion+":2448" {
+		t.Fatalf("dialer got %v", d.dialed)
+	}
+
+	msg := []byte("over tor")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	readBuf := make([]byte, len(msg))
+	if _, err := localConn.Read(readBuf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBuf, msg) {
+		t.Fatalf("got %q", readBuf)
+	}
+
+	// addresses can have .onion hosts, which don't get resolved
+	adr, err := LnAddrFromString(
+		hex.EncodeToString(myPub[:])+"@"+onion, &chaincfg.TestNet3Params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adr.NetAddr != nil || adr.host != onion+":2448" {
+		t.Fatalf("onion address host %s, NetAddr %v", adr.host, adr.NetAddr)
+	}
+	// and with a proxy, neither do other hosts.  .invalid can't resolve.
+	adr, err = LnAddrFromString(hex.EncodeToString(myPub[:])+"@lit.invalid:9000",
+		&chaincfg.TestNet3Params, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adr.NetAddr != nil || adr.host != "lit.invalid:9000" {
+		t.Fatalf("proxied address host %s, NetAddr %v", adr.host, adr.NetAddr)
+	}
+}
+
+// connPair dials listener l with a new key, and returns both ends
+func connPair(t *testing.T, l *Listener, legacy bool) (*LNDConn, *LNDConn, error) {
+	remotePriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lPub [33]byte
+	copy(lPub[:], l.longTermPriv.PubKey().SerializeCompressed())
+
+	conn := NewConn(nil)
+	conn.Legacy = legacy
+	dialErr := make(chan error, 1)
+	go func() {
+		dialErr <- conn.Dial(remotePriv, l.Addr().String(),
+			lnutil.LitAdrFromPubkey(lPub))
+	}()
+	localConn, err := l.Accept()
+	if err != nil {
+		<-dialErr
+		return nil, nil, err
+	}
+	err = <-dialErr
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(localConn.(*LNDConn).RemotePub.SerializeCompressed(),
+		remotePriv.PubKey().SerializeCompressed()) {
+		t.Fatalf("listener got the wrong remote pubkey")
+	}
+	return conn, localConn.(*LNDConn), nil
+}
+
+// TestNoise makes Noise_XK connections, and sends enough both ways that
+// the keys rotate a few times.
+func TestNoise(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, localConn, err := connPair(t, listener, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.version != noiseVersion || localConn.version != noiseVersion {
+		t.Fatalf("connected with version %d, %d", conn.version, localConn.version)
+	}
+	if !conn.RemotePub.IsEqual(localPriv.PubKey()) {
+		t.Fatalf("dialer got the wrong remote pubkey")
+	}
+
+	firstKey := conn.sendCipher.key
+	for i := 0; i < noiseRekeyAfter*3+5; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		from, to := conn, localConn
+		if i%2 == 1 {
+			from, to = localConn, conn
+		}
+		if _, err := from.Write(msg); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		readBuf := make([]byte, len(msg))
+		if _, err := to.Read(readBuf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(readBuf, msg) {
+			t.Fatalf("got %q, expect %q", readBuf, msg)
+		}
+	}
+	if conn.sendCipher.key == firstKey {
+		t.Fatalf("key didn't rotate")
+	}
+	if conn.sendCipher.key == conn.recvCipher.key {
+		t.Fatalf("same key both ways")
+	}
+	if conn.sendCipher.key != localConn.recvCipher.key ||
+		conn.sendCipher.nonce != localConn.recvCipher.nonce {
+		t.Fatalf("ends out of sync")
+	}
+
+	// a tampered message doesn't decrypt
+	ct, _ := conn.sendCipher.seal([]byte("hello"))
+	ct[0] ^= 1
+	writeClear(conn.Conn, ct)
+	if _, err := localConn.Read(make([]byte, 5)); err == nil {
+		t.Fatalf("read tampered message")
+	}
+}
+
+// TestBigWrite writes more than fits in a record, both handshakes.
+func TestBigWrite(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Legacy = true
+	defer listener.Close()
+
+	for _, legacy := range []bool{false, true} {
+		conn, localConn, err := connPair(t, listener, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := make([]byte, MaxRecordLen*3+100)
+		_, _ = rand.Read(msg)
+		errChan := make(chan error, 1)
+		go func() {
+			n, err := conn.Write(msg)
+			if err == nil && n != len(msg) {
+				err = fmt.Errorf("wrote %d of %d bytes", n, len(msg))
+			}
+			errChan <- err
+		}()
+
+		readBuf := make([]byte, len(msg))
+		for got := 0; got < len(msg); {
+			n, err := localConn.Read(readBuf[got:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > MaxRecordLen {
+				t.Fatalf("read %d bytes, more than a record", n)
+			}
+			got += n
+		}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(readBuf, msg) {
+			t.Fatalf("legacy %v: got different bytes", legacy)
+		}
+		conn.Close()
+		localConn.Close()
+	}
+}
+
+// TestCloseWhileReading closes a connection out from under a reader and a
+// writer in other goroutines.  They get errors, not panics.
+func TestCloseWhileReading(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	conn, localConn, err := connPair(t, listener, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localConn.Close()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			_, err = conn.Write([]byte("hello"))
+		}
+		writeErr <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	conn.Close()
+	if <-readErr == nil || <-writeErr == nil {
+		t.Fatalf("read or write on closed conn worked")
+	}
+	if _, err := conn.Write([]byte("hello")); err == nil {
+		t.Fatalf("write after close worked")
+	}
+}
+
+// TestLegacyHandshake only connects with the old handshake if the
+// listener allows it.
+func TestLegacyHandshake(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, _, err = connPair(t, listener, true)
+	if err == nil {
+		t.Fatalf("old handshake accepted")
+	}
+
+	listener.Legacy = true
+	conn, localConn, err := connPair(t, listener, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.version != 0 || localConn.version != 0 {
+		t.Fatalf("connected with version %d, %d", conn.version, localConn.version)
+	}
+	msg := []byte("old style")
+	conn.Write(msg)
+	readBuf := make([]byte, len(msg))
+	if _, err := localConn.Read(readBuf); err != nil || !bytes.Equal(readBuf, msg) {
+		t.Fatalf("got %q %v", readBuf, err)
+	}
+
+	// noise still works with legacy allowed
+	_, _, err = connPair(t, listener, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNoiseWrongKey dials a listener with someone else's address.
+func TestNoiseWrongKey(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	var otherPub [33]byte
+	copy(otherPub[:], otherPriv.PubKey().SerializeCompressed())
+	dialErr := make(chan error, 1)
+	go func() {
+		dialErr <- NewConn(nil).Dial(otherPriv, listener.Addr().String(),
+			lnutil.LitAdrFromPubkey(otherPub))
+	}()
+	_, err = listener.Accept()
+	if err == nil {
+		t.Fatalf("accepted connection for another key")
+	}
+	if <-dialErr == nil {
+		t.Fatalf("dialed wrong key")
+	}
+
+	// pubkey hash checks, 20 and 12 bytes
+	pub := localPriv.PubKey().SerializeCompressed()
+	pkh := fastsha256.Sum256(pub)
+	short := append([]byte{}, pkh[:12]...)
+	short[11] &= 0xfe
+	if !pkhMatches(pub, pkh[:20]) || !pkhMatches(pub, short) ||
+		pkhMatches(pub, pkh[:12]) && pkh[11]&1 == 1 ||
+		pkhMatches(otherPub[:], pkh[:20]) || pkhMatches(pub, pkh[:16]) {
+		t.Fatalf("pkhMatches wrong")
+	}
+}
+
+// TestSilentConn checks a connection that never sends anything doesn't hold
+// up handshakes with others, and that it gets a deadline.
+func TestSilentConn(t *testing.T) {
+	localPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(localPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	silent, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silentConn, err := listener.AcceptRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	silentErr := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := listener.Handshake(silentConn)
+		silentErr <- err
+	}()
+
+	// someone else can still connect
+	remotePriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lPub [33]byte
+	copy(lPub[:], localPriv.PubKey().SerializeCompressed())
+	dialErr := make(chan error, 1)
+	go func() {
+		dialErr <- NewConn(nil).Dial(remotePriv, listener.Addr().String(),
+			lnutil.LitAdrFromPubkey(lPub))
+	}()
+	_, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-dialErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-silentErr:
+		if err == nil {
+			t.Fatalf("handshake with silent connection worked")
+		}
+		if time.Since(start) < HandshakeTimeout {
+			t.Fatalf("silent handshake failed after %s, before the timeout",
+				time.Since(start))
+		}
+	case <-time.After(HandshakeTimeout + 5*time.Second):
+		t.Fatalf("silent handshake still going after %s", HandshakeTimeout)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"net"
 )
 
+// This is the old handshake, used only with the Legacy flags; new
+// connections use Noise_XK, in noise.go.
 // New & improved tcp open session.
 // There's connector A and listener B.  Once the connection is set up there's no
 // difference, but there can be during the setup.
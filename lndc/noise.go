@@ -0,0 +1,389 @@
+package lndc
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/btcsuite/fastsha256"
+	"github.com/codahale/chacha20poly1305"
+)
+
+// Noise_XK handshake.  This replaces the old ephemeral DH + DH proof scheme
+// in netio.go, which only has the one session key for the whole connection,
+// and leaks who's connecting to anyone in the middle.
+//
+// The connector A only knows B's pubkey hash, and XK needs B's pubkey up
+// front, so first there's a clear exchange for it:
+//
+// 0 -> A sends [version, PubKeyHashB] (21 or 13 bytes)
+// 0 <- B sends [version, PubKeyB] (34 bytes)
+// A checks PubKeyB against the hash, then it's XK
+// (http://noiseprotocol.org/noise.html#interactive-handshake-patterns):
+// 1 -> A sends [version, e, tag] (50 bytes)           e, es
+// 2 <- B sends [version, e, tag] (50 bytes)           e, ee
+// 3 -> A sends [version, enc(s), tag] (66 bytes)      s, se
+//
+// All of these go through writeClear, so have a 2 byte length before them.
+// An old style connection starts with a 33 byte ephemeral pubkey, so the
+// first message says which handshake it is.  PubKeyA only goes over
+// encrypted, and only to whoever has B's private key.  Both ephemeral DHs
+// go into the keys, so they're forward secret.
+//
+// After the handshake, each direction has its own key, and every
+// noiseRekeyAfter messages the key rotates: ck, k = HKDF(ck, k).
+//
+// Differences from the Noise spec: DH is sha256 of the compressed shared
+// point (same as BOLT 8), and ChaChaPoly is the original 64 bit nonce
+// chacha20poly1305 the rest of lndc uses; the nonce is the little endian
+// message count.
+
+const (
+	// noiseVersion is the first byte of every handshake message; the old
+	// handshake is version 0.
+	noiseVersion = 1
+
+	noiseProtocolName = "Noise_XK_secp256k1_ChaChaPoly_SHA256"
+	noisePrologue     = "lit"
+
+	// noiseRekeyAfter is how many messages are sent with a key before
+	// it's rotated
+	noiseRekeyAfter = 1000
+
+	macSize = 16
+
+	act1Size = 1 + 33 + macSize
+	act2Size = 1 + 33 + macSize
+	act3Size = 1 + 33 + macSize + macSize
+)
+
+// newAEAD makes the cipher used in the handshake and after
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
+
+// hkdf is HKDF-SHA256 with 2 32 byte outputs
+func hkdf(salt, ikm []byte) (a, b [32]byte) {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{0x01})
+	copy(a[:], mac.Sum(nil))
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(a[:])
+	mac.Write([]byte{0x02})
+	copy(b[:], mac.Sum(nil))
+	return
+}
+
+// ecdh is sha256 of the compressed point priv * pub
+func ecdh(priv *btcec.PrivateKey, pub *btcec.PublicKey) []byte {
+	x, y := btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	shared := btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}
+	h := fastsha256.Sum256(shared.SerializeCompressed())
+	return h[:]
+}
+
+func noiseNonce(n uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	return b[:]
+}
+
+// pkhMatches says if pub hashes to pkh.  pkh is 20 bytes, or 12 with the
+// low bit of the last byte cleared, like ln addresses without checksums.
+func pkhMatches(pub, pkh []byte) bool {
+	full := fastsha256.Sum256(pub)
+	switch len(pkh) {
+	case 20:
+		return hmac.Equal(pkh, full[:20])
+	case 12:
+		full[11] &= 0xfe
+		return hmac.Equal(pkh, full[:12])
+	}
+	return false
+}
+
+// handshakeState is the symmetric state during the handshake
+type handshakeState struct {
+	ck   [32]byte // chaining key
+	h    [32]byte // hash of everything so far
+	temp [32]byte // key for the handshake's tags
+}
+
+// newHandshake starts a handshake with the responder's static key rs
+func newHandshake(rs *btcec.PublicKey) *handshakeState {
+	hs := new(handshakeState)
+	hs.h = sha256.Sum256([]byte(noiseProtocolName))
+	hs.ck = hs.h
+	hs.mixHash([]byte(noisePrologue))
+	hs.mixHash(rs.SerializeCompressed())
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	hs.h = sha256.Sum256(append(hs.h[:], data...))
+}
+
+func (hs *handshakeState) mixKey(ikm []byte) {
+	hs.ck, hs.temp = hkdf(hs.ck[:], ikm)
+}
+
+// encrypt seals pt with the temp key, and hashes in the ciphertext
+func (hs *handshakeState) encrypt(n uint64, pt []byte) ([]byte, error) {
+	aead, err := newAEAD(hs.temp[:])
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, noiseNonce(n), pt, hs.h[:])
+	hs.mixHash(ct)
+	return ct, nil
+}
+
+// decrypt opens ct with the temp key, and hashes in the ciphertext
+func (hs *handshakeState) decrypt(n uint64, ct []byte) ([]byte, error) {
+	aead, err := newAEAD(hs.temp[:])
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, noiseNonce(n), ct, hs.h[:])
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(ct)
+	return pt, nil
+}
+
+// noiseCipher is one direction of a connection after the handshake
+type noiseCipher struct {
+	aead  cipher.AEAD
+	key   [32]byte
+	ck    [32]byte
+	nonce uint64
+}
+
+func newNoiseCipher(key, ck [32]byte) (*noiseCipher, error) {
+	nc := &noiseCipher{key: key, ck: ck}
+	var err error
+	nc.aead, err = newAEAD(key[:])
+	return nc, err
+}
+
+// rotate switches to the next key if this one's been used enough
+func (nc *noiseCipher) rotate() error {
+	if nc.nonce < noiseRekeyAfter {
+		return nil
+	}
+	nc.ck, nc.key = hkdf(nc.ck[:], nc.key[:])
+	nc.nonce = 0
+	var err error
+	nc.aead, err = newAEAD(nc.key[:])
+	return err
+}
+
+func (nc *noiseCipher) seal(pt []byte) ([]byte, error) {
+	ct := nc.aead.Seal(nil, noiseNonce(nc.nonce), pt, nil)
+	nc.nonce++
+	return ct, nc.rotate()
+}
+
+func (nc *noiseCipher) open(ct []byte) ([]byte, error) {
+	pt, err := nc.aead.Open(nil, noiseNonce(nc.nonce), ct, nil)
+	if err != nil {
+		return nil, err
+	}
+	nc.nonce++
+	return pt, nc.rotate()
+}
+
+// split makes the ciphers for after the handshake.  The first is the
+// initiator's sending one.
+func (hs *handshakeState) split() (*noiseCipher, *noiseCipher, error) {
+	k1, k2 := hkdf(hs.ck[:], nil)
+	c1, err := newNoiseCipher(k1, hs.ck)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newNoiseCipher(k2, hs.ck)
+	return c1, c2, err
+}
+
+// readAct reads a handshake message of size bytes and checks the version
+func readAct(c *LNDConn, size int) ([]byte, error) {
+	msg, err := readClear(c.Conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) != size {
+		return nil, fmt.Errorf("handshake message %d bytes, expect %d",
+			len(msg), size)
+	}
+	if msg[0] != noiseVersion {
+		return nil, fmt.Errorf("handshake version %d, expect %d",
+			msg[0], noiseVersion)
+	}
+	return msg[1:], nil
+}
+
+// dialNoise does the connector's side of the handshake
+func (c *LNDConn) dialNoise(myId *btcec.PrivateKey, theirPKH []byte) error {
+	// act 0: ask for their pubkey
+	_, err := writeClear(c.Conn, append([]byte{noiseVersion}, theirPKH...))
+	if err != nil {
+		return err
+	}
+	msg, err := readAct(c, 34)
+	if err != nil {
+		return err
+	}
+	if !pkhMatches(msg, theirPKH) {
+		return fmt.Errorf("remote pubkey %x doesn't match %x", msg, theirPKH)
+	}
+	rs, err := btcec.ParsePubKey(msg, btcec.S256())
+	if err != nil {
+		return err
+	}
+	hs := newHandshake(rs)
+
+	// act 1: e, es
+	e, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return err
+	}
+	ePub := e.PubKey().SerializeCompressed()
+	hs.mixHash(ePub)
+	hs.mixKey(ecdh(e, rs))
+	tag, err := hs.encrypt(0, nil)
+	if err != nil {
+		return err
+	}
+	act1 := append(append([]byte{noiseVersion}, ePub...), tag...)
+	_, err = writeClear(c.Conn, act1)
+	if err != nil {
+		return err
+	}
+
+	// act 2: e, ee
+	msg, err = readAct(c, act2Size)
+	if err != nil {
+		return err
+	}
+	re, err := btcec.ParsePubKey(msg[:33], btcec.S256())
+	if err != nil {
+		return err
+	}
+	hs.mixHash(msg[:33])
+	hs.mixKey(ecdh(e, re))
+	_, err = hs.decrypt(0, msg[33:])
+	if err != nil {
+		return fmt.Errorf("handshake act 2: %s", err.Error())
+	}
+
+	// act 3: s, se
+	encS, err := hs.encrypt(1, myId.PubKey().SerializeCompressed())
+	if err != nil {
+		return err
+	}
+	hs.mixKey(ecdh(myId, re))
+	tag, err = hs.encrypt(0, nil)
+	if err != nil {
+		return err
+	}
+	act3 := append(append([]byte{noiseVersion}, encS...), tag...)
+	_, err = writeClear(c.Conn, act3)
+	if err != nil {
+		return err
+	}
+
+	c.sendCipher, c.recvCipher, err = hs.split()
+	if err != nil {
+		return err
+	}
+	c.version = noiseVersion
+	c.RemotePub = rs
+	c.Authed = true
+	return nil
+}
+
+// acceptNoise does the listener's side of the handshake.  act0 is the
+// first message, which asked for our pubkey by its hash.
+func (l *Listener) acceptNoise(c *LNDConn, act0 []byte) error {
+	if !pkhMatches(l.longTermPriv.PubKey().SerializeCompressed(), act0[1:]) {
+		return fmt.Errorf("remote host asking for PKH %x, not us", act0[1:])
+	}
+	myPub := l.longTermPriv.PubKey()
+	_, err := writeClear(c.Conn,
+		append([]byte{noiseVersion}, myPub.SerializeCompressed()...))
+	if err != nil {
+		return err
+	}
+	hs := newHandshake(myPub)
+
+	// act 1: e, es
+	msg, err := readAct(c, act1Size)
+	if err != nil {
+		return err
+	}
+	re, err := btcec.ParsePubKey(msg[:33], btcec.S256())
+	if err != nil {
+		return err
+	}
+	hs.mixHash(msg[:33])
+	hs.mixKey(ecdh(l.longTermPriv, re))
+	_, err = hs.decrypt(0, msg[33:])
+	if err != nil {
+		return fmt.Errorf("handshake act 1: %s", err.Error())
+	}
+
+	// act 2: e, ee
+	e, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return err
+	}
+	ePub := e.PubKey().SerializeCompressed()
+	hs.mixHash(ePub)
+	hs.mixKey(ecdh(e, re))
+	tag, err := hs.encrypt(0, nil)
+	if err != nil {
+		return err
+	}
+	act2 := append(append([]byte{noiseVersion}, ePub...), tag...)
+	_, err = writeClear(c.Conn, act2)
+	if err != nil {
+		return err
+	}
+
+	// act 3: s, se
+	msg, err = readAct(c, act3Size)
+	if err != nil {
+		return err
+	}
+	rsBytes, err := hs.decrypt(1, msg[:33+macSize])
+	if err != nil {
+		return fmt.Errorf("handshake act 3: %s", err.Error())
+	}
+	rs, err := btcec.ParsePubKey(rsBytes, btcec.S256())
+	if err != nil {
+		return err
+	}
+	hs.mixKey(ecdh(e, rs))
+	_, err = hs.decrypt(0, msg[33+macSize:])
+	if err != nil {
+		return fmt.Errorf("handshake act 3: %s", err.Error())
+	}
+
+	c.recvCipher, c.sendCipher, err = hs.split()
+	if err != nil {
+		return err
+	}
+	c.version = noiseVersion
+	c.RemotePub = rs
+	c.Authed = true
+	return nil
+}
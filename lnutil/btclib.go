@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/txscript"
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil"
@@ -18,15 +19,66 @@ type TxAndHeight struct {
 	Height int32
 }
 
+// BlockDisconnect says the block at Height, with hash Hash, isn't in the
+// chain anymore.  A reorg sends one for each block it takes out, tip first.
+type BlockDisconnect struct {
+	Height int32
+	Hash   chainhash.Hash
+}
+
+// ChainPeerInfo describes a full node a chainhook is connected to.
+type ChainPeerInfo struct {
+	Addr      string
+	UserAgent string
+	Version   int32
+	Services  uint64
+	Height    int32 // height it said it was at when we connected
+	Sync      bool  // headers and blocks come from this one
+	BanScore  int32
+	BytesSent uint64
+	BytesRecv uint64
+	ConnTime  int64 // unix time connected
+}
+
+// ChainConnState says whether a chainhook can reach the blockchain.  Since is
+// when that last changed.  If it's not connected, NextTry is when it'll try
+// again (0 if it doesn't know) and LastError is what went wrong.  Times are
+// unix times.
+type ChainConnState struct {
+	Connected bool
+	Peers     int // how many full nodes, for chainhooks that use them
+	Since     int64
+	NextTry   int64
+	LastError string
+}
+
 // OutPointEvent is a message describing events concerning an outpoint.
 // There's 2 event types: confirmation and spend.  If the Tx pointer is nil,
 // then it's a confirm.  If the Tx has an actual MsgTx in there, it's a spend.
 // The Height refers to either the confirmation height
 // or the height at which it was spent. (0 means seen but unconfirmed)
+// If Disconnect is set, it's neither; blocks from Height up got reorged out,
+// so a confirmation or spend at or above Height didn't happen after all.
+// If DoubleSpent is set, the unconfirmed tx making the outpoint had one of
+// its inputs spent by Tx instead, so the outpoint is never going to exist.
 type OutPointEvent struct {
-	Op     wire.OutPoint // the outpoint being described
-	Height int32         // the height of the event
-	Tx     *wire.MsgTx   // the tx spending the outpoint
+	Op          wire.OutPoint // the outpoint being described
+	Height      int32         // the height of the event
+	Tx          *wire.MsgTx   // the tx spending the outpoint
+	Disconnect  bool          // blocks from Height up were reorged out
+	DoubleSpent bool          // the tx making Op got double spent by Tx
+}
+
+// TxConflict says an unconfirmed tx isn't going to confirm, because ByTx
+// spent Op as well.  Op is one of Tx's inputs, or the output of a tx Tx
+// depends on which got double spent.  Height is where ByTx confirmed, or 0
+// if it's unconfirmed too.  Ours is set if we broadcast Tx.
+type TxConflict struct {
+	Tx     *wire.MsgTx
+	ByTx   *wire.MsgTx
+	Op     wire.OutPoint
+	Height int32
+	Ours   bool
 }
 
 // need this because before I was comparing pointers maybe?
@@ -111,6 +163,17 @@ func KeyHashFromPkScript(pkscript []byte) []byte {
 	return nil
 }
 
+// IsWitnessV0Script is true for p2wpkh (22 byte) and p2wsh (34 byte) scripts
+func IsWitnessV0Script(script []byte) bool {
+	if len(script) == 22 && script[0] == 0x00 && script[1] == 0x14 {
+		return true
+	}
+	if len(script) == 34 && script[0] == 0x00 && script[1] == 0x20 {
+		return true
+	}
+	return false
+}
+
 // TxToString prints out some info about a transaction. for testing / debugging
 func TxToString(tx *wire.MsgTx) string {
 	utx := btcutil.NewTx(tx)
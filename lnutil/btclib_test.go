@@ -271,3 +271,35 @@ func TestDirectWPKHScriptFromPKH(t *testing.T) {
 
 	// TODO: one more test case
 }
+
+// IsWitnessV0Script
+// test p2wpkh, p2wsh, and some things which aren't either
+func TestIsWitnessV0Script(t *testing.T) {
+	var pkh [20]byte
+	if !IsWitnessV0Script(DirectWPKHScriptFromPKH(pkh)) {
+		t.Fatalf("p2wpkh script should be witness v0")
+	}
+
+	if !IsWitnessV0Script(P2WSHify([]byte{0x51})) {
+		t.Fatalf("p2wsh script should be witness v0")
+	}
+
+	// p2pkh
+	p2pkh := make([]byte, 25)
+	p2pkh[0], p2pkh[1], p2pkh[2], p2pkh[23], p2pkh[24] =
+		0x76, 0xa9, 0x14, 0x88, 0xac
+	if IsWitnessV0Script(p2pkh) {
+		t.Fatalf("p2pkh script is not witness v0")
+	}
+
+	// witness v1 with 32 byte program
+	v1 := P2WSHify([]byte{0x51})
+	v1[0] = 0x51
+	if IsWitnessV0Script(v1) {
+		t.Fatalf("witness v1 script is not witness v0")
+	}
+
+	if IsWitnessV0Script(nil) {
+		t.Fatalf("empty script is not witness v0")
+	}
+}
@@ -0,0 +1,104 @@
+// Package chaintest has the made up blocks and txs that the ChainHook tests
+// feed to their stand-in nodes and explorers, and reads what comes out the
+// other side.
+package chaintest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// Block makes a block on prev (nil for genesis) with a unique coinbase tx
+// and the given txs
+func Block(prev *wire.MsgBlock, nonce uint32, txs ...*wire.MsgTx) *wire.MsgBlock {
+	cb := wire.NewMsgTx()
+	cb.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+		[]byte{byte(nonce), byte(nonce >> 8)}, nil))
+	cb.AddTxOut(wire.NewTxOut(5000000000, []byte{0x51}))
+
+	b := new(wire.MsgBlock)
+	b.Header.Version = 4
+	b.Header.Nonce = nonce
+	if prev != nil {
+		b.Header.PrevBlock = prev.BlockHash()
+	}
+	b.Transactions = append([]*wire.MsgTx{cb}, txs...)
+	return b
+}
+
+// Tx makes a tx spending prev with a made up witness, paying value to
+// pkScript
+func Tx(prev wire.OutPoint, value int64, pkScript []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(&prev, nil, [][]byte{[]byte("sig"), []byte("pub")}))
+	tx.AddTxOut(wire.NewTxOut(value, pkScript))
+	return tx
+}
+
+// Txs are the txs a sync test looks for.  Pay pays to the wallet's script,
+// Spend spends that, Other is someone else's, and Mempool pays to the
+// wallet's script but isn't in a block.
+type Txs struct {
+	Pay, Spend, Other, Mempool *wire.MsgTx
+}
+
+// NewTxs makes Txs paying to myScript
+func NewTxs(myScript []byte) Txs {
+	var x Txs
+	x.Pay = Tx(wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("a"))},
+		50000, myScript)
+	x.Spend = Tx(wire.OutPoint{Hash: x.Pay.TxHash()}, 40000, []byte{0x51})
+	x.Other = Tx(wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("b"))},
+		30000, []byte{0x51})
+	x.Mempool = Tx(wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("c"))},
+		20000, myScript)
+	return x
+}
+
+// Collected is what came out of a ChainHook's channels
+type Collected struct {
+	Heights []int32                  // every height sent, in order
+	Gone    []lnutil.BlockDisconnect // disconnected blocks
+	Extra   []lnutil.TxAndHeight     // txs not wanted, or sent again
+}
+
+// Collect reads from a ChainHook's channels until all the wanted txs have
+// come up at their heights, and the height is wantHeight.  Fails the test
+// if that takes more than 5 seconds, or a wanted tx is at the wrong height.
+func Collect(t *testing.T, txChan chan lnutil.TxAndHeight,
+	heightChan chan int32, dcChan chan lnutil.BlockDisconnect,
+	wantTxs map[chainhash.Hash]int32, wantHeight int32) Collected {
+
+	var c Collected
+	gotHeight := int32(-1)
+	timeout := time.After(time.Second * 5)
+	for len(wantTxs) != 0 || gotHeight != wantHeight {
+		select {
+		case txah := <-txChan:
+			txid := txah.Tx.TxHash()
+			h, ok := wantTxs[txid]
+			if !ok {
+				c.Extra = append(c.Extra, txah)
+				continue
+			}
+			if h != txah.Height {
+				t.Fatalf("tx %s at height %d, expect %d",
+					txid.String(), txah.Height, h)
+			}
+			delete(wantTxs, txid)
+		case gotHeight = <-heightChan:
+			c.Heights = append(c.Heights, gotHeight)
+		case d := <-dcChan:
+			c.Gone = append(c.Gone, d)
+		case <-timeout:
+			t.Fatalf("timed out; %d txs left, height %d", len(wantTxs), gotHeight)
+		}
+	}
+	return c
+}
@@ -0,0 +1,245 @@
+package lnutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer makes outgoing connections.  uspv uses one to reach full nodes and
+// lndc to reach other lit nodes.  *net.Dialer is one; Socks5Dialer goes
+// through a proxy like Tor.  Where a Dialer is nil, connections go out
+// directly.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// DialTimeout dials address over tcp with d, or directly with timeout if d
+// is nil.
+func DialTimeout(d Dialer, address string, timeout time.Duration) (
+	net.Conn, error) {
+	if d == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return d.Dial("tcp", address)
+}
+
+// HTTPClient makes an http client whose connections go out through d, or
+// directly if d is nil.  With a dialer, proxy environment variables are
+// ignored, so nothing goes around it.
+func HTTPClient(d Dialer, timeout time.Duration) *http.Client {
+	if d == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	transport := &http.Transport{
+		DialContext: func(
+			ctx context.Context, network, address string) (net.Conn, error) {
+			return d.Dial(network, address)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// IsOnion is true if host (with or without a port) is a Tor hidden service.
+// Those can only be reached through Tor.
+func IsOnion(host string) bool {
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// Socks5Dialer connects through a SOCKS5 proxy (RFC 1928).  Host names are
+// sent to the proxy to resolve, so nothing gets looked up locally and
+// .onion addresses work through Tor.
+type Socks5Dialer struct {
+	Proxy string // host:port of the proxy; Tor's is usually 127.0.0.1:9050
+
+	// Username and Password, if the proxy wants them (RFC 1929).
+	Username string
+	Password string
+
+	// Isolate sends the destination as the username, so each peer gets its
+	// own circuit with Tor's IsolateSOCKSAuth (on by default).  Overrides
+	// Username.
+	Isolate bool
+
+	// Timeout is for connecting to the proxy, and the proxy connecting to
+	// the destination.  0 is no timeout.
+	Timeout time.Duration
+}
+
+// SOCKS5 protocol bytes
+const (
+	socks5Version     = 0x05
+	socks5NoAuth      = 0x00
+	socks5UserPass    = 0x02
+	socks5Connect     = 0x01
+	socks5AtypIPv4    = 0x01
+	socks5AtypDomain  = 0x03
+	socks5AtypIPv6    = 0x04
+	socks5UserPassVer = 0x01
+)
+
+// socks5Errors are the reply codes from RFC 1928 section 6
+var socks5Errors = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Dial connects to address (host:port) through the proxy.  Only tcp.
+func (d *Socks5Dialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("socks5: can't dial %s", network)
+	}
+	con, err := net.DialTimeout("tcp", d.Proxy, d.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %s", d.Proxy, err.Error())
+	}
+	if d.Timeout != 0 {
+		con.SetDeadline(time.Now().Add(d.Timeout))
+	}
+	err = d.handshake(con, address)
+	if err != nil {
+		con.Close()
+		return nil, fmt.Errorf("socks5 proxy %s to %s: %s",
+			d.Proxy, address, err.Error())
+	}
+	con.SetDeadline(time.Time{})
+	return con, nil
+}
+
+// handshake authenticates if needed and asks the proxy to connect
+func (d *Socks5Dialer) handshake(con net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port %s", portStr)
+	}
+
+	user, pass := d.Username, d.Password
+	if d.Isolate {
+		user = address
+		if pass == "" {
+			pass = "lit"
+		}
+	}
+	if len(user) > 255 || len(pass) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+
+	// say which auth methods we do
+	method := byte(socks5NoAuth)
+	if user != "" {
+		method = socks5UserPass
+	}
+	_, err = con.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(con, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("proxy speaks version %d, not 5", reply[0])
+	}
+	if reply[1] != method {
+		return fmt.Errorf("proxy won't take auth method %d", method)
+	}
+
+	if method == socks5UserPass {
+		msg := []byte{socks5UserPassVer, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		_, err = con.Write(msg)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(con, reply[:])
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("proxy rejected username / password")
+		}
+	}
+
+	// connect request.  IPs as IPs, anything else as a name for the proxy
+	// to resolve.
+	req := []byte{socks5Version, socks5Connect, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip != nil && ip.To4() != nil:
+		req = append(req, socks5AtypIPv4)
+		req = append(req, ip.To4()...)
+	case ip != nil:
+		req = append(req, socks5AtypIPv6)
+		req = append(req, ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	_, err = con.Write(req)
+	if err != nil {
+		return err
+	}
+
+	// reply is version, code, reserved, then the bound address, which we
+	// read and ignore
+	var head [4]byte
+	_, err = io.ReadFull(con, head[:])
+	if err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return fmt.Errorf("proxy speaks version %d, not 5", head[0])
+	}
+	if head[1] != 0 {
+		why, ok := socks5Errors[head[1]]
+		if !ok {
+			why = fmt.Sprintf("unknown error %d", head[1])
+		}
+		return fmt.Errorf("%s", why)
+	}
+	var addrLen int
+	switch head[3] {
+	case socks5AtypIPv4:
+		addrLen = 4
+	case socks5AtypIPv6:
+		addrLen = 16
+	case socks5AtypDomain:
+		var l [1]byte
+		_, err = io.ReadFull(con, l[:])
+		if err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("unknown address type %d in reply", head[3])
+	}
+	bound := make([]byte, addrLen+2)
+	_, err = io.ReadFull(con, bound)
+	return err
+}
@@ -0,0 +1,323 @@
+package lnutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socksRequest is what the stand-in proxy got asked for
+type socksRequest struct {
+	user, pass string
+	host       string // as sent; names aren't resolved
+	port       int
+}
+
+// socksStandIn is a minimal SOCKS5 proxy.  Everything it's asked to connect
+// to goes to target, and what each client asked for comes out on reqs.  If
+// refuse isn't 0, it sends that reply code instead of connecting.
+func socksStandIn(t *testing.T, target string, refuse byte) (
+	string, chan socksRequest, func()) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := make(chan socksRequest, 10)
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks(con, target, refuse, reqs)
+		}
+	}()
+	return l.Addr().String(), reqs, func() { l.Close() }
+}
+
+func serveSocks(con net.Conn, target string, refuse byte,
+	reqs chan socksRequest) {
+
+	defer con.Close()
+	var req socksRequest
+	b := make([]byte, 256)
+
+	// greeting; take user / pass if offered
+	_, err := io.ReadFull(con, b[:2])
+	if err != nil || b[0] != 5 {
+		return
+	}
+	methods := b[2 : 2+b[1]]
+	_, err = io.ReadFull(con, methods)
+	if err != nil {
+		return
+	}
+	method := byte(0xff)
+	for _, m := range methods {
+		if m == 0 || m == 2 {
+			method = m
+		}
+	}
+	con.Write([]byte{5, method})
+	if method == 0xff {
+		return
+	}
+	if method == 2 {
+		io.ReadFull(con, b[:2])
+		u := make([]byte, b[1])
+		io.ReadFull(con, u)
+		io.ReadFull(con, b[:1])
+		p := make([]byte, b[0])
+		io.ReadFull(con, p)
+		req.user, req.pass = string(u), string(p)
+		con.Write([]byte{1, 0})
+	}
+
+	// connect request
+	_, err = io.ReadFull(con, b[:4])
+	if err != nil || b[1] != 1 {
+		return
+	}
+	switch b[3] {
+	case 1:
+		io.ReadFull(con, b[:4])
+		req.host = net.IP(b[:4]).String()
+	case 4:
+		io.ReadFull(con, b[:16])
+		req.host = net.IP(b[:16]).String()
+	case 3:
+		io.ReadFull(con, b[:1])
+		h := make([]byte, b[0])
+		io.ReadFull(con, h)
+		req.host = string(h)
+	}
+	io.ReadFull(con, b[:2])
+	req.port = int(b[0])<<8 | int(b[1])
+	reqs <- req
+
+	if refuse != 0 {
+		con.Write([]byte{5, refuse, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	out, err := net.Dial("tcp", target)
+	if err != nil {
+		con.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer out.Close()
+	con.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 1})
+	go io.Copy(out, con)
+	io.Copy(con, out)
+}
+
+// echoServer echoes back whatever it gets
+func echoServer(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(con, con)
+				con.Close()
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestSocks5Dialer(t *testing.T) {
+	echo, closeEcho := echoServer(t)
+	defer closeEcho()
+	proxy, reqs, closeProxy := socksStandIn(t, echo, 0)
+	defer closeProxy()
+
+	d := &Socks5Dialer{Proxy: proxy, Timeout: 5 * time.Second}
+	dests := []struct {
+		addr, host string
+		port       int
+	}{
+		{"10.1.2.3:8333", "10.1.2.3", 8333},
+		{"[2001:db8::1]:18333", "2001:db8::1", 18333},
+		{"expyuzz4wqqyqhjn.onion:2448", "expyuzz4wqqyqhjn.onion", 2448},
+		{"node.example.com:9735", "node.example.com", 9735},
+	}
+	for _, dest := range dests {
+		con, err := d.Dial("tcp", dest.addr)
+		if err != nil {
+			t.Fatalf("dial %s: %s", dest.addr, err.Error())
+		}
+		req := <-reqs
+		if req.host != dest.host || req.port != dest.port || req.user != "" {
+			t.Fatalf("dial %s asked proxy for %+v", dest.addr, req)
+		}
+		msg := []byte("hello " + dest.addr)
+		con.Write(msg)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(con, got)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("through proxy got %q %v", got, err)
+		}
+		con.Close()
+	}
+
+	// isolation: username per destination
+	d.Isolate = true
+	for _, addr := range []string{"10.1.2.3:8333", "10.1.2.4:8333"} {
+		con, err := d.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		con.Close()
+		req := <-reqs
+		if req.user != addr || req.pass == "" {
+			t.Fatalf("isolated dial to %s sent user %q pass %q",
+				addr, req.user, req.pass)
+		}
+	}
+
+	// given credentials
+	d = &Socks5Dialer{Proxy: proxy, Username: "u", Password: "p"}
+	con, err := d.Dial("tcp", "10.1.2.3:8333")
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.Close()
+	req := <-reqs
+	if req.user != "u" || req.pass != "p" {
+		t.Fatalf("sent user %q pass %q", req.user, req.pass)
+	}
+
+	if _, err = d.Dial("udp", "10.1.2.3:8333"); err == nil {
+		t.Fatalf("dialed udp through socks5")
+	}
+	if _, err = d.Dial("tcp", "10.1.2.3"); err == nil {
+		t.Fatalf("dialed without a port")
+	}
+}
+
+func TestSocks5DialerErrors(t *testing.T) {
+	proxy, reqs, closeProxy := socksStandIn(t, "", 5)
+	defer closeProxy()
+
+	d := &Socks5Dialer{Proxy: proxy, Timeout: 5 * time.Second}
+	_, err := d.Dial("tcp", "10.1.2.3:8333")
+	if err == nil {
+		t.Fatalf("refused connection worked")
+	}
+	<-reqs
+
+	// nothing listening at the proxy
+	closeProxy()
+	_, err = d.Dial("tcp", "10.1.2.3:8333")
+	if err == nil {
+		t.Fatalf("dialed through closed proxy")
+	}
+
+	// proxy that never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d = &Socks5Dialer{Proxy: l.Addr().String(), Timeout: 100 * time.Millisecond}
+	_, err = d.Dial("tcp", "10.1.2.3:8333")
+	if err == nil {
+		t.Fatalf("dialed through silent proxy")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	echo, closeEcho := echoServer(t)
+	defer closeEcho()
+
+	// nil dials directly
+	con, err := DialTimeout(nil, echo, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.Close()
+
+	proxy, reqs, closeProxy := socksStandIn(t, echo, 0)
+	defer closeProxy()
+	_, port, _ := net.SplitHostPort(echo)
+	con, err = DialTimeout(&Socks5Dialer{Proxy: proxy}, "x.onion:"+port, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.Close()
+	req := <-reqs
+	if req.host != "x.onion" || strconv.Itoa(req.port) != port {
+		t.Fatalf("asked proxy for %+v", req)
+	}
+}
+
+// TestHTTPClient makes sure http requests go through the proxy
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	defer server.Close()
+	target := strings.TrimPrefix(server.URL, "http://")
+
+	proxy, reqs, closeProxy := socksStandIn(t, target, 0)
+	defer closeProxy()
+	c := HTTPClient(&Socks5Dialer{Proxy: proxy}, time.Second*5)
+	resp, err := c.Get("http://somenode.onion:8332/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("got %q", body)
+	}
+	req := <-reqs
+	if req.host != "somenode.onion" || req.port != 8332 {
+		t.Fatalf("asked proxy for %+v", req)
+	}
+
+	// no proxy is no proxy
+	resp, err = HTTPClient(nil, time.Second*5).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case req = <-reqs:
+		t.Fatalf("direct client went through proxy for %+v", req)
+	default:
+	}
+}
+
+func TestIsOnion(t *testing.T) {
+	for host, onion := range map[string]bool{
+		"expyuzz4wqqyqhjn.onion":      true,
+		"expyuzz4wqqyqhjn.onion:2448": true,
+		"EXPYUZZ4WQQYQHJN.ONION":      true,
+		"onion.example.com:2448":      false,
+		"127.0.0.1:9050":              false,
+		"":                            false,
+	} {
+		if IsOnion(host) != onion {
+			t.Errorf("IsOnion(%q) should be %t", host, onion)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package lnutil
+
+import "fmt"
+
+// Features are the feature bits a node sends in its init message.  They
+// come in pairs: the even bit means the feature is required, and the odd
+// bit that it's supported but optional.  A node that gets a required bit
+// it doesn't know disconnects; optional bits it doesn't know are ignored
+// ("it's OK to be odd").  Bit 0 is the low bit of the last byte.
+type Features []byte
+
+// feature bit pairs; each is the even (required) bit
+const (
+	// FeatureReestablish is the channel reestablish message after
+	// connecting.  Without it, the last push / pull message is re-sent.
+	FeatureReestablish = 0
+	// FeatureTower means the node takes watchtower messages
+	FeatureTower = 2
+	// FeatureKeepalive is ping / pong.  Peers without it don't get pinged,
+	// and their connections don't time out.
+	FeatureKeepalive = 4
+	// FeatureFraming is length-prefixed messages (see framing.go), which
+	// can be bigger than one lndc record.
+	FeatureFraming = 6
+	// FeatureGossip is node and channel announcements (see gossipmsg.go)
+	FeatureGossip = 8
+)
+
+// knownFeatures are the feature pairs this version of lit knows
+var knownFeatures = []uint{
+	FeatureReestablish, FeatureTower, FeatureKeepalive, FeatureFraming,
+	FeatureGossip}
+
+// IsSet says if bit is set
+func (f Features) IsSet(bit uint) bool {
+	i := len(f) - 1 - int(bit/8)
+	if i < 0 {
+		return false
+	}
+	return f[i]&(1<<(bit%8)) != 0
+}
+
+// Set sets bit, making f longer if needed
+func (f *Features) Set(bit uint) {
+	need := int(bit/8) + 1
+	if len(*f) < need {
+		*f = append(make(Features, need-len(*f)), *f...)
+	}
+	(*f)[len(*f)-1-int(bit/8)] |= 1 << (bit % 8)
+}
+
+// Supports says if either bit of the feature pair is set
+func (f Features) Supports(feature uint) bool {
+	return f.IsSet(feature&^1) || f.IsSet(feature|1)
+}
+
+// CheckRequired returns an error if a required (even) bit is set for a
+// feature we don't know.
+func (f Features) CheckRequired() error {
+	for bit := uint(0); bit < uint(len(f))*8; bit += 2 {
+		if !f.IsSet(bit) {
+			continue
+		}
+		known := false
+		for _, k := range knownFeatures {
+			if k == bit {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown required feature bit %d", bit)
+		}
+	}
+	return nil
+}
+
+// msgFeatures are the messages that can only be sent to peers supporting a
+// feature
+var msgFeatures = map[uint8]uint{
+	MSGID_PING:         FeatureKeepalive,
+	MSGID_PONG:         FeatureKeepalive,
+	MSGID_REESTABLISH:  FeatureReestablish,
+	MSGID_WATCH_DESC:   FeatureTower,
+	MSGID_WATCH_COMMSG: FeatureTower,
+	MSGID_WATCH_DELETE: FeatureTower,
+	MSGID_NODE_ANN:     FeatureGossip,
+	MSGID_CHAN_ANN:     FeatureGossip,
+	MSGID_ANN_SIGS:     FeatureGossip,
+	MSGID_CHAN_UPDATE:  FeatureGossip,
+}
+
+// CanSend says if a message type can be sent to a peer with features f
+func (f Features) CanSend(msgType uint8) bool {
+	feature, ok := msgFeatures[msgType]
+	return !ok || f.Supports(feature)
+}
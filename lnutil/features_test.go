@@ -0,0 +1,42 @@
+package lnutil
+
+import "testing"
+
+func TestFeatures(t *testing.T) {
+	var f Features
+	f.Set(FeatureReestablish + 1)
+	if len(f) != 1 || f[0] != 0x02 {
+		t.Fatalf("got %x, expect 02", []byte(f))
+	}
+	f.Set(9)
+	if len(f) != 2 || f[0] != 0x02 || f[1] != 0x02 {
+		t.Fatalf("got %x, expect 0202", []byte(f))
+	}
+	if !f.IsSet(1) || !f.IsSet(9) || f.IsSet(0) || f.IsSet(8) || f.IsSet(100) {
+		t.Fatalf("%x: wrong bits set", []byte(f))
+	}
+	if !f.Supports(FeatureReestablish) || f.Supports(FeatureTower) {
+		t.Fatalf("%x: wrong features supported", []byte(f))
+	}
+
+	// unknown odd bits are fine, unknown even bits aren't
+	if err := f.CheckRequired(); err != nil {
+		t.Fatal(err)
+	}
+	f.Set(FeatureTower)
+	if err := f.CheckRequired(); err != nil {
+		t.Fatal(err)
+	}
+	f.Set(16)
+	if f.CheckRequired() == nil {
+		t.Fatalf("%x: unknown required bit 16 not caught", []byte(f))
+	}
+
+	if !f.CanSend(MSGID_TEXTCHAT) || !f.CanSend(MSGID_REESTABLISH) ||
+		!f.CanSend(MSGID_WATCH_COMMSG) {
+		t.Fatalf("%x: can't send supported messages", []byte(f))
+	}
+	if (Features{}).CanSend(MSGID_REESTABLISH) {
+		t.Fatalf("can send reestablish without the feature")
+	}
+}
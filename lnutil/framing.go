@@ -0,0 +1,53 @@
+package lnutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+Framing for LitMsgs over an lndc connection.  Each message goes out with a
+4 byte length in front, so it can be bigger than one lndc record (LNDConn
+splits writes into as many as it takes), and reads don't have to line up
+with messages.  Peers only frame messages if both have FeatureFraming;
+otherwise each message is a single record, as before.
+*/
+
+// MaxMsgLen is the largest message ReadFrame takes, so a peer can't make us
+// allocate much more than that.
+const MaxMsgLen = 1 << 22
+
+// WriteFrame writes a message with its length in front.  It's a single
+// Write, so messages written from different goroutines don't interleave.
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) == 0 || len(b) > MaxMsgLen {
+		return fmt.Errorf("can't send %d byte message; 1 to %d", len(b), MaxMsgLen)
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(b)))
+	copy(frame[4:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one message written by WriteFrame.  It blocks until the
+// whole message is in, however many reads that takes.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var lenBytes [4]byte
+	_, err := io.ReadFull(r, lenBytes[:])
+	if err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint32(lenBytes[:])
+	if msgLen == 0 || msgLen > MaxMsgLen {
+		return nil, fmt.Errorf("got %d byte message length; 1 to %d",
+			msgLen, MaxMsgLen)
+	}
+	b := make([]byte, msgLen)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,182 @@
+package lnutil
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// recordReader gives at most n bytes per Read, like LNDConn does with one
+// record's worth at a time
+type recordReader struct {
+	r io.Reader
+	n int
+}
+
+func (rr recordReader) Read(b []byte) (int, error) {
+	if len(b) > rr.n {
+		b = b[:rr.n]
+	}
+	return rr.r.Read(b)
+}
+
+func TestFrame(t *testing.T) {
+	var msgs [][]byte
+	for _, l := range []int{1, 100, 65514, 65535, 200000, MaxMsgLen} {
+		b := make([]byte, l)
+		_, _ = rand.Read(b)
+		msgs = append(msgs, b)
+	}
+
+	var buf bytes.Buffer
+	for _, b := range msgs {
+		err := WriteFrame(&buf, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := buf.Bytes()
+
+	for _, r := range []io.Reader{
+		bytes.NewReader(stream),
+		recordReader{bytes.NewReader(stream), 65514},
+		recordReader{bytes.NewReader(stream), 7},
+		iotest.HalfReader(bytes.NewReader(stream)),
+	} {
+		for i, b := range msgs {
+			b2, err := ReadFrame(r)
+			if err != nil {
+				t.Fatalf("message %d: %s", i, err.Error())
+			}
+			if !bytes.Equal(b, b2) {
+				t.Fatalf("message %d: %d bytes, got %d different bytes",
+					i, len(b), len(b2))
+			}
+		}
+		_, err := ReadFrame(r)
+		if err != io.EOF {
+			t.Fatalf("got %v after last message, expect EOF", err)
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if WriteFrame(&buf, nil) == nil {
+		t.Fatalf("wrote empty message")
+	}
+	if WriteFrame(&buf, make([]byte, MaxMsgLen+1)) == nil {
+		t.Fatalf("wrote message over MaxMsgLen")
+	}
+
+	for _, stream := range [][]byte{
+		{0, 0, 0, 0},             // empty
+		{0, 0x40, 0, 1},          // too long
+		{0xff, 0xff, 0xff, 0xff}, // way too long
+		{0, 0, 0, 5, 1, 2, 3},    // cut off
+		{0, 0},                   // cut off in the length
+	} {
+		_, err := ReadFrame(bytes.NewReader(stream))
+		if err == nil {
+			t.Fatalf("%x: should have errored, but didn't", stream)
+		}
+	}
+}
+
+// TestLitMsgFuzz gives LitMsgFromBytes random bytes, and valid messages
+// with bytes changed, cut off, or added, through the framing.  Nothing
+// should panic, and anything that parses should come out the same after
+// going back to bytes.
+func TestLitMsgFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	var op [36]byte
+	var pub [33]byte
+	var sig [64]byte
+	var hash [32]byte
+	valid := []LitMsg{
+		NewChatMsg(1, "hi"),
+		NewInitMsg(1, Features{0x2a}),
+		NewPingMsg(1, 7),
+		NewPongMsg(1, 7),
+		NewPointReqMsg(1, 1),
+		NewPointRespMsg(1, pub, pub, pub),
+		NewChanDescMsg(1, *OutPointFromBytes(op), pub, pub, pub, 1, 2, 3,
+			pub, pub, pub),
+		NewChanAckMsg(1, *OutPointFromBytes(op), pub, pub, pub, sig),
+		NewSigProofMsg(1, *OutPointFromBytes(op), sig),
+		NewCloseReqMsg(1, *OutPointFromBytes(op), sig),
+		NewDeltaSigMsg(1, *OutPointFromBytes(op), 5, sig),
+		NewSigRev(1, *OutPointFromBytes(op), sig, hash, pub),
+		NewGapSigRev(1, *OutPointFromBytes(op), sig, hash, pub),
+		NewRevMsg(1, *OutPointFromBytes(op), hash, pub),
+		NewReestablishMsg(1, *OutPointFromBytes(op), 5, 4),
+		NewWatchDescMsg(1, [20]byte{}, 5, 5000, pub, pub),
+		NewComMsg(1, [20]byte{}, hash, [16]byte{}, sig),
+		NewNodeAnnMsg(1, pub, 5, "nick", []string{"host:2448"}),
+		fuzzChanAnn(),
+		NewAnnSigsMsg(1, *OutPointFromBytes(op), sig, sig),
+		NewChanUpdateMsg(1, *OutPointFromBytes(op), 1, 1, 1, 1, 1),
+	}
+
+	for i := 0; i < 100000; i++ {
+		var b []byte
+		if i%2 == 0 {
+			b = make([]byte, r.Intn(400))
+			_, _ = r.Read(b)
+			if len(b) != 0 {
+				b[0] = byte(r.Intn(0x74))
+			}
+		} else {
+			b = valid[r.Intn(len(valid))].Bytes()
+			for j := r.Intn(4); j > 0; j-- {
+				b[r.Intn(len(b))] = byte(r.Int())
+			}
+			switch r.Intn(3) {
+			case 0:
+				b = b[:r.Intn(len(b)+1)]
+			case 1:
+				extra := make([]byte, r.Intn(10))
+				_, _ = r.Read(extra)
+				b = append(b, extra...)
+			}
+		}
+
+		var buf bytes.Buffer
+		if WriteFrame(&buf, b) == nil {
+			b2, err := ReadFrame(&buf)
+			if err != nil || !bytes.Equal(b, b2) {
+				t.Fatalf("%x: framing gave %x, %v", b, b2, err)
+			}
+		}
+
+		msg, err := LitMsgFromBytes(b, 1)
+		if err != nil {
+			continue
+		}
+		msg2, err := LitMsgFromBytes(msg.Bytes(), 1)
+		if err != nil {
+			t.Fatalf("%x parsed, but not its bytes %x: %s",
+				b, msg.Bytes(), err.Error())
+		}
+		if !LitMsgEqual(msg, msg2) {
+			t.Fatalf("%x: parsed to %x, then %x", b, msg.Bytes(), msg2.Bytes())
+		}
+	}
+}
+
+func fuzzChanAnn() ChanAnnMsg {
+	var op wire.OutPoint
+	var pubs [2][33]byte
+	c := NewChanAnnMsg(1, 1, op, 1000000, pubs, pubs)
+	c.Proof.Branch = make([]chainhash.Hash, 1)
+	c.FundTx = wire.NewMsgTx()
+	c.FundTx.AddTxIn(&wire.TxIn{PreviousOutPoint: op})
+	c.FundTx.AddTxOut(wire.NewTxOut(1000000, []byte{0x00, 0x20}))
+	return c
+}
@@ -0,0 +1,41 @@
+//go:build gofuzz
+// +build gofuzz
+
+package lnutil
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Fuzz is for go-fuzz (github.com/dvyukov/go-fuzz):
+//
+//	go-fuzz-build github.com/mit-dci/lit/lnutil
+//	go-fuzz -bin=lnutil-fuzz.zip -workdir=fuzz
+//
+// It reads framed messages from data, which should never panic, and checks
+// that anything that parses comes out the same after going back to bytes.
+func Fuzz(data []byte) int {
+	r := bytes.NewReader(data)
+	score := 0
+	for {
+		b, err := ReadFrame(r)
+		if err != nil {
+			return score
+		}
+		msg, err := LitMsgFromBytes(b, 0)
+		if err != nil {
+			continue
+		}
+		msg2, err := LitMsgFromBytes(msg.Bytes(), 0)
+		if err != nil {
+			panic(fmt.Sprintf("%x parsed, but not its bytes %x: %s",
+				b, msg.Bytes(), err.Error()))
+		}
+		if !LitMsgEqual(msg, msg2) {
+			panic(fmt.Sprintf("%x: parsed to %x, then %x",
+				b, msg.Bytes(), msg2.Bytes()))
+		}
+		score = 1
+	}
+}
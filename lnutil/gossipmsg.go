@@ -0,0 +1,400 @@
+package lnutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+/*
+Gossip messages tell the network about nodes and channels.  Node and channel
+announcements get passed on to peers with FeatureGossip, and kept in each
+node's graph.
+
+A node announcement is signed by the node's identity key.  Newer ones (by
+timestamp) replace older ones.
+
+A channel announcement is signed by both nodes' identity keys, and both
+funding keys, so each node says it's in the channel and each funding key
+says which node it's with.  It comes with the funding tx and proof that it's
+in a block, so anyone with the headers can check the channel's really there.
+The two nodes in a channel make it together: each sends the other its two
+signatures in an AnnSigsMsg, once the funding tx is in a block.
+
+In a channel announcement, node 0 is the one whose pubkey sorts first, and
+FundPub[0] is node 0's funding key.
+
+Each node in a channel says what it charges to forward payments through it
+with a channel update, signed by that node.  Newer ones replace older ones.
+*/
+
+const (
+	// MaxNicknameLen is the longest nickname a node can announce
+	MaxNicknameLen = 32
+
+	// MaxNodeAddrs is how many addresses a node can announce
+	MaxNodeAddrs = 8
+
+	// MaxFeeBase and MaxFeeRate are the highest fees a channel update can
+	// ask for: 0.01 coin per payment, and 10% of the amount
+	MaxFeeBase = 1000000
+	MaxFeeRate = 100000
+)
+
+// NodeAnnMsg announces a node: its nickname, and where to connect to it.
+// Addresses are host:port; the lit address comes from Pub.
+type NodeAnnMsg struct {
+	PeerIdx   uint32
+	Pub       [33]byte
+	Timestamp int64 // unix time
+	Nickname  string
+	Addrs     []string
+	Sig       [64]byte // by Pub, over SigHash()
+}
+
+func NewNodeAnnMsg(peerid uint32, pub [33]byte, timestamp int64,
+	nickname string, addrs []string) NodeAnnMsg {
+	n := new(NodeAnnMsg)
+	n.PeerIdx = peerid
+	n.Pub = pub
+	n.Timestamp = timestamp
+	n.Nickname = nickname
+	n.Addrs = addrs
+	return *n
+}
+
+func NewNodeAnnMsgFromBytes(b []byte, peerid uint32) (NodeAnnMsg, error) {
+	n := new(NodeAnnMsg)
+	n.PeerIdx = peerid
+
+	if len(b) < 108 {
+		return *n, fmt.Errorf("NodeAnn %d bytes, expect 108 or more", len(b))
+	}
+	buf := bytes.NewBuffer(b[1:]) // get rid of messageType
+
+	copy(n.Pub[:], buf.Next(33))
+	n.Timestamp = BtI64(buf.Next(8))
+
+	str, err := nextString(buf, MaxNicknameLen)
+	if err != nil {
+		return *n, err
+	}
+	n.Nickname = str
+
+	nAddrs, err := buf.ReadByte()
+	if err != nil {
+		return *n, err
+	}
+	if nAddrs > MaxNodeAddrs {
+		return *n, fmt.Errorf("NodeAnn %d addresses, max %d", nAddrs, MaxNodeAddrs)
+	}
+	for i := 0; i < int(nAddrs); i++ {
+		str, err = nextString(buf, 255)
+		if err != nil {
+			return *n, err
+		}
+		n.Addrs = append(n.Addrs, str)
+	}
+
+	if buf.Len() < 64 {
+		return *n, fmt.Errorf("NodeAnn missing signature")
+	}
+	copy(n.Sig[:], buf.Next(64))
+	return *n, nil
+}
+
+// nextString reads a string with its length (1 byte) in front
+func nextString(buf *bytes.Buffer, max int) (string, error) {
+	l, err := buf.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if int(l) > max || buf.Len() < int(l) {
+		return "", fmt.Errorf("%d byte string; max %d, %d left",
+			l, max, buf.Len())
+	}
+	return string(buf.Next(int(l))), nil
+}
+
+// signedBytes is the message up to the signature
+func (self NodeAnnMsg) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(self.MsgType())
+	buf.Write(self.Pub[:])
+	buf.Write(I64tB(self.Timestamp))
+	buf.WriteByte(byte(len(self.Nickname)))
+	buf.WriteString(self.Nickname)
+	buf.WriteByte(byte(len(self.Addrs)))
+	for _, a := range self.Addrs {
+		buf.WriteByte(byte(len(a)))
+		buf.WriteString(a)
+	}
+	return buf.Bytes()
+}
+
+// SigHash is what Sig signs
+func (self NodeAnnMsg) SigHash() chainhash.Hash {
+	return chainhash.DoubleHashH(self.signedBytes())
+}
+
+func (self NodeAnnMsg) Bytes() []byte {
+	return append(self.signedBytes(), self.Sig[:]...)
+}
+
+func (self NodeAnnMsg) Peer() uint32   { return self.PeerIdx }
+func (self NodeAnnMsg) MsgType() uint8 { return MSGID_NODE_ANN }
+
+//----------
+
+// chanAnnSignedLen is how much of a ChanAnnMsg the signatures cover:
+// type, coin, outpoint, capacity, 2 node pubs, 2 funding pubs
+const chanAnnSignedLen = 1 + 4 + 36 + 8 + 4*33
+
+// ChanAnnMsg announces a channel between two nodes.
+type ChanAnnMsg struct {
+	PeerIdx  uint32
+	Coin     uint32
+	Outpoint wire.OutPoint
+	Capacity int64
+	NodePub  [2][33]byte
+	FundPub  [2][33]byte
+	NodeSig  [2][64]byte // by NodePub, over SigHash()
+	FundSig  [2][64]byte // by FundPub, over SigHash()
+	Proof    TxProof     // FundTx is in a block
+	FundTx   *wire.MsgTx
+}
+
+func NewChanAnnMsg(peerid, coin uint32, op wire.OutPoint, capacity int64,
+	nodePub, fundPub [2][33]byte) ChanAnnMsg {
+	c := new(ChanAnnMsg)
+	c.PeerIdx = peerid
+	c.Coin = coin
+	c.Outpoint = op
+	c.Capacity = capacity
+	c.NodePub = nodePub
+	c.FundPub = fundPub
+	return *c
+}
+
+func NewChanAnnMsgFromBytes(b []byte, peerid uint32) (ChanAnnMsg, error) {
+	c := new(ChanAnnMsg)
+	c.PeerIdx = peerid
+
+	if len(b) < chanAnnSignedLen+4*64+9 {
+		return *c, fmt.Errorf("ChanAnn %d bytes, expect %d or more",
+			len(b), chanAnnSignedLen+4*64+9)
+	}
+	buf := bytes.NewBuffer(b[1:]) // get rid of messageType
+
+	c.Coin = BtU32(buf.Next(4))
+	var opArr [36]byte
+	copy(opArr[:], buf.Next(36))
+	c.Outpoint = *OutPointFromBytes(opArr)
+	c.Capacity = BtI64(buf.Next(8))
+	for i := range c.NodePub {
+		copy(c.NodePub[i][:], buf.Next(33))
+	}
+	for i := range c.FundPub {
+		copy(c.FundPub[i][:], buf.Next(33))
+	}
+	for i := range c.NodeSig {
+		copy(c.NodeSig[i][:], buf.Next(64))
+	}
+	for i := range c.FundSig {
+		copy(c.FundSig[i][:], buf.Next(64))
+	}
+
+	proof, plen, err := TxProofFromBytes(buf.Bytes())
+	if err != nil {
+		return *c, err
+	}
+	c.Proof = proof
+	buf.Next(plen)
+
+	// the rest is the funding tx
+	c.FundTx = wire.NewMsgTx()
+	err = c.FundTx.Deserialize(buf)
+	if err != nil {
+		return *c, err
+	}
+	// (a tx with no inputs wouldn't come out the same after serializing)
+	if len(c.FundTx.TxIn) == 0 || len(c.FundTx.TxOut) == 0 {
+		return *c, fmt.Errorf("ChanAnn funding tx has %d inputs, %d outputs",
+			len(c.FundTx.TxIn), len(c.FundTx.TxOut))
+	}
+	return *c, nil
+}
+
+// SigHash is what all four signatures sign
+func (self ChanAnnMsg) SigHash() chainhash.Hash {
+	return chainhash.DoubleHashH(self.Bytes()[:chanAnnSignedLen])
+}
+
+func (self ChanAnnMsg) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(self.MsgType())
+	buf.Write(U32tB(self.Coin))
+	opArr := OutPointToBytes(self.Outpoint)
+	buf.Write(opArr[:])
+	buf.Write(I64tB(self.Capacity))
+	for _, pub := range self.NodePub {
+		buf.Write(pub[:])
+	}
+	for _, pub := range self.FundPub {
+		buf.Write(pub[:])
+	}
+	for _, sig := range self.NodeSig {
+		buf.Write(sig[:])
+	}
+	for _, sig := range self.FundSig {
+		buf.Write(sig[:])
+	}
+	buf.Write(self.Proof.Bytes())
+	if self.FundTx != nil {
+		self.FundTx.Serialize(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (self ChanAnnMsg) Peer() uint32   { return self.PeerIdx }
+func (self ChanAnnMsg) MsgType() uint8 { return MSGID_CHAN_ANN }
+
+//----------
+
+// AnnSigsMsg is one side of a channel's signatures for its announcement,
+// sent to the other side.
+type AnnSigsMsg struct {
+	PeerIdx  uint32
+	Outpoint wire.OutPoint
+	NodeSig  [64]byte
+	FundSig  [64]byte
+}
+
+func NewAnnSigsMsg(peerid uint32, op wire.OutPoint,
+	nodeSig, fundSig [64]byte) AnnSigsMsg {
+	a := new(AnnSigsMsg)
+	a.PeerIdx = peerid
+	a.Outpoint = op
+	a.NodeSig = nodeSig
+	a.FundSig = fundSig
+	return *a
+}
+
+func NewAnnSigsMsgFromBytes(b []byte, peerid uint32) (AnnSigsMsg, error) {
+	a := new(AnnSigsMsg)
+	a.PeerIdx = peerid
+
+	if len(b) < 165 {
+		return *a, fmt.Errorf("AnnSigs %d bytes, expect 165", len(b))
+	}
+	buf := bytes.NewBuffer(b[1:]) // get rid of messageType
+
+	var opArr [36]byte
+	copy(opArr[:], buf.Next(36))
+	a.Outpoint = *OutPointFromBytes(opArr)
+	copy(a.NodeSig[:], buf.Next(64))
+	copy(a.FundSig[:], buf.Next(64))
+	return *a, nil
+}
+
+func (self AnnSigsMsg) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(self.MsgType())
+	opArr := OutPointToBytes(self.Outpoint)
+	buf.Write(opArr[:])
+	buf.Write(self.NodeSig[:])
+	buf.Write(self.FundSig[:])
+	return buf.Bytes()
+}
+
+func (self AnnSigsMsg) Peer() uint32   { return self.PeerIdx }
+func (self AnnSigsMsg) MsgType() uint8 { return MSGID_ANN_SIGS }
+
+//----------
+
+// ChanUpdateMsg is what one node in an announced channel charges to send
+// payments through it to the other node.
+type ChanUpdateMsg struct {
+	PeerIdx   uint32
+	Outpoint  wire.OutPoint
+	Timestamp int64    // unix time
+	Node      uint8    // which node in the ChanAnnMsg; 0 or 1
+	FeeBase   int64    // satoshis per payment
+	FeeRate   int64    // millionths of the amount
+	Delta     uint16   // blocks of timelock the node wants
+	Sig       [64]byte // by the node, over SigHash()
+}
+
+func NewChanUpdateMsg(peerid uint32, op wire.OutPoint, timestamp int64,
+	node uint8, feeBase, feeRate int64, delta uint16) ChanUpdateMsg {
+	c := new(ChanUpdateMsg)
+	c.PeerIdx = peerid
+	c.Outpoint = op
+	c.Timestamp = timestamp
+	c.Node = node
+	c.FeeBase = feeBase
+	c.FeeRate = feeRate
+	c.Delta = delta
+	return *c
+}
+
+func NewChanUpdateMsgFromBytes(b []byte, peerid uint32) (ChanUpdateMsg, error) {
+	c := new(ChanUpdateMsg)
+	c.PeerIdx = peerid
+
+	if len(b) < 128 {
+		return *c, fmt.Errorf("ChanUpdate %d bytes, expect 128", len(b))
+	}
+	buf := bytes.NewBuffer(b[1:]) // get rid of messageType
+
+	var opArr [36]byte
+	copy(opArr[:], buf.Next(36))
+	c.Outpoint = *OutPointFromBytes(opArr)
+	c.Timestamp = BtI64(buf.Next(8))
+	c.Node, _ = buf.ReadByte()
+	if c.Node > 1 {
+		return *c, fmt.Errorf("ChanUpdate for node %d", c.Node)
+	}
+	c.FeeBase = BtI64(buf.Next(8))
+	c.FeeRate = BtI64(buf.Next(8))
+	if c.FeeBase < 0 || c.FeeBase > MaxFeeBase {
+		return *c, fmt.Errorf("ChanUpdate fee base %d, max %d",
+			c.FeeBase, MaxFeeBase)
+	}
+	if c.FeeRate < 0 || c.FeeRate > MaxFeeRate {
+		return *c, fmt.Errorf("ChanUpdate fee rate %d, max %d",
+			c.FeeRate, MaxFeeRate)
+	}
+	_ = binary.Read(buf, binary.BigEndian, &c.Delta)
+	copy(c.Sig[:], buf.Next(64))
+	return *c, nil
+}
+
+// signedBytes is the message up to the signature
+func (self ChanUpdateMsg) signedBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(self.MsgType())
+	opArr := OutPointToBytes(self.Outpoint)
+	buf.Write(opArr[:])
+	buf.Write(I64tB(self.Timestamp))
+	buf.WriteByte(self.Node)
+	buf.Write(I64tB(self.FeeBase))
+	buf.Write(I64tB(self.FeeRate))
+	binary.Write(&buf, binary.BigEndian, self.Delta)
+	return buf.Bytes()
+}
+
+// SigHash is what Sig signs
+func (self ChanUpdateMsg) SigHash() chainhash.Hash {
+	return chainhash.DoubleHashH(self.signedBytes())
+}
+
+func (self ChanUpdateMsg) Bytes() []byte {
+	return append(self.signedBytes(), self.Sig[:]...)
+}
+
+func (self ChanUpdateMsg) Peer() uint32   { return self.PeerIdx }
+func (self ChanUpdateMsg) MsgType() uint8 { return MSGID_CHAN_UPDATE }
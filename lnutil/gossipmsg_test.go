@@ -0,0 +1,164 @@
+package lnutil
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+func TestNodeAnnMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var pub [33]byte
+	_, _ = rand.Read(pub[:])
+
+	msg := NewNodeAnnMsg(peerid, pub, 1500000000, "bob",
+		[]string{"1.2.3.4:2448", "bobsnode.onion:2448"})
+	_, _ = rand.Read(msg.Sig[:])
+	b := msg.Bytes()
+
+	msg2, err := LitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg, msg2) {
+		t.Fatalf("from bytes mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+	}
+	if msg.SigHash() != msg2.(NodeAnnMsg).SigHash() {
+		t.Fatalf("sighash changed")
+	}
+	// the signature isn't in the sighash
+	msg.Sig[0]++
+	if msg.SigHash() != msg2.(NodeAnnMsg).SigHash() {
+		t.Fatalf("sighash covers the signature")
+	}
+
+	_, err = LitMsgFromBytes(b[:len(b)-1], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+
+	msg.Nickname = "a nickname that's too long to announce"
+	_, err = LitMsgFromBytes(msg.Bytes(), peerid)
+	if err == nil {
+		t.Fatalf("long nickname parsed")
+	}
+}
+
+func TestChanAnnMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var op wire.OutPoint
+	_, _ = rand.Read(op.Hash[:])
+	op.Index = 1
+	var nodePub, fundPub [2][33]byte
+	for i := 0; i < 2; i++ {
+		_, _ = rand.Read(nodePub[i][:])
+		_, _ = rand.Read(fundPub[i][:])
+	}
+
+	msg := NewChanAnnMsg(peerid, 1, op, 5000000, nodePub, fundPub)
+	sigHash := msg.SigHash()
+
+	for i := 0; i < 2; i++ {
+		_, _ = rand.Read(msg.NodeSig[i][:])
+		_, _ = rand.Read(msg.FundSig[i][:])
+	}
+	msg.Proof.Height = 1000
+	msg.Proof.Pos = 3
+	msg.Proof.Branch = make([]chainhash.Hash, 2)
+	msg.FundTx = wire.NewMsgTx()
+	msg.FundTx.AddTxIn(&wire.TxIn{PreviousOutPoint: op})
+	msg.FundTx.AddTxOut(wire.NewTxOut(5000000, []byte{0x00, 0x20}))
+	b := msg.Bytes()
+
+	msg2, err := LitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg, msg2) {
+		t.Fatalf("from bytes mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+	}
+	// signatures, proof and tx aren't signed
+	if msg2.(ChanAnnMsg).SigHash() != sigHash {
+		t.Fatalf("sighash changed")
+	}
+
+	_, err = LitMsgFromBytes(b[:len(b)-1], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+}
+
+func TestAnnSigsMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var op wire.OutPoint
+	_, _ = rand.Read(op.Hash[:])
+	var nodeSig, fundSig [64]byte
+	_, _ = rand.Read(nodeSig[:])
+	_, _ = rand.Read(fundSig[:])
+
+	msg := NewAnnSigsMsg(peerid, op, nodeSig, fundSig)
+	b := msg.Bytes()
+
+	msg2, err := LitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg, msg2) {
+		t.Fatalf("from bytes mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+	}
+
+	_, err = LitMsgFromBytes(b[:len(b)-1], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+}
+
+func TestChanUpdateMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var op wire.OutPoint
+	_, _ = rand.Read(op.Hash[:])
+
+	msg := NewChanUpdateMsg(peerid, op, 1500000000, 1, 1000, 100, 144)
+	_, _ = rand.Read(msg.Sig[:])
+	b := msg.Bytes()
+
+	msg2, err := LitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg, msg2) {
+		t.Fatalf("from bytes mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+	}
+	if msg2.(ChanUpdateMsg).Delta != 144 {
+		t.Fatalf("delta %d, expect 144", msg2.(ChanUpdateMsg).Delta)
+	}
+
+	_, err = LitMsgFromBytes(b[:len(b)-1], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+
+	b[45] = 2 // node
+	_, err = LitMsgFromBytes(b, peerid)
+	if err == nil {
+		t.Fatalf("node 2 should have errored, but didn't")
+	}
+	b[45] = 1
+
+	for _, fees := range [][2]int64{
+		{-1, 100}, {1000, -1}, {MaxFeeBase + 1, 100}, {1000, MaxFeeRate + 1}} {
+		msg.FeeBase, msg.FeeRate = fees[0], fees[1]
+		_, err = LitMsgFromBytes(msg.Bytes(), peerid)
+		if err == nil {
+			t.Fatalf("fee base %d rate %d should have errored, but didn't",
+				fees[0], fees[1])
+		}
+	}
+	msg.FeeBase, msg.FeeRate = MaxFeeBase, MaxFeeRate
+	_, err = LitMsgFromBytes(msg.Bytes(), peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,6 +12,9 @@ import (
 //id numbers for messages, semi-arbitrary
 const (
 	MSGID_TEXTCHAT = 0x00 // send a text message
+	MSGID_INIT     = 0x01 // first message after connecting; feature bits
+	MSGID_PING     = 0x02 // keepalive; expects a pong
+	MSGID_PONG     = 0x03
 
 	//Channel creation messages
 	MSGID_POINTREQ  = 0x10
@@ -25,10 +28,11 @@ const (
 	MSGID_CLOSERESP = 0x21
 
 	//Push Pull Messages
-	MSGID_DELTASIG  = 0x30 // pushing funds in channel; request to send
-	MSGID_SIGREV    = 0x31 // pulling funds; signing new state and revoking old
-	MSGID_GAPSIGREV = 0x32 // resolving collision
-	MSGID_REV       = 0x33 // pushing funds; revoking previous channel state
+	MSGID_DELTASIG    = 0x30 // pushing funds in channel; request to send
+	MSGID_SIGREV      = 0x31 // pulling funds; signing new state and revoking old
+	MSGID_GAPSIGREV   = 0x32 // resolving collision
+	MSGID_REV         = 0x33 // pushing funds; revoking previous channel state
+	MSGID_REESTABLISH = 0x34 // after reconnecting; where each side's state is
 
 	//not implemented
 	MSGID_FWDMSG     = 0x40
@@ -41,6 +45,12 @@ const (
 	MSGID_WATCH_DESC   = 0x60 // desc describes a new channel
 	MSGID_WATCH_COMMSG = 0x61 // commsg is a single state in the channel
 	MSGID_WATCH_DELETE = 0x62 // Watch_clear marks a channel as ok to delete.  No further updates possible.
+
+	//Gossip messages
+	MSGID_NODE_ANN    = 0x70 // a node's nickname and addresses
+	MSGID_CHAN_ANN    = 0x71 // a channel and its funding proof
+	MSGID_ANN_SIGS    = 0x72 // one side's signatures for a channel announcement
+	MSGID_CHAN_UPDATE = 0x73 // one side's fees for a channel
 )
 
 //interface that all messages follow, for easy use
@@ -67,6 +77,12 @@ func LitMsgFromBytes(b []byte, peerid uint32) (LitMsg, error) {
 	switch msgType {
 	case MSGID_TEXTCHAT:
 		return NewChatMsgFromBytes(b, peerid)
+	case MSGID_INIT:
+		return NewInitMsgFromBytes(b, peerid)
+	case MSGID_PING:
+		return NewPingMsgFromBytes(b, peerid)
+	case MSGID_PONG:
+		return NewPongMsgFromBytes(b, peerid)
 	case MSGID_POINTREQ:
 		return NewPointReqMsgFromBytes(b, peerid)
 	case MSGID_POINTRESP:
@@ -92,6 +108,8 @@ func LitMsgFromBytes(b []byte, peerid uint32) (LitMsg, error) {
 		return NewGapSigRevFromBytes(b, peerid)
 	case MSGID_REV:
 		return NewRevMsgFromBytes(b, peerid)
+	case MSGID_REESTABLISH:
+		return NewReestablishMsgFromBytes(b, peerid)
 
 	/*
 		case MSGID_FWDMSG:
@@ -108,6 +126,15 @@ func LitMsgFromBytes(b []byte, peerid uint32) (LitMsg, error) {
 		case MSGID_WATCH_DELETE:
 	*/
 
+	case MSGID_NODE_ANN:
+		return NewNodeAnnMsgFromBytes(b, peerid)
+	case MSGID_CHAN_ANN:
+		return NewChanAnnMsgFromBytes(b, peerid)
+	case MSGID_ANN_SIGS:
+		return NewAnnSigsMsgFromBytes(b, peerid)
+	case MSGID_CHAN_UPDATE:
+		return NewChanUpdateMsgFromBytes(b, peerid)
+
 	default:
 		return nil, fmt.Errorf("Unknown message of type %d ", msgType)
 	}
@@ -154,6 +181,125 @@ func (self ChatMsg) MsgType() uint8 { return MSGID_TEXTCHAT }
 
 //----------
 
+// InitMsg is the first message each side sends after connecting, with the
+// features it supports.  Nothing else is sent until both have been sent.
+type InitMsg struct {
+	PeerIdx  uint32
+	Features Features
+}
+
+func NewInitMsg(peerid uint32, features Features) InitMsg {
+	i := new(InitMsg)
+	i.PeerIdx = peerid
+	i.Features = features
+	return *i
+}
+
+func NewInitMsgFromBytes(b []byte, peerid uint32) (InitMsg, error) {
+	i := new(InitMsg)
+	i.PeerIdx = peerid
+
+	if len(b) < 3 {
+		return *i, fmt.Errorf("got %d bytes, expect 3 or more", len(b))
+	}
+	flen := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 3+flen {
+		return *i, fmt.Errorf("got %d bytes, expect %d", len(b), 3+flen)
+	}
+	// anything after the features is for later versions
+	i.Features = Features(append([]byte{}, b[3:3+flen]...))
+
+	return *i, nil
+}
+
+func (self InitMsg) Bytes() []byte {
+	var msg []byte
+	msg = append(msg, self.MsgType())
+	var flen [2]byte
+	binary.BigEndian.PutUint16(flen[:], uint16(len(self.Features)))
+	msg = append(msg, flen[:]...)
+	msg = append(msg, self.Features...)
+	return msg
+}
+
+func (self InitMsg) Peer() uint32   { return self.PeerIdx }
+func (self InitMsg) MsgType() uint8 { return MSGID_INIT }
+
+//----------
+
+// PingMsg is sent to peers that have been quiet, to see if they're still
+// there.  They reply with a pong with the same nonce.
+type PingMsg struct {
+	PeerIdx uint32
+	Nonce   uint64
+}
+
+func NewPingMsg(peerid uint32, nonce uint64) PingMsg {
+	p := new(PingMsg)
+	p.PeerIdx = peerid
+	p.Nonce = nonce
+	return *p
+}
+
+func NewPingMsgFromBytes(b []byte, peerid uint32) (PingMsg, error) {
+	p := new(PingMsg)
+	p.PeerIdx = peerid
+
+	if len(b) < 9 {
+		return *p, fmt.Errorf("got %d bytes, expect 9 or more", len(b))
+	}
+	p.Nonce = binary.BigEndian.Uint64(b[1:9])
+
+	return *p, nil
+}
+
+func (self PingMsg) Bytes() []byte {
+	var msg []byte
+	msg = append(msg, self.MsgType())
+	msg = append(msg, U64tB(self.Nonce)...)
+	return msg
+}
+
+func (self PingMsg) Peer() uint32   { return self.PeerIdx }
+func (self PingMsg) MsgType() uint8 { return MSGID_PING }
+
+// PongMsg is the reply to a ping
+type PongMsg struct {
+	PeerIdx uint32
+	Nonce   uint64
+}
+
+func NewPongMsg(peerid uint32, nonce uint64) PongMsg {
+	p := new(PongMsg)
+	p.PeerIdx = peerid
+	p.Nonce = nonce
+	return *p
+}
+
+func NewPongMsgFromBytes(b []byte, peerid uint32) (PongMsg, error) {
+	p := new(PongMsg)
+	p.PeerIdx = peerid
+
+	if len(b) < 9 {
+		return *p, fmt.Errorf("got %d bytes, expect 9 or more", len(b))
+	}
+	p.Nonce = binary.BigEndian.Uint64(b[1:9])
+
+	return *p, nil
+}
+
+func (self PongMsg) Bytes() []byte {
+	var msg []byte
+	msg = append(msg, self.MsgType())
+	msg = append(msg, U64tB(self.Nonce)...)
+	return msg
+}
+
+func (self PongMsg) Peer() uint32   { return self.PeerIdx }
+func (self PongMsg) MsgType() uint8 { return MSGID_PONG }
+
+//----------
+
 //message with no information, just shows a point is requested
 type PointReqMsg struct {
 	PeerIdx  uint32
@@ -683,6 +829,61 @@ func (self RevMsg) MsgType() uint8 { return MSGID_REV }
 
 //----------
 
+// ReestablishMsg is sent for each channel after reconnecting, so both sides
+// can work out which push / pull messages the other missed.
+type ReestablishMsg struct {
+	PeerIdx  uint32
+	Outpoint wire.OutPoint
+	// StateIdx is the sender's current state index
+	StateIdx uint64
+	// RevokedIdx is the last of the receiver's states the sender has a
+	// revocation for
+	RevokedIdx uint64
+}
+
+func NewReestablishMsg(peerid uint32, OP wire.OutPoint,
+	stateIdx, revokedIdx uint64) ReestablishMsg {
+	r := new(ReestablishMsg)
+	r.PeerIdx = peerid
+	r.Outpoint = OP
+	r.StateIdx = stateIdx
+	r.RevokedIdx = revokedIdx
+	return *r
+}
+
+func NewReestablishMsgFromBytes(b []byte, peerId uint32) (ReestablishMsg, error) {
+	r := new(ReestablishMsg)
+	r.PeerIdx = peerId
+
+	if len(b) < 53 {
+		return *r, fmt.Errorf("got %d byte reestablish, expect 53", len(b))
+	}
+
+	buf := bytes.NewBuffer(b[1:]) // get rid of messageType
+
+	var op [36]byte
+	copy(op[:], buf.Next(36))
+	r.Outpoint = *OutPointFromBytes(op)
+	r.StateIdx = BtU64(buf.Next(8))
+	r.RevokedIdx = BtU64(buf.Next(8))
+	return *r, nil
+}
+
+func (self ReestablishMsg) Bytes() []byte {
+	var msg []byte
+	msg = append(msg, self.MsgType())
+	opArr := OutPointToBytes(self.Outpoint)
+	msg = append(msg, opArr[:]...)
+	msg = append(msg, U64tB(self.StateIdx)...)
+	msg = append(msg, U64tB(self.RevokedIdx)...)
+	return msg
+}
+
+func (self ReestablishMsg) Peer() uint32   { return self.PeerIdx }
+func (self ReestablishMsg) MsgType() uint8 { return MSGID_REESTABLISH }
+
+//----------
+
 // 2 structs that the watchtower gets from clients: Descriptors and Msgs
 
 // Descriptors are 128 bytes
@@ -41,6 +41,68 @@ func TestChatMsg(t *testing.T) {
 	}
 }
 
+func TestInitMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var f Features
+	f.Set(FeatureReestablish + 1)
+	f.Set(FeatureTower + 1)
+	f.Set(17)
+
+	msg := NewInitMsg(peerid, f)
+	b := msg.Bytes()
+
+	msg2, err := NewInitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg, msg2) {
+		t.Fatalf("from bytes mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+	}
+
+	msg3, err := LitMsgFromBytes(append(b, 0xff), peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg2, msg3) {
+		t.Fatalf("interface mismatch:\n%x\n%x\n", msg2.Bytes(), msg3.Bytes())
+	}
+
+	_, err = LitMsgFromBytes(b[:len(b)-1], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+}
+
+func TestPingPongMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	nonce := uint64(rand.Int63())
+
+	for _, msg := range []LitMsg{NewPingMsg(peerid, nonce), NewPongMsg(peerid, nonce)} {
+		b := msg.Bytes()
+
+		msg2, err := LitMsgFromBytes(b, peerid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !LitMsgEqual(msg, msg2) {
+			t.Fatalf("interface mismatch:\n%x\n%x\n", msg.Bytes(), msg2.Bytes())
+		}
+
+		_, err = LitMsgFromBytes(b[:8], peerid)
+		if err == nil {
+			t.Fatalf("Should have errored, but didn't")
+		}
+	}
+
+	ping, err := NewPingMsgFromBytes(NewPingMsg(peerid, nonce).Bytes(), peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ping.Nonce != nonce {
+		t.Fatalf("nonce %d, expect %d", ping.Nonce, nonce)
+	}
+}
+
 func TestPointReqMsg(t *testing.T) {
 	peerid := rand.Uint32()
 	cointype := rand.Uint32()
@@ -477,6 +539,37 @@ func TestRevMsg(t *testing.T) {
 	}
 }
 
+func TestReestablishMsg(t *testing.T) {
+	peerid := rand.Uint32()
+	var outPoint [36]byte
+	_, _ = rand.Read(outPoint[:])
+	op := *OutPointFromBytes(outPoint)
+
+	msg := NewReestablishMsg(peerid, op, uint64(rand.Int63()), uint64(rand.Int63()))
+	b := msg.Bytes()
+
+	msg2, err := NewReestablishMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg2 != msg {
+		t.Fatalf("from bytes mismatch:\n%+v\n%+v\n", msg, msg2)
+	}
+
+	msg3, err := LitMsgFromBytes(b, peerid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !LitMsgEqual(msg2, msg3) {
+		t.Fatalf("interface mismatch:\n%x\n%x\n", msg2.Bytes(), msg3.Bytes())
+	}
+
+	_, err = LitMsgFromBytes(b[:52], peerid)
+	if err == nil {
+		t.Fatalf("Should have errored, but didn't")
+	}
+}
+
 func TestWatchDescMsg(t *testing.T) {
 	peerid := rand.Uint32()
 	var pkh [20]byte
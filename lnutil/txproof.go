@@ -0,0 +1,124 @@
+package lnutil
+
+import (
+	"fmt"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// TxProof shows a tx is in a block: the block's height, the tx's position
+// in the block, and the merkle branch from the txid up to the merkle root
+// in the block's header.  Checking it needs the header; see the ChainHooks.
+type TxProof struct {
+	Height int32
+	Pos    uint32
+	Branch []chainhash.Hash
+}
+
+// maxBranch is as deep as a merkle tree can get; a block with 2^32 txs.
+const maxBranch = 32
+
+// NewTxProof makes a proof for the tx at pos, given all the txids in the
+// block in order.
+func NewTxProof(txids []chainhash.Hash, pos uint32, height int32) (TxProof, error) {
+	p := TxProof{Height: height, Pos: pos}
+	if int(pos) >= len(txids) {
+		return p, fmt.Errorf("tx %d of %d", pos, len(txids))
+	}
+
+	level := append([]chainhash.Hash{}, txids...)
+	for len(level) > 1 {
+		// odd levels repeat their last hash
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		p.Branch = append(p.Branch, level[pos^1])
+
+		next := make([]chainhash.Hash, len(level)/2)
+		for i := range next {
+			next[i] = merkleParent(level[2*i], level[2*i+1])
+		}
+		level = next
+		pos >>= 1
+	}
+	return p, nil
+}
+
+// Root gives the merkle root the proof leads to from txid.  It's right if
+// it matches the one in the header at Height.
+func (p TxProof) Root(txid chainhash.Hash) chainhash.Hash {
+	h := txid
+	pos := p.Pos
+	for _, sib := range p.Branch {
+		if pos&1 == 0 {
+			h = merkleParent(h, sib)
+		} else {
+			h = merkleParent(sib, h)
+		}
+		pos >>= 1
+	}
+	return h
+}
+
+func merkleParent(left, right chainhash.Hash) chainhash.Hash {
+	var b [64]byte
+	copy(b[:32], left[:])
+	copy(b[32:], right[:])
+	return chainhash.DoubleHashH(b[:])
+}
+
+// Bytes is height (4), pos (4), branch length (1), then the branch
+func (p TxProof) Bytes() []byte {
+	var b []byte
+	b = append(b, I32tB(p.Height)...)
+	b = append(b, U32tB(p.Pos)...)
+	b = append(b, byte(len(p.Branch)))
+	for _, h := range p.Branch {
+		b = append(b, h[:]...)
+	}
+	return b
+}
+
+// TxProofFromBytes parses a proof from the start of b, and says how many
+// bytes it took.
+func TxProofFromBytes(b []byte) (TxProof, int, error) {
+	var p TxProof
+	if len(b) < 9 {
+		return p, 0, fmt.Errorf("tx proof %d bytes, expect 9 or more", len(b))
+	}
+	p.Height = BtI32(b[:4])
+	p.Pos = BtU32(b[4:8])
+	n := int(b[8])
+	if n > maxBranch {
+		return p, 0, fmt.Errorf("tx proof branch %d long, max %d", n, maxBranch)
+	}
+	plen := 9 + 32*n
+	if len(b) < plen {
+		return p, 0, fmt.Errorf("tx proof %d bytes, expect %d", len(b), plen)
+	}
+	p.Branch = make([]chainhash.Hash, n)
+	for i := range p.Branch {
+		copy(p.Branch[i][:], b[9+32*i:])
+	}
+	return p, plen, nil
+}
+
+// BlockTxProof finds a tx in a block, and makes a proof for it
+func BlockTxProof(block *wire.MsgBlock, txid chainhash.Hash, height int32) (
+	*wire.MsgTx, TxProof, error) {
+	txids := make([]chainhash.Hash, len(block.Transactions))
+	pos := -1
+	for i, tx := range block.Transactions {
+		txids[i] = tx.TxHash()
+		if txids[i] == txid {
+			pos = i
+		}
+	}
+	if pos == -1 {
+		return nil, TxProof{}, fmt.Errorf("tx %s not in block %s at height %d",
+			txid.String(), block.BlockHash().String(), height)
+	}
+	p, err := NewTxProof(txids, uint32(pos), height)
+	return block.Transactions[pos], p, err
+}
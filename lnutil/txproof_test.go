@@ -0,0 +1,66 @@
+package lnutil
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+)
+
+// merkleRoot is the plain way of working out a block's merkle root
+func merkleRoot(txids []chainhash.Hash) chainhash.Hash {
+	level := txids
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		var next []chainhash.Hash
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func TestTxProof(t *testing.T) {
+	for n := 1; n < 20; n++ {
+		txids := make([]chainhash.Hash, n)
+		for i := range txids {
+			_, _ = rand.Read(txids[i][:])
+		}
+		root := merkleRoot(append([]chainhash.Hash{}, txids...))
+
+		for pos := range txids {
+			p, err := NewTxProof(txids, uint32(pos), 500)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Root(txids[pos]) != root {
+				t.Fatalf("tx %d of %d: wrong root", pos, n)
+			}
+			// some other tx doesn't get there
+			if p.Root(txids[(pos+1)%n]) == root && n > 1 {
+				t.Fatalf("tx %d of %d: other txid gives root", pos, n)
+			}
+
+			b := p.Bytes()
+			p2, plen, err := TxProofFromBytes(append(b, 0xff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plen != len(b) || p2.Height != 500 || p2.Root(txids[pos]) != root {
+				t.Fatalf("tx %d of %d: proof changed going through bytes", pos, n)
+			}
+			_, _, err = TxProofFromBytes(b[:len(b)-1])
+			if err == nil {
+				t.Fatalf("short proof parsed")
+			}
+		}
+	}
+
+	_, err := NewTxProof(make([]chainhash.Hash, 3), 3, 1)
+	if err == nil {
+		t.Fatalf("proof for tx past the end")
+	}
+}
@@ -0,0 +1,289 @@
+package portxo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/adiabat/btcd/wire"
+)
+
+/* PartialTx is a transaction which may not have all of its signatures yet,
+along with a PorTxo for every input.  Since the PorTxos say how to derive
+the keys and what is being spent, anything with the right root key can sign
+it, without having seen the utxos itself.  Like a PSBT, but made out of
+portxos.
+
+Ins[i] describes what tx.TxIn[i] spends; the order has to line up.
+
+Non-witness inputs also carry the tx they come from.  Their signatures
+don't commit to the input value, so without it a signer would have to take
+the PorTxo's word for how much is being spent (and so for the fee).
+
+Note that any PrivKey in the input KeyGens goes along with the PartialTx.
+Only move these around between wallets you control.
+
+Serialization:
+TxLen		4
+Tx			TxLen (witness serialization)
+NumIns		1
+	InLen	2
+	PorTxo	InLen
+	PrevLen	4 (0 if no previous tx)
+	PrevTx	PrevLen
+*/
+type PartialTx struct {
+	Tx  *wire.MsgTx
+	Ins []*PorTxo
+	// PrevTxs[i] is the tx Ins[i] comes from, or nil.  Only needed for
+	// non-witness inputs.
+	PrevTxs []*wire.MsgTx
+}
+
+// NewPartialTx makes a PartialTx from a tx and the utxos it spends.
+// The utxos can come in any order; they're matched up to the txins by outpoint.
+func NewPartialTx(tx *wire.MsgTx, utxos []*PorTxo) (*PartialTx, error) {
+	if tx == nil {
+		return nil, fmt.Errorf("NewPartialTx: nil tx")
+	}
+	if len(tx.TxIn) != len(utxos) {
+		return nil, fmt.Errorf("NewPartialTx: %d txins but %d utxos",
+			len(tx.TxIn), len(utxos))
+	}
+	if len(utxos) > 255 {
+		return nil, fmt.Errorf("NewPartialTx: %d inputs, max 255", len(utxos))
+	}
+
+	p := new(PartialTx)
+	p.Tx = tx
+	p.Ins = make([]*PorTxo, len(tx.TxIn))
+	p.PrevTxs = make([]*wire.MsgTx, len(tx.TxIn))
+
+	for i, txin := range tx.TxIn {
+		for _, u := range utxos {
+			if u != nil && u.Op == txin.PreviousOutPoint {
+				p.Ins[i] = u
+				break
+			}
+		}
+		if p.Ins[i] == nil {
+			return nil, fmt.Errorf("NewPartialTx: no utxo for input %d (%s)",
+				i, txin.PreviousOutPoint.String())
+		}
+	}
+	return p, nil
+}
+
+// CoinType returns the coin type of the first input's key path.
+// All inputs should be the same coin.
+func (p *PartialTx) CoinType() uint32 {
+	if p == nil || len(p.Ins) == 0 {
+		return 0
+	}
+	return p.Ins[0].KeyGen.Step[1] & 0x7fffffff
+}
+
+// NumSigned returns how many inputs have a signature script or witness.
+func (p *PartialTx) NumSigned() int {
+	var n int
+	for _, txin := range p.Tx.TxIn {
+		if len(txin.SignatureScript) != 0 || len(txin.Witness) != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Complete is true when every input has been signed.
+func (p *PartialTx) Complete() bool {
+	return p.NumSigned() == len(p.Tx.TxIn)
+}
+
+// NeedsPrevTx is true for inputs which have to come with their previous tx,
+// since their signatures don't commit to the input value.
+func (u *PorTxo) NeedsPrevTx() bool {
+	return u.Mode&FlagTxoWitness == 0
+}
+
+// CheckPrevTxs makes sure every non-witness input has its previous tx, and
+// that the output it spends is what the PorTxo says.
+func (p *PartialTx) CheckPrevTxs() error {
+	if len(p.PrevTxs) != len(p.Ins) {
+		return fmt.Errorf("PartialTx has %d portxos but %d previous txs",
+			len(p.Ins), len(p.PrevTxs))
+	}
+	for i, u := range p.Ins {
+		if !u.NeedsPrevTx() {
+			continue
+		}
+		prev := p.PrevTxs[i]
+		if prev == nil {
+			return fmt.Errorf("input %d (%s) is non-witness; needs its previous tx",
+				i, u.Op.String())
+		}
+		if prev.TxHash() != u.Op.Hash {
+			return fmt.Errorf("input %d spends %s but previous tx is %s",
+				i, u.Op.String(), prev.TxHash().String())
+		}
+		if int(u.Op.Index) >= len(prev.TxOut) {
+			return fmt.Errorf("input %d spends %s but previous tx has %d outputs",
+				i, u.Op.String(), len(prev.TxOut))
+		}
+		out := prev.TxOut[u.Op.Index]
+		if out.Value != u.Value {
+			return fmt.Errorf("input %d portxo says %d but previous tx output is %d",
+				i, u.Value, out.Value)
+		}
+		if u.Mode&FlagTxoPubKeyHash != 0 && !bytes.Equal(out.PkScript, u.PkScript) {
+			return fmt.Errorf("input %d portxo script %x but previous tx output is %x",
+				i, u.PkScript, out.PkScript)
+		}
+	}
+	return nil
+}
+
+// Bytes serializes a PartialTx
+func (p *PartialTx) Bytes() ([]byte, error) {
+	if p == nil || p.Tx == nil {
+		return nil, fmt.Errorf("Can't serialize nil PartialTx")
+	}
+	if len(p.Ins) != len(p.Tx.TxIn) {
+		return nil, fmt.Errorf("PartialTx has %d txins but %d portxos",
+			len(p.Tx.TxIn), len(p.Ins))
+	}
+	if len(p.Ins) > 255 {
+		return nil, fmt.Errorf("PartialTx has %d inputs, max 255", len(p.Ins))
+	}
+	if p.PrevTxs != nil && len(p.PrevTxs) != len(p.Ins) {
+		return nil, fmt.Errorf("PartialTx has %d portxos but %d previous txs",
+			len(p.Ins), len(p.PrevTxs))
+	}
+
+	var buf, txBuf bytes.Buffer
+	err := p.Tx.Serialize(&txBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	err = binary.Write(&buf, binary.BigEndian, uint32(txBuf.Len()))
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(txBuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	err = buf.WriteByte(uint8(len(p.Ins)))
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range p.Ins {
+		uBytes, err := u.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(&buf, binary.BigEndian, uint16(len(uBytes)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(uBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		var prevBuf bytes.Buffer
+		if p.PrevTxs != nil && p.PrevTxs[i] != nil {
+			err = p.PrevTxs[i].Serialize(&prevBuf)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = binary.Write(&buf, binary.BigEndian, uint32(prevBuf.Len()))
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(prevBuf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// PartialTxFromBytes turns bytes into a PartialTx, and checks that the
+// portxos line up with the tx inputs.
+func PartialTxFromBytes(b []byte) (*PartialTx, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("%d bytes, too short for PartialTx", len(b))
+	}
+	buf := bytes.NewBuffer(b)
+
+	var txLen uint32
+	err := binary.Read(buf, binary.BigEndian, &txLen)
+	if err != nil {
+		return nil, err
+	}
+	if int(txLen) > buf.Len() {
+		return nil, fmt.Errorf("PartialTx tx length %d but %d bytes left",
+			txLen, buf.Len())
+	}
+
+	p := new(PartialTx)
+	p.Tx = wire.NewMsgTx()
+	err = p.Tx.Deserialize(bytes.NewReader(buf.Next(int(txLen))))
+	if err != nil {
+		return nil, err
+	}
+
+	numIns, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if int(numIns) != len(p.Tx.TxIn) {
+		return nil, fmt.Errorf("PartialTx has %d txins but %d portxos",
+			len(p.Tx.TxIn), numIns)
+	}
+
+	p.Ins = make([]*PorTxo, numIns)
+	p.PrevTxs = make([]*wire.MsgTx, numIns)
+	for i, _ := range p.Ins {
+		var uLen uint16
+		err = binary.Read(buf, binary.BigEndian, &uLen)
+		if err != nil {
+			return nil, err
+		}
+		if int(uLen) > buf.Len() {
+			return nil, fmt.Errorf("PartialTx input %d length %d but %d bytes left",
+				i, uLen, buf.Len())
+		}
+		p.Ins[i], err = PorTxoFromBytes(buf.Next(int(uLen)))
+		if err != nil {
+			return nil, err
+		}
+		if p.Ins[i].Op != p.Tx.TxIn[i].PreviousOutPoint {
+			return nil, fmt.Errorf("PartialTx input %d spends %s but portxo is %s",
+				i, p.Tx.TxIn[i].PreviousOutPoint.String(), p.Ins[i].Op.String())
+		}
+
+		var prevLen uint32
+		err = binary.Read(buf, binary.BigEndian, &prevLen)
+		if err != nil {
+			return nil, err
+		}
+		if int(prevLen) > buf.Len() {
+			return nil, fmt.Errorf("PartialTx input %d previous tx length %d but %d bytes left",
+				i, prevLen, buf.Len())
+		}
+		if prevLen != 0 {
+			p.PrevTxs[i] = wire.NewMsgTx()
+			err = p.PrevTxs[i].Deserialize(bytes.NewReader(buf.Next(int(prevLen))))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
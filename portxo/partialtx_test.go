@@ -0,0 +1,173 @@
+package portxo
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// TestPartialTxRoundTrip serializes and deserializes a partial tx with
+// one signed and one unsigned input
+func TestPartialTxRoundTrip(t *testing.T) {
+	u1 := new(PorTxo)
+	u1.Op.Hash = chainhash.DoubleHashH([]byte("in1"))
+	u1.Op.Index = 1
+	u1.Value = 100000
+	u1.Mode = TxoP2WPKHComp
+	u1.KeyGen.Depth = 5
+	u1.KeyGen.Step[0] = 44 | 1<<31
+	u1.KeyGen.Step[1] = 1 | 1<<31
+	u1.PkScript = []byte("witness pkh script stuff")
+
+	u2 := new(PorTxo)
+	u2.Op.Hash = chainhash.DoubleHashH([]byte("in2"))
+	u2.Value = 200000
+	u2.Mode = TxoP2PKHComp
+	u2.KeyGen = u1.KeyGen
+	u2.KeyGen.Step[4] = 7 | 1<<31
+	u2.PkScript = []byte("pkh script stuff")
+
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(&u2.Op, nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&u1.Op, nil, [][]byte{[]byte("sig"), []byte("pub")}))
+	tx.AddTxOut(wire.NewTxOut(250000, []byte("out script")))
+
+	// give utxos in a different order than the txins
+	p, err := NewPartialTx(tx, []*PorTxo{u1, u2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Ins[0] != u2 || p.Ins[1] != u1 {
+		t.Fatalf("utxos not matched up to txins")
+	}
+	if p.NumSigned() != 1 || p.Complete() {
+		t.Fatalf("expect 1 of 2 signed, got %d", p.NumSigned())
+	}
+	if p.CoinType() != 1 {
+		t.Fatalf("expect coin type 1, got %d", p.CoinType())
+	}
+
+	b, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("partial tx: %x", b)
+
+	p2, err := PartialTxFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.Tx.TxHash() != tx.TxHash() || p2.Tx.WitnessHash() != tx.WitnessHash() {
+		t.Fatalf("tx changed in round trip")
+	}
+	for i := range p.Ins {
+		if !p.Ins[i].Equal(p2.Ins[i]) {
+			t.Fatalf("input %d changed in round trip", i)
+		}
+	}
+
+	b2, err := p2.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Fatalf("re-serialized bytes differ")
+	}
+
+	// truncated bytes should error, not panic
+	_, err = PartialTxFromBytes(b[:len(b)-10])
+	if err == nil {
+		t.Fatalf("expected error on truncated partial tx")
+	}
+}
+
+// TestPartialTxMismatch makes sure portxos which don't line up are rejected
+func TestPartialTxMismatch(t *testing.T) {
+	u1 := new(PorTxo)
+	u1.Op.Hash = chainhash.DoubleHashH([]byte("in1"))
+	u1.Mode = TxoP2WPKHComp
+
+	tx := wire.NewMsgTx()
+	op := wire.NewOutPoint(&u1.Op.Hash, 5)
+	tx.AddTxIn(wire.NewTxIn(op, nil, nil))
+
+	_, err := NewPartialTx(tx, []*PorTxo{u1})
+	if err == nil {
+		t.Fatalf("expected error for utxo not in tx")
+	}
+}
+
+// TestPartialTxPrevTxs checks non-witness inputs need a previous tx which
+// matches their portxo, and that it makes it through serialization.
+func TestPartialTxPrevTxs(t *testing.T) {
+	prev := wire.NewMsgTx()
+	prev.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+	prev.AddTxOut(wire.NewTxOut(5000, []byte("other script")))
+	prev.AddTxOut(wire.NewTxOut(200000, []byte("pkh script stuff")))
+
+	u1 := new(PorTxo)
+	u1.Op.Hash = chainhash.DoubleHashH([]byte("in1"))
+	u1.Value = 100000
+	u1.Mode = TxoP2WPKHComp
+	u1.PkScript = []byte("witness pkh script stuff")
+
+	u2 := new(PorTxo)
+	u2.Op.Hash = prev.TxHash()
+	u2.Op.Index = 1
+	u2.Value = 200000
+	u2.Mode = TxoP2PKHComp
+	u2.PkScript = []byte("pkh script stuff")
+
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&u1.Op, nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&u2.Op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(250000, []byte("out script")))
+
+	p, err := NewPartialTx(tx, []*PorTxo{u1, u2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CheckPrevTxs() == nil {
+		t.Fatalf("p2pkh input without previous tx passed")
+	}
+
+	// witness input doesn't need one
+	p.PrevTxs[1] = prev
+	err = p.CheckPrevTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, err := PartialTxFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.PrevTxs[0] != nil || p2.PrevTxs[1] == nil ||
+		p2.PrevTxs[1].TxHash() != prev.TxHash() {
+		t.Fatalf("previous txs changed in round trip")
+	}
+	err = p2.CheckPrevTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// portxo claiming more than the previous tx output has
+	u2.Value = 300000
+	if p.CheckPrevTxs() == nil {
+		t.Fatalf("portxo with wrong value passed")
+	}
+	u2.Value = 200000
+
+	// previous tx for some other outpoint
+	p.PrevTxs[1] = tx
+	if p.CheckPrevTxs() == nil {
+		t.Fatalf("wrong previous tx passed")
+	}
+}
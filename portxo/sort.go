@@ -57,6 +57,17 @@ func (s TxoSliceByAmt) Sum() int64 {
 	return total
 }
 
+// SumUnconfirmed adds up the txos which aren't in a block yet
+func (s TxoSliceByAmt) SumUnconfirmed() int64 {
+	var total int64
+	for _, txo := range s {
+		if txo.Height == 0 {
+			total += txo.Value
+		}
+	}
+	return total
+}
+
 func (s TxoSliceByAmt) SumWitness(currentHeight int32) int64 {
 	var total int64
 	for _, txo := range s {
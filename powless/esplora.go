@@ -0,0 +1,149 @@
+package powless
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// Esplora is the blockstream.info style API.  It understands segwit
+// addresses, so all addresses get queried directly.
+// https://github.com/Blockstream/esplora/blob/master/API.md
+type Esplora struct {
+	BaseURL string
+	client  *http.Client
+}
+
+type esploraStatus struct {
+	Confirmed   bool  `json:"confirmed"`
+	BlockHeight int32 `json:"block_height"`
+}
+
+type esploraTx struct {
+	Txid   string        `json:"txid"`
+	Status esploraStatus `json:"status"`
+}
+
+type esploraOutSpend struct {
+	Spent  bool          `json:"spent"`
+	Txid   string        `json:"txid"`
+	Status esploraStatus `json:"status"`
+}
+
+func (s esploraStatus) height() int32 {
+	if !s.Confirmed {
+		return 0
+	}
+	return s.BlockHeight
+}
+
+func (e *Esplora) TipHeight() (int32, error) {
+	body, err := httpGet(e.client, e.BaseURL+"/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	height, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 32)
+	return int32(height), err
+}
+
+func (e *Esplora) BlockHash(height int32) (*chainhash.Hash, error) {
+	body, err := httpGet(e.client, fmt.Sprintf("%s/block-height/%d", e.BaseURL, height))
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(strings.TrimSpace(string(body)))
+}
+
+func (e *Esplora) RawBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	body, err := httpGet(e.client, e.BaseURL+"/block/"+hash.String()+"/raw")
+	if err != nil {
+		return nil, err
+	}
+	block := new(wire.MsgBlock)
+	err = block.Deserialize(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// AdrTxs asks about each address separately.  Esplora gives the mempool txs
+// and newest confirmed txs first, then pages through older ones by last txid.
+func (e *Esplora) AdrTxs(legacy, witty []string) ([]TxRef, error) {
+	var refs []TxRef
+	for _, adr := range append(legacy, witty...) {
+		url := e.BaseURL + "/address/" + adr + "/txs"
+		for {
+			var txs []esploraTx
+			err := httpGetJSON(e.client, url, &txs)
+			if err != nil {
+				return nil, err
+			}
+			var lastConfirmed string
+			var numConfirmed int
+			for _, etx := range txs {
+				txid, err := chainhash.NewHashFromStr(etx.Txid)
+				if err != nil {
+					return nil, err
+				}
+				refs = append(refs, TxRef{Txid: *txid, Height: etx.Status.height()})
+				if etx.Status.Confirmed {
+					lastConfirmed = etx.Txid
+					numConfirmed++
+				}
+			}
+			// pages of confirmed txs are 25 long; a short page is the end
+			if numConfirmed < 25 {
+				break
+			}
+			url = e.BaseURL + "/address/" + adr + "/txs/chain/" + lastConfirmed
+		}
+	}
+	return refs, nil
+}
+
+func (e *Esplora) OutSpend(op wire.OutPoint) (*TxRef, error) {
+	var spend esploraOutSpend
+	err := httpGetJSON(e.client,
+		fmt.Sprintf("%s/tx/%s/outspend/%d", e.BaseURL, op.Hash.String(), op.Index),
+		&spend)
+	if err != nil {
+		return nil, err
+	}
+	if !spend.Spent {
+		return nil, nil
+	}
+	txid, err := chainhash.NewHashFromStr(spend.Txid)
+	if err != nil {
+		return nil, err
+	}
+	return &TxRef{Txid: *txid, Height: spend.Status.height()}, nil
+}
+
+func (e *Esplora) TxHeight(txid *chainhash.Hash) (int32, error) {
+	var status esploraStatus
+	err := httpGetJSON(e.client, e.BaseURL+"/tx/"+txid.String()+"/status", &status)
+	return status.height(), err
+}
+
+func (e *Esplora) RawTx(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	body, err := httpGet(e.client, e.BaseURL+"/tx/"+txid.String()+"/hex")
+	if err != nil {
+		return nil, err
+	}
+	return txFromHex(string(body))
+}
+
+func (e *Esplora) PushTx(tx *wire.MsgTx) error {
+	txHex, err := txToHex(tx)
+	if err != nil {
+		return err
+	}
+	_, err = httpPost(e.client, e.BaseURL+"/tx", "text/plain", []byte(txHex))
+	return err
+}
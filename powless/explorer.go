@@ -0,0 +1,190 @@
+package powless
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// Explorer is what APILink needs from a block explorer web API.  There's
+// one of these for each flavour of API.
+type Explorer interface {
+	// TipHeight returns the height of the explorer's best block
+	TipHeight() (int32, error)
+
+	// BlockHash returns the hash of the block at a height
+	BlockHash(height int32) (*chainhash.Hash, error)
+
+	// RawBlock returns a full block
+	RawBlock(hash *chainhash.Hash) (*wire.MsgBlock, error)
+
+	// AdrTxs returns all the txs (confirmed and not) involving the addresses.
+	// legacy are base58 addresses, witty are bech32.
+	AdrTxs(legacy, witty []string) ([]TxRef, error)
+
+	// OutSpend returns the tx spending an outpoint, or nil if it's unspent
+	OutSpend(op wire.OutPoint) (*TxRef, error)
+
+	// TxHeight returns the height a tx is confirmed at, 0 if unconfirmed
+	TxHeight(txid *chainhash.Hash) (int32, error)
+
+	// RawTx gets a tx by txid
+	RawTx(txid *chainhash.Hash) (*wire.MsgTx, error)
+
+	// PushTx broadcasts a tx
+	PushTx(tx *wire.MsgTx) error
+}
+
+// TxRef is a txid and the height it's confirmed at; 0 for unconfirmed.
+type TxRef struct {
+	Txid   chainhash.Hash
+	Height int32
+}
+
+// API flavours
+const (
+	FlavourInsight = "insight"
+	FlavourEsplora = "esplora"
+)
+
+// default explorers for each network, if not given a url
+var defaultURLs = map[string]map[string]string{
+	FlavourInsight: {
+		"testnet3": "https://testnet.blockexplorer.com/api",
+	},
+	FlavourEsplora: {
+		"testnet3": "https://blockstream.info/testnet/api",
+	},
+}
+
+// ExplorerURL makes a host string which selects an APILink with a given
+// API flavour.  If host isn't an http url, the default for the network
+// is used.  Looks like "esplora+https://blockstream.info/testnet/api"
+func ExplorerURL(flavour, host string, p *chaincfg.Params) (string, error) {
+	if flavour != FlavourInsight && flavour != FlavourEsplora {
+		return "", fmt.Errorf("unknown explorer API %s; use %s or %s",
+			flavour, FlavourInsight, FlavourEsplora)
+	}
+	if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		var ok bool
+		host, ok = defaultURLs[flavour][p.Name]
+		if !ok {
+			return "", fmt.Errorf("no default %s explorer for %s; give a url",
+				flavour, p.Name)
+		}
+	}
+	return flavour + "+" + strings.TrimRight(host, "/"), nil
+}
+
+// IsExplorerURL is true for hosts which should use an APILink.
+func IsExplorerURL(host string) bool {
+	_, _, err := parseExplorerURL(host)
+	return err == nil
+}
+
+// parseExplorerURL splits a host from ExplorerURL into flavour and base url
+func parseExplorerURL(host string) (string, string, error) {
+	parts := strings.SplitN(host, "+", 2)
+	if len(parts) != 2 ||
+		(parts[0] != FlavourInsight && parts[0] != FlavourEsplora) ||
+		!(strings.HasPrefix(parts[1], "http://") ||
+			strings.HasPrefix(parts[1], "https://")) {
+		return "", "", fmt.Errorf("%s is not an explorer url", host)
+	}
+	return parts[0], parts[1], nil
+}
+
+// NewExplorer returns the Explorer for a flavour and base url.  Requests go
+// out through d, or directly if it's nil.
+func NewExplorer(flavour, baseURL string, d lnutil.Dialer) (Explorer, error) {
+	c := lnutil.HTTPClient(d, time.Second*30)
+	switch flavour {
+	case FlavourInsight:
+		return &Insight{BaseURL: baseURL, client: c}, nil
+	case FlavourEsplora:
+		return &Esplora{BaseURL: baseURL, client: c}, nil
+	}
+	return nil, fmt.Errorf("unknown explorer API %s", flavour)
+}
+
+// httpGet gets a url and returns the body.  Non-200 responses are errors.
+func httpGet(c *http.Client, url string) ([]byte, error) {
+	response, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s %s",
+			url, response.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// httpGetJSON gets a url and decodes the json body into v
+func httpGetJSON(c *http.Client, url string, v interface{}) error {
+	body, err := httpGet(c, url)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// httpPost posts to a url and returns the body.  Non-200 responses are errors.
+func httpPost(c *http.Client, url, contentType string, data []byte) ([]byte, error) {
+	response, err := c.Post(url, contentType, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s %s",
+			url, response.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// txFromHex deserializes a hex tx
+func txFromHex(s string) (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx()
+	err = tx.Deserialize(bytes.NewReader(txBytes))
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// txToHex serializes a tx (with witnesses) to hex
+func txToHex(tx *wire.MsgTx) (string, error) {
+	if tx == nil {
+		return "", fmt.Errorf("tx is nil")
+	}
+	var buf bytes.Buffer
+	err := tx.Serialize(&buf)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf.Bytes()), nil
+}
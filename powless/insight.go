@@ -0,0 +1,185 @@
+package powless
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// Insight is the bitpay insight API.  At least that's open source, can run
+// yourself, seems to have some dev activity behind it.
+// Insight doesn't know about segwit addresses, so only base58 addresses get
+// queried.  Witness outputs are found when they're spent, or when
+// the wallit registers their outpoints.
+// https://github.com/bitpay/insight-api
+type Insight struct {
+	BaseURL string
+	client  *http.Client
+}
+
+// ARGHGH all fields have to be exported (caps) or the json unmarshaller won't
+// populate them !
+type insightStatus struct {
+	Info struct {
+		Blocks int32
+	}
+}
+
+type insightBlockIndex struct {
+	BlockHash string
+}
+
+type insightRawBlock struct {
+	RawBlock string
+}
+
+type insightAdrTxs struct {
+	TotalItems int
+	From, To   int
+	Items      []TxResponse
+}
+
+// do you even need a struct here..?
+type RawTxResponse struct {
+	RawTx string `json:"rawtx"`
+}
+
+type TxResponse struct {
+	Txid        string
+	Blockheight int32
+	Vout        []VoutJson
+}
+
+// Get txid of spending tx
+type VoutJson struct {
+	N           uint32
+	SpentTxId   string
+	SpentHeight int32
+}
+
+// insight gives -1 for unconfirmed heights
+func insightHeight(h int32) int32 {
+	if h < 0 {
+		return 0
+	}
+	return h
+}
+
+func (n *Insight) TipHeight() (int32, error) {
+	var st insightStatus
+	err := httpGetJSON(n.client, n.BaseURL+"/status?q=getInfo", &st)
+	return st.Info.Blocks, err
+}
+
+func (n *Insight) BlockHash(height int32) (*chainhash.Hash, error) {
+	var bi insightBlockIndex
+	err := httpGetJSON(n.client, fmt.Sprintf("%s/block-index/%d", n.BaseURL, height), &bi)
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(bi.BlockHash)
+}
+
+func (n *Insight) RawBlock(hash *chainhash.Hash) (*wire.MsgBlock, error) {
+	var rb insightRawBlock
+	err := httpGetJSON(n.client, n.BaseURL+"/rawblock/"+hash.String(), &rb)
+	if err != nil {
+		return nil, err
+	}
+	blockBytes, err := hex.DecodeString(rb.RawBlock)
+	if err != nil {
+		return nil, err
+	}
+	block := new(wire.MsgBlock)
+	err = block.Deserialize(bytes.NewReader(blockBytes))
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// AdrTxs asks about all the base58 addresses at once, 50 txs at a time.
+func (n *Insight) AdrTxs(legacy, witty []string) ([]TxRef, error) {
+	if len(legacy) == 0 {
+		return nil, nil
+	}
+	adrList := strings.Join(legacy, ",")
+
+	var refs []TxRef
+	for from := 0; ; {
+		var page insightAdrTxs
+		err := httpGetJSON(n.client, fmt.Sprintf("%s/addrs/%s/txs?from=%d&to=%d",
+			n.BaseURL, adrList, from, from+50), &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			txid, err := chainhash.NewHashFromStr(item.Txid)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, TxRef{Txid: *txid, Height: insightHeight(item.Blockheight)})
+		}
+		if len(page.Items) == 0 || page.To >= page.TotalItems {
+			break
+		}
+		from = page.To
+	}
+	return refs, nil
+}
+
+func (n *Insight) OutSpend(op wire.OutPoint) (*TxRef, error) {
+	var txr TxResponse
+	err := httpGetJSON(n.client, n.BaseURL+"/tx/"+op.Hash.String(), &txr)
+	if err != nil {
+		return nil, err
+	}
+	for _, txout := range txr.Vout {
+		if txout.N != op.Index {
+			continue
+		}
+		if txout.SpentTxId == "" {
+			return nil, nil // not yet spent
+		}
+		txid, err := chainhash.NewHashFromStr(txout.SpentTxId)
+		if err != nil {
+			return nil, err
+		}
+		return &TxRef{Txid: *txid, Height: insightHeight(txout.SpentHeight)}, nil
+	}
+	return nil, fmt.Errorf("%s has no output %d", op.Hash.String(), op.Index)
+}
+
+func (n *Insight) TxHeight(txid *chainhash.Hash) (int32, error) {
+	var txr TxResponse
+	err := httpGetJSON(n.client, n.BaseURL+"/tx/"+txid.String(), &txr)
+	return insightHeight(txr.Blockheight), err
+}
+
+func (n *Insight) RawTx(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	var rtx RawTxResponse
+	err := httpGetJSON(n.client, n.BaseURL+"/rawtx/"+txid.String(), &rtx)
+	if err != nil {
+		return nil, err
+	}
+	return txFromHex(rtx.RawTx)
+}
+
+func (n *Insight) PushTx(tx *wire.MsgTx) error {
+	txHex, err := txToHex(tx)
+	if err != nil {
+		return err
+	}
+	reqBytes, err := json.Marshal(RawTxResponse{RawTx: txHex})
+	if err != nil {
+		return err
+	}
+	_, err = httpPost(n.client, n.BaseURL+"/tx/send", "application/json", reqBytes)
+	return err
+}
@@ -1,19 +1,15 @@
 package powless
 
 import (
-	"bytes"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
-	"os"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/adiabat/bech32"
 	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil"
 	"github.com/mit-dci/lit/lnutil"
@@ -51,8 +47,9 @@ spending outpoint [txid]:[index].
 Those two calls get you basically everything you need for a wallet, in a pretty
 efficient way.
 
-(but yeah re-orgs and stuff, right?  None of this deals with that yet.  That's
-going to be a pain.)
+Re-orgs are noticed by remembering the hash of the block at each height we
+sync to, and checking it's still there next time.  If it's not, the height
+goes back to where the chains agree and everything above gets sent again.
 
 */
 
@@ -65,23 +62,41 @@ ChainHook interface
 		chan lnutil.TxAndHeight, chan int32, error)
 
 	RegisterAddress(address [20]byte) error
+	RegisterScriptHash(scriptHash [32]byte) error
 	RegisterOutPoint(wire.OutPoint) error
+	Rescan(fromHeight int32) error
 
 	PushTx(tx *wire.MsgTx) error
 
 	RawBlocks() chan *wire.MsgBlock
+	BlockDisconnects() chan lnutil.BlockDisconnect
 
 */
 
+// DefaultPollInterval is how often to ask the explorer about everything, if
+// PollInterval isn't set.  Each poll is a request per address (esplora) and
+// per outpoint, so don't go too fast on someone else's server.
+const DefaultPollInterval = time.Second * 30
+
+// maxReorgDepth is how far back to go if we can't find where a reorg forked
+const maxReorgDepth = 100
+
 // APILink is a link to a web API that can tell you about blockchain data.
 type APILink struct {
-	apiCon net.Conn
+	api Explorer
+
+	// Dialer connects to the explorer, maybe through a proxy.  nil dials
+	// directly.
+	Dialer lnutil.Dialer
 
 	// TrackingAdrs and OPs are slices of addresses and outpoints to watch for.
 	// Using struct{} saves a byte of RAM but is ugly so I'll use bool.
 	TrackingAdrs    map[[20]byte]bool
 	TrackingAdrsMtx sync.Mutex
 
+	// TrackingScripts are p2wsh script hashes.  Also uses TrackingAdrsMtx.
+	TrackingScripts map[[32]byte]bool
+
 	TrackingOPs    map[wire.OutPoint]bool
 	TrackingOPsMtx sync.Mutex
 
@@ -89,171 +104,349 @@ type APILink struct {
 
 	CurrentHeightChan chan int32
 
+	DisconnectChan chan lnutil.BlockDisconnect
+
+	// RawBlockSender sends full blocks up to the watchtower.  Made when
+	// RawBlocks() is called; until then, no blocks get downloaded.
+	RawBlockSender chan *wire.MsgBlock
+	blockMtx       sync.Mutex
+
+	// PollInterval is how often to ask the explorer for new stuff.  Can be
+	// set before calling Start().
+	PollInterval time.Duration
+
 	// we've "synced" up to this height; older txs won't get pushed up to wallit
-	height int32
+	height    int32
+	heightMtx sync.Mutex
+
+	// hashes of blocks at heights we've synced to, for noticing reorgs
+	hashes map[int32]chainhash.Hash
+
+	// heights of confirmed txs with outpoints we're watching, so we don't
+	// have to keep asking
+	knownHeights map[chainhash.Hash]int32
 
-	// time based polling
-	dirtybool bool
+	// unconfirmed txs already sent up to the wallit
+	sentUnconf map[chainhash.Hash]bool
+
+	// wake up the poll loop early (after a rescan)
+	wake chan bool
 
 	p *chaincfg.Params
 }
 
-// Start starts the APIlink
+// Start starts the APIlink.  host is from ExplorerURL, and says which API
+// flavour to use and where it is.
 func (a *APILink) Start(
 	startHeight int32, host, path string, params *chaincfg.Params) (
 	chan lnutil.TxAndHeight, chan int32, error) {
 
-	// later, use params to detect which api to connect to
 	a.p = params
 
+	flavour, baseURL, err := parseExplorerURL(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.api, err = NewExplorer(flavour, baseURL, a.Dialer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.PollInterval == 0 {
+		a.PollInterval = DefaultPollInterval
+	}
+
 	a.TrackingAdrs = make(map[[20]byte]bool)
+	a.TrackingScripts = make(map[[32]byte]bool)
 	a.TrackingOPs = make(map[wire.OutPoint]bool)
 
+	a.hashes = make(map[int32]chainhash.Hash)
+	a.knownHeights = make(map[chainhash.Hash]int32)
+	a.sentUnconf = make(map[chainhash.Hash]bool)
+
 	a.TxUpToWallit = make(chan lnutil.TxAndHeight, 1)
 	a.CurrentHeightChan = make(chan int32, 1)
+	a.DisconnectChan = make(chan lnutil.BlockDisconnect)
+	a.wake = make(chan bool, 1)
 
 	a.height = startHeight
 
-	go a.ClockLoop()
+	// make sure the explorer is on the same network we are
+	genesis, err := a.api.BlockHash(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !genesis.IsEqual(params.GenesisHash) {
+		return nil, nil, fmt.Errorf("explorer %s has genesis %s, not %s (%s)",
+			baseURL, genesis.String(), params.GenesisHash.String(), params.Name)
+	}
+	log.Printf("using %s explorer %s\n", flavour, baseURL)
+
+	go a.PollLoop()
 
 	return a.TxUpToWallit, a.CurrentHeightChan, nil
 }
 
-func (a *APILink) ClockLoop() {
-
+// PollLoop asks the explorer for updates every PollInterval, or right away
+// when woken up.  The first poll is after PollInterval, by which time the
+// wallit has registered its addresses and outpoints.
+func (a *APILink) PollLoop() {
 	for {
-		if a.dirtybool {
-			err := a.GetAdrTxos()
-			if err != nil {
-				log.Printf(err.Error())
-			}
-			err = a.GetOPTxs()
-			if err != nil {
-				log.Printf(err.Error())
-			}
-			time.Sleep(time.Second * 1)
-			a.dirtybool = false
+		select {
+		case <-a.wake:
+		case <-time.After(a.PollInterval):
 		}
-		fmt.Printf("clean, sleep 5 sec\n")
-		time.Sleep(time.Second * 5)
-
-		// some kind of long range refresh for blocks...?
 
+		err := a.Sync()
+		if err != nil {
+			log.Printf("powless Sync error: %s\n", err.Error())
+		}
 	}
-
-	return
 }
 
 // RegisterAddress gets a 20 byte address from the wallit and starts
 // watching for utxos at that address.
 func (a *APILink) RegisterAddress(adr160 [20]byte) error {
-	fmt.Printf("register %x\n", adr160)
 	a.TrackingAdrsMtx.Lock()
 	a.TrackingAdrs[adr160] = true
 	a.TrackingAdrsMtx.Unlock()
+	return nil
+}
 
-	a.dirtybool = true
-
-	fmt.Printf("dirty %v\n", a.dirtybool)
+// RegisterScriptHash gets a 32 byte p2wsh script hash from the wallit.
+// Queried the same way as addresses, by bech32 address string.
+func (a *APILink) RegisterScriptHash(sh [32]byte) error {
+	a.TrackingAdrsMtx.Lock()
+	a.TrackingScripts[sh] = true
+	a.TrackingAdrsMtx.Unlock()
 	return nil
 }
 
 // RegisterOutPoint gets an outpoint from the wallit and starts looking
 // for txins that spend it.
 func (a *APILink) RegisterOutPoint(op wire.OutPoint) error {
-	fmt.Printf("register %s\n", op.String())
 	a.TrackingOPsMtx.Lock()
 	a.TrackingOPs[op] = true
 	a.TrackingOPsMtx.Unlock()
-
-	a.dirtybool = true
 	return nil
 }
 
-// ARGHGH all fields have to be exported (caps) or the json unmarshaller won't
-// populate them !
-type AdrUtxoResponse struct {
-	Txid     string
-	Height   int32
-	Satoshis int64
-}
+// Rescan sets the height back, so that everything above fromHeight gets
+// pushed up to the wallit again on the next poll, which happens right away.
+func (a *APILink) Rescan(fromHeight int32) error {
+	if fromHeight < 1 {
+		return fmt.Errorf("Can't rescan from height %d", fromHeight)
+	}
+	a.heightMtx.Lock()
+	a.height = fromHeight - 1
+	a.heightMtx.Unlock()
 
-// do you even need a struct here..?
-type RawTxResponse struct {
-	RawTx string
+	select {
+	case a.wake <- true:
+	default: // already awake
+	}
+	return nil
 }
 
-// GetAdrTxos
-// ...use insight api.  at least that's open source, can run yourself, seems to have
-// some dev activity behind it.
-func (a *APILink) GetAdrTxos() error {
-
-	apitxourl := "https://testnet.blockexplorer.com/api"
-	// make a comma-separated list of base58 addresses
-	var adrlist string
+// Sync checks for a reorg, then asks the explorer about all the addresses
+// and outpoints, and sends new txs up to the wallit.
+func (a *APILink) Sync() error {
+	tip, err := a.api.TipHeight()
+	if err != nil {
+		return err
+	}
+	err = a.CheckReorg()
+	if err != nil {
+		return err
+	}
 
-	a.TrackingAdrsMtx.Lock()
-	for adr160, _ := range a.TrackingAdrs {
-		adr58, err := btcutil.NewAddressPubKeyHash(adr160[:], a.p)
-		if err != nil {
-			return err
+	a.heightMtx.Lock()
+	synced := a.height
+	a.heightMtx.Unlock()
+
+	// full blocks for the watchtower, if anyone asked for them
+	a.blockMtx.Lock()
+	blockChan := a.RawBlockSender
+	a.blockMtx.Unlock()
+	if blockChan != nil {
+		for h := synced + 1; h <= tip; h++ {
+			hash, err := a.api.BlockHash(h)
+			if err != nil {
+				return err
+			}
+			block, err := a.api.RawBlock(hash)
+			if err != nil {
+				return err
+			}
+			blockChan <- block
 		}
-		adrlist += adr58.String()
-		adrlist += ","
 	}
-	a.TrackingAdrsMtx.Unlock()
 
-	// chop off last comma, and add /utxo
-	adrlist = adrlist[:len(adrlist)-1] + "/utxo"
+	// txs involving our addresses
+	legacy, witty, err := a.adrStrings()
+	if err != nil {
+		return err
+	}
+	refs, err := a.api.AdrTxs(legacy, witty)
+	if err != nil {
+		return err
+	}
 
-	response, err := http.Get(apitxourl + "/addrs/" + adrlist)
+	// txs which spend or confirm outpoints we're watching
+	opRefs, err := a.opTxs()
 	if err != nil {
 		return err
 	}
+	refs = append(refs, opRefs...)
+
+	// send up anything new, lowest height first and unconfirmed last
+	sort.Sort(txRefsByHeight(refs))
+	sent := make(map[chainhash.Hash]bool)
+	for _, ref := range refs {
+		if sent[ref.Txid] {
+			continue
+		}
+		if ref.Height == 0 && a.sentUnconf[ref.Txid] {
+			continue // already told the wallit about this one
+		}
+		if ref.Height != 0 && ref.Height <= synced {
+			continue // already synced past this
+		}
 
-	ars := new([]AdrUtxoResponse)
+		tx, err := a.api.RawTx(&ref.Txid)
+		if err != nil {
+			return err
+		}
+		a.TxUpToWallit <- lnutil.TxAndHeight{Tx: tx, Height: ref.Height}
+		sent[ref.Txid] = true
+
+		if ref.Height == 0 {
+			a.sentUnconf[ref.Txid] = true
+		} else {
+			delete(a.sentUnconf, ref.Txid)
+		}
+	}
 
-	err = json.NewDecoder(response.Body).Decode(ars)
+	if tip <= synced {
+		return nil
+	}
+	tipHash, err := a.api.BlockHash(tip)
 	if err != nil {
 		return err
 	}
+	a.heightMtx.Lock()
+	// if there was a rescan while we were asking, don't move up
+	moved := a.height == synced
+	if moved {
+		a.height = tip
+		a.hashes[tip] = *tipHash
+		delete(a.hashes, tip-maxReorgDepth)
+	}
+	a.heightMtx.Unlock()
 
-	if len(*ars) == 0 {
-		return fmt.Errorf("no ars \n")
+	if moved {
+		a.CurrentHeightChan <- tip
 	}
+	return nil
+}
 
-	// go through txids, request hex tx, build txahdheight and send that up
-	for _, adrUtxo := range *ars {
+// CheckReorg makes sure the block we synced to is still in the explorer's
+// chain.  If it isn't, go back to the last height where it agrees with
+// what we've seen, and tell the wallit the blocks above that are gone.
+// We only keep hashes for some heights, so some disconnects have no hash.
+func (a *APILink) CheckReorg() error {
+	a.heightMtx.Lock()
+	synced := a.height
+	known, ok := a.hashes[synced]
+	a.heightMtx.Unlock()
+	if !ok {
+		return nil // haven't seen this height; nothing to check
+	}
+
+	remote, err := a.api.BlockHash(synced)
+	if err != nil {
+		return err
+	}
+	if remote.IsEqual(&known) {
+		return nil
+	}
 
-		// only request if higher than current 'sync' height
-		if adrUtxo.Height < a.height {
-			// skip this address; it's lower than we've already seen
+	// find where the chains fork
+	fork := synced - maxReorgDepth
+	for h := synced - 1; h > synced-maxReorgDepth && h >= 0; h-- {
+		a.heightMtx.Lock()
+		known, ok = a.hashes[h]
+		a.heightMtx.Unlock()
+		if !ok {
 			continue
 		}
-
-		tx, err := GetRawTx(adrUtxo.Txid)
+		remote, err = a.api.BlockHash(h)
 		if err != nil {
 			return err
 		}
+		if remote.IsEqual(&known) {
+			fork = h
+			break
+		}
+	}
+	if fork < 0 {
+		fork = 0
+	}
+	log.Printf("reorg: block at %d changed, going back to %d\n", synced, fork)
+
+	a.heightMtx.Lock()
+	a.height = fork
+	var gone []lnutil.BlockDisconnect
+	for h := synced; h > fork; h-- {
+		gone = append(gone, lnutil.BlockDisconnect{Height: h, Hash: a.hashes[h]})
+		delete(a.hashes, h)
+	}
+	a.heightMtx.Unlock()
 
-		var txah lnutil.TxAndHeight
-		txah.Height = int32(adrUtxo.Height)
-		txah.Tx = tx
-
-		fmt.Printf("tx %s at height %d\n", txah.Tx.TxHash().String(), txah.Height)
-		a.TxUpToWallit <- txah
+	// tx heights may have changed; ask again
+	a.knownHeights = make(map[chainhash.Hash]int32)
+	a.sentUnconf = make(map[chainhash.Hash]bool)
 
-		// don't know what order we get these in, so update APILink height at the end
-		// I think it's OK to do this?  Seems OK but haven't seen this use of defer()
-		defer a.UpdateHeight(adrUtxo.Height)
+	for _, d := range gone {
+		a.DisconnectChan <- d
 	}
-
+	a.CurrentHeightChan <- fork
 	return nil
 }
 
-func (a *APILink) GetOPTxs() error {
-	apitxourl := "https://testnet.blockexplorer.com/api/"
+// adrStrings returns all the tracked addresses as base58 and bech32 strings
+func (a *APILink) adrStrings() ([]string, []string, error) {
+	var legacy, witty []string
+
+	a.TrackingAdrsMtx.Lock()
+	defer a.TrackingAdrsMtx.Unlock()
+	for adr160, _ := range a.TrackingAdrs {
+		adr58, err := btcutil.NewAddressPubKeyHash(adr160[:], a.p)
+		if err != nil {
+			return nil, nil, err
+		}
+		legacy = append(legacy, adr58.String())
+		adrBech, err := bech32.SegWitV0Encode(a.p.Bech32Prefix, adr160[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		witty = append(witty, adrBech)
+	}
+	// script hashes go in as bech32 p2wsh addresses
+	for sh, _ := range a.TrackingScripts {
+		adrBech, err := bech32.SegWitV0Encode(a.p.Bech32Prefix, sh[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		witty = append(witty, adrBech)
+	}
+	return legacy, witty, nil
+}
 
+// opTxs returns the txs which spend the outpoints we're watching, as well as
+// the txs the outpoints are in, so they get confirmed even if the explorer
+// can't find them by address.
+func (a *APILink) opTxs() ([]TxRef, error) {
 	var oplist []wire.OutPoint
 
 	// copy registered ops here to minimize time mutex is locked
@@ -263,192 +456,72 @@ func (a *APILink) GetOPTxs() error {
 	}
 	a.TrackingOPsMtx.Unlock()
 
-	// need to query each txid with a different http request
+	var refs []TxRef
 	for _, op := range oplist {
-		fmt.Printf("asking for %s\n", op.String())
-		// get full tx info for the outpoint's tx
-		// (if we have 2 outpoints with the same txid we query twice...)
-		response, err := http.Get(apitxourl + "tx/" + op.Hash.String())
-		if err != nil {
-			return err
-		}
-
-		var txr TxResponse
-		// parse the response to get the spending txid
-		err = json.NewDecoder(response.Body).Decode(&txr)
+		spend, err := a.api.OutSpend(op)
 		if err != nil {
-			fmt.Printf("json decode error; op %s not found\n", op.String())
-			continue
+			return nil, err
 		}
-
-		// what is the "v" for here?
-		for _, txout := range txr.Vout {
-			if op.Index == txout.N { // hit; request this outpoint's spend tx
-				// see if it's been spent
-				if txout.SpentTxId == "" {
-					fmt.Printf("%s has nil spenttxid\n", op.String())
-					// this outpoint is not yet spent, can't request
-					continue
-				}
-
-				tx, err := GetRawTx(txout.SpentTxId)
-				if err != nil {
-					return err
-				}
-
-				var txah lnutil.TxAndHeight
-				txah.Tx = tx
-				txah.Height = txout.SpentHeight
-				a.TxUpToWallit <- txah
-
-				a.UpdateHeight(txout.SpentHeight)
-			}
+		if spend != nil {
+			refs = append(refs, *spend)
 		}
 
-		// TODO -- REMOVE once there is any API support for segwit addresses.
-		// This queries the outpoints we already have and re-downloads them to
-		// update their height. (IF the height is non-zero)  It's a huge hack
-		// and not scalable.  But allows segwit outputs to be confirmed now.
-		//if txr.
-
-		if txr.Blockheight > 1 {
-			// this outpoint is confirmed; redownload it and send to wallit
-			tx, err := GetRawTx(txr.Txid)
+		height, ok := a.knownHeights[op.Hash]
+		if !ok {
+			height, err = a.api.TxHeight(&op.Hash)
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if height != 0 {
+				a.knownHeights[op.Hash] = height
 			}
-
-			var txah lnutil.TxAndHeight
-			txah.Tx = tx
-			txah.Height = txr.Blockheight
-			a.TxUpToWallit <- txah
-
-			a.UpdateHeight(txr.Blockheight)
 		}
-
-		// TODO -- end REMOVE section
-
+		refs = append(refs, TxRef{Txid: op.Hash, Height: height})
 	}
-
-	return nil
-}
-
-type TxResponse struct {
-	Txid        string
-	Blockheight int32
-	Vout        []VoutJson
-}
-
-// Get txid of spending tx
-type VoutJson struct {
-	N           uint32
-	SpentTxId   string
-	SpentHeight int32
+	return refs, nil
 }
 
-func (a *APILink) UpdateHeight(height int32) {
-	// if it's an increment (note reorgs are still... not a thing yet)
-	if height > a.height {
-		// update internal height
-		a.height = height
-		// send that back up to the wallit
-		a.CurrentHeightChan <- height
-	}
-}
-
-// GetRawTx is a helper function to get a tx from the insight api
-func GetRawTx(txid string) (*wire.MsgTx, error) {
-	rawTxURL := "https://testnet.blockexplorer.com/api/rawtx/"
-	response, err := http.Get(rawTxURL + txid)
-	if err != nil {
-		return nil, err
-	}
-
-	var rtx RawTxResponse
-
-	err = json.NewDecoder(response.Body).Decode(&rtx)
-	if err != nil {
-		return nil, err
-	}
+// txRefsByHeight sorts by height, with unconfirmed (0) at the end
+type txRefsByHeight []TxRef
 
-	txBytes, err := hex.DecodeString(rtx.RawTx)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(txBytes)
-	tx := wire.NewMsgTx()
-	err = tx.Deserialize(buf)
-	if err != nil {
-		return nil, err
+func (s txRefsByHeight) Len() int      { return len(s) }
+func (s txRefsByHeight) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s txRefsByHeight) Less(i, j int) bool {
+	if s[i].Height == 0 || s[j].Height == 0 {
+		return s[j].Height == 0 && s[i].Height != 0
 	}
-
-	return tx, nil
-}
-
-/* smartbit structs
-type AdrResponse struct {
-	Success bool
-	//	Paging  interface{}
-	Unspent []JsUtxo
-}
-
-type TxResponse struct {
-	Success     bool
-	Transaction []TxJson
-}
-
-type TxJson struct {
-	Block int32
-	Txid  string
-}
-
-type TxHexResponse struct {
-	Success bool
-	Hex     []TxHexString
-}
-
-type TxHexString struct {
-	Txid string
-	Hex  string
-}
-
-type JsUtxo struct {
-	Value_int int64
-	Txid      string
-	N         uint32
-	Addresses []string // why more than 1 ..? always 1.
+	return s[i].Height < s[j].Height
 }
 
-*/
-
-// PushTx pushes a tx to the network via the smartbit site / api
-// smartbit supports segwit so
+// PushTx pushes a tx to the network via the explorer
 func (a *APILink) PushTx(tx *wire.MsgTx) error {
 	if tx == nil {
 		return fmt.Errorf("tx is nil")
 	}
-	var b bytes.Buffer
+	return a.api.PushTx(tx)
+}
 
-	err := tx.Serialize(&b)
+// IsUnspent asks the explorer if an outpoint has been spent
+func (a *APILink) IsUnspent(op wire.OutPoint) (bool, error) {
+	spend, err := a.api.OutSpend(op)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return spend == nil, nil
+}
 
-	// turn into hex
-	txHexString := fmt.Sprintf("{\"hex\": \"%x\"}", b.Bytes())
-
-	fmt.Printf("tx hex string is %s\n", txHexString)
-
-	apiurl := "https://testnet-api.smartbit.com.au/v1/blockchain/pushtx"
-	response, err := http.Post(
-		apiurl, "application/json", bytes.NewBuffer([]byte(txHexString)))
-	fmt.Printf("respo	nse: %s", response.Status)
-	_, err = io.Copy(os.Stdout, response.Body)
-
-	return err
+// BlockDisconnects returns the channel reorged out blocks come up through.
+func (a *APILink) BlockDisconnects() chan lnutil.BlockDisconnect {
+	return a.DisconnectChan
 }
 
+// RawBlocks turns on full block downloads, and returns the channel they
+// come up through.
 func (a *APILink) RawBlocks() chan *wire.MsgBlock {
-	// dummy channel for now
-	return make(chan *wire.MsgBlock, 1)
+	a.blockMtx.Lock()
+	defer a.blockMtx.Unlock()
+	if a.RawBlockSender == nil {
+		a.RawBlockSender = make(chan *wire.MsgBlock, 1)
+	}
+	return a.RawBlockSender
 }
@@ -0,0 +1,487 @@
+package powless
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiabat/bech32"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/lnutil/chaintest"
+)
+
+// standIn is a stand-in block explorer.  It serves either the esplora or
+// insight API from the same chain.
+type standIn struct {
+	mtx     sync.Mutex
+	p       *chaincfg.Params
+	blocks  []*wire.MsgBlock
+	mempool []*wire.MsgTx
+	pushed  []*wire.MsgTx
+}
+
+// every tx, with its height; 0 for mempool
+func (s *standIn) allTxs() ([]*wire.MsgTx, []int32) {
+	var txs []*wire.MsgTx
+	var heights []int32
+	for h, b := range s.blocks {
+		for _, tx := range b.Transactions {
+			txs = append(txs, tx)
+			heights = append(heights, int32(h))
+		}
+	}
+	for _, tx := range s.mempool {
+		txs = append(txs, tx)
+		heights = append(heights, 0)
+	}
+	return txs, heights
+}
+
+func (s *standIn) findTx(txid string) (*wire.MsgTx, int32) {
+	txs, heights := s.allTxs()
+	for i, tx := range txs {
+		if tx.TxHash().String() == txid {
+			return tx, heights[i]
+		}
+	}
+	return nil, -1
+}
+
+// addresses an output script pays to; bech32 for witness, base58 for p2pkh
+func (s *standIn) scriptAdr(script []byte) string {
+	if len(script) > 2 && script[0] == 0x00 {
+		adr, _ := bech32.SegWitV0Encode(s.p.Bech32Prefix, script[2:])
+		return adr
+	}
+	if len(script) == 25 && script[0] == 0x76 {
+		adr, _ := btcutil.NewAddressPubKeyHash(script[3:23], s.p)
+		return adr.String()
+	}
+	return ""
+}
+
+// adrTxs returns txs paying to or spending from an address
+func (s *standIn) adrTxs(adr string) ([]*wire.MsgTx, []int32) {
+	var outTxs []*wire.MsgTx
+	var outHeights []int32
+	txs, heights := s.allTxs()
+	for i, tx := range txs {
+		hit := false
+		for _, out := range tx.TxOut {
+			hit = hit || s.scriptAdr(out.PkScript) == adr
+		}
+		for _, in := range tx.TxIn {
+			prev, _ := s.findTx(in.PreviousOutPoint.Hash.String())
+			if prev != nil && int(in.PreviousOutPoint.Index) < len(prev.TxOut) {
+				hit = hit ||
+					s.scriptAdr(prev.TxOut[in.PreviousOutPoint.Index].PkScript) == adr
+			}
+		}
+		if hit {
+			outTxs = append(outTxs, tx)
+			outHeights = append(outHeights, heights[i])
+		}
+	}
+	return outTxs, outHeights
+}
+
+// spender returns the tx spending an outpoint
+func (s *standIn) spender(txid string, n uint32) (*wire.MsgTx, int32) {
+	txs, heights := s.allTxs()
+	for i, tx := range txs {
+		for _, in := range tx.TxIn {
+			if in.PreviousOutPoint.Hash.String() == txid &&
+				in.PreviousOutPoint.Index == n {
+				return tx, heights[i]
+			}
+		}
+	}
+	return nil, 0
+}
+
+func hexOf(tx *wire.MsgTx) string {
+	s, _ := txToHex(tx)
+	return s
+}
+
+func esploraStat(h int32) esploraStatus {
+	return esploraStatus{Confirmed: h != 0, BlockHeight: h}
+}
+
+// esplora serves the esplora API
+func (s *standIn) esplora(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == "POST" && len(path) == 1 && path[0] == "tx":
+		body, _ := ioutil.ReadAll(r.Body)
+		tx, err := txFromHex(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.pushed = append(s.pushed, tx)
+		fmt.Fprintf(w, "%s", tx.TxHash().String())
+
+	case len(path) == 3 && path[0] == "blocks":
+		fmt.Fprintf(w, "%d", len(s.blocks)-1)
+
+	case len(path) == 2 && path[0] == "block-height":
+		h, _ := strconv.Atoi(path[1])
+		if h >= len(s.blocks) {
+			http.Error(w, "Block not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "%s", s.blocks[h].BlockHash().String())
+
+	case len(path) == 3 && path[0] == "block":
+		for _, b := range s.blocks {
+			if b.BlockHash().String() == path[1] {
+				b.Serialize(w)
+				return
+			}
+		}
+		http.Error(w, "Block not found", http.StatusNotFound)
+
+	case len(path) == 3 && path[0] == "address":
+		txs, heights := s.adrTxs(path[1])
+		reply := []esploraTx{}
+		for i, tx := range txs {
+			reply = append(reply,
+				esploraTx{Txid: tx.TxHash().String(), Status: esploraStat(heights[i])})
+		}
+		json.NewEncoder(w).Encode(reply)
+
+	case len(path) >= 3 && path[0] == "tx":
+		tx, h := s.findTx(path[1])
+		if tx == nil {
+			http.Error(w, "Transaction not found", http.StatusNotFound)
+			return
+		}
+		switch path[2] {
+		case "hex":
+			fmt.Fprintf(w, "%s", hexOf(tx))
+		case "status":
+			json.NewEncoder(w).Encode(esploraStat(h))
+		case "outspend":
+			n, _ := strconv.Atoi(path[3])
+			spend, sh := s.spender(path[1], uint32(n))
+			var reply esploraOutSpend
+			if spend != nil {
+				reply.Spent = true
+				reply.Txid = spend.TxHash().String()
+				reply.Status = esploraStat(sh)
+			}
+			json.NewEncoder(w).Encode(reply)
+		}
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// insight serves the insight API
+func (s *standIn) insight(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	iHeight := func(h int32) int32 {
+		if h == 0 {
+			return -1
+		}
+		return h
+	}
+
+	switch {
+	case r.Method == "POST" && path[0] == "tx":
+		var req RawTxResponse
+		json.NewDecoder(r.Body).Decode(&req)
+		tx, err := txFromHex(req.RawTx)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.pushed = append(s.pushed, tx)
+		fmt.Fprintf(w, `{"txid":"%s"}`, tx.TxHash().String())
+
+	case path[0] == "status":
+		fmt.Fprintf(w, `{"info":{"blocks":%d}}`, len(s.blocks)-1)
+
+	case path[0] == "block-index":
+		h, _ := strconv.Atoi(path[1])
+		if h >= len(s.blocks) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"blockHash":"%s"}`, s.blocks[h].BlockHash().String())
+
+	case path[0] == "rawblock":
+		for _, b := range s.blocks {
+			if b.BlockHash().String() == path[1] {
+				var buf bytes.Buffer
+				b.Serialize(&buf)
+				fmt.Fprintf(w, `{"rawblock":"%x"}`, buf.Bytes())
+				return
+			}
+		}
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	case path[0] == "addrs":
+		var reply insightAdrTxs
+		for _, adr := range strings.Split(path[1], ",") {
+			txs, heights := s.adrTxs(adr)
+			for i, tx := range txs {
+				reply.Items = append(reply.Items, TxResponse{
+					Txid: tx.TxHash().String(), Blockheight: iHeight(heights[i])})
+			}
+		}
+		reply.TotalItems = len(reply.Items)
+		reply.To = len(reply.Items)
+		json.NewEncoder(w).Encode(reply)
+
+	case path[0] == "tx":
+		tx, h := s.findTx(path[1])
+		if tx == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		reply := TxResponse{Txid: path[1], Blockheight: iHeight(h)}
+		for i, _ := range tx.TxOut {
+			vout := VoutJson{N: uint32(i)}
+			spend, sh := s.spender(path[1], uint32(i))
+			if spend != nil {
+				vout.SpentTxId = spend.TxHash().String()
+				vout.SpentHeight = iHeight(sh)
+			}
+			reply.Vout = append(reply.Vout, vout)
+		}
+		json.NewEncoder(w).Encode(reply)
+
+	case path[0] == "rawtx":
+		tx, _ := s.findTx(path[1])
+		if tx == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"rawtx":"%s"}`, hexOf(tx))
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// testParams are testnet3 params with the stand-in's genesis block
+func testParams(genesis *wire.MsgBlock) *chaincfg.Params {
+	p := chaincfg.TestNet3Params
+	h := genesis.BlockHash()
+	p.GenesisHash = &h
+	return &p
+}
+
+// collect is chaintest.Collect on a's channels.  Txs can come up more
+// than once.
+func collect(t *testing.T, a *APILink, wantTxs map[chainhash.Hash]int32,
+	wantHeight int32) ([]int32, []lnutil.BlockDisconnect) {
+
+	c := chaintest.Collect(t, a.TxUpToWallit, a.CurrentHeightChan,
+		a.DisconnectChan, wantTxs, wantHeight)
+	return c.Heights, c.Gone
+}
+
+// TestEsploraSync syncs against a stand-in esplora explorer, then reorgs it.
+func TestEsploraSync(t *testing.T) {
+	adr := [20]byte{1, 2, 3}
+	myScript := lnutil.DirectWPKHScriptFromPKH(adr)
+
+	txs := chaintest.NewTxs(myScript)
+	tx1, tx2, tx3, tx4 := txs.Pay, txs.Spend, txs.Other, txs.Mempool
+
+	b0 := chaintest.Block(nil, 0)
+	b1 := chaintest.Block(b0, 1, tx1)
+	b2 := chaintest.Block(b1, 2, tx2)
+	node := &standIn{
+		p:       testParams(b0),
+		blocks:  []*wire.MsgBlock{b0, b1, b2},
+		mempool: []*wire.MsgTx{tx4},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(node.esplora))
+	defer srv.Close()
+
+	host, err := ExplorerURL(FlavourEsplora, srv.URL, node.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(APILink)
+	a.PollInterval = time.Millisecond * 10
+	_, _, err = a.Start(0, host, "", node.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterAddress(adr)
+
+	collect(t, a, map[chainhash.Hash]int32{
+		tx1.TxHash(): 1,
+		tx2.TxHash(): 2,
+		tx4.TxHash(): 0,
+	}, 2)
+
+	// the explorer switches to a chain where tx2 is in b3b, not b2
+	node.mtx.Lock()
+	b2b := chaintest.Block(b1, 22, tx3)
+	b3b := chaintest.Block(b2b, 33, tx2)
+	node.blocks = []*wire.MsgBlock{b0, b1, b2b, b3b}
+	node.mtx.Unlock()
+
+	heights, gone := collect(t, a, map[chainhash.Hash]int32{tx2.TxHash(): 3}, 3)
+	if heights[0] > 1 {
+		t.Fatalf("expected to go back to at most 1 on reorg, got %v", heights)
+	}
+	// block 2 gets disconnected first, then maybe 1 since we don't know
+	// its hash
+	if len(gone) == 0 || gone[0].Height != 2 || gone[0].Hash != b2.BlockHash() ||
+		gone[len(gone)-1].Height != heights[0]+1 {
+		t.Fatalf("disconnected %v on reorg", gone)
+	}
+
+	// push a tx
+	err = a.PushTx(tx3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.mtx.Lock()
+	pushed := node.pushed
+	node.mtx.Unlock()
+	if len(pushed) != 1 || pushed[0].TxHash() != tx3.TxHash() {
+		t.Fatalf("stand-in explorer didn't get pushed tx")
+	}
+
+	// tx2 spent tx1's output; tx4's isn't spent
+	unspent, err := a.IsUnspent(wire.OutPoint{Hash: tx1.TxHash()})
+	if err != nil || unspent {
+		t.Fatalf("tx1 output unspent %t, err %v", unspent, err)
+	}
+	unspent, err = a.IsUnspent(wire.OutPoint{Hash: tx4.TxHash()})
+	if err != nil || !unspent {
+		t.Fatalf("tx4 output unspent %t, err %v", unspent, err)
+	}
+}
+
+// TestInsightSync syncs against a stand-in insight explorer, finding a
+// p2pkh output by address and a witness output by its outpoint.
+func TestInsightSync(t *testing.T) {
+	adr := [20]byte{4, 5, 6}
+	pkhScript := append(append([]byte{0x76, 0xa9, 0x14}, adr[:]...), 0x88, 0xac)
+
+	tx1 := chaintest.Tx(wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("a"))},
+		50000, pkhScript)
+	// insight can't look up witness addresses; this gets found by outpoint
+	tx2 := chaintest.Tx(wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("b"))},
+		60000, lnutil.DirectWPKHScriptFromPKH([20]byte{7}))
+
+	b0 := chaintest.Block(nil, 0)
+	b1 := chaintest.Block(b0, 1, tx1, tx2)
+	node := &standIn{
+		blocks: []*wire.MsgBlock{b0, b1},
+		p:      testParams(b0),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(node.insight))
+	defer srv.Close()
+
+	host, err := ExplorerURL(FlavourInsight, srv.URL, node.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(APILink)
+	a.PollInterval = time.Millisecond * 10
+	_, _, err = a.Start(0, host, "", node.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.RegisterAddress(adr)
+	a.RegisterOutPoint(wire.OutPoint{Hash: tx2.TxHash(), Index: 0})
+
+	collect(t, a, map[chainhash.Hash]int32{
+		tx1.TxHash(): 1,
+		tx2.TxHash(): 1,
+	}, 1)
+
+	// ask for blocks; should get block 1 again after a rescan
+	blocks := a.RawBlocks()
+	err = a.Rescan(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-blocks:
+		if b.BlockHash() != b1.BlockHash() {
+			t.Fatalf("got wrong block")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out waiting for block")
+	}
+}
+
+// TestWrongNetwork makes sure an explorer for some other chain is rejected
+func TestWrongNetwork(t *testing.T) {
+	node := &standIn{
+		blocks: []*wire.MsgBlock{chaintest.Block(nil, 0)},
+		p:      &chaincfg.TestNet3Params,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(node.esplora))
+	defer srv.Close()
+
+	host, err := ExplorerURL(FlavourEsplora, srv.URL, node.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = new(APILink).Start(0, host, "", node.p)
+	if err == nil {
+		t.Fatalf("expected error for explorer on a different network")
+	}
+}
+
+func TestExplorerURL(t *testing.T) {
+	p := &chaincfg.TestNet3Params
+	host, err := ExplorerURL(FlavourEsplora, "testnet3.lit3.co", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "esplora+https://blockstream.info/testnet/api" {
+		t.Fatalf("got %s", host)
+	}
+	host, err = ExplorerURL(FlavourInsight, "http://127.0.0.1:3001/api/", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "insight+http://127.0.0.1:3001/api" || !IsExplorerURL(host) {
+		t.Fatalf("got %s", host)
+	}
+	if IsExplorerURL("http://127.0.0.1:3001/api") || IsExplorerURL("127.0.0.1") {
+		t.Fatalf("IsExplorerURL wrong")
+	}
+	_, err = ExplorerURL("smartbit", "", p)
+	if err == nil {
+		t.Fatalf("expected error for unknown flavour")
+	}
+	_, err = ExplorerURL(FlavourEsplora, "", &chaincfg.RegressionNetParams)
+	if err == nil {
+		t.Fatalf("expected error with no default url")
+	}
+}
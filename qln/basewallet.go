@@ -26,9 +26,9 @@ type UWallet interface {
 	PushTx(tx *wire.MsgTx) error
 
 	// ExportUtxo gives a utxo to the underlying wallet; that wallet saves it
-	// and can spend it later.  Doesn't return errors; error will exist only in
-	// base wallet.
-	ExportUtxo(txo *portxo.PorTxo)
+	// in account and can spend it later.  Doesn't return errors; error will
+	// exist only in base wallet.
+	ExportUtxo(txo *portxo.PorTxo, account uint32)
 
 	// MaybeSend makes an unsigned tx, populated with inputs and outputs.
 	// The specified txouts are in there somewhere.
@@ -40,6 +40,10 @@ type UWallet interface {
 	// So if you (as usual) just give one txo, you basically get back an outpoint.
 	MaybeSend(txos []*wire.TxOut, onlyWit bool) ([]*wire.OutPoint, error)
 
+	// MaybeSendFrom is MaybeSend, but only using utxos from one account.
+	MaybeSendFrom(
+		account uint32, txos []*wire.TxOut, onlyWit bool) ([]*wire.OutPoint, error)
+
 	// ReallySend really sends the transaction specified previously in MaybeSend.
 	// Underlying wallet does all needed signing.
 	// Once you call ReallySend, the outpoint is tracked and responses are
@@ -49,18 +53,67 @@ type UWallet interface {
 	// NahDontSend cancels the MaybeSend transaction.
 	NahDontSend(txid *chainhash.Hash) error
 
+	// ExportUnsigned is like MaybeSend, but gives back the unsigned tx along
+	// with the portxos for its inputs so it can be signed elsewhere.
+	// Inputs stay frozen until BroadcastPartial / NahDontSend / restart.
+	ExportUnsigned(
+		account uint32, txos []*wire.TxOut) (*portxo.PartialTx, error)
+
+	// SignPartial signs whatever inputs of the partial tx it has keys for,
+	// and returns how many it signed.
+	SignPartial(p *portxo.PartialTx) (int, error)
+
+	// BroadcastPartial checks all the signatures of a partial tx and sends it out.
+	BroadcastPartial(p *portxo.PartialTx) error
+
+	// WatchOnly is true if the wallet has no private keys.  Watch-only
+	// wallets can't be used for channels.
+	WatchOnly() bool
+
 	// Return a new address
 	NewAdr() ([20]byte, error)
 
+	// Return a new address from a specific account
+	NewAccountAdr(account uint32) ([20]byte, error)
+
 	// Dump all the utxos in the sub wallet
 	UtxoDump() ([]*portxo.PorTxo, error)
 
+	// Dump the utxos in one account of the sub wallet
+	AccountUtxoDump(account uint32) ([]*portxo.PorTxo, error)
+
 	// Dump all the addresses the sub wallet is watching
 	AdrDump() ([][20]byte, error)
 
+	// Dump the addresses handed out from one account
+	AccountAdrDump(account uint32) ([][20]byte, error)
+
+	// AccountXpub returns the extended public key of an account, for making
+	// a watch-only wallet
+	AccountXpub(account uint32) (string, error)
+
 	// Return current height the wallet is synced to
 	CurrentHeight() int32
 
+	// Rescan goes back and looks through the blocks from fromHeight on again
+	Rescan(fromHeight int32) error
+
+	// ChainPeers lists the full nodes the wallet gets blocks from, if any
+	ChainPeers() []lnutil.ChainPeerInfo
+
+	// ChainConnState says whether the wallet can reach the blockchain
+	ChainConnState() lnutil.ChainConnState
+
+	// TxProof gets a tx that confirmed at height, and proof it's in the block
+	TxProof(txid chainhash.Hash, height int32) (*wire.MsgTx, lnutil.TxProof, error)
+
+	// CheckTxProof checks a proof that a tx is in a block
+	CheckTxProof(txid chainhash.Hash, p lnutil.TxProof) error
+
+	// IsUnspent says if an outpoint is unspent; ok is false if the
+	// wallet's chain connection can't tell
+	IsUnspent(op wire.OutPoint) (unspent, ok bool, err error)
+
 	// This is redundand... just use UtxoDump and figure it out yourself.
 	// Feels like helper functions shouldn't be in the interface.
 	// how much utxo the wallet has -- only confirmed segwit outputs
@@ -69,8 +122,9 @@ type UWallet interface {
 	// How much utxo the sub wallet has, including non-segwit, unconfirmed, immature
 	//	HowMuchTotal() int64
 
-	// WatchThis tells the basewallet to watch an outpoint
-	WatchThis(wire.OutPoint) error
+	// WatchThis tells the basewallet to watch an outpoint.  pkScript is the
+	// outpoint's output script; chainhooks that match by script need it.
+	WatchThis(op wire.OutPoint, pkScript []byte) error
 
 	// LetMeKnow opens the chan where OutPointEvent flows from the underlying
 	// wallet up to the LN module.
@@ -97,6 +151,10 @@ func (nd *LitNode) GetUsePub(k portxo.KeyGen, use uint32) (pubArr [33]byte, err
 	}
 	k.Step[2] = use
 	pub := nd.SubWallet[coin].GetPub(k)
+	if pub == nil {
+		err = fmt.Errorf("couldn't derive pubkey for %s", k.String())
+		return
+	}
 	copy(pubArr[:], pub.SerializeCompressed())
 	return
 }
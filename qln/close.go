@@ -71,8 +71,7 @@ func (nd *LitNode) CoopClose(q *Qchan) error {
 
 	outMsg := lnutil.NewCloseReqMsg(q.Peer(), q.Op, signature)
 
-	nd.OmniOut <- outMsg
-	return nil
+	return nd.SendMsg(outMsg)
 }
 
 // CloseReqHandler takes in a close request from a remote host, signs and
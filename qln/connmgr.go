@@ -0,0 +1,203 @@
+package qln
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+The connection manager keeps peers with open channels connected.  When a
+connection to one drops, it's redialed at the host saved when we first
+connected out to it, waiting minRedialWait, then twice as long each time
+it doesn't work, up to maxRedialWait.  Peers that only ever connected to us
+have no saved host, so they're left to come back on their own.
+
+Whenever a peer connects, either way, we send reestablish messages for our
+channels with it (see reestablish.go), so a state update that got cut off
+picks up where it left off.  Peers without the reestablish feature just get
+the last message for each channel again (ReSendMsg).  Gossip peers also
+get the graph (see gossip.go).
+*/
+
+const (
+	minRedialWait = time.Second * 5
+	maxRedialWait = time.Minute * 10
+
+	// a connection that drops before stableConnTime doesn't reset the
+	// wait, so peers that take us and drop us right away don't get
+	// redialed in a tight loop.
+	stableConnTime = time.Minute
+)
+
+// peer connection states, for ListConnections
+const (
+	PeerConnected = "connected"
+	PeerRedialing = "redialing"
+)
+
+// peerConnState is what the connection manager knows about a peer
+type peerConnState struct {
+	host      string
+	state     string
+	upSince   time.Time
+	wait      time.Duration // wait before the next redial
+	tries     uint32        // redials since it dropped
+	lastError string
+}
+
+// peerUp is called once a peer's connected.  Stops redialing it, and
+// sends reestablish messages for its channels, or re-sends the last
+// message if it doesn't do reestablish.
+func (nd *LitNode) peerUp(peerIdx uint32) {
+	nd.connMtx.Lock()
+	ps, ok := nd.connStates[peerIdx]
+	if !ok {
+		ps = new(peerConnState)
+		nd.connStates[peerIdx] = ps
+	}
+	ps.state = PeerConnected
+	ps.upSince = time.Now()
+	ps.tries = 0
+	ps.lastError = ""
+	nd.connMtx.Unlock()
+
+	if nd.PeerSupports(peerIdx, lnutil.FeatureGossip) {
+		go nd.syncGraph(peerIdx)
+	}
+	if !nd.PeerSupports(peerIdx, lnutil.FeatureReestablish) {
+		go nd.reSendAll(peerIdx)
+		return
+	}
+	go func() {
+		err := nd.SendReestablish(peerIdx)
+		if err != nil {
+			fmt.Printf("SendReestablish %d: %s\n", peerIdx, err.Error())
+		}
+	}()
+}
+
+// reSendAll re-sends the last message for each open channel with a peer
+func (nd *LitNode) reSendAll(peerIdx uint32) {
+	qcs, err := nd.GetAllQchans()
+	if err != nil {
+		fmt.Printf("reSendAll %d: %s\n", peerIdx, err.Error())
+		return
+	}
+	for _, q := range qcs {
+		// channels without a state yet have nothing to re-send
+		if q.Peer() != peerIdx || q.CloseData.Closed || q.State.StateIdx == 0 {
+			continue
+		}
+		err = nd.ReloadQchanState(q)
+		if err != nil {
+			fmt.Printf("reSendAll %d: %s\n", peerIdx, err.Error())
+			continue
+		}
+		err = nd.ReSendMsg(q)
+		if err != nil {
+			fmt.Printf("reSendAll %d: channel %d ReSendMsg %s\n",
+				peerIdx, q.Idx(), err.Error())
+		}
+	}
+}
+
+// peerDown is called when a peer's connection drops.  If it has open
+// channels and we know where it is, it gets redialed.
+func (nd *LitNode) peerDown(peerIdx uint32) {
+	if isTempPeer(peerIdx) {
+		nd.forgetTempPeer(peerIdx)
+	}
+	pub, host := nd.GetPubHostFromPeerIdx(peerIdx)
+	if host == "" || !nd.hasOpenChannels(peerIdx) ||
+		nd.peerDenied(lnutil.LitAdrFromPubkey(pub)) {
+		nd.connMtx.Lock()
+		delete(nd.connStates, peerIdx)
+		nd.connMtx.Unlock()
+		return
+	}
+
+	nd.connMtx.Lock()
+	ps, ok := nd.connStates[peerIdx]
+	if ok && ps.state == PeerRedialing {
+		// already on it
+		nd.connMtx.Unlock()
+		return
+	}
+	if !ok {
+		ps = new(peerConnState)
+		nd.connStates[peerIdx] = ps
+	}
+	if ps.wait == 0 || time.Since(ps.upSince) > stableConnTime {
+		ps.wait = minRedialWait
+	} else if ps.wait < maxRedialWait {
+		ps.wait *= 2
+	}
+	ps.host = host
+	ps.state = PeerRedialing
+	nd.connMtx.Unlock()
+
+	fmt.Printf("lost peer %d, redialing %s\n", peerIdx, host)
+	go nd.redialPeer(peerIdx)
+}
+
+// redialPeer keeps dialing a peer until it's connected, one way or the
+// other.
+func (nd *LitNode) redialPeer(peerIdx uint32) {
+	for {
+		nd.connMtx.Lock()
+		ps, ok := nd.connStates[peerIdx]
+		if !ok || ps.state != PeerRedialing {
+			nd.connMtx.Unlock()
+			return
+		}
+		wait := ps.wait
+		nd.connMtx.Unlock()
+
+		time.Sleep(wait)
+
+		// they may have connected to us while we waited
+		if nd.ConnectedToPeer(peerIdx) {
+			return
+		}
+
+		pub, host := nd.GetPubHostFromPeerIdx(peerIdx)
+		err := nd.DialPeer(lnutil.LitAdrFromPubkey(pub) + "@" + host)
+		if err == nil {
+			return
+		}
+
+		nd.connMtx.Lock()
+		ps, ok = nd.connStates[peerIdx]
+		if !ok || ps.state != PeerRedialing {
+			nd.connMtx.Unlock()
+			return
+		}
+		ps.tries++
+		ps.lastError = err.Error()
+		ps.wait *= 2
+		if ps.wait > maxRedialWait {
+			ps.wait = maxRedialWait
+		}
+		fmt.Printf("redial peer %d try %d: %s; next in %s\n",
+			peerIdx, ps.tries, err.Error(), ps.wait.String())
+		nd.connMtx.Unlock()
+	}
+}
+
+// hasOpenChannels says if there are any channels with a peer that aren't
+// closed
+func (nd *LitNode) hasOpenChannels(peerIdx uint32) bool {
+	qcs, err := nd.GetAllQchans()
+	if err != nil {
+		fmt.Printf("hasOpenChannels: %s\n", err.Error())
+		return false
+	}
+	for _, q := range qcs {
+		if q.Peer() == peerIdx && !q.CloseData.Closed {
+			return true
+		}
+	}
+	return false
+}
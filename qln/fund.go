@@ -99,13 +99,17 @@ an exact timing for the payment.
 
 // FundChannel opens a channel with a peer.  Doesn't return until the channel
 // has been created.  Maybe timeout if it takes too long?
+// The funding inputs come from the given account of the wallet.
 func (nd *LitNode) FundChannel(
-	peerIdx, cointype uint32, ccap, initSend int64) (uint32, error) {
+	peerIdx, cointype, account uint32, ccap, initSend int64) (uint32, error) {
 
-	_, ok := nd.SubWallet[cointype]
+	wal, ok := nd.SubWallet[cointype]
 	if !ok {
 		return 0, fmt.Errorf("No wallet of type %d connected", cointype)
 	}
+	if wal.WatchOnly() {
+		return 0, fmt.Errorf("Wallet of type %d is watch-only", cointype)
+	}
 
 	nd.InProg.mtx.Lock()
 	//	defer nd.InProg.mtx.Lock()
@@ -133,6 +137,13 @@ func (nd *LitNode) FundChannel(
 		return 0, fmt.Errorf("Not connected to peer %d. Do that yourself.", peerIdx)
 	}
 
+	// a peer we haven't saved gets saved now, so its index sticks
+	peerIdx, err := nd.persistPeer(peerIdx)
+	if err != nil {
+		nd.InProg.mtx.Unlock()
+		return 0, err
+	}
+
 	cIdx, err := nd.NextChannelIdx()
 	if err != nil {
 		nd.InProg.mtx.Unlock()
@@ -145,11 +156,18 @@ func (nd *LitNode) FundChannel(
 	nd.InProg.InitSend = initSend
 
 	nd.InProg.Coin = cointype
+	nd.InProg.Account = account
 	nd.InProg.mtx.Unlock() // switch to defer
 
 	outMsg := lnutil.NewPointReqMsg(peerIdx, cointype)
 
-	nd.OmniOut <- outMsg
+	err = nd.SendMsg(outMsg)
+	if err != nil {
+		nd.InProg.mtx.Lock()
+		nd.InProg.Clear()
+		nd.InProg.mtx.Unlock()
+		return 0, err
+	}
 
 	// wait until it's done!
 	idx := <-nd.InProg.done
@@ -180,18 +198,29 @@ func (nd *LitNode) PointReqHandler(msg lnutil.PointReqMsg) {
 
 	cointype := msg.Cointype
 
-	_, ok := nd.SubWallet[cointype]
+	wal, ok := nd.SubWallet[cointype]
 	if !ok {
 		fmt.Printf("PointReqHandler err no wallet for type %d", cointype)
 		return
 	}
+	if wal.WatchOnly() {
+		fmt.Printf("PointReqHandler err wallet type %d is watch-only", cointype)
+		return
+	}
+
+	// the channel keys use the peer index, so it can't be a temporary one
+	peerIdx, err := nd.persistPeer(msg.Peer())
+	if err != nil {
+		fmt.Printf("PointReqHandler err %s", err.Error())
+		return
+	}
 
 	var kg portxo.KeyGen
 	kg.Depth = 5
 	kg.Step[0] = 44 | 1<<31
 	kg.Step[1] = cointype | 1<<31
 	kg.Step[2] = UseChannelFund
-	kg.Step[3] = msg.Peer() | 1<<31
+	kg.Step[3] = peerIdx | 1<<31
 	kg.Step[4] = cIdx | 1<<31
 
 	myChanPub, _ := nd.GetUsePub(kg, UseChannelFund)
@@ -204,16 +233,18 @@ func (nd *LitNode) PointReqHandler(msg lnutil.PointReqMsg) {
 
 	fmt.Printf("Generated channel pubkey %x\n", myChanPub)
 
-	outMsg := lnutil.NewPointRespMsg(msg.Peer(), myChanPub, myRefundPub, myHAKDbase)
-	nd.OmniOut <- outMsg
-	outMsg.Bytes()
+	outMsg := lnutil.NewPointRespMsg(peerIdx, myChanPub, myRefundPub, myHAKDbase)
+	err = nd.SendMsg(outMsg)
+	if err != nil {
+		fmt.Printf("PointReqHandler err %s", err.Error())
+	}
 
 	return
 }
 
 // FUNDER
 // PointRespHandler takes in a point response, and returns a channel description
-func (nd LitNode) PointRespHandler(msg lnutil.PointRespMsg) error {
+func (nd *LitNode) PointRespHandler(msg lnutil.PointRespMsg) error {
 
 	nd.InProg.mtx.Lock()
 	defer nd.InProg.mtx.Unlock()
@@ -238,6 +269,7 @@ func (nd LitNode) PointRespHandler(msg lnutil.PointRespMsg) error {
 	q.Height = -1
 
 	q.Value = nd.InProg.Amt
+	q.Account = nd.InProg.Account
 
 	q.KeyGen.Depth = 5
 	q.KeyGen.Step[0] = 44 | 1<<31
@@ -281,7 +313,8 @@ func (nd LitNode) PointRespHandler(msg lnutil.PointRespMsg) error {
 
 	// call MaybeSend, freezing inputs and learning the txid of the channel
 	// here, we require only witness inputs
-	outPoints, err := nd.SubWallet[q.Coin()].MaybeSend([]*wire.TxOut{txo}, true)
+	outPoints, err := nd.SubWallet[q.Coin()].MaybeSendFrom(
+		nd.InProg.Account, []*wire.TxOut{txo}, true)
 	if err != nil {
 		return err
 	}
@@ -332,9 +365,7 @@ func (nd LitNode) PointRespHandler(msg lnutil.PointRespMsg) error {
 		nd.InProg.Coin, nd.InProg.Amt, nd.InProg.InitSend,
 		elkPointZero, elkPointOne, elkPointTwo)
 
-	nd.OmniOut <- outMsg
-
-	return nil
+	return nd.SendMsg(outMsg)
 }
 
 // RECIPIENT
@@ -446,9 +477,11 @@ func (nd *LitNode) QChanDescHandler(msg lnutil.ChanDescMsg) {
 		msg.Peer(), op,
 		theirElkPointZero, theirElkPointOne, theirElkPointTwo,
 		sig)
-	outMsg.Bytes()
 
-	nd.OmniOut <- outMsg
+	err = nd.SendMsg(outMsg)
+	if err != nil {
+		fmt.Printf("QChanDescHandler err %s", err.Error())
+	}
 
 	return
 }
@@ -505,7 +538,12 @@ func (nd *LitNode) QChanAckHandler(msg lnutil.ChanAckMsg, peer *RemotePeer) {
 		return
 	}
 
-	err = nd.SubWallet[qc.Coin()].WatchThis(qc.Op)
+	fundTxOut, err := lnutil.FundTxOut(qc.MyPub, qc.TheirPub, qc.Value)
+	if err != nil {
+		fmt.Printf("QChanAckHandler FundTxOut err %s", err.Error())
+		return
+	}
+	err = nd.SubWallet[qc.Coin()].WatchThis(qc.Op, fundTxOut.PkScript)
 	if err != nil {
 		fmt.Printf("QChanAckHandler WatchThis err %s", err.Error())
 		return
@@ -517,7 +555,7 @@ func (nd *LitNode) QChanAckHandler(msg lnutil.ChanAckMsg, peer *RemotePeer) {
 	nullTxo.Value = 0 // redundant, but explicitly show that this is just for adr
 	nullTxo.KeyGen = qc.KeyGen
 	nullTxo.KeyGen.Step[2] = UseChannelWatchRefund
-	nd.SubWallet[qc.Coin()].ExportUtxo(nullTxo)
+	nd.SubWallet[qc.Coin()].ExportUtxo(nullTxo, qc.Account)
 
 	// channel creation is ~complete, clear InProg.
 	// We may be asked to re-send the sig-proof
@@ -536,7 +574,10 @@ func (nd *LitNode) QChanAckHandler(msg lnutil.ChanAckMsg, peer *RemotePeer) {
 
 	outMsg := lnutil.NewSigProofMsg(msg.Peer(), msg.Outpoint, sig)
 
-	nd.OmniOut <- outMsg
+	err = nd.SendMsg(outMsg)
+	if err != nil {
+		fmt.Printf("QChanAckHandler err %s", err.Error())
+	}
 
 	return
 }
@@ -574,7 +615,12 @@ func (nd *LitNode) SigProofHandler(msg lnutil.SigProofMsg, peer *RemotePeer) {
 		return
 	}
 
-	err = wal.WatchThis(op)
+	fundTxOut, err := lnutil.FundTxOut(qc.MyPub, qc.TheirPub, qc.Value)
+	if err != nil {
+		fmt.Printf("SigProofHandler err %s", err.Error())
+		return
+	}
+	err = wal.WatchThis(op, fundTxOut.PkScript)
 
 	if err != nil {
 		fmt.Printf("SigProofHandler err %s", err.Error())
@@ -586,7 +632,7 @@ func (nd *LitNode) SigProofHandler(msg lnutil.SigProofMsg, peer *RemotePeer) {
 	nullTxo.Value = 0 // redundant, but explicitly show that this is just for adr
 	nullTxo.KeyGen = qc.KeyGen
 	nullTxo.KeyGen.Step[2] = UseChannelWatchRefund
-	wal.ExportUtxo(nullTxo)
+	wal.ExportUtxo(nullTxo, qc.Account)
 
 	peer.QCs[qc.Idx()] = qc
 	peer.OpMap[opArr] = qc.Idx()
@@ -0,0 +1,534 @@
+package qln
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/sig64"
+)
+
+/*
+Gossip is how nodes hear about channels and nodes they aren't part of (see
+lnutil/gossipmsg.go for the messages).  Everything that checks out goes in
+the graph (graph.go) and gets passed on to our other gossip peers; things
+already in the graph stop there, so nothing goes around forever.
+
+Once a channel's funding tx is in a block, both sides send the other their
+signatures for its announcement.  Whoever gets the other's first puts the
+announcement together, and sends theirs back in case it hasn't been sent.
+If the other side already has it, it sends back the whole announcement.
+
+Once one of our channels is announced, we send out a channel update for
+our side of it, saying what we charge to forward through it.
+
+When a gossip peer connects, it gets the whole graph, and the signatures
+for any of our channels with it that aren't announced yet.
+*/
+
+const (
+	// maxAnnFuture is how far ahead of our clock node announcements and
+	// channel updates can be
+	maxAnnFuture = time.Hour
+
+	// what we charge to forward through our channels
+	defaultFeeBase = 1   // satoshis
+	defaultFeeRate = 100 // millionths
+)
+
+func (nd *LitNode) GossipHandler(msg lnutil.LitMsg) error {
+	switch message := msg.(type) {
+	case lnutil.NodeAnnMsg:
+		return nd.NodeAnnHandler(message)
+
+	case lnutil.ChanAnnMsg:
+		return nd.ChanAnnHandler(message)
+
+	case lnutil.AnnSigsMsg:
+		return nd.AnnSigsHandler(message)
+
+	case lnutil.ChanUpdateMsg:
+		return nd.ChanUpdateHandler(message)
+
+	default:
+		return fmt.Errorf("Unknown message type %x", msg.MsgType())
+	}
+}
+
+// signAnn signs an announcement's SigHash
+func signAnn(priv *btcec.PrivateKey, hash chainhash.Hash) ([64]byte, error) {
+	var sig [64]byte
+	if priv == nil {
+		return sig, fmt.Errorf("no key to sign with")
+	}
+	bigSig, err := priv.Sign(hash[:])
+	if err != nil {
+		return sig, err
+	}
+	return sig64.SigCompress(bigSig.Serialize())
+}
+
+// checkAnnSig checks a signature on an announcement's SigHash
+func checkAnnSig(pub [33]byte, hash chainhash.Hash, sig [64]byte) error {
+	pubKey, err := btcec.ParsePubKey(pub[:], btcec.S256())
+	if err != nil {
+		return err
+	}
+	bigSig, err := btcec.ParseDERSignature(sig64.SigDecompress(sig), btcec.S256())
+	if err != nil {
+		return err
+	}
+	if !bigSig.Verify(hash[:], pubKey) {
+		return fmt.Errorf("bad signature from %x", pub)
+	}
+	return nil
+}
+
+// checkChanAnn makes sure a channel announcement is signed by everyone in
+// it, and that the funding output it says is in a block and unspent.
+func (nd *LitNode) checkChanAnn(ann lnutil.ChanAnnMsg) error {
+	if _, order := sortedPubs(ann.NodePub[0], ann.NodePub[1]); order != 0 ||
+		ann.NodePub[0] == ann.NodePub[1] {
+		return fmt.Errorf("ChanAnn %s node pubkeys out of order",
+			ann.Outpoint.String())
+	}
+
+	if ann.FundTx == nil || ann.FundTx.TxHash() != ann.Outpoint.Hash {
+		return fmt.Errorf("ChanAnn %s funding tx doesn't match",
+			ann.Outpoint.String())
+	}
+	if int(ann.Outpoint.Index) >= len(ann.FundTx.TxOut) {
+		return fmt.Errorf("ChanAnn %s funding tx has %d outputs",
+			ann.Outpoint.String(), len(ann.FundTx.TxOut))
+	}
+	fundTxOut, err := lnutil.FundTxOut(ann.FundPub[0], ann.FundPub[1], ann.Capacity)
+	if err != nil {
+		return err
+	}
+	txo := ann.FundTx.TxOut[ann.Outpoint.Index]
+	if txo.Value != fundTxOut.Value ||
+		string(txo.PkScript) != string(fundTxOut.PkScript) {
+		return fmt.Errorf("ChanAnn %s output isn't the channel's",
+			ann.Outpoint.String())
+	}
+
+	hash := ann.SigHash()
+	for i := range ann.NodePub {
+		err = checkAnnSig(ann.NodePub[i], hash, ann.NodeSig[i])
+		if err != nil {
+			return fmt.Errorf("ChanAnn %s node %d: %s",
+				ann.Outpoint.String(), i, err.Error())
+		}
+		err = checkAnnSig(ann.FundPub[i], hash, ann.FundSig[i])
+		if err != nil {
+			return fmt.Errorf("ChanAnn %s funding key %d: %s",
+				ann.Outpoint.String(), i, err.Error())
+		}
+	}
+
+	wal, ok := nd.SubWallet[ann.Coin]
+	if !ok {
+		return fmt.Errorf("ChanAnn %s: no wallet for cointype %d",
+			ann.Outpoint.String(), ann.Coin)
+	}
+	err = wal.CheckTxProof(ann.Outpoint.Hash, ann.Proof)
+	if err != nil {
+		return err
+	}
+
+	// a closed channel's no use.  If the wallet can't tell, a spend
+	// after we start watching it still prunes it; see graphOPEvent.
+	unspent, ok, err := wal.IsUnspent(ann.Outpoint)
+	if err != nil {
+		return fmt.Errorf("ChanAnn %s: %s", ann.Outpoint.String(), err.Error())
+	}
+	if ok && !unspent {
+		return fmt.Errorf("ChanAnn %s funding output spent",
+			ann.Outpoint.String())
+	}
+	return nil
+}
+
+// unsignedChanAnn makes the announcement for one of our channels, without
+// signatures or proof, and says which node we are in it.
+func (nd *LitNode) unsignedChanAnn(qc *Qchan) (lnutil.ChanAnnMsg, int) {
+	theirPub, _ := nd.GetPubHostFromPeerIdx(qc.Peer())
+	nodePub, ours := sortedPubs(nd.idPub(), theirPub)
+	fundPub := [2][33]byte{qc.MyPub, qc.TheirPub}
+	if ours == 1 {
+		fundPub = [2][33]byte{qc.TheirPub, qc.MyPub}
+	}
+	ann := lnutil.NewChanAnnMsg(
+		qc.Peer(), qc.Coin(), qc.Op, qc.Value, nodePub, fundPub)
+	return ann, ours
+}
+
+// signChanAnn makes our two signatures for one of our channels
+func (nd *LitNode) signChanAnn(qc *Qchan, hash chainhash.Hash) (
+	nodeSig, fundSig [64]byte, err error) {
+	wal, ok := nd.SubWallet[qc.Coin()]
+	if !ok {
+		return nodeSig, fundSig, fmt.Errorf("no wallet for cointype %d", qc.Coin())
+	}
+	nodeSig, err = signAnn(nd.IdKey(), hash)
+	if err != nil {
+		return
+	}
+	fundSig, err = signAnn(wal.GetPriv(qc.KeyGen), hash)
+	return
+}
+
+// sendAnnSigs sends our signatures for a confirmed channel's announcement
+// to the other side, if it's connected and does gossip.
+func (nd *LitNode) sendAnnSigs(qc *Qchan) error {
+	if qc.Height <= 0 || qc.CloseData.Closed ||
+		!nd.PeerSupports(qc.Peer(), lnutil.FeatureGossip) {
+		return nil
+	}
+	ann, _ := nd.unsignedChanAnn(qc)
+	nodeSig, fundSig, err := nd.signChanAnn(qc, ann.SigHash())
+	if err != nil {
+		return err
+	}
+	return nd.SendMsg(lnutil.NewAnnSigsMsg(qc.Peer(), qc.Op, nodeSig, fundSig))
+}
+
+// AnnSigsHandler gets the other side's signatures for one of our channels,
+// and announces it.
+func (nd *LitNode) AnnSigsHandler(msg lnutil.AnnSigsMsg) error {
+	opArr := lnutil.OutPointToBytes(msg.Outpoint)
+	qc, err := nd.GetQchan(opArr)
+	if err != nil {
+		return fmt.Errorf("AnnSigsHandler GetQchan err %s", err.Error())
+	}
+	if qc.Peer() != msg.Peer() {
+		return fmt.Errorf("AnnSigsHandler: channel %s is with peer %d, not %d",
+			msg.Outpoint.String(), qc.Peer(), msg.Peer())
+	}
+	if qc.CloseData.Closed {
+		return nil
+	}
+	if qc.Height <= 0 {
+		// we'll send ours when we see it confirm, and they'll answer
+		fmt.Printf("AnnSigsHandler: channel %s not confirmed yet\n",
+			msg.Outpoint.String())
+		return nil
+	}
+
+	// they might not have it; send them the whole thing
+	have, err := nd.getChanAnn(qc.Op)
+	if err != nil {
+		return err
+	}
+	if have != nil {
+		have.PeerIdx = msg.Peer()
+		return nd.SendMsg(*have)
+	}
+
+	ann, ours := nd.unsignedChanAnn(qc)
+	hash := ann.SigHash()
+	ann.NodeSig[ours], ann.FundSig[ours], err = nd.signChanAnn(qc, hash)
+	if err != nil {
+		return err
+	}
+	ann.NodeSig[1-ours], ann.FundSig[1-ours] = msg.NodeSig, msg.FundSig
+
+	ann.FundTx, ann.Proof, err = nd.SubWallet[qc.Coin()].TxProof(qc.Op.Hash, qc.Height)
+	if err != nil {
+		return fmt.Errorf("AnnSigsHandler TxProof err %s", err.Error())
+	}
+	err = nd.checkChanAnn(ann)
+	if err != nil {
+		return err
+	}
+	isNew, err := nd.saveChanAnn(ann)
+	if err != nil || !isNew {
+		return err
+	}
+	fmt.Printf("announcing channel %s\n", qc.Op.String())
+	nd.relayGossip(ann, msg.Peer())
+	err = nd.sendChanUpdate(qc)
+	if err != nil {
+		fmt.Printf("AnnSigsHandler sendChanUpdate err %s\n", err.Error())
+	}
+
+	return nd.SendMsg(lnutil.NewAnnSigsMsg(
+		msg.Peer(), qc.Op, ann.NodeSig[ours], ann.FundSig[ours]))
+}
+
+// ChanAnnHandler checks a channel announcement, and if it's new, adds it to
+// the graph and passes it on.
+func (nd *LitNode) ChanAnnHandler(msg lnutil.ChanAnnMsg) error {
+	if nd.hasChanAnn(msg.Outpoint) {
+		return nil
+	}
+	err := nd.checkChanAnn(msg)
+	if err != nil {
+		return err
+	}
+	isNew, err := nd.saveChanAnn(msg)
+	if err != nil || !isNew {
+		return err
+	}
+
+	nd.relayGossip(msg, msg.Peer())
+
+	// watch it so we know when it closes.  Ours are already watched.
+	opArr := lnutil.OutPointToBytes(msg.Outpoint)
+	qc, err := nd.GetQchan(opArr)
+	if err == nil {
+		return nd.sendChanUpdate(qc)
+	}
+	err = nd.SubWallet[msg.Coin].WatchThis(
+		msg.Outpoint, msg.FundTx.TxOut[msg.Outpoint.Index].PkScript)
+	if err != nil {
+		fmt.Printf("ChanAnnHandler WatchThis err %s\n", err.Error())
+	}
+	return nil
+}
+
+// sendChanUpdate says what we charge to forward through one of our
+// announced channels, and sends it to our gossip peers.
+func (nd *LitNode) sendChanUpdate(qc *Qchan) error {
+	_, ours := nd.unsignedChanAnn(qc)
+	node := uint8(ours)
+	ts := time.Now().Unix()
+	old, err := nd.getChanUpdate(qc.Op, node)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.Timestamp >= ts {
+		ts = old.Timestamp + 1
+	}
+
+	u := lnutil.NewChanUpdateMsg(
+		0, qc.Op, ts, node, defaultFeeBase, defaultFeeRate, qc.Delay)
+	u.Sig, err = signAnn(nd.IdKey(), u.SigHash())
+	if err != nil {
+		return err
+	}
+	_, err = nd.saveChanUpdate(u)
+	if err != nil {
+		return err
+	}
+	nd.relayGossip(u, 0)
+	return nil
+}
+
+// ChanUpdateHandler checks a channel update, and if it's newer than what
+// we have, saves it and passes it on.
+func (nd *LitNode) ChanUpdateHandler(msg lnutil.ChanUpdateMsg) error {
+	ann, err := nd.getChanAnn(msg.Outpoint)
+	if err != nil {
+		return err
+	}
+	if ann == nil {
+		return fmt.Errorf("ChanUpdate for %s, not in graph",
+			msg.Outpoint.String())
+	}
+	if msg.Timestamp > time.Now().Add(maxAnnFuture).Unix() {
+		return fmt.Errorf("ChanUpdate %s timestamp %d is in the future",
+			msg.Outpoint.String(), msg.Timestamp)
+	}
+	err = checkAnnSig(ann.NodePub[msg.Node], msg.SigHash(), msg.Sig)
+	if err != nil {
+		return fmt.Errorf("ChanUpdate %s: %s", msg.Outpoint.String(), err.Error())
+	}
+	isNew, err := nd.saveChanUpdate(msg)
+	if err != nil || !isNew {
+		return err
+	}
+	nd.relayGossip(msg, msg.Peer())
+	return nil
+}
+
+// checkNodeAnn makes sure a node announcement is signed by the node, and
+// isn't from the future.
+func checkNodeAnn(ann lnutil.NodeAnnMsg, now time.Time) error {
+	if ann.Timestamp > now.Add(maxAnnFuture).Unix() {
+		return fmt.Errorf("NodeAnn %s timestamp %d is in the future",
+			lnutil.LitAdrFromPubkey(ann.Pub), ann.Timestamp)
+	}
+	return checkAnnSig(ann.Pub, ann.SigHash(), ann.Sig)
+}
+
+// NodeAnnHandler checks a node announcement, and if it's newer than what we
+// have, saves it and passes it on.
+func (nd *LitNode) NodeAnnHandler(msg lnutil.NodeAnnMsg) error {
+	err := checkNodeAnn(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	isNew, err := nd.saveNodeAnn(msg)
+	if err != nil || !isNew {
+		return err
+	}
+	nd.relayGossip(msg, msg.Peer())
+	return nil
+}
+
+// AnnounceNode tells the network our nickname, and where to connect to us
+func (nd *LitNode) AnnounceNode(nickname string, addrs []string) error {
+	if len(nickname) > lnutil.MaxNicknameLen {
+		return fmt.Errorf("nickname %d bytes, max %d",
+			len(nickname), lnutil.MaxNicknameLen)
+	}
+	if len(addrs) > lnutil.MaxNodeAddrs {
+		return fmt.Errorf("%d addresses, max %d", len(addrs), lnutil.MaxNodeAddrs)
+	}
+	for _, a := range addrs {
+		if len(a) > 255 {
+			return fmt.Errorf("address %s too long", a)
+		}
+		_, _, err := net.SplitHostPort(a)
+		if err != nil {
+			return fmt.Errorf("address %s: %s", a, err.Error())
+		}
+	}
+
+	pub := nd.idPub()
+	ts := time.Now().Unix()
+	old, err := nd.getNodeAnn(pub)
+	if err != nil {
+		return err
+	}
+	// newer ones replace older ones, so always go up
+	if old != nil && old.Timestamp >= ts {
+		ts = old.Timestamp + 1
+	}
+
+	ann := lnutil.NewNodeAnnMsg(0, pub, ts, nickname, addrs)
+	ann.Sig, err = signAnn(nd.IdKey(), ann.SigHash())
+	if err != nil {
+		return err
+	}
+	_, err = nd.saveNodeAnn(ann)
+	if err != nil {
+		return err
+	}
+	nd.relayGossip(ann, 0)
+	return nil
+}
+
+// gossipTo addresses a gossip message to a peer
+func gossipTo(msg lnutil.LitMsg, peerIdx uint32) lnutil.LitMsg {
+	switch m := msg.(type) {
+	case lnutil.NodeAnnMsg:
+		m.PeerIdx = peerIdx
+		return m
+	case lnutil.ChanAnnMsg:
+		m.PeerIdx = peerIdx
+		return m
+	case lnutil.ChanUpdateMsg:
+		m.PeerIdx = peerIdx
+		return m
+	}
+	return msg
+}
+
+// relayGossip sends a message to all our gossip peers, except the one it
+// came from.
+func (nd *LitNode) relayGossip(msg lnutil.LitMsg, from uint32) {
+	var to []uint32
+	nd.RemoteMtx.Lock()
+	for idx, rp := range nd.RemoteCons {
+		if idx != from && rp.Features.Supports(lnutil.FeatureGossip) {
+			to = append(to, idx)
+		}
+	}
+	nd.RemoteMtx.Unlock()
+
+	for _, idx := range to {
+		go func(m lnutil.LitMsg) {
+			err := nd.SendMsg(m)
+			if err != nil {
+				fmt.Printf("relayGossip: %s\n", err.Error())
+			}
+		}(gossipTo(msg, idx))
+	}
+}
+
+// syncGraph sends a peer that just connected the whole graph, and our
+// signatures for channels with it that aren't announced yet.
+func (nd *LitNode) syncGraph(peerIdx uint32) {
+	chans, err := nd.GraphChans()
+	if err != nil {
+		fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+		return
+	}
+	for _, ann := range chans {
+		err = nd.SendMsg(gossipTo(ann, peerIdx))
+		if err != nil {
+			fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+			return
+		}
+	}
+	updates, err := nd.GraphUpdates()
+	if err != nil {
+		fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+		return
+	}
+	for _, u := range updates {
+		err = nd.SendMsg(gossipTo(u, peerIdx))
+		if err != nil {
+			fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+			return
+		}
+	}
+	nodes, err := nd.GraphNodes()
+	if err != nil {
+		fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+		return
+	}
+	for _, ann := range nodes {
+		err = nd.SendMsg(gossipTo(ann, peerIdx))
+		if err != nil {
+			fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+			return
+		}
+	}
+
+	qcs, err := nd.GetAllQchans()
+	if err != nil {
+		fmt.Printf("syncGraph %d: %s\n", peerIdx, err.Error())
+		return
+	}
+	for _, qc := range qcs {
+		if qc.Peer() != peerIdx || nd.hasChanAnn(qc.Op) {
+			continue
+		}
+		err = nd.sendAnnSigs(qc)
+		if err != nil {
+			fmt.Printf("syncGraph %d: channel %d %s\n",
+				peerIdx, qc.Idx(), err.Error())
+		}
+	}
+}
+
+// graphOPEvent handles events for channels in the graph that aren't ours,
+// and says if it was one.  When they close, they come out of the graph.
+func (nd *LitNode) graphOPEvent(ev lnutil.OutPointEvent) bool {
+	if !nd.hasChanAnn(ev.Op) {
+		return false
+	}
+	if ev.Tx != nil && !ev.Disconnect && !ev.DoubleSpent {
+		nd.graphClose(ev.Op)
+	}
+	return true
+}
+
+// graphClose takes a channel that closed out of the graph
+func (nd *LitNode) graphClose(op wire.OutPoint) {
+	found, err := nd.deleteChanAnn(op)
+	if err != nil {
+		fmt.Printf("graphClose %s: %s\n", op.String(), err.Error())
+		return
+	}
+	if found {
+		fmt.Printf("channel %s closed, out of the graph\n", op.String())
+	}
+}
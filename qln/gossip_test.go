@@ -0,0 +1,189 @@
+package qln
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+func testPub(t *testing.T) (*btcec.PrivateKey, [33]byte) {
+	var pub [33]byte
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(pub[:], priv.PubKey().SerializeCompressed())
+	return priv, pub
+}
+
+// TestNodeAnnSig signs a node announcement, and makes sure changed ones and
+// ones from the future don't check out.
+func TestNodeAnnSig(t *testing.T) {
+	priv, pub := testPub(t)
+	now := time.Now()
+
+	ann := lnutil.NewNodeAnnMsg(0, pub, now.Unix(), "bob", []string{"1.2.3.4:2448"})
+	var err error
+	ann.Sig, err = signAnn(priv, ann.SigHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkNodeAnn(ann, now)
+	if err != nil {
+		t.Fatalf("good announcement: %s", err.Error())
+	}
+	got, err := lnutil.NewNodeAnnMsgFromBytes(ann.Bytes(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkNodeAnn(got, now)
+	if err != nil {
+		t.Fatalf("parsed announcement: %s", err.Error())
+	}
+
+	changed := ann
+	changed.Addrs = []string{"6.6.6.6:2448"}
+	if checkNodeAnn(changed, now) == nil {
+		t.Fatalf("changed announcement checked out")
+	}
+
+	ann.Timestamp = now.Add(2 * maxAnnFuture).Unix()
+	ann.Sig, err = signAnn(priv, ann.SigHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkNodeAnn(ann, now) == nil {
+		t.Fatalf("announcement from the future checked out")
+	}
+}
+
+func testChanAnn(a, b [33]byte, n uint32) lnutil.ChanAnnMsg {
+	pubs, _ := sortedPubs(a, b)
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: n}, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000000, []byte{0x00, 0x20}))
+	op := wire.OutPoint{Hash: tx.TxHash()}
+	ann := lnutil.NewChanAnnMsg(0, 1, op, 1000000, pubs, pubs)
+	ann.FundTx = tx
+	return ann
+}
+
+// TestGraph saves and deletes announcements in the graph, and makes sure
+// nodes are only kept while they have channels.
+func TestGraph(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nd := new(LitNode)
+	nd.IdentityKey, _ = testPub(t)
+	err = nd.OpenDB(filepath.Join(dir, "ln.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nd.LitDB.Close()
+
+	_, alice := testPub(t)
+	_, bob := testPub(t)
+	_, carol := testPub(t)
+	ab := testChanAnn(alice, bob, 1)
+	bc := testChanAnn(bob, carol, 2)
+
+	_, err = nd.saveNodeAnn(lnutil.NewNodeAnnMsg(0, bob, 10, "bob", nil))
+	if err == nil {
+		t.Fatalf("saved node without channels")
+	}
+	// we don't need channels to announce ourselves
+	isNew, err := nd.saveNodeAnn(lnutil.NewNodeAnnMsg(0, nd.idPub(), 10, "me", nil))
+	if err != nil || !isNew {
+		t.Fatalf("save our node: %v %v", isNew, err)
+	}
+
+	for _, ann := range []lnutil.ChanAnnMsg{ab, bc} {
+		isNew, err = nd.saveChanAnn(ann)
+		if err != nil || !isNew {
+			t.Fatalf("save channel: %v %v", isNew, err)
+		}
+	}
+	isNew, err = nd.saveChanAnn(ab)
+	if err != nil || isNew {
+		t.Fatalf("save channel again: %v %v", isNew, err)
+	}
+
+	u := lnutil.NewChanUpdateMsg(0, ab.Outpoint, 10, 1, 1, 100, 10)
+	for _, c := range []struct {
+		ts  int64
+		new bool
+	}{{10, true}, {9, false}, {11, true}} {
+		u.Timestamp = c.ts
+		isNew, err = nd.saveChanUpdate(u)
+		if err != nil || isNew != c.new {
+			t.Fatalf("save update at %d: %v %v, expect %v", c.ts, isNew, err, c.new)
+		}
+	}
+	_, err = nd.saveChanUpdate(lnutil.NewChanUpdateMsg(0, wire.OutPoint{}, 10, 0, 1, 100, 10))
+	if err == nil {
+		t.Fatalf("saved update without a channel")
+	}
+
+	for _, c := range []struct {
+		ts  int64
+		new bool
+	}{{10, true}, {9, false}, {10, false}, {11, true}} {
+		isNew, err = nd.saveNodeAnn(lnutil.NewNodeAnnMsg(0, bob, c.ts, "bob", nil))
+		if err != nil || isNew != c.new {
+			t.Fatalf("save bob at %d: %v %v, expect %v", c.ts, isNew, err, c.new)
+		}
+	}
+
+	chans, err := nd.GraphChans()
+	if err != nil || len(chans) != 2 {
+		t.Fatalf("%d channels, %v", len(chans), err)
+	}
+	nodes, err := nd.GraphNodes()
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("%d nodes, %v", len(nodes), err)
+	}
+	updates, err := nd.GraphUpdates()
+	if err != nil || len(updates) != 1 || updates[0].Timestamp != 11 {
+		t.Fatalf("updates %v, %v", updates, err)
+	}
+
+	// bob's still in bc
+	found, err := nd.deleteChanAnn(ab.Outpoint)
+	if err != nil || !found {
+		t.Fatalf("delete ab: %v %v", found, err)
+	}
+	got, err := nd.getChanUpdate(ab.Outpoint, 1)
+	if err != nil || got != nil {
+		t.Fatalf("ab update after deleting ab: %v %v", got, err)
+	}
+	ann, err := nd.getNodeAnn(bob)
+	if err != nil || ann == nil || ann.Timestamp != 11 {
+		t.Fatalf("bob after deleting ab: %v %v", ann, err)
+	}
+
+	found, err = nd.deleteChanAnn(bc.Outpoint)
+	if err != nil || !found {
+		t.Fatalf("delete bc: %v %v", found, err)
+	}
+	ann, err = nd.getNodeAnn(bob)
+	if err != nil || ann != nil {
+		t.Fatalf("bob after deleting bc: %v %v", ann, err)
+	}
+	if nd.hasChanAnn(bc.Outpoint) {
+		t.Fatalf("bc still there")
+	}
+	found, err = nd.deleteChanAnn(bc.Outpoint)
+	if err != nil || found {
+		t.Fatalf("delete bc again: %v %v", found, err)
+	}
+}
@@ -0,0 +1,298 @@
+package qln
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/adiabat/btcd/wire"
+	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+The graph is every channel and node we've heard about through gossip,
+ours included.  It's kept as the announcements themselves, checked before
+they're saved:
+
+GraphChans
+|- outpoint (36) : channel announcement
+
+GraphNodes
+|- pubkey (33) : node announcement
+
+GraphFees
+|- outpoint (36), node (1) : channel update
+
+Nodes are only kept while they have a channel in the graph, so anyone
+announcing a node has to have paid for a channel first.  Channel updates
+need their channel too.  When a channel closes, it's taken out with its
+updates, and so are its nodes if that was their last one.
+*/
+
+// saveChanAnn saves a channel announcement, and says if it's new
+func (nd *LitNode) saveChanAnn(ann lnutil.ChanAnnMsg) (bool, error) {
+	opArr := lnutil.OutPointToBytes(ann.Outpoint)
+	isNew := false
+	err := nd.LitDB.Update(func(btx *bolt.Tx) error {
+		bkt := btx.Bucket(BKTGraphChans)
+		if bkt.Get(opArr[:]) != nil {
+			return nil
+		}
+		isNew = true
+		return bkt.Put(opArr[:], ann.Bytes())
+	})
+	return isNew, err
+}
+
+// getChanAnn gets a channel's announcement, if it's in the graph
+func (nd *LitNode) getChanAnn(op wire.OutPoint) (*lnutil.ChanAnnMsg, error) {
+	opArr := lnutil.OutPointToBytes(op)
+	var ann *lnutil.ChanAnnMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(BKTGraphChans).Get(opArr[:])
+		if b == nil {
+			return nil
+		}
+		a, err := lnutil.NewChanAnnMsgFromBytes(b, 0)
+		if err != nil {
+			return err
+		}
+		ann = &a
+		return nil
+	})
+	return ann, err
+}
+
+// hasChanAnn says if a channel's in the graph
+func (nd *LitNode) hasChanAnn(op wire.OutPoint) bool {
+	opArr := lnutil.OutPointToBytes(op)
+	found := false
+	_ = nd.LitDB.View(func(btx *bolt.Tx) error {
+		found = btx.Bucket(BKTGraphChans).Get(opArr[:]) != nil
+		return nil
+	})
+	return found
+}
+
+// deleteChanAnn takes a closed channel out of the graph, along with nodes
+// other than us that have no channels left.  Says if it was there.
+func (nd *LitNode) deleteChanAnn(op wire.OutPoint) (bool, error) {
+	opArr := lnutil.OutPointToBytes(op)
+	us := nd.idPub()
+	found := false
+	err := nd.LitDB.Update(func(btx *bolt.Tx) error {
+		chans := btx.Bucket(BKTGraphChans)
+		b := chans.Get(opArr[:])
+		if b == nil {
+			return nil
+		}
+		found = true
+		ann, err := lnutil.NewChanAnnMsgFromBytes(b, 0)
+		if err != nil {
+			return err
+		}
+		err = chans.Delete(opArr[:])
+		if err != nil {
+			return err
+		}
+		fees := btx.Bucket(BKTGraphFees)
+		for i := byte(0); i < 2; i++ {
+			err = fees.Delete(append(opArr[:], i))
+			if err != nil {
+				return err
+			}
+		}
+		nodes := btx.Bucket(BKTGraphNodes)
+		for _, pub := range ann.NodePub {
+			if pub == us {
+				continue
+			}
+			has, err := nodeHasChan(chans, pub)
+			if err != nil {
+				return err
+			}
+			if !has {
+				err = nodes.Delete(pub[:])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// nodeHasChan says if a node has a channel in the graph
+func nodeHasChan(chans *bolt.Bucket, pub [33]byte) (bool, error) {
+	found := false
+	err := chans.ForEach(func(k, v []byte) error {
+		if found {
+			return nil
+		}
+		ann, err := lnutil.NewChanAnnMsgFromBytes(v, 0)
+		if err != nil {
+			return err
+		}
+		found = ann.NodePub[0] == pub || ann.NodePub[1] == pub
+		return nil
+	})
+	return found, err
+}
+
+// saveNodeAnn saves a node announcement if it's newer than the one we
+// have, and says if it was.  Nodes without channels aren't saved, except
+// for us.
+func (nd *LitNode) saveNodeAnn(ann lnutil.NodeAnnMsg) (bool, error) {
+	isNew := false
+	err := nd.LitDB.Update(func(btx *bolt.Tx) error {
+		if ann.Pub != nd.idPub() {
+			has, err := nodeHasChan(btx.Bucket(BKTGraphChans), ann.Pub)
+			if err != nil {
+				return err
+			}
+			if !has {
+				return fmt.Errorf("node %s has no channels",
+					lnutil.LitAdrFromPubkey(ann.Pub))
+			}
+		}
+		nodes := btx.Bucket(BKTGraphNodes)
+		b := nodes.Get(ann.Pub[:])
+		if b != nil {
+			old, err := lnutil.NewNodeAnnMsgFromBytes(b, 0)
+			if err == nil && old.Timestamp >= ann.Timestamp {
+				return nil
+			}
+		}
+		isNew = true
+		return nodes.Put(ann.Pub[:], ann.Bytes())
+	})
+	return isNew, err
+}
+
+// saveChanUpdate saves a channel update if its channel's in the graph and
+// it's newer than the one we have, and says if it was.
+func (nd *LitNode) saveChanUpdate(u lnutil.ChanUpdateMsg) (bool, error) {
+	opArr := lnutil.OutPointToBytes(u.Outpoint)
+	key := append(opArr[:], u.Node)
+	isNew := false
+	err := nd.LitDB.Update(func(btx *bolt.Tx) error {
+		if btx.Bucket(BKTGraphChans).Get(opArr[:]) == nil {
+			return fmt.Errorf("ChanUpdate for %s, not in graph",
+				u.Outpoint.String())
+		}
+		fees := btx.Bucket(BKTGraphFees)
+		b := fees.Get(key)
+		if b != nil {
+			old, err := lnutil.NewChanUpdateMsgFromBytes(b, 0)
+			if err == nil && old.Timestamp >= u.Timestamp {
+				return nil
+			}
+		}
+		isNew = true
+		return fees.Put(key, u.Bytes())
+	})
+	return isNew, err
+}
+
+// getChanUpdate gets one side of a channel's update, if we have it
+func (nd *LitNode) getChanUpdate(op wire.OutPoint, node uint8) (
+	*lnutil.ChanUpdateMsg, error) {
+	opArr := lnutil.OutPointToBytes(op)
+	var u *lnutil.ChanUpdateMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(BKTGraphFees).Get(append(opArr[:], node))
+		if b == nil {
+			return nil
+		}
+		got, err := lnutil.NewChanUpdateMsgFromBytes(b, 0)
+		if err != nil {
+			return err
+		}
+		u = &got
+		return nil
+	})
+	return u, err
+}
+
+// getNodeAnn gets a node's announcement, if it's in the graph
+func (nd *LitNode) getNodeAnn(pub [33]byte) (*lnutil.NodeAnnMsg, error) {
+	var ann *lnutil.NodeAnnMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(BKTGraphNodes).Get(pub[:])
+		if b == nil {
+			return nil
+		}
+		a, err := lnutil.NewNodeAnnMsgFromBytes(b, 0)
+		if err != nil {
+			return err
+		}
+		ann = &a
+		return nil
+	})
+	return ann, err
+}
+
+// GraphChans returns the announcements for every channel in the graph
+func (nd *LitNode) GraphChans() ([]lnutil.ChanAnnMsg, error) {
+	var anns []lnutil.ChanAnnMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKTGraphChans).ForEach(func(k, v []byte) error {
+			ann, err := lnutil.NewChanAnnMsgFromBytes(v, 0)
+			if err != nil {
+				return err
+			}
+			anns = append(anns, ann)
+			return nil
+		})
+	})
+	return anns, err
+}
+
+// GraphNodes returns the announcements for every node in the graph
+func (nd *LitNode) GraphNodes() ([]lnutil.NodeAnnMsg, error) {
+	var anns []lnutil.NodeAnnMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKTGraphNodes).ForEach(func(k, v []byte) error {
+			ann, err := lnutil.NewNodeAnnMsgFromBytes(v, 0)
+			if err != nil {
+				return err
+			}
+			anns = append(anns, ann)
+			return nil
+		})
+	})
+	return anns, err
+}
+
+// GraphUpdates returns the channel updates for channels in the graph
+func (nd *LitNode) GraphUpdates() ([]lnutil.ChanUpdateMsg, error) {
+	var us []lnutil.ChanUpdateMsg
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKTGraphFees).ForEach(func(k, v []byte) error {
+			u, err := lnutil.NewChanUpdateMsgFromBytes(v, 0)
+			if err != nil {
+				return err
+			}
+			us = append(us, u)
+			return nil
+		})
+	})
+	return us, err
+}
+
+// idPub is our identity pubkey
+func (nd *LitNode) idPub() [33]byte {
+	var pub [33]byte
+	copy(pub[:], nd.IdKey().PubKey().SerializeCompressed())
+	return pub
+}
+
+// sortedPubs puts two nodes' pubkeys in graph order, and says which
+// place a ended up in.
+func sortedPubs(a, b [33]byte) ([2][33]byte, int) {
+	if bytes.Compare(a[:], b[:]) < 0 {
+		return [2][33]byte{a, b}, 0
+	}
+	return [2][33]byte{b, a}, 1
+}
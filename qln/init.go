@@ -10,6 +10,7 @@ import (
 	"github.com/boltdb/bolt"
 	"github.com/mit-dci/lit/lnutil"
 	"github.com/mit-dci/lit/portxo"
+	"github.com/mit-dci/lit/routing"
 	"github.com/mit-dci/lit/wallit"
 )
 
@@ -25,6 +26,10 @@ func NewLitNode(privKey *[32]byte, path string, tower bool) (*LitNode, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = nd.loadPeerPolicy()
+	if err != nil {
+		return nil, err
+	}
 
 	// Maybe make a new parameter set for "LN".. meh
 	rootPrivKey, err := hdkeychain.NewMaster(privKey[:], &chaincfg.TestNet3Params)
@@ -75,13 +80,16 @@ func NewLitNode(privKey *[32]byte, path string, tower bool) (*LitNode, error) {
 	nd.InProg.done = make(chan uint32, 1)
 
 	nd.RemoteCons = make(map[uint32]*RemotePeer)
+	nd.connStates = make(map[uint32]*peerConnState)
+	nd.ipConns = make(ipLimiter)
+	nd.tempPeers = make(map[[33]byte]uint32)
+
+	nd.Router = routing.NewRouter()
 
 	nd.SubWallet = make(map[uint32]UWallet)
 
-	nd.OmniOut = make(chan lnutil.LitMsg, 10)
 	nd.OmniIn = make(chan lnutil.LitMsg, 10)
 	//	go nd.OmniHandler()
-	go nd.OutMessager()
 
 	return nd, nil
 }
@@ -112,7 +120,44 @@ func (nd *LitNode) LinkBaseWallet(
 	// if there aren't, Multiwallet will still be false; set new wallit to
 	// be the first & default
 	nd.SubWallet[WallitIdx] = wallit.NewWallit(
-		rootpriv, birthHeight, resync, host, nd.LitFolder, param)
+		rootpriv, birthHeight, resync, host, nd.LitFolder, param, nd.Dialer)
+
+	go nd.OPEventHandler(nd.SubWallet[WallitIdx].LetMeKnow())
+
+	if !nd.MultiWallet {
+		nd.DefaultCoin = param.HDCoinType
+	}
+
+	return nil
+}
+
+// LinkWatchOnlyWallet activates a wallet with no private keys, built from an
+// account level extended public key, and hooks it into the litnode.
+func (nd *LitNode) LinkWatchOnlyWallet(
+	xpub string, birthHeight int32, resync bool,
+	host string, param *chaincfg.Params) error {
+
+	acctPub, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		return err
+	}
+
+	WallitIdx := param.HDCoinType
+
+	if nd.SubWallet[WallitIdx] != nil {
+		return fmt.Errorf("coin type %d already linked", WallitIdx)
+	}
+
+	if len(nd.SubWallet) != 0 {
+		nd.MultiWallet = true
+	}
+
+	wal, err := wallit.NewWatchOnlyWallit(
+		acctPub, birthHeight, resync, host, nd.LitFolder, param, nd.Dialer)
+	if err != nil {
+		return err
+	}
+	nd.SubWallet[WallitIdx] = wal
 
 	go nd.OPEventHandler(nd.SubWallet[WallitIdx].LetMeKnow())
 
@@ -169,6 +214,19 @@ func (nd *LitNode) OpenDB(filename string) error {
 			return err
 		}
 
+		_, err = btx.CreateBucketIfNotExists(BKTGraphChans)
+		if err != nil {
+			return err
+		}
+		_, err = btx.CreateBucketIfNotExists(BKTGraphNodes)
+		if err != nil {
+			return err
+		}
+		_, err = btx.CreateBucketIfNotExists(BKTGraphFees)
+		if err != nil {
+			return err
+		}
+
 		return nil
 	})
 	if err != nil {
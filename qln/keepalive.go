@@ -0,0 +1,48 @@
+package qln
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+Keepalive: peers with the keepalive feature get a ping every pingInterval,
+and reads from them have a deadline of deadPeerTimeout, pushed back every
+time a message comes in.  A peer that's gone without closing the connection
+(behind a NAT that timed out, say) misses the deadline, and LNDCReader drops
+it the same as on any other read error: it's taken out of RemoteCons and
+handed to the connection manager to redial.
+
+Peers without the feature aren't pinged, and their reads don't time out.
+*/
+
+const (
+	pingInterval    = time.Second * 30
+	deadPeerTimeout = pingInterval * 3
+)
+
+// keepAlive pings a peer every pingInterval, until its connection's gone
+func (nd *LitNode) keepAlive(peer *RemotePeer) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-peer.quit:
+			return
+		case <-ticker.C:
+		}
+		err := nd.SendMsg(
+			lnutil.NewPingMsg(peer.PeerIdx(), uint64(time.Now().UnixNano())))
+		if err != nil {
+			fmt.Printf("keepAlive: %s\n", err.Error())
+		}
+	}
+}
+
+// PingHandler replies to a ping.  There's nothing to do with pongs; any
+// message from the peer pushes back the read deadline.
+func (nd *LitNode) PingHandler(msg lnutil.PingMsg) error {
+	return nd.SendMsg(lnutil.NewPongMsg(msg.Peer(), msg.Nonce))
+}
@@ -38,6 +38,8 @@ type Qchan struct {
 
 	Delay uint16 // blocks for timeout (default 5 for testing)
 
+	Account uint32 // S wallet account that funded it; closes go back there
+
 	State *StatCom // S current state of channel
 
 	ClearToSend chan bool // send a true here when you get a rev
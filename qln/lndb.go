@@ -3,6 +3,7 @@ package qln
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/adiabat/btcd/btcec"
 	"github.com/adiabat/btcd/wire"
@@ -11,6 +12,7 @@ import (
 	"github.com/mit-dci/lit/elkrem"
 	"github.com/mit-dci/lit/lndc"
 	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/routing"
 	"github.com/mit-dci/lit/watchtower"
 )
 
@@ -101,13 +103,31 @@ type LitNode struct {
 
 	RemoteCons map[uint32]*RemotePeer
 	RemoteMtx  sync.Mutex
+	// inboundSlots is how many incoming peers checkInbound let in that
+	// aren't in RemoteCons yet.  RemoteMtx covers it.
+	inboundSlots int
+
+	// connection manager state of peers we're keeping connected; see
+	// connmgr.go
+	connStates map[uint32]*peerConnState
+	connMtx    sync.Mutex
+
+	// who can connect; see policy.go.  policyMtx also covers ipConns
+	// and the temporary peer indexes.
+	policy      PeerPolicy
+	ipConns     ipLimiter
+	tempPeers   map[[33]byte]uint32
+	nextTempIdx uint32
+	policyMtx   sync.Mutex
+
+	// Router finds routes over the graph, and remembers failures
+	Router *routing.Router
 
 	// WatchCon is currently just for the watchtower
 	WatchCon *lndc.LNDConn // merge these later
 
 	// OmniChan is the channel for the OmniHandler
-	OmniIn  chan lnutil.LitMsg
-	OmniOut chan lnutil.LitMsg
+	OmniIn chan lnutil.LitMsg
 
 	// the current channel that in the process of being created
 	// (1 at a time for now)
@@ -121,14 +141,38 @@ type LitNode struct {
 
 	// The port(s) in which it listens for incoming connections
 	LisIpPorts []string
+
+	// Dialer makes outgoing connections, to peers and full nodes.  nil
+	// dials directly; set it before linking wallets or dialing peers.
+	Dialer lnutil.Dialer
+
+	// LegacyConn dials peers with the old lndc handshake, and lets in
+	// peers using it.  Otherwise it's Noise_XK only.
+	LegacyConn bool
 }
 
 type RemotePeer struct {
-	Idx      uint32 // the peer index
+	Idx      uint32 // the peer index; can change, see PeerIdx
 	Nickname string
 	Con      *lndc.LNDConn
 	QCs      map[uint32]*Qchan   // keep map of all peer's channels in ram
 	OpMap    map[[36]byte]uint32 // quick lookup for channels
+	Features lnutil.Features     // from their init message
+	Inbound  bool                // they connected to us
+	slot     bool                // holds an inbound slot till it's in RemoteCons
+
+	// firstMsg is a message an old node sent instead of init, for readMsg
+	firstMsg []byte
+
+	outbox chan outMsg   // messages waiting to be written; see outqueue.go
+	quit   chan struct{} // closed when the connection's dropped
+}
+
+// PeerIdx returns the peer's index.  persistPeer changes it when a peer with
+// a temporary index gets saved, while the peer's goroutines are running, so
+// they read it with this.
+func (peer *RemotePeer) PeerIdx() uint32 {
+	return atomic.LoadUint32(&peer.Idx)
 }
 
 // InFlightFund is a funding transaction that has not yet been broadcast
@@ -136,6 +180,8 @@ type InFlightFund struct {
 	PeerIdx, ChanIdx, Coin uint32
 	Amt, InitSend          int64
 
+	Account uint32 // wallet account to fund from
+
 	op *wire.OutPoint
 
 	done chan uint32
@@ -149,6 +195,7 @@ func (inff *InFlightFund) Clear() {
 
 	inff.Amt = 0
 	inff.InitSend = 0
+	inff.Account = 0
 }
 
 // GetPubHostFromPeerIdx gets the pubkey and internet host name for a peer
@@ -391,6 +438,13 @@ func (nd *LitNode) SaveQChan(q *Qchan) error {
 		if err != nil {
 			return err
 		}
+		// no account means account 0, like channels from before accounts
+		if q.Account != 0 {
+			err = qcBucket.Put(KEYAccount, lnutil.U32tB(q.Account))
+			if err != nil {
+				return err
+			}
+		}
 
 		// also save all state; maybe there isn't any ..?
 		// serialize elkrem receiver if it exists
@@ -447,6 +501,10 @@ func (nd *LitNode) RestoreQchanFromBucket(bkt *bolt.Bucket) (*Qchan, error) {
 	if err != nil {
 		return nil, err
 	}
+	acctBytes := bkt.Get(KEYAccount)
+	if acctBytes != nil {
+		qc.Account = lnutil.BtU32(acctBytes)
+	}
 
 	// get my channel pubkey
 	qc.MyPub, _ = nd.GetUsePub(qc.KeyGen, UseChannelFund)
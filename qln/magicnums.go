@@ -24,13 +24,21 @@ var (
 	BKTPeerMap = []byte("pmp") // map of peer index to pubkey
 	BKTChanMap = []byte("cmp") // map of channel index to outpoint
 	BKTWatch   = []byte("wch") // txids & signatures for export to watchtowers
+	BKTPolicy  = []byte("pol") // settings for who can connect
+
+	BKTGraphChans = []byte("gch") // channel announcements by outpoint
+	BKTGraphNodes = []byte("gnd") // node announcements by pubkey
+	BKTGraphFees  = []byte("gfe") // channel updates by outpoint and node
 
 	KEYIdx      = []byte("idx")  // index for key derivation
 	KEYhost     = []byte("hst")  // hostname where peer lives
 	KEYnickname = []byte("nick") // nickname where peer lives
 
+	KEYPeerPolicy = []byte("peer") // PeerPolicy, as json
+
 	KEYutxo    = []byte("utx") // serialized utxo for the channel
 	KEYState   = []byte("now") // channel state
 	KEYElkRecv = []byte("elk") // elkrem receiver
 	KEYqclose  = []byte("cls") // channel close outpoint & height
+	KEYAccount = []byte("act") // wallet account the channel's funded from
 )
@@ -2,6 +2,7 @@ package qln
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mit-dci/lit/lnutil"
 )
@@ -9,14 +10,22 @@ import (
 // handles stuff that comes in over the wire.  Not user-initiated.
 func (nd *LitNode) PeerHandler(msg lnutil.LitMsg, q *Qchan, peer *RemotePeer) error {
 	switch msg.MsgType() & 0xf0 {
-	case 0x00: // TEXT MESSAGE.  SIMPLE
-		chat, ok := msg.(lnutil.ChatMsg)
-		if !ok {
-			return fmt.Errorf("can't cast to chat message")
+	case 0x00:
+		switch m := msg.(type) {
+		case lnutil.ChatMsg: // TEXT MESSAGE.  SIMPLE
+			nd.UserMessageBox <- fmt.Sprintf(
+				"\nmsg from %s: %s", lnutil.White(msg.Peer()), lnutil.Green(m.Text))
+			return nil // no error
+		case lnutil.InitMsg:
+			// already got theirs when they connected
+			return fmt.Errorf("init message from %d after connecting", msg.Peer())
+		case lnutil.PingMsg:
+			return nd.PingHandler(m)
+		case lnutil.PongMsg:
+			return nil
+		default:
+			return fmt.Errorf("can't cast message type %x", msg.MsgType())
 		}
-		nd.UserMessageBox <- fmt.Sprintf(
-			"\nmsg from %s: %s", lnutil.White(msg.Peer()), lnutil.Green(chat.Text))
-		return nil // no error
 
 	case 0x10: //Making Channel, or using
 		return nd.ChannelHandler(msg, peer)
@@ -46,6 +55,9 @@ func (nd *LitNode) PeerHandler(msg lnutil.LitMsg, q *Qchan, peer *RemotePeer) er
 		}
 		return nd.Tower.HandleMessage(msg)
 
+	case 0x70: // Gossip
+		return nd.GossipHandler(msg)
+
 	default:
 		return fmt.Errorf("Unknown message id byte %x &f0", msg.MsgType())
 
@@ -63,6 +75,7 @@ func (nd *LitNode) LNDCReader(peer *RemotePeer) error {
 	// have this as a separate func to drop extra channels from mem
 	err := nd.PopulateQchanMap(peer)
 	if err != nil {
+		nd.dropPeer(peer)
 		return err
 	}
 	var opArr [36]byte
@@ -74,25 +87,33 @@ func (nd *LitNode) LNDCReader(peer *RemotePeer) error {
 		peer.OpMap[opArr] = q.Idx()
 	}
 
+	keepalive := peer.Features.Supports(lnutil.FeatureKeepalive)
+	if keepalive {
+		go nd.keepAlive(peer)
+	}
+
 	for {
-		msg := make([]byte, 65535)
+		if keepalive {
+			// only errors if the connection's closed, which Read finds
+			peer.Con.SetReadDeadline(time.Now().Add(deadPeerTimeout))
+		}
 		//	fmt.Printf("read message from %x\n", l.RemoteLNId)
-		n, err := peer.Con.Read(msg)
+		msg, err := peer.readMsg()
 		if err != nil {
-			fmt.Printf("read error with %d: %s\n", peer.Idx, err.Error())
-			nd.RemoteMtx.Lock()
-			delete(nd.RemoteCons, peer.Idx)
-			nd.RemoteMtx.Unlock()
-			return peer.Con.Close()
+			fmt.Printf("read error with %d: %s\n", peer.PeerIdx(), err.Error())
+			nd.dropPeer(peer)
+			return err
 		}
-		msg = msg[:n]
 
 		fmt.Printf("decrypted message is %x\n", msg)
 
 		var routedMsg lnutil.LitMsg
-		routedMsg, err = lnutil.LitMsgFromBytes(msg, peer.Idx)
+		routedMsg, err = lnutil.LitMsgFromBytes(msg, peer.PeerIdx())
 		if err != nil {
-			return err
+			// keep reading; returning would leave the peer connected
+			// with nothing reading from it
+			fmt.Printf("message from %d: %s\n", peer.PeerIdx(), err.Error())
+			continue
 		}
 
 		fmt.Printf("peerIdx is %d\n", routedMsg.Peer())
@@ -119,11 +140,28 @@ func (nd *LitNode) LNDCReader(peer *RemotePeer) error {
 		}
 
 		if err != nil {
-			fmt.Printf("PeerHandler error with %d: %s\n", peer.Idx, err.Error())
+			fmt.Printf("PeerHandler error with %d: %s\n", peer.PeerIdx(), err.Error())
 		}
 	}
 }
 
+// dropPeer takes a connection that's done out of RemoteCons, and stops its
+// writer, which closes it.  The peer may have connected again already, in
+// which case the new connection's left alone.
+func (nd *LitNode) dropPeer(peer *RemotePeer) {
+	nd.RemoteMtx.Lock()
+	peerIdx := peer.PeerIdx()
+	replaced := nd.RemoteCons[peerIdx] != peer
+	if !replaced {
+		delete(nd.RemoteCons, peerIdx)
+	}
+	nd.RemoteMtx.Unlock()
+	close(peer.quit)
+	if !replaced {
+		nd.peerDown(peerIdx)
+	}
+}
+
 func (nd *LitNode) PopulateQchanMap(peer *RemotePeer) error {
 	allQs, err := nd.GetAllQchans()
 	if err != nil {
@@ -133,7 +171,7 @@ func (nd *LitNode) PopulateQchanMap(peer *RemotePeer) error {
 	peer.QCs = make(map[uint32]*Qchan)
 	// populate from all channels (inefficient)
 	for i, q := range allQs {
-		if q.Peer() == peer.Idx {
+		if q.Peer() == peer.PeerIdx() {
 			peer.QCs[q.Idx()] = allQs[i]
 		}
 	}
@@ -215,6 +253,10 @@ func (nd *LitNode) PushPullHandler(routedMsg lnutil.LitMsg, q *Qchan) error {
 		fmt.Printf("Got REV from %x\n", routedMsg.Peer())
 		return nd.RevHandler(message, q)
 
+	case lnutil.ReestablishMsg: // AFTER RECONNECTING
+		fmt.Printf("Got REESTABLISH from %x\n", routedMsg.Peer())
+		return nd.ReestablishHandler(message, q)
+
 	default:
 		return fmt.Errorf("Unknown message type %x", routedMsg.MsgType())
 
@@ -237,7 +279,7 @@ func (nd *LitNode) SelfPushHandler(msg lnutil.LitMsg) error { // not yet impleme
 }
 
 // OPEventHandler gets outpoint events from the base wallet,
-// and modifies the ln node db to reflect confirmations.  Can also respond
+// and modifies the ln node db to reflect confirmations and reorgs.  Can also respond
 // with exporting txos to the base wallet, or penalty txs.
 func (nd *LitNode) OPEventHandler(OPEventChan chan lnutil.OutPointEvent) {
 	for {
@@ -256,11 +298,51 @@ func (nd *LitNode) OPEventHandler(OPEventChan chan lnutil.OutPointEvent) {
 		}
 		// end if no associated channel
 		if theQ == nil {
+			if nd.graphOPEvent(curOPEvent) {
+				continue
+			}
 			fmt.Printf("OPEvent %s doesn't match any channel\n",
 				curOPEvent.Op.String())
 			continue
 		}
 
+		// reorg event; un-close and un-confirm if it happened in the
+		// blocks that are gone.  If the txs get mined again, there'll be
+		// new events for them.
+		if curOPEvent.Disconnect {
+			changed := false
+			if theQ.CloseData.Closed &&
+				theQ.CloseData.CloseHeight >= curOPEvent.Height {
+				fmt.Printf("OP %s close tx %s reorged out, un-closing\n",
+					curOPEvent.Op.String(), theQ.CloseData.CloseTxid.String())
+				theQ.CloseData = QCloseData{}
+				changed = true
+			}
+			if theQ.Height >= curOPEvent.Height {
+				fmt.Printf("OP %s confirmation at %d reorged out\n",
+					curOPEvent.Op.String(), theQ.Height)
+				theQ.Height = 0
+				changed = true
+			}
+			if changed {
+				err = nd.SaveQchanUtxoData(theQ)
+				if err != nil {
+					fmt.Printf("SaveQchanUtxoData error: %s", err.Error())
+				}
+			}
+			continue
+		}
+
+		// the funding tx got double spent, so the channel isn't going to
+		// open.  Nothing to do but tell the user.
+		if curOPEvent.DoubleSpent {
+			fmt.Printf("WARNING: channel (%d,%d) funding tx %s double spent "+
+				"by %s; the channel won't open\n",
+				theQ.Peer(), theQ.Idx(), curOPEvent.Op.Hash.String(),
+				curOPEvent.Tx.TxHash().String())
+			continue
+		}
+
 		// confirmation event
 		if curOPEvent.Tx == nil {
 			fmt.Printf("OP %s Confirmation event\n", curOPEvent.Op.String())
@@ -270,6 +352,12 @@ func (nd *LitNode) OPEventHandler(OPEventChan chan lnutil.OutPointEvent) {
 				fmt.Printf("SaveQchanUtxoData error: %s", err.Error())
 				continue
 			}
+			go func(q *Qchan) {
+				err := nd.sendAnnSigs(q)
+				if err != nil {
+					fmt.Printf("sendAnnSigs error: %s\n", err.Error())
+				}
+			}(theQ)
 			// spend event (note: happens twice!)
 		} else {
 			fmt.Printf("OP %s Spend event\n", curOPEvent.Op.String())
@@ -282,6 +370,7 @@ func (nd *LitNode) OPEventHandler(OPEventChan chan lnutil.OutPointEvent) {
 				fmt.Printf("SaveQchanUtxoData error: %s", err.Error())
 				continue
 			}
+			nd.graphClose(theQ.Op)
 
 			// detect close tx outs.
 			txos, err := theQ.GetCloseTxos(curOPEvent.Tx)
@@ -309,7 +398,7 @@ func (nd *LitNode) OPEventHandler(OPEventChan chan lnutil.OutPointEvent) {
 						privBase, elkScalar[:])
 				}
 				// make this concurrent to avoid circular locking
-				go nd.SubWallet[theQ.Coin()].ExportUtxo(&portxo)
+				go nd.SubWallet[theQ.Coin()].ExportUtxo(&portxo, theQ.Account)
 			}
 		}
 	}
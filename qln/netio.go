@@ -3,6 +3,8 @@ package qln
 import (
 	"fmt"
 	"log"
+	"net"
+	"time"
 
 	"github.com/adiabat/btcd/btcec"
 	"github.com/mit-dci/lit/lndc"
@@ -35,6 +37,8 @@ func (nd *LitNode) TCPListener(
 	if err != nil {
 		return "", err
 	}
+	listener.Legacy = nd.LegacyConn
+	listener.Allow = nd.allowConnFrom
 
 	var idPub [33]byte
 	copy(idPub[:], idPriv.PubKey().SerializeCompressed())
@@ -42,42 +46,21 @@ func (nd *LitNode) TCPListener(
 	adr := lnutil.LitAdrFromPubkey(idPub)
 
 	fmt.Printf("Listening on %s\n", listener.Addr().String())
+	if lnutil.IsOnion(lisIpPort) {
+		fmt.Printf("for hidden service %s\n", lisIpPort)
+	}
 	fmt.Printf("Listening with ln address: %s \n", adr)
 
 	go func() {
 		for {
-			netConn, err := listener.Accept() // this blocks
+			netConn, err := listener.AcceptRaw() // this blocks
 			if err != nil {
 				log.Printf("Listener error: %s\n", err.Error())
 				continue
 			}
-			newConn, ok := netConn.(*lndc.LNDConn)
-			if !ok {
-				fmt.Printf("Got something that wasn't a LNDC")
-				continue
-			}
-			fmt.Printf("Incomming connection from %x on %s\n",
-				newConn.RemotePub.SerializeCompressed(), newConn.RemoteAddr().String())
-
-			// don't save host/port for incomming connections
-			peerIdx, err := nd.GetPeerIdx(newConn.RemotePub, "")
-			if err != nil {
-				log.Printf("Listener error: %s\n", err.Error())
-				continue
-			}
-
-			nickname := nd.GetNicknameFromPeerIdx(peerIdx)
-
-			nd.RemoteMtx.Lock()
-			var peer RemotePeer
-			peer.Idx = peerIdx
-			peer.Con = newConn
-			peer.Nickname = nickname
-			nd.RemoteCons[peerIdx] = &peer
-			nd.RemoteMtx.Unlock()
-
-			// each connection to a peer gets its own LNDCReader
-			go nd.LNDCReader(&peer)
+			// the handshake and init exchange can take a while; don't
+			// hold up others
+			go nd.acceptPeer(listener, netConn)
 		}
 	}()
 	nd.RemoteMtx.Lock()
@@ -86,6 +69,183 @@ func (nd *LitNode) TCPListener(
 	return adr, nil
 }
 
+// acceptPeer does the handshake on an incoming connection, and sets it up
+func (nd *LitNode) acceptPeer(listener *lndc.Listener, netConn net.Conn) {
+	newConn, err := listener.Handshake(netConn)
+	if err != nil {
+		log.Printf("Listener error: %s\n", err.Error())
+		return
+	}
+
+	fmt.Printf("Incomming connection from %x on %s\n",
+		newConn.RemotePub.SerializeCompressed(), newConn.RemoteAddr().String())
+
+	slot, err := nd.checkInbound(newConn.RemotePub)
+	if err != nil {
+		log.Printf("Listener error: %s\n", err.Error())
+		newConn.Close()
+		return
+	}
+
+	features, first, err := nd.exchangeInit(newConn)
+	if err != nil {
+		log.Printf("Listener error: %s\n", err.Error())
+		nd.releaseInbound(slot)
+		return
+	}
+
+	peerIdx, err := nd.inboundPeerIdx(newConn.RemotePub)
+	if err != nil {
+		log.Printf("Listener error: %s\n", err.Error())
+		nd.releaseInbound(slot)
+		newConn.Close()
+		return
+	}
+
+	var peer RemotePeer
+	peer.Idx = peerIdx
+	peer.Con = newConn
+	peer.Features = features
+	peer.firstMsg = first
+	peer.Inbound = true
+	peer.slot = slot
+	if !isTempPeer(peerIdx) {
+		peer.Nickname = nd.GetNicknameFromPeerIdx(peerIdx)
+	}
+	nd.addRemotePeer(&peer)
+}
+
+// initTimeout is how long a peer has to send its init message
+const initTimeout = time.Second * 30
+
+// legacyInitTimeout is how long to wait for an init message on an old
+// handshake connection.  Old nodes don't send one, so don't wait long.
+const legacyInitTimeout = time.Second * 3
+
+// ourFeatures are the features we send in our init message
+func (nd *LitNode) ourFeatures() lnutil.Features {
+	var f lnutil.Features
+	f.Set(lnutil.FeatureReestablish + 1)
+	f.Set(lnutil.FeatureKeepalive + 1)
+	f.Set(lnutil.FeatureFraming + 1)
+	f.Set(lnutil.FeatureGossip + 1)
+	if nd.Tower.Accepting {
+		f.Set(lnutil.FeatureTower + 1)
+	}
+	return f
+}
+
+// exchangeInit sends our init message on a new connection, and reads
+// theirs, which has to be the first thing they send.  If it isn't, or they
+// require a feature we don't know, the connection's closed.  Old handshake
+// connections can be from nodes from before init messages; see swapInit.
+func (nd *LitNode) exchangeInit(con *lndc.LNDConn) (lnutil.Features, []byte, error) {
+	features, first, err := swapInit(con, nd.ourFeatures())
+	if err != nil {
+		con.Close()
+		return nil, nil, err
+	}
+	return features, first, nil
+}
+
+// swapInit writes our init message and reads theirs.  On an old handshake
+// (version 0) connection, a peer that doesn't send init has no features,
+// and if it sent something else first, that comes back to be handled
+// before anything after it.
+func swapInit(con *lndc.LNDConn, ours lnutil.Features) (
+	lnutil.Features, []byte, error) {
+	_, err := con.Write(lnutil.NewInitMsg(0, ours).Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	legacy := con.Version() == 0
+	timeout := initTimeout
+	if legacy {
+		timeout = legacyInitTimeout
+	}
+	err = con.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, 65535)
+	n, err := con.Read(b)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() && legacy {
+		n, err = 0, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("no init message: %s", err.Error())
+	}
+	err = con.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n == 0 || b[0] != lnutil.MSGID_INIT {
+		if legacy {
+			var first []byte
+			if n != 0 {
+				first = b[:n]
+			}
+			return lnutil.Features{}, first, nil
+		}
+		return nil, nil, fmt.Errorf("first message type %x, expect init", b[0])
+	}
+	msg, err := lnutil.NewInitMsgFromBytes(b[:n], 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = msg.Features.CheckRequired()
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg.Features, nil, nil
+}
+
+// readMsg reads the next message from a peer
+func (peer *RemotePeer) readMsg() ([]byte, error) {
+	if peer.firstMsg != nil {
+		msg := peer.firstMsg
+		peer.firstMsg = nil
+		return msg, nil
+	}
+	if peer.Features.Supports(lnutil.FeatureFraming) {
+		return lnutil.ReadFrame(peer.Con)
+	}
+	// one message per record
+	msg := make([]byte, lndc.MaxRecordLen)
+	n, err := peer.Con.Read(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg[:n], nil
+}
+
+// writeMsg writes a message to a peer
+func (peer *RemotePeer) writeMsg(b []byte) error {
+	if peer.Features.Supports(lnutil.FeatureFraming) {
+		return lnutil.WriteFrame(peer.Con, b)
+	}
+	_, err := peer.Con.Write(b)
+	return err
+}
+
+// maxMsgLen is the biggest message a peer can take
+func (peer *RemotePeer) maxMsgLen() int {
+	if peer.Features.Supports(lnutil.FeatureFraming) {
+		return lnutil.MaxMsgLen
+	}
+	return lndc.MaxRecordLen
+}
+
+// PeerSupports says if a connected peer supports a feature
+func (nd *LitNode) PeerSupports(peerIdx uint32, feature uint) bool {
+	nd.RemoteMtx.Lock()
+	defer nd.RemoteMtx.Unlock()
+	peer, ok := nd.RemoteCons[peerIdx]
+	return ok && peer.Features.Supports(feature)
+}
+
 // DialPeer makes an outgoing connection to another node.
 func (nd *LitNode) DialPeer(connectAdr string) error {
 
@@ -96,85 +256,105 @@ func (nd *LitNode) DialPeer(connectAdr string) error {
 	if !lnutil.LitAdrOK(who) {
 		return fmt.Errorf("ln address %s invalid", who)
 	}
+	if nd.peerDenied(who) {
+		return fmt.Errorf("%s is denied", who)
+	}
 
 	// get my private ID key
 	idPriv := nd.IdKey()
 
 	// Assign remote connection
 	newConn := new(lndc.LNDConn)
+	newConn.Dialer = nd.Dialer
+	newConn.Legacy = nd.LegacyConn
 
 	err := newConn.Dial(idPriv, where, who)
 	if err != nil {
 		return err
 	}
+	// who might have been a full key address
+	if adr := pubAdr(newConn.RemotePub); nd.peerDenied(adr) {
+		newConn.Close()
+		return fmt.Errorf("%s is denied", adr)
+	}
+
+	features, first, err := nd.exchangeInit(newConn)
+	if err != nil {
+		return err
+	}
 
 	// if connect is successful, either query for already existing peer index, or
 	// if the peer is new, make an new index, and save the hostname&port
 
 	// figure out peer index, or assign new one for new peer.  Since
-	// we're connecting out, also specify the hostname&port
-	peerIdx, err := nd.GetPeerIdx(newConn.RemotePub, newConn.RemoteAddr().String())
+	// we're connecting out, also specify the hostname&port.  Through a
+	// proxy, the remote address is the proxy's, so keep what we dialed.
+	host := newConn.RemoteAddr().String()
+	if nd.Dialer != nil {
+		host = where
+	}
+	peerIdx, err := nd.GetPeerIdx(newConn.RemotePub, host)
 	if err != nil {
+		newConn.Close()
 		return err
 	}
 
 	// also retrieve their nickname, if they have one
 	nickname := nd.GetNicknameFromPeerIdx(uint32(peerIdx))
 
-	nd.RemoteMtx.Lock()
 	var p RemotePeer
 	p.Con = newConn
 	p.Idx = peerIdx
 	p.Nickname = nickname
-	nd.RemoteCons[peerIdx] = &p
-	nd.RemoteMtx.Unlock()
-
-	// each connection to a peer gets its own LNDCReader
-	go nd.LNDCReader(&p)
+	p.Features = features
+	p.firstMsg = first
+	nd.addRemotePeer(&p)
 
 	return nil
 }
 
-// OutMessager takes messages from the outbox and sends them to the ether. net.
-func (nd *LitNode) OutMessager() {
-	for {
-		msg := <-nd.OmniOut
-		if !nd.ConnectedToPeer(msg.Peer()) {
-			fmt.Printf("message type %x to peer %d but not connected\n",
-				msg.MsgType(), msg.Peer())
-			continue
-		}
-
-		//rawmsg := append([]byte{msg.MsgType()}, msg.Data...)
-		rawmsg := msg.Bytes() // automatically includes messageType
-		nd.RemoteMtx.Lock()   // not sure this is needed...
-		n, err := nd.RemoteCons[msg.Peer()].Con.Write(rawmsg)
-		if err != nil {
-			fmt.Printf("error writing to peer %d: %s\n", msg.Peer(), err.Error())
-		} else {
-			fmt.Printf("type %x %d bytes to peer %d\n", msg.MsgType(), n, msg.Peer())
-		}
-		nd.RemoteMtx.Unlock()
-	}
-}
-
 type PeerInfo struct {
 	PeerNumber uint32
 	RemoteHost string
 	Nickname   string
+
+	// State is PeerConnected, or PeerRedialing for peers with open
+	// channels that dropped.  Redialing peers also have how many redials
+	// haven't worked, and the last error.
+	State     string
+	Tries     uint32
+	LastError string
 }
 
+// GetConnectedPeerList returns connected peers, and peers being redialed
 func (nd *LitNode) GetConnectedPeerList() []PeerInfo {
-	nd.RemoteMtx.Lock()
-	nd.RemoteMtx.Unlock() //TODO: This unlock is in the wrong place...?
 	var peers []PeerInfo
+	nd.RemoteMtx.Lock()
 	for k, v := range nd.RemoteCons {
 		var newPeer PeerInfo
 		newPeer.PeerNumber = k
 		newPeer.RemoteHost = v.Con.RemoteAddr().String()
 		newPeer.Nickname = v.Nickname
+		newPeer.State = PeerConnected
+		peers = append(peers, newPeer)
+	}
+	nd.RemoteMtx.Unlock()
+
+	nd.connMtx.Lock()
+	for k, ps := range nd.connStates {
+		if ps.state != PeerRedialing {
+			continue
+		}
+		var newPeer PeerInfo
+		newPeer.PeerNumber = k
+		newPeer.RemoteHost = ps.host
+		newPeer.Nickname = nd.GetNicknameFromPeerIdx(k)
+		newPeer.State = ps.state
+		newPeer.Tries = ps.tries
+		newPeer.LastError = ps.lastError
 		peers = append(peers, newPeer)
 	}
+	nd.connMtx.Unlock()
 	return peers
 }
 
@@ -199,7 +379,5 @@ func (nd *LitNode) SendChat(peer uint32, chat string) error {
 
 	outMsg := lnutil.NewChatMsg(peer, chat)
 
-	nd.OmniOut <- outMsg
-
-	return nil
+	return nd.SendMsg(outMsg)
 }
@@ -0,0 +1,117 @@
+package qln
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/mit-dci/lit/lndc"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// lndcPair connects two lndc conns over localhost, with the old handshake
+// if legacy.
+func lndcPair(t *testing.T, legacy bool) (*lndc.LNDConn, *lndc.LNDConn) {
+	lPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rPriv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := lndc.NewListener(lPriv, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Legacy = legacy
+
+	var lPub [33]byte
+	copy(lPub[:], lPriv.PubKey().SerializeCompressed())
+	con := lndc.NewConn(nil)
+	con.Legacy = legacy
+	dialErr := make(chan error, 1)
+	go func() {
+		dialErr <- con.Dial(rPriv, l.Addr().String(), lnutil.LitAdrFromPubkey(lPub))
+	}()
+	lCon, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-dialErr
+	if err != nil {
+		t.Fatal(err)
+	}
+	return con, lCon.(*lndc.LNDConn)
+}
+
+// TestSwapInitLegacy checks old handshake connections work with peers that
+// send init, peers that send something else first, and silent ones.
+func TestSwapInitLegacy(t *testing.T) {
+	var ours lnutil.Features
+	ours.Set(lnutil.FeatureGossip + 1)
+
+	// both send init
+	a, b := lndcPair(t, true)
+	theirs := make(chan lnutil.Features, 1)
+	go func() {
+		f, _, err := swapInit(b, ours)
+		if err != nil {
+			t.Error(err)
+		}
+		theirs <- f
+	}()
+	f, first, err := swapInit(a, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Supports(lnutil.FeatureGossip) || first != nil ||
+		!(<-theirs).Supports(lnutil.FeatureGossip) {
+		t.Fatalf("features %x, first msg %x", f, first)
+	}
+	a.Close()
+	b.Close()
+
+	// old node says something else first; it comes back to be handled
+	a, b = lndcPair(t, true)
+	chat := lnutil.NewChatMsg(0, "hi").Bytes()
+	_, err = b.Write(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, first, err = swapInit(a, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f) != 0 || !bytes.Equal(first, chat) {
+		t.Fatalf("features %x, first msg %x", f, first)
+	}
+	a.Close()
+	b.Close()
+
+	// old node says nothing
+	a, b = lndcPair(t, true)
+	f, first, err = swapInit(a, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f) != 0 || first != nil {
+		t.Fatalf("features %x, first msg %x", f, first)
+	}
+	a.Close()
+	b.Close()
+
+	// but new connections have to start with init
+	a, b = lndcPair(t, false)
+	_, err = b.Write(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = swapInit(a, ours)
+	if err == nil {
+		t.Fatalf("noise connection without init worked")
+	}
+	a.Close()
+	b.Close()
+}
@@ -0,0 +1,147 @@
+package qln
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+Each connected peer has its own queue of messages to send, and a writer
+goroutine that sends them, so a slow peer only holds up messages to itself.
+SendMsg puts a message in the queue and waits for it to be written.  If the
+queue's full for queueTimeout, or the write fails, the connection is
+dropped: LNDCReader sees it and the connection manager takes over, and when
+the peer's back, reestablish works out what didn't get there.
+*/
+
+const (
+	// outQueueSize is how many messages can wait to go out to a peer
+	outQueueSize = 32
+
+	// queueTimeout is how long SendMsg waits for room in a full queue
+	queueTimeout = time.Second * 30
+
+	// writes that take longer than this drop the connection
+	writeTimeout = time.Second * 10
+)
+
+// outMsg is a message waiting to go out, and where to say how it went
+type outMsg struct {
+	msg  lnutil.LitMsg
+	b    []byte
+	sent chan error
+}
+
+// addRemotePeer puts a newly connected peer in RemoteCons, and starts its
+// reader and writer.  A connection to the same peer that it replaces is
+// closed.
+func (nd *LitNode) addRemotePeer(peer *RemotePeer) {
+	peer.outbox = make(chan outMsg, outQueueSize)
+	peer.quit = make(chan struct{})
+
+	old := nd.putRemotePeer(peer)
+	if old != nil {
+		old.Con.Conn.Close()
+	}
+
+	go nd.peerWriter(peer)
+	// each connection to a peer gets its own LNDCReader
+	go nd.LNDCReader(peer)
+	nd.peerUp(peer.PeerIdx())
+}
+
+// putRemotePeer puts a peer in RemoteCons, and returns the one it replaced.
+// An inbound slot the peer holds becomes its RemoteCons entry.
+func (nd *LitNode) putRemotePeer(peer *RemotePeer) *RemotePeer {
+	nd.RemoteMtx.Lock()
+	defer nd.RemoteMtx.Unlock()
+	if peer.slot {
+		nd.inboundSlots--
+		peer.slot = false
+	}
+	old := nd.RemoteCons[peer.Idx]
+	nd.RemoteCons[peer.Idx] = peer
+	return old
+}
+
+// SendMsg sends a message to a peer.  It returns once the message has been
+// written to the connection, with an error if it couldn't be.
+func (nd *LitNode) SendMsg(msg lnutil.LitMsg) error {
+	nd.RemoteMtx.Lock()
+	peer, ok := nd.RemoteCons[msg.Peer()]
+	nd.RemoteMtx.Unlock()
+	if !ok {
+		return fmt.Errorf("message type %x to peer %d but not connected",
+			msg.MsgType(), msg.Peer())
+	}
+	if !peer.Features.CanSend(msg.MsgType()) {
+		return fmt.Errorf("peer %d doesn't support message type %x",
+			msg.Peer(), msg.MsgType())
+	}
+
+	b := msg.Bytes()
+	if len(b) > peer.maxMsgLen() {
+		return fmt.Errorf("message type %x is %d bytes; peer %d takes %d",
+			msg.MsgType(), len(b), msg.Peer(), peer.maxMsgLen())
+	}
+
+	om := outMsg{msg: msg, b: b, sent: make(chan error, 1)}
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case peer.outbox <- om:
+	case <-peer.quit:
+		return fmt.Errorf("peer %d disconnected; message type %x not sent",
+			msg.Peer(), msg.MsgType())
+	case <-timer.C:
+		// it's not keeping up; drop it
+		peer.Con.Conn.Close()
+		return fmt.Errorf("peer %d queue full for %s; message type %x not sent",
+			msg.Peer(), queueTimeout.String(), msg.MsgType())
+	}
+
+	select {
+	case err := <-om.sent:
+		return err
+	case <-peer.quit:
+		// the writer may have got to it just before quitting
+		select {
+		case err := <-om.sent:
+			return err
+		default:
+		}
+		return fmt.Errorf("peer %d disconnected; message type %x not sent",
+			msg.Peer(), msg.MsgType())
+	}
+}
+
+// peerWriter writes a peer's queued messages to its connection, one at a
+// time, until LNDCReader quits.  Then it closes the connection.
+func (nd *LitNode) peerWriter(peer *RemotePeer) {
+	for {
+		select {
+		case <-peer.quit:
+			peer.Con.Close()
+			return
+		case om := <-peer.outbox:
+			err := peer.Con.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err == nil {
+				err = peer.writeMsg(om.b)
+				if err == nil {
+					fmt.Printf("type %x %d bytes to peer %d\n",
+						om.msg.MsgType(), len(om.b), peer.PeerIdx())
+				}
+			}
+			if err != nil {
+				err = fmt.Errorf("error writing to peer %d: %s",
+					peer.PeerIdx(), err.Error())
+				fmt.Printf("%s\n", err.Error())
+				// close the socket under it, so LNDCReader drops it
+				peer.Con.Conn.Close()
+			}
+			om.sent <- err
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package qln
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+The peer policy says who can connect to us.  Incoming connections get
+checked twice:
+  - before the handshake, by IP: each IP gets IPRateLimit new connections a
+    minute.  Tor's connections all come from localhost, so it isn't limited.
+  - after, by pubkey: denied peers are dropped, and once there's anything on
+    the allow list, only peers on it get in.  Past MaxInbound incoming peers,
+    only allowed peers and peers with open channels get in.
+Denied peers don't get dialed either, and denying a connected peer drops it.
+
+With NoPersist, incoming peers that aren't in the db don't get saved when
+they connect.  They get a temporary index, from tempPeerIdxStart up, until
+they make a channel with us or we fund one with them; then they're saved and
+get a real one (channel keys are derived from it).
+
+The policy's saved in the db.
+*/
+
+// tempPeerIdxStart is the first temporary peer index.  Real ones count up
+// from 1, and have to stay under 1<<31 for key derivation.
+const tempPeerIdxStart = 1 << 30
+
+// PeerPolicy is who can connect to us.  Peers are lit addresses.
+type PeerPolicy struct {
+	Allow []string
+	Deny  []string
+
+	// MaxInbound is how many incoming peers can be connected at once; 0
+	// for no limit
+	MaxInbound int
+
+	// IPRateLimit is how many connections a minute each IP can make; 0
+	// for no limit
+	IPRateLimit int
+
+	// NoPersist doesn't save incoming peers until they make a channel
+	NoPersist bool
+}
+
+// ipLimiter counts each IP's connections, a minute at a time
+type ipLimiter map[string]ipWindow
+
+type ipWindow struct {
+	start time.Time
+	n     int
+}
+
+// allow counts a connection from host, and says if it's within limit
+func (l ipLimiter) allow(host string, limit int, now time.Time) bool {
+	w, ok := l[host]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		if len(l) > 1000 {
+			// clear out IPs we haven't heard from in a while
+			for h, old := range l {
+				if now.Sub(old.start) >= time.Minute {
+					delete(l, h)
+				}
+			}
+		}
+		w = ipWindow{start: now}
+	}
+	w.n++
+	l[host] = w
+	return w.n <= limit
+}
+
+// peerAdr turns a lit address, full key address or hex pubkey into a lit
+// address.  Shortened addresses aren't enough to match on.
+func peerAdr(s string) (string, error) {
+	if len(s) == 66 {
+		b, err := hex.DecodeString(s)
+		if err == nil {
+			_, err = btcec.ParsePubKey(b, btcec.S256())
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", s, err.Error())
+		}
+		var pub [33]byte
+		copy(pub[:], b)
+		return lnutil.LitAdrFromPubkey(pub), nil
+	}
+	if pub, err := lnutil.LitFullAdrDecode(s); err == nil {
+		return lnutil.LitAdrFromPubkey(pub), nil
+	}
+	b, err := lnutil.LitAdrBytes(s)
+	if err != nil || len(b) != 20 {
+		return "", fmt.Errorf("%s isn't a full lit address or pubkey", s)
+	}
+	return s, nil
+}
+
+func pubAdr(pub *btcec.PublicKey) string {
+	var pubArr [33]byte
+	copy(pubArr[:], pub.SerializeCompressed())
+	return lnutil.LitAdrFromPubkey(pubArr)
+}
+
+func hasAdr(adrs []string, adr string) bool {
+	for _, a := range adrs {
+		if a == adr {
+			return true
+		}
+	}
+	return false
+}
+
+// GetPeerPolicy returns a copy of the peer policy
+func (nd *LitNode) GetPeerPolicy() PeerPolicy {
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	p := nd.policy
+	p.Allow = append([]string{}, p.Allow...)
+	p.Deny = append([]string{}, p.Deny...)
+	return p
+}
+
+// AllowPeer adds a peer to the allow list, or removes it
+func (nd *LitNode) AllowPeer(peer string, remove bool) error {
+	adr, err := peerAdr(peer)
+	if err != nil {
+		return err
+	}
+	return nd.updatePeerPolicy(func(p *PeerPolicy) {
+		p.Allow = listUpdate(p.Allow, adr, remove)
+	})
+}
+
+// DenyPeer adds a peer to the deny list, or removes it.  If it's
+// connected, it's dropped.
+func (nd *LitNode) DenyPeer(peer string, remove bool) error {
+	adr, err := peerAdr(peer)
+	if err != nil {
+		return err
+	}
+	err = nd.updatePeerPolicy(func(p *PeerPolicy) {
+		p.Deny = listUpdate(p.Deny, adr, remove)
+	})
+	if err != nil || remove {
+		return err
+	}
+
+	nd.RemoteMtx.Lock()
+	for _, rp := range nd.RemoteCons {
+		if pubAdr(rp.Con.RemotePub) == adr {
+			fmt.Printf("dropping denied peer %d\n", rp.PeerIdx())
+			// LNDCReader does the rest
+			rp.Con.Conn.Close()
+		}
+	}
+	nd.RemoteMtx.Unlock()
+	return nil
+}
+
+// SetPeerLimits sets the numbers in the peer policy
+func (nd *LitNode) SetPeerLimits(maxInbound, ipRateLimit int, noPersist bool) error {
+	if maxInbound < 0 || ipRateLimit < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nd.updatePeerPolicy(func(p *PeerPolicy) {
+		p.MaxInbound = maxInbound
+		p.IPRateLimit = ipRateLimit
+		p.NoPersist = noPersist
+	})
+}
+
+func listUpdate(adrs []string, adr string, remove bool) []string {
+	var out []string
+	for _, a := range adrs {
+		if a != adr {
+			out = append(out, a)
+		}
+	}
+	if !remove {
+		out = append(out, adr)
+	}
+	return out
+}
+
+// updatePeerPolicy changes the policy and saves it
+func (nd *LitNode) updatePeerPolicy(change func(p *PeerPolicy)) error {
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	p := nd.policy
+	p.Allow = append([]string{}, p.Allow...)
+	p.Deny = append([]string{}, p.Deny...)
+	change(&p)
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = nd.LitDB.Update(func(btx *bolt.Tx) error {
+		bkt, err := btx.CreateBucketIfNotExists(BKTPolicy)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(KEYPeerPolicy, b)
+	})
+	if err != nil {
+		return err
+	}
+	nd.policy = p
+	return nil
+}
+
+// loadPeerPolicy reads the policy from the db, if there is one
+func (nd *LitNode) loadPeerPolicy() error {
+	var b []byte
+	err := nd.LitDB.View(func(btx *bolt.Tx) error {
+		bkt := btx.Bucket(BKTPolicy)
+		if bkt == nil {
+			return nil
+		}
+		b = bkt.Get(KEYPeerPolicy)
+		return nil
+	})
+	if err != nil || b == nil {
+		return err
+	}
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	return json.Unmarshal(b, &nd.policy)
+}
+
+// allowConnFrom is the listener's check on new connections, before the
+// handshake
+func (nd *LitNode) allowConnFrom(addr net.Addr) error {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	limit := nd.policy.IPRateLimit
+	if limit != 0 && !nd.ipConns.allow(host, limit, time.Now()) {
+		return fmt.Errorf("%s over %d connections a minute", host, limit)
+	}
+	return nil
+}
+
+// peerDenied says if a peer's on the deny list
+func (nd *LitNode) peerDenied(adr string) bool {
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	return hasAdr(nd.policy.Deny, adr)
+}
+
+// checkInbound says if a peer that's connected to us can stay, by pubkey.
+// If it took up one of the MaxInbound slots, slot is true; the slot's counted
+// till addRemotePeer puts the peer in RemoteCons, or releaseInbound gives it
+// back.
+func (nd *LitNode) checkInbound(pub *btcec.PublicKey) (slot bool, err error) {
+	adr := pubAdr(pub)
+	p := nd.GetPeerPolicy()
+
+	if hasAdr(p.Deny, adr) {
+		return false, fmt.Errorf("%s is denied", adr)
+	}
+	allowed := hasAdr(p.Allow, adr)
+	if len(p.Allow) != 0 && !allowed {
+		return false, fmt.Errorf("%s isn't on the allow list", adr)
+	}
+	if p.MaxInbound == 0 || allowed {
+		return false, nil
+	}
+
+	// count and take the slot under one lock, so handshakes finishing
+	// at the same time can't all get the last one
+	nd.RemoteMtx.Lock()
+	inbound := nd.inboundSlots
+	for _, rp := range nd.RemoteCons {
+		if rp.Inbound {
+			inbound++
+		}
+	}
+	if inbound < p.MaxInbound {
+		nd.inboundSlots++
+		nd.RemoteMtx.Unlock()
+		return true, nil
+	}
+	nd.RemoteMtx.Unlock()
+
+	idx, ok := nd.lookupPeerIdx(pub)
+	if ok && nd.hasOpenChannels(idx) {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: already %d incoming peers", adr, inbound)
+}
+
+// releaseInbound gives back a slot checkInbound took, for a peer that never
+// made it into RemoteCons
+func (nd *LitNode) releaseInbound(slot bool) {
+	if !slot {
+		return
+	}
+	nd.RemoteMtx.Lock()
+	nd.inboundSlots--
+	nd.RemoteMtx.Unlock()
+}
+
+// lookupPeerIdx gets a saved peer's index, without saving new ones
+func (nd *LitNode) lookupPeerIdx(pub *btcec.PublicKey) (uint32, bool) {
+	var idx uint32
+	_ = nd.LitDB.View(func(btx *bolt.Tx) error {
+		prs := btx.Bucket(BKTPeers)
+		if prs == nil {
+			return nil
+		}
+		pbk := prs.Bucket(pub.SerializeCompressed())
+		if pbk != nil {
+			idx = lnutil.BtU32(pbk.Get(KEYIdx))
+		}
+		return nil
+	})
+	return idx, idx != 0
+}
+
+// inboundPeerIdx gets the index for a peer that's connected to us.  With
+// NoPersist, new peers get a temporary one.
+func (nd *LitNode) inboundPeerIdx(pub *btcec.PublicKey) (uint32, error) {
+	idx, ok := nd.lookupPeerIdx(pub)
+	if ok {
+		return idx, nil
+	}
+
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	var pubArr [33]byte
+	copy(pubArr[:], pub.SerializeCompressed())
+	idx, ok = nd.tempPeers[pubArr]
+	if ok {
+		return idx, nil
+	}
+	if !nd.policy.NoPersist {
+		// don't save host/port for incomming connections
+		return nd.GetPeerIdx(pub, "")
+	}
+	if nd.nextTempIdx < tempPeerIdxStart {
+		nd.nextTempIdx = tempPeerIdxStart
+	}
+	idx = nd.nextTempIdx
+	nd.nextTempIdx++
+	nd.tempPeers[pubArr] = idx
+	return idx, nil
+}
+
+// isTempPeer says if a peer index is a temporary one
+func isTempPeer(peerIdx uint32) bool {
+	return peerIdx >= tempPeerIdxStart
+}
+
+// forgetTempPeer drops a temporary peer that's disconnected
+func (nd *LitNode) forgetTempPeer(peerIdx uint32) {
+	nd.policyMtx.Lock()
+	defer nd.policyMtx.Unlock()
+	for pub, idx := range nd.tempPeers {
+		if idx == peerIdx {
+			delete(nd.tempPeers, pub)
+		}
+	}
+}
+
+// persistPeer saves a peer with a temporary index, before a channel's made
+// with it, and returns its real index.  Saved peers keep theirs.
+func (nd *LitNode) persistPeer(peerIdx uint32) (uint32, error) {
+	if !isTempPeer(peerIdx) {
+		return peerIdx, nil
+	}
+
+	nd.RemoteMtx.Lock()
+	defer nd.RemoteMtx.Unlock()
+	peer, ok := nd.RemoteCons[peerIdx]
+	if !ok {
+		return 0, fmt.Errorf("peer %d not connected", peerIdx)
+	}
+	newIdx, err := nd.GetPeerIdx(peer.Con.RemotePub, "")
+	if err != nil {
+		return 0, err
+	}
+
+	delete(nd.RemoteCons, peerIdx)
+	// the peer's goroutines read this with PeerIdx
+	atomic.StoreUint32(&peer.Idx, newIdx)
+	nd.RemoteCons[newIdx] = peer
+
+	nd.forgetTempPeer(peerIdx)
+
+	nd.connMtx.Lock()
+	ps, ok := nd.connStates[peerIdx]
+	if ok {
+		delete(nd.connStates, peerIdx)
+		nd.connStates[newIdx] = ps
+	}
+	nd.connMtx.Unlock()
+
+	fmt.Printf("saved peer %d as peer %d\n", peerIdx, newIdx)
+	return newIdx, nil
+}
@@ -0,0 +1,109 @@
+package qln
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/btcec"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l := make(ipLimiter)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("10.0.0.1", 3, now) {
+			t.Fatalf("connection %d refused, limit 3", i+1)
+		}
+	}
+	if l.allow("10.0.0.1", 3, now.Add(time.Second)) {
+		t.Fatalf("4th connection in a minute allowed")
+	}
+	if !l.allow("10.0.0.2", 3, now) {
+		t.Fatalf("other IP refused")
+	}
+	if !l.allow("10.0.0.1", 3, now.Add(time.Minute)) {
+		t.Fatalf("refused after a minute")
+	}
+
+	// old IPs get cleared out once there are lots
+	for i := 0; i < 1001; i++ {
+		l.allow(string(rune(i)), 1, now)
+	}
+	l.allow("10.0.0.3", 1, now.Add(2*time.Minute))
+	if len(l) != 1 {
+		t.Fatalf("%d IPs kept, expect 1", len(l))
+	}
+}
+
+func TestListUpdate(t *testing.T) {
+	var l []string
+	l = listUpdate(l, "a", false)
+	l = listUpdate(l, "b", false)
+	l = listUpdate(l, "a", false)
+	if len(l) != 2 || !hasAdr(l, "a") || !hasAdr(l, "b") {
+		t.Fatalf("got %v, expect a and b", l)
+	}
+	l = listUpdate(l, "a", true)
+	if len(l) != 1 || hasAdr(l, "a") {
+		t.Fatalf("got %v, expect just b", l)
+	}
+}
+
+// TestMaxInbound has more peers than MaxInbound get through the handshake at
+// once; only MaxInbound of them get slots, and slots come back when a peer
+// goes away before it's added.
+func TestMaxInbound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var key [32]byte
+	copy(key[:], "policy")
+	nd, err := NewLitNode(&key, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nd.LitDB.Close()
+	nd.LitDB.NoSync = true
+	err = nd.SetPeerLimits(2, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), []byte{byte(i + 1)})
+			slot, err := nd.checkInbound(priv.PubKey())
+			if err == nil {
+				slots <- slot
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(slots)
+	if len(slots) != 2 {
+		t.Fatalf("%d peers let in, MaxInbound 2", len(slots))
+	}
+
+	// one gets added, the other drops out before init
+	nd.putRemotePeer(&RemotePeer{Idx: 1, Inbound: true, slot: true})
+	nd.releaseInbound(true)
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), []byte{20})
+	slot, err := nd.checkInbound(priv.PubKey())
+	if err != nil || !slot {
+		t.Fatalf("refused with 1 of 2 inbound peers: %v", err)
+	}
+	_, err = nd.checkInbound(priv.PubKey())
+	if err == nil {
+		t.Fatalf("let in a 3rd peer, MaxInbound 2")
+	}
+}
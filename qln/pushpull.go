@@ -2,6 +2,7 @@ package qln
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/adiabat/btcd/wire"
 	"github.com/mit-dci/lit/lnutil"
@@ -55,6 +56,9 @@ revoking the previous state which has already been revoked.
 We could distinguish by writing to the db that we've sent the REV message...
 but that doesn't seem that useful because we don't know if they got it so
 we might have to send it again anyway.
+
+After reconnecting, there's no guessing; both sides send reestablish messages
+and re-send exactly what the other missed.  See reestablish.go.
 */
 
 /*
@@ -147,7 +151,7 @@ func (nd *LitNode) ReSendMsg(qc *Qchan) error {
 }
 
 // PushChannel initiates a state update by sending an DeltaSig
-func (nd LitNode) PushChannel(qc *Qchan, amt uint32) error {
+func (nd *LitNode) PushChannel(qc *Qchan, amt uint32) error {
 	// sanity checks
 	if amt >= 1<<30 {
 		return fmt.Errorf("max send 1G sat (1073741823)")
@@ -212,8 +216,11 @@ func (nd LitNode) PushChannel(qc *Qchan, amt uint32) error {
 
 	err = nd.SendDeltaSig(qc)
 	if err != nil {
-		// don't clear; something is wrong with the network
-		return err
+		// don't clear; something is wrong with the network.  The delta's
+		// saved, so the DeltaSig is sent again when the peer's back.
+		// Don't route through it for a while either.
+		nd.Router.ReportFailure(qc.Op, nd.idPub(), time.Now())
+		return fmt.Errorf("DeltaSig not sent: %s", err.Error())
 	}
 
 	fmt.Printf("got pre CTS... \n")
@@ -222,6 +229,7 @@ func (nd LitNode) PushChannel(qc *Qchan, amt uint32) error {
 	fmt.Printf("got post CTS... \n")
 	// since we cleared with that statement, fill it again before returning
 	qc.ClearToSend <- true
+	nd.Router.ReportSuccess(qc.Op, nd.idPub())
 
 	return nil
 }
@@ -242,9 +250,8 @@ func (nd *LitNode) SendDeltaSig(q *Qchan) error {
 	}
 
 	outMsg := lnutil.NewDeltaSigMsg(q.Peer(), q.Op, -q.State.Delta, sig)
-	nd.OmniOut <- outMsg
 
-	return nil
+	return nd.SendMsg(outMsg)
 }
 
 // DeltaSigHandler takes in a DeltaSig and responds with an SigRev (normally)
@@ -272,6 +279,11 @@ func (nd *LitNode) DeltaSigHandler(msg lnutil.DeltaSigMsg, qc *Qchan) error {
 	if err != nil {
 		return fmt.Errorf("DeltaSigHandler ReloadQchan err %s", err.Error())
 	}
+	// after reconnecting, clear to send is reset, but a saved negative
+	// delta means we're pushing too
+	if qc.State.Delta < 0 {
+		collision = true
+	}
 
 	// TODO we should send a response that the channel is closed.
 	// or offer to double spend with a cooperative close?
@@ -403,9 +415,7 @@ func (nd *LitNode) SendGapSigRev(q *Qchan) error {
 
 	outMsg := lnutil.NewGapSigRev(q.KeyGen.Step[3]&0x7fffffff, q.Op, sig, *elk, n2ElkPoint)
 
-	nd.OmniOut <- outMsg
-
-	return nil
+	return nd.SendMsg(outMsg)
 }
 
 // SendSigRev sends an SigRev message based on channel info
@@ -437,8 +447,7 @@ func (nd *LitNode) SendSigRev(q *Qchan) error {
 
 	outMsg := lnutil.NewSigRev(q.KeyGen.Step[3]&0x7fffffff, q.Op, sig, *elk, n2ElkPoint)
 
-	nd.OmniOut <- outMsg
-	return nil
+	return nd.SendMsg(outMsg)
 }
 
 // GapSigRevHandler takes in a GapSigRev, responds with a Rev, and
@@ -588,8 +597,12 @@ func (nd *LitNode) SigRevHandler(msg lnutil.SigRevMsg, qc *Qchan) error {
 		}
 	}()
 
-	// done updating channel, no new messages expected.  Set clear to send
-	qc.ClearToSend <- true
+	// done updating channel, no new messages expected.  Set clear to send,
+	// unless it's set already; a channel loaded after reconnecting is.
+	select {
+	case qc.ClearToSend <- true:
+	default:
+	}
 
 	return nil
 }
@@ -609,9 +622,7 @@ func (nd *LitNode) SendREV(q *Qchan) error {
 
 	outMsg := lnutil.NewRevMsg(q.Peer(), q.Op, *elk, n2ElkPoint)
 
-	nd.OmniOut <- outMsg
-
-	return err
+	return nd.SendMsg(outMsg)
 }
 
 // REVHandler takes in an REV and clears the state's prev HAKD.  This is the
@@ -661,8 +672,12 @@ func (nd *LitNode) RevHandler(msg lnutil.RevMsg, qc *Qchan) error {
 		}
 	}()
 
-	// got rev, assert clear to send
-	qc.ClearToSend <- true
+	// got rev, assert clear to send (unless it's set already, after
+	// reconnecting)
+	select {
+	case qc.ClearToSend <- true:
+	default:
+	}
 
 	fmt.Printf("REV OK, state %d all clear.\n", qc.State.StateIdx)
 	return nil
@@ -0,0 +1,226 @@
+package qln
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+Reestablish: right after connecting, each side sends a reestablish message
+for every open channel, with its state index and the last of the other
+side's states it has a revocation for.  With that and its own state from
+the db, each side works out which push / pull messages the other didn't
+get, and sends just those, in order.
+
+Starting from rest at state n (revocations up to n-1 both ways), a push is
+  pusher A (n, delta < 0) -> DeltaSig -> puller B (n+1, delta > 0)
+  B -> SigRev (sig n+1, revoke n) -> A (n+1, delta 0)
+  A -> Rev (revoke n) -> B (n+1, delta 0)
+and a collision, where both push at n, is
+  each (n, delta < 0) -> DeltaSig -> other (n+1, collision set)
+  each -> GapSigRev (revoke n, sig n+2) -> other (n+2, delta > 0)
+  each -> Rev (revoke n+1) -> other (n+2, delta 0)
+
+The two sides are never more than one state apart, and neither can have
+more than 3 revocations fewer than the other's state, so anything past that
+means one side lost data.  If it's them, their current state is one they've
+revoked, so we break the channel with ours.  If it's us, we can't safely
+broadcast anything; they have to close.
+*/
+
+// things to re-send after a reestablish, in this order
+const (
+	resendDeltaSig = 1 << iota
+	resendGapSigRev
+	resendSigRev
+	resendRev
+)
+
+var (
+	errWeLostData   = fmt.Errorf("we're behind; our channel data is old")
+	errTheyLostData = fmt.Errorf("they're behind; their channel data is old")
+)
+
+// syncActions works out what to re-send, given our state, the last of their
+// states we have a revocation for (rcvIdx), and their reestablish message.
+func syncActions(s *StatCom, rcvIdx uint64, msg lnutil.ReestablishMsg) (
+	int, error) {
+
+	n, them, theirRcv := s.StateIdx, msg.StateIdx, msg.RevokedIdx
+
+	if them > n+1 || theirRcv >= n {
+		return 0, errWeLostData
+	}
+	if them+1 < n || theirRcv+3 < n || rcvIdx >= them {
+		return 0, errTheyLostData
+	}
+
+	switch {
+	case s.Collision != 0:
+		// we're at n+1 with their DeltaSig.  If they're still at n they
+		// didn't get ours; if they're at n+1 they didn't get our GapSigRev
+		if them+1 == n {
+			return resendDeltaSig | resendGapSigRev, nil
+		}
+		if them == n {
+			return resendGapSigRev, nil
+		}
+
+	case s.Delta < 0:
+		// pushing, haven't got their SigRev.  If they're still here, they
+		// didn't get our DeltaSig
+		if them == n {
+			return resendDeltaSig, nil
+		}
+
+	case s.Delta > 0:
+		// either pulling, or after a GapSigRev.  Waiting for their Rev
+		// either way.
+		if them+1 == n {
+			// they didn't get our SigRev, or GapSigRev.  After a
+			// collision, they're still missing our revocation of n-2.
+			if theirRcv+3 == n {
+				return resendGapSigRev | resendRev, nil
+			}
+			return resendSigRev, nil
+		}
+		if them == n && theirRcv+2 == n {
+			// both past a GapSigRev; they didn't get our Rev
+			return resendRev, nil
+		}
+
+	default:
+		// at rest; they may not have our last revocation
+		if theirRcv+1 < n {
+			return resendRev, nil
+		}
+	}
+	return 0, nil
+}
+
+// SendReestablish sends a reestablish message for each of a peer's open
+// channels.  Called when the peer connects.
+func (nd *LitNode) SendReestablish(peerIdx uint32) error {
+	qcs, err := nd.GetAllQchans()
+	if err != nil {
+		return err
+	}
+	for _, q := range qcs {
+		// channels without a state yet have nothing to sync
+		if q.Peer() != peerIdx || q.CloseData.Closed || q.State.StateIdx == 0 {
+			continue
+		}
+		err = nd.SendMsg(lnutil.NewReestablishMsg(
+			peerIdx, q.Op, q.State.StateIdx, q.ElkRcv.UpTo()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReestablishHandler re-sends what the other side missed, or breaks the
+// channel if they lost data.
+func (nd *LitNode) ReestablishHandler(msg lnutil.ReestablishMsg, qc *Qchan) error {
+	err := nd.ReloadQchanState(qc)
+	if err != nil {
+		return fmt.Errorf("ReestablishHandler err %s", err.Error())
+	}
+	if qc.CloseData.Closed || qc.State.StateIdx == 0 {
+		return nil
+	}
+
+	resend, err := syncActions(qc.State, qc.ElkRcv.UpTo(), msg)
+	switch err {
+	case nil:
+	case errTheyLostData:
+		fmt.Printf("channel (%d,%d) peer at state %d, revoked %d; we're at %d. "+
+			"Breaking channel\n", qc.Peer(), qc.Idx(),
+			msg.StateIdx, msg.RevokedIdx, qc.State.StateIdx)
+		return nd.BreakChannel(qc)
+	default:
+		return fmt.Errorf("channel (%d,%d) peer at state %d, revoked %d; "+
+			"we're at %d: %s.  Don't break; they need to close it",
+			qc.Peer(), qc.Idx(), msg.StateIdx, msg.RevokedIdx,
+			qc.State.StateIdx, err.Error())
+	}
+	if resend == 0 {
+		return nil
+	}
+	fmt.Printf("channel (%d,%d) reestablish: re-sending %04b\n",
+		qc.Peer(), qc.Idx(), resend)
+
+	// the Send functions change the state in ram, so reload after each
+	if resend&resendDeltaSig != 0 {
+		if qc.State.Collision != 0 {
+			// back to how things were when we sent it
+			qc.State.StateIdx--
+			qc.State.MyAmt -= int64(qc.State.Collision)
+		}
+		err = nd.SendDeltaSig(qc)
+		if err != nil {
+			return err
+		}
+		err = nd.ReloadQchanState(qc)
+		if err != nil {
+			return err
+		}
+	}
+	if resend&resendGapSigRev != 0 {
+		if qc.State.Collision != 0 {
+			err = nd.SendGapSigRev(qc)
+		} else {
+			err = nd.reSendGapSigRev(qc)
+		}
+		if err != nil {
+			return err
+		}
+		err = nd.ReloadQchanState(qc)
+		if err != nil {
+			return err
+		}
+	}
+	if resend&resendSigRev != 0 {
+		err = nd.SendSigRev(qc)
+		if err != nil {
+			return err
+		}
+		err = nd.ReloadQchanState(qc)
+		if err != nil {
+			return err
+		}
+	}
+	if resend&resendRev != 0 {
+		err = nd.SendREV(qc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reSendGapSigRev makes the GapSigRev we sent before getting theirs, once
+// we're past the collision: revoking n-2 and signing n.
+func (nd *LitNode) reSendGapSigRev(q *Qchan) error {
+	elk, err := q.ElkSnd.AtIndex(q.State.StateIdx - 2)
+	if err != nil {
+		return err
+	}
+	// the n+2 point from back then
+	q.State.StateIdx--
+	n2ElkPoint, err := q.N2ElkPointForThem()
+	q.State.StateIdx++
+	if err != nil {
+		return err
+	}
+
+	q.State.ElkPoint = q.State.NextElkPoint
+	sig, err := nd.SignState(q)
+	if err != nil {
+		return err
+	}
+
+	outMsg := lnutil.NewGapSigRev(q.Peer(), q.Op, sig, *elk, n2ElkPoint)
+	return nd.SendMsg(outMsg)
+}
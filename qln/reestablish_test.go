@@ -0,0 +1,489 @@
+package qln
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil/hdkeychain"
+	"github.com/mit-dci/lit/elkrem"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// The tests here run pushes and collisions between two LitNodes with a
+// channel between them, each with its own db.  Messages go through the
+// real SendMsg and handlers; the test decides when they get delivered.  The
+// connection drops after every message, and again after every message of
+// the recovery, and reestablishing has to get both sides back to the same
+// state, without any handler erroring.
+
+const (
+	testCoin    = 257
+	testPeerIdx = 1
+	testChanIdx = 1
+)
+
+// testWallet is just enough of a UWallet for channel updates
+type testWallet struct {
+	UWallet // not there; anything else panics
+	root    *hdkeychain.ExtendedKey
+	pushed  []*wire.MsgTx
+}
+
+func (w *testWallet) GetPriv(k portxo.KeyGen) *btcec.PrivateKey {
+	priv, err := k.DerivePrivateKey(w.root)
+	if err != nil {
+		return nil
+	}
+	return priv
+}
+
+func (w *testWallet) GetPub(k portxo.KeyGen) *btcec.PublicKey {
+	priv := w.GetPriv(k)
+	if priv == nil {
+		return nil
+	}
+	return priv.PubKey()
+}
+
+func (w *testWallet) PushTx(tx *wire.MsgTx) error {
+	w.pushed = append(w.pushed, tx)
+	return nil
+}
+
+// testSide is one node, and the messages it's written that the other side
+// hasn't read yet
+type testSide struct {
+	name string
+	nd   *LitNode
+	wal  *testWallet
+	peer *RemotePeer
+
+	mtx  sync.Mutex
+	sent [][]byte
+}
+
+// newTestSide makes a node in dir with a peer connected
+func newTestSide(t *testing.T, name, dir string) *testSide {
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key [32]byte
+	copy(key[:], name)
+	nd, err := NewLitNode(&key, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd.LitDB.NoSync = true
+	root, err := hdkeychain.NewMaster(key[:], &chaincfg.TestNet3Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &testSide{name: name, nd: nd, wal: &testWallet{root: root}}
+	nd.SubWallet[testCoin] = x.wal
+	nd.DefaultCoin = testCoin
+
+	// what the peer's writer would put on the wire
+	x.peer = &RemotePeer{Idx: testPeerIdx, Features: nd.ourFeatures(),
+		outbox: make(chan outMsg, outQueueSize), quit: make(chan struct{})}
+	nd.RemoteCons[testPeerIdx] = x.peer
+	go func() {
+		for {
+			select {
+			case <-x.peer.quit:
+				return
+			case om := <-x.peer.outbox:
+				x.mtx.Lock()
+				x.sent = append(x.sent, om.b)
+				x.mtx.Unlock()
+				om.sent <- nil
+			}
+		}
+	}()
+	return x
+}
+
+func (x *testSide) close() {
+	close(x.peer.quit)
+	x.nd.LitDB.Close()
+}
+
+// qchan loads the channel from the db, like after connecting
+func (x *testSide) qchan(t *testing.T, op wire.OutPoint) *Qchan {
+	q, err := x.nd.GetQchan(lnutil.OutPointToBytes(op))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// testChan is a channel between two testSides
+type testChan struct {
+	a, b  *testSide
+	op    wire.OutPoint
+	order int // 0 alternate, 1 a's messages first, 2 b's first
+	n     int // messages delivered
+	log   []string
+	errs  []string
+
+	rest [2]*Qchan // both sides at rest, to start each run from
+}
+
+// newTestChan funds a channel with 500000 each way between 2 new nodes in
+// dir, and gets it to rest at state 3.
+func newTestChan(t *testing.T, dir string) *testChan {
+	c := &testChan{
+		a:  newTestSide(t, "a", filepath.Join(dir, "a")),
+		b:  newTestSide(t, "b", filepath.Join(dir, "b")),
+		op: wire.OutPoint{Hash: chainhash.DoubleHashH([]byte("fund"))},
+	}
+
+	// what the funding messages would have set up
+	qa, qb := c.a.newQchan(t, c.op), c.b.newQchan(t, c.op)
+	for _, p := range [][2]*Qchan{{qa, qb}, {qb, qa}} {
+		q, them := p[0], p[1]
+		q.TheirPub = them.MyPub
+		q.TheirRefundPub = them.MyRefundPub
+		q.TheirHAKDBase = them.MyHAKDBase
+		var err error
+		for i, pt := range []*[33]byte{
+			&q.State.ElkPoint, &q.State.NextElkPoint, &q.State.N2ElkPoint} {
+			*pt, err = them.ElkPoint(false, uint64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// each signs the other's state 0
+	sig, err := c.a.nd.SignState(qa)
+	if err == nil {
+		err = qb.VerifySig(sig)
+	}
+	if err == nil {
+		sig, err = c.b.nd.SignState(qb)
+	}
+	if err == nil {
+		err = qa.VerifySig(sig)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []*Qchan{qa, qb} {
+		q.ElkRcv = new(elkrem.ElkremReceiver)
+	}
+	qa.Account = 2 // a funded it from account 2
+	err = c.a.nd.SaveQChan(qa)
+	if err == nil {
+		err = c.b.nd.SaveQChan(qb)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, x := range []*testSide{c.a, c.b, c.a} {
+		c.push(t, x, int32(1000*(i+1)))
+		for c.deliver(t) {
+		}
+	}
+	c.check(t, 500000-1000+2000-3000)
+	c.rest = [2]*Qchan{c.a.qchan(t, c.op), c.b.qchan(t, c.op)}
+	if c.rest[0].Account != 2 || c.rest[1].Account != 0 {
+		t.Fatalf("channel accounts %d, %d, expect 2, 0",
+			c.rest[0].Account, c.rest[1].Account)
+	}
+	return c
+}
+
+// newQchan is the channel as funding leaves it, with nothing about them
+func (x *testSide) newQchan(t *testing.T, op wire.OutPoint) *Qchan {
+	q := new(Qchan)
+	q.KeyGen.Depth = 5
+	q.KeyGen.Step[0] = 44 | 1<<31
+	q.KeyGen.Step[1] = testCoin | 1<<31
+	q.KeyGen.Step[2] = UseChannelFund
+	q.KeyGen.Step[3] = testPeerIdx | 1<<31
+	q.KeyGen.Step[4] = testChanIdx | 1<<31
+	q.Value = 1000000
+	q.Mode = portxo.TxoP2WSHComp
+	q.Op = op
+	q.Height = 100
+	q.Delay = 5
+
+	var err error
+	q.MyPub, err = x.nd.GetUsePub(q.KeyGen, UseChannelFund)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.MyRefundPub, _ = x.nd.GetUsePub(q.KeyGen, UseChannelRefund)
+	q.MyHAKDBase, _ = x.nd.GetUsePub(q.KeyGen, UseChannelHAKDBase)
+	r, err := x.nd.GetElkremRoot(q.KeyGen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.ElkSnd = elkrem.NewElkremSender(r)
+
+	q.State = new(StatCom)
+	q.State.Fee = 10000
+	q.State.MyAmt = 500000
+	return q
+}
+
+// push starts a push the way PushChannel does, without waiting for it
+func (c *testChan) push(t *testing.T, x *testSide, amt int32) {
+	c.log = append(c.log, fmt.Sprintf("%s pushes %d", x.name, amt))
+	q := x.qchan(t, c.op)
+	q.State.Delta = -amt
+	err := x.nd.SaveQchanState(q)
+	if err == nil {
+		err = x.nd.SendDeltaSig(q)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deliver has one side read the next message from the other, and says if
+// there was one
+func (c *testChan) deliver(t *testing.T) bool {
+	c.a.mtx.Lock()
+	c.b.mtx.Lock()
+	from, to := c.a, c.b
+	switch {
+	case len(c.a.sent) == 0 && len(c.b.sent) == 0:
+		c.a.mtx.Unlock()
+		c.b.mtx.Unlock()
+		return false
+	case len(c.b.sent) == 0:
+	case len(c.a.sent) == 0:
+		from, to = c.b, c.a
+	case c.order == 1:
+	case c.order == 2:
+		from, to = c.b, c.a
+	default:
+		if c.n%2 == 1 {
+			from, to = c.b, c.a
+		}
+	}
+	b := from.sent[0]
+	from.sent = from.sent[1:]
+	c.a.mtx.Unlock()
+	c.b.mtx.Unlock()
+
+	c.n++
+	msg, err := lnutil.LitMsgFromBytes(b, testPeerIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.log = append(c.log, fmt.Sprintf("%s %T", from.name, msg))
+	// handlers go by what's on disk, so the channel in ram can be fresh
+	err = to.nd.PeerHandler(msg, to.qchan(t, c.op), to.peer)
+	if err != nil {
+		c.errs = append(c.errs, to.name+": "+err.Error())
+	}
+	return true
+}
+
+// reconnect drops what's in flight, and sends reestablish messages
+func (c *testChan) reconnect(t *testing.T) {
+	c.log = append(c.log, "-- reconnect")
+	for _, x := range []*testSide{c.a, c.b} {
+		x.mtx.Lock()
+		x.sent = nil
+		x.mtx.Unlock()
+	}
+	for _, x := range []*testSide{c.a, c.b} {
+		err := x.nd.SendReestablish(testPeerIdx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// reset puts both sides back at rest, with nothing in flight
+func (c *testChan) reset(t *testing.T, order int, name string) {
+	for i, x := range []*testSide{c.a, c.b} {
+		x.mtx.Lock()
+		x.sent = nil
+		x.mtx.Unlock()
+		err := x.nd.SaveQchanState(c.rest[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.order, c.n = order, 0
+	c.log, c.errs = []string{name}, nil
+}
+
+func (c *testChan) check(t *testing.T, expectA int64) {
+	a, b := c.a.qchan(t, c.op), c.b.qchan(t, c.op)
+	errs := c.errs
+	if len(errs) == 0 {
+		switch {
+		case a.State.Delta != 0 || b.State.Delta != 0 ||
+			a.State.Collision != 0 || b.State.Collision != 0:
+			errs = append(errs, "not at rest")
+		case a.State.StateIdx != b.State.StateIdx:
+			errs = append(errs, "different states")
+		case a.ElkRcv.UpTo()+1 != b.State.StateIdx ||
+			b.ElkRcv.UpTo()+1 != a.State.StateIdx:
+			errs = append(errs, "missing revocations")
+		case a.State.MyAmt+b.State.MyAmt != a.Value || a.State.MyAmt != expectA:
+			errs = append(errs, fmt.Sprintf("amounts %d, %d",
+				a.State.MyAmt, b.State.MyAmt))
+		}
+	}
+	if len(errs) != 0 {
+		t.Fatalf("%v\na state %d amt %d delta %d collision %d rcv %d\n"+
+			"b state %d amt %d delta %d collision %d rcv %d\n%v", errs,
+			a.State.StateIdx, a.State.MyAmt, a.State.Delta, a.State.Collision,
+			a.ElkRcv.UpTo(), b.State.StateIdx, b.State.MyAmt, b.State.Delta,
+			b.State.Collision, b.ElkRcv.UpTo(), c.log)
+	}
+}
+
+func testChanDir(t *testing.T) (*testChan, func()) {
+	dir, err := ioutil.TempDir("", "reestablish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestChan(t, dir)
+	return c, func() {
+		c.a.close()
+		c.b.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestReestablish disconnects at every step of a push each way and of a
+// collision, then at every step of recovering from that.
+func TestReestablish(t *testing.T) {
+	c, done := testChanDir(t)
+	defer done()
+	restA := c.rest[0].State.MyAmt
+
+	scenarios := []struct {
+		name         string
+		aPush, bPush int32
+	}{
+		{"a pushes", 1000, 0},
+		{"b pushes", 0, 2000},
+		{"collision", 1000, 2000},
+	}
+	for _, sc := range scenarios {
+		start := func(order int) {
+			c.reset(t, order, sc.name)
+			if sc.aPush != 0 {
+				c.push(t, c.a, sc.aPush)
+			}
+			if sc.bPush != 0 {
+				c.push(t, c.b, sc.bPush)
+			}
+		}
+		expectA := restA - int64(sc.aPush) + int64(sc.bPush)
+
+		for order := 0; order < 3; order++ {
+			// how many messages without disconnecting
+			start(order)
+			steps := 0
+			for c.deliver(t) {
+				steps++
+			}
+			c.check(t, expectA)
+
+			for cut := 0; cut <= steps; cut++ {
+				// disconnect after cut messages
+				start(order)
+				for i := 0; i < cut; i++ {
+					c.deliver(t)
+				}
+				c.reconnect(t)
+				recovery := 0
+				for c.deliver(t) {
+					recovery++
+				}
+				c.check(t, expectA)
+
+				// and again during recovery
+				for cut2 := 0; cut2 < recovery; cut2++ {
+					start(order)
+					for i := 0; i < cut; i++ {
+						c.deliver(t)
+					}
+					c.reconnect(t)
+					for i := 0; i < cut2; i++ {
+						c.deliver(t)
+					}
+					c.reconnect(t)
+					for c.deliver(t) {
+					}
+					c.check(t, expectA)
+				}
+			}
+		}
+	}
+}
+
+// TestReestablishOldData has a come back with its channel from before the
+// last push.  b breaks the channel, since a's state is revoked; a can't
+// break with an old state, and has to leave it to b.
+func TestReestablishOldData(t *testing.T) {
+	c, done := testChanDir(t)
+	defer done()
+
+	old := c.a.qchan(t, c.op)
+	c.push(t, c.b, 2000)
+	for c.deliver(t) {
+	}
+	err := c.a.nd.SaveQchanState(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.reconnect(t)
+	for c.deliver(t) {
+	}
+	if len(c.errs) != 1 || c.errs[0][:2] != "a:" {
+		t.Fatalf("errors %v, expect one from a", c.errs)
+	}
+	if len(c.b.wal.pushed) != 1 || !c.b.qchan(t, c.op).CloseData.Closed {
+		t.Fatalf("b didn't break the channel")
+	}
+	if len(c.a.wal.pushed) != 0 || c.a.qchan(t, c.op).CloseData.Closed {
+		t.Fatalf("a broke the channel with old data")
+	}
+}
+
+// TestReestablishLostData has one side come back with old data.
+func TestReestablishLostData(t *testing.T) {
+	var s StatCom
+	s.StateIdx = 10
+
+	for _, tc := range []struct {
+		them, theirRcv, rcv uint64
+		err                 error
+	}{
+		{10, 9, 9, nil},
+		{11, 9, 9, nil},            // they pushed
+		{12, 9, 9, errWeLostData},  // too far ahead
+		{10, 10, 9, errWeLostData}, // they have a revocation of our current state
+		{8, 7, 7, errTheyLostData},
+		{10, 6, 9, errTheyLostData},  // missing our revocations
+		{10, 9, 10, errTheyLostData}, // we've got theirs for their current state
+	} {
+		msg := lnutil.ReestablishMsg{StateIdx: tc.them, RevokedIdx: tc.theirRcv}
+		_, err := syncActions(&s, tc.rcv, msg)
+		if err != tc.err {
+			t.Errorf("them %d rcv %d, our rcv %d: got %v, expect %v",
+				tc.them, tc.theirRcv, tc.rcv, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package qln
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/routing"
+)
+
+// RouteEdges turns the graph's channels of one coin type into edges to
+// route over, two for each channel.  Other nodes' sides need a channel
+// update to be used.  Our sides of our own channels use what we have in
+// them, and only if the peer's connected.
+func (nd *LitNode) RouteEdges(coin uint32) ([]routing.Edge, error) {
+	anns, err := nd.GraphChans()
+	if err != nil {
+		return nil, err
+	}
+	updates, err := nd.GraphUpdates()
+	if err != nil {
+		return nil, err
+	}
+	fees := make(map[[37]byte]lnutil.ChanUpdateMsg)
+	for _, u := range updates {
+		var k [37]byte
+		opArr := lnutil.OutPointToBytes(u.Outpoint)
+		copy(k[:], opArr[:])
+		k[36] = u.Node
+		fees[k] = u
+	}
+	qcs, err := nd.GetAllQchans()
+	if err != nil {
+		return nil, err
+	}
+	ours := make(map[[36]byte]*Qchan)
+	for _, qc := range qcs {
+		ours[lnutil.OutPointToBytes(qc.Op)] = qc
+	}
+
+	us := nd.idPub()
+	var edges []routing.Edge
+	for _, ann := range anns {
+		if ann.Coin != coin {
+			continue
+		}
+		opArr := lnutil.OutPointToBytes(ann.Outpoint)
+		for i := 0; i < 2; i++ {
+			e := routing.Edge{
+				Outpoint: ann.Outpoint,
+				From:     ann.NodePub[i],
+				To:       ann.NodePub[1-i],
+				Capacity: ann.Capacity,
+			}
+			if e.From == us {
+				qc, ok := ours[opArr]
+				if !ok || qc.CloseData.Closed || !nd.ConnectedToPeer(qc.Peer()) {
+					continue
+				}
+				e.Capacity = qc.State.MyAmt - minBal
+				e.Delta = qc.Delay
+			} else {
+				var k [37]byte
+				copy(k[:], opArr[:])
+				k[36] = uint8(i)
+				u, ok := fees[k]
+				if !ok {
+					continue
+				}
+				e.FeeBase, e.FeeRate, e.Delta = u.FeeBase, u.FeeRate, u.Delta
+			}
+			if e.Capacity > 0 {
+				edges = append(edges, e)
+			}
+		}
+	}
+	return edges, nil
+}
+
+// QueryRoutes finds up to n routes to send amt to a node, best first
+func (nd *LitNode) QueryRoutes(dst [33]byte, coin uint32, amt int64, n int) (
+	[]routing.Route, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("asked for %d routes", n)
+	}
+	edges, err := nd.RouteEdges(coin)
+	if err != nil {
+		return nil, err
+	}
+	return nd.Router.FindRoutes(edges, nd.idPub(), dst, amt, n, time.Now())
+}
+
+// GraphNodePub finds a node in the graph by lit address or pubkey
+func (nd *LitNode) GraphNodePub(s string) ([33]byte, error) {
+	var pub [33]byte
+	adr, err := peerAdr(s)
+	if err != nil {
+		return pub, err
+	}
+	anns, err := nd.GraphChans()
+	if err != nil {
+		return pub, err
+	}
+	for _, ann := range anns {
+		for _, p := range ann.NodePub {
+			if lnutil.LitAdrFromPubkey(p) == adr {
+				return p, nil
+			}
+		}
+	}
+	return pub, fmt.Errorf("%s isn't in the graph", s)
+}
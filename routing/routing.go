@@ -0,0 +1,411 @@
+package routing
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adiabat/btcd/wire"
+)
+
+/*
+Routing finds ways to pay nodes through other nodes' channels.  It's a
+shortest path search (Dijkstra) over the channel graph, going backwards
+from the destination, since what each node charges depends on how much it
+has to send on.
+
+An edge's weight is what it costs to use it: the fee, plus what it's worth
+to not have the coins locked up for the node's timelock delta, plus a
+penalty for using up a lot of the channel's capacity (the balance might not
+be on the right side), plus a penalty for failing lately, which fades out
+over FailureMemory.  We don't charge ourselves fees or timelocks, so those
+don't count for the first hop.  Weights are never negative, and edges whose
+fees don't fit in an int64 can't be used.
+
+After the best route, more come from Yen's k shortest paths: for each node
+along the last route found, keep the route up to that node (the root), and
+search from the node on without the root's nodes, and without the next edge
+of every route found so far with the same root.  Since what an edge costs
+depends on the amount, and the root's amounts depend on the rest of the
+route, each candidate's weight gets worked out again for the whole route.
+*/
+
+// Edge is one direction of a channel: From sends to To through it, and
+// charges its fee for doing so.
+type Edge struct {
+	Outpoint wire.OutPoint
+	From     [33]byte
+	To       [33]byte
+	Capacity int64  // the most that can go through
+	FeeBase  int64  // satoshis
+	FeeRate  int64  // millionths of the amount
+	Delta    uint16 // blocks of timelock From wants
+}
+
+// Fee is what From charges to send amt to To.  It's false if the fee's
+// negative or doesn't fit in an int64.
+func (e Edge) Fee(amt int64) (int64, bool) {
+	if e.FeeBase < 0 || e.FeeRate < 0 || amt < 0 {
+		return 0, false
+	}
+	if e.FeeRate != 0 && amt > math.MaxInt64/e.FeeRate {
+		return 0, false
+	}
+	prop := amt * e.FeeRate / 1000000
+	if e.FeeBase > math.MaxInt64-prop {
+		return 0, false
+	}
+	return e.FeeBase + prop, true
+}
+
+// Hop is one channel in a route
+type Hop struct {
+	Edge
+	Amt int64 // what goes to To through the channel
+	Fee int64 // what From gets for it
+
+	idx int // which edge it is, in the search
+}
+
+// Route is a way to pay someone
+type Route struct {
+	Hops   []Hop
+	Amt    int64   // what the payer sends, with fees
+	Fee    int64   // all the fees
+	Delta  uint32  // all the timelock deltas
+	Weight float64 // what the search figured it costs, in satoshis
+}
+
+// Weights say how much things besides fees count, in satoshis
+type Weights struct {
+	// TimelockRisk is what having coins locked up costs, in billionths
+	// of the amount, a block.
+	TimelockRisk float64
+
+	// CapacityPenalty is added for an edge the payment takes all the
+	// capacity of; proportionally less for less.
+	CapacityPenalty float64
+
+	// FailurePenalty is added for an edge that just failed, going down to
+	// nothing over FailureMemory.
+	FailurePenalty float64
+	FailureMemory  time.Duration
+
+	// HopPenalty is added for every edge, so shorter routes win ties
+	HopPenalty float64
+}
+
+var DefaultWeights = Weights{
+	TimelockRisk:    15,
+	CapacityPenalty: 1000,
+	FailurePenalty:  100000,
+	FailureMemory:   time.Hour,
+	HopPenalty:      1,
+}
+
+// Router finds routes, and remembers which edges failed lately
+type Router struct {
+	Weights Weights
+
+	failures map[edgeKey]time.Time
+	mtx      sync.Mutex
+}
+
+type edgeKey struct {
+	op   wire.OutPoint
+	from [33]byte
+}
+
+func NewRouter() *Router {
+	r := new(Router)
+	r.Weights = DefaultWeights
+	r.failures = make(map[edgeKey]time.Time)
+	return r
+}
+
+// ReportFailure says a payment couldn't go from From through a channel
+func (r *Router) ReportFailure(op wire.OutPoint, from [33]byte, now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.failures[edgeKey{op, from}] = now
+}
+
+// ReportSuccess says a payment went through, so earlier failures don't count
+func (r *Router) ReportSuccess(op wire.OutPoint, from [33]byte) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.failures, edgeKey{op, from})
+}
+
+// failurePenalties works out the penalty for each edge that failed lately,
+// and forgets failures that are too old to count.
+func (r *Router) failurePenalties(now time.Time) map[edgeKey]float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	pens := make(map[edgeKey]float64)
+	for k, t := range r.failures {
+		age := now.Sub(t)
+		if age >= r.Weights.FailureMemory {
+			delete(r.failures, k)
+			continue
+		}
+		left := float64(r.Weights.FailureMemory-age) / float64(r.Weights.FailureMemory)
+		pens[k] = r.Weights.FailurePenalty * left
+	}
+	return pens
+}
+
+// FindRoutes finds up to n routes to send amt from src to dst over edges,
+// best first.
+func (r *Router) FindRoutes(edges []Edge, src, dst [33]byte, amt int64,
+	n int, now time.Time) ([]Route, error) {
+	if amt <= 0 {
+		return nil, fmt.Errorf("can't route %d", amt)
+	}
+	if src == dst {
+		return nil, fmt.Errorf("can't route to ourselves")
+	}
+
+	s := &search{
+		edges: edges,
+		into:  make(map[[33]byte][]int),
+		src:   src,
+		dst:   dst,
+		amt:   amt,
+		w:     r.Weights,
+		fails: r.failurePenalties(now),
+	}
+	for i, e := range edges {
+		s.into[e.To] = append(s.into[e.To], i)
+	}
+
+	path, ok := s.shortest(src, nil, nil)
+	if !ok {
+		return nil, fmt.Errorf("no route for %d", amt)
+	}
+	best, ok := s.route(path)
+	if !ok {
+		return nil, fmt.Errorf("no route for %d", amt)
+	}
+	routes := []Route{best}
+	var candidates []Route
+	for len(routes) < n {
+		last := routes[len(routes)-1]
+		for i, h := range last.Hops {
+			root := last.Hops[:i]
+
+			// the next edge of every route with the same root's out
+			banned := make(map[edgeKey]bool)
+			for _, r := range routes {
+				if len(r.Hops) > i && sameHops(r.Hops[:i], root) {
+					banned[edgeKey{r.Hops[i].Outpoint, r.Hops[i].From}] = true
+				}
+			}
+			// and so are the root's nodes, so routes don't loop
+			avoid := make(map[[33]byte]bool)
+			for _, rh := range root {
+				avoid[rh.From] = true
+			}
+
+			spur, ok := s.shortest(h.From, banned, avoid)
+			if !ok {
+				continue
+			}
+			path := make([]int, 0, len(root)+len(spur))
+			for _, rh := range root {
+				path = append(path, rh.idx)
+			}
+			c, ok := s.route(append(path, spur...))
+			if ok && !hasRoute(routes, c) && !hasRoute(candidates, c) {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Weight < candidates[j].Weight
+		})
+		routes = append(routes, candidates[0])
+		candidates = candidates[1:]
+	}
+	return routes, nil
+}
+
+// hasRoute says if a route's in a list already
+func hasRoute(routes []Route, r Route) bool {
+	for _, have := range routes {
+		if sameHops(have.Hops, r.Hops) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameHops says if two lists of hops go through the same edges
+func sameHops(a, b []Hop) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].idx != b[i].idx {
+			return false
+		}
+	}
+	return true
+}
+
+// search is one FindRoutes
+type search struct {
+	edges []Edge
+	into  map[[33]byte][]int // edges to each node
+	src   [33]byte
+	dst   [33]byte
+	amt   int64
+	w     Weights
+	fails map[edgeKey]float64
+}
+
+// nodeState is how to get from a node to the destination
+type nodeState struct {
+	weight float64
+	amt    int64 // what has to get to the node
+	next   int   // edge out of the node, towards dst
+	done   bool
+}
+
+// weight is what it costs to send amt through an edge.  It's false if the
+// edge can't take amt.
+func (s *search) weight(e Edge, amt int64) (float64, bool) {
+	if amt > e.Capacity {
+		return 0, false
+	}
+	w := s.w.HopPenalty + s.w.CapacityPenalty*float64(amt)/float64(e.Capacity)
+	if e.From != s.src {
+		fee, ok := e.Fee(amt)
+		if !ok {
+			return 0, false
+		}
+		w += float64(fee) +
+			float64(amt)*float64(e.Delta)*s.w.TimelockRisk/1000000000
+	}
+	w += s.fails[edgeKey{e.Outpoint, e.From}]
+	if w < 0 || math.IsNaN(w) {
+		// Dijkstra needs weights that don't go down
+		w = 0
+	}
+	return w, true
+}
+
+// sendAmt is what has to get to an edge's From to send amt through it
+func (s *search) sendAmt(e Edge, amt int64) (int64, bool) {
+	if e.From == s.src {
+		return amt, true
+	}
+	fee, ok := e.Fee(amt)
+	if !ok || amt > math.MaxInt64-fee {
+		return 0, false
+	}
+	return amt + fee, true
+}
+
+// shortest finds the best path from a node to dst, not using banned edges or
+// going through nodes to avoid.  It returns the path's edges, in order.
+func (s *search) shortest(from [33]byte,
+	banned map[edgeKey]bool, avoid map[[33]byte]bool) ([]int, bool) {
+	states := map[[33]byte]*nodeState{
+		s.dst: {amt: s.amt, next: -1},
+	}
+	q := &nodeQueue{{s.dst, 0}}
+	for q.Len() > 0 {
+		node := heap.Pop(q).(queued).node
+		ns := states[node]
+		if ns.done {
+			continue
+		}
+		ns.done = true
+		if node == from {
+			var path []int
+			for i := ns.next; i != -1; i = states[s.edges[i].To].next {
+				path = append(path, i)
+			}
+			return path, true
+		}
+
+		for _, i := range s.into[node] {
+			e := s.edges[i]
+			if banned[edgeKey{e.Outpoint, e.From}] || avoid[e.From] {
+				continue
+			}
+			prev, ok := states[e.From]
+			if ok && prev.done {
+				continue
+			}
+			ew, ok2 := s.weight(e, ns.amt)
+			if !ok2 {
+				continue
+			}
+			w := ns.weight + ew
+			if ok && prev.weight <= w {
+				continue
+			}
+			amt, ok2 := s.sendAmt(e, ns.amt)
+			if !ok2 {
+				continue
+			}
+			states[e.From] = &nodeState{weight: w, amt: amt, next: i}
+			heap.Push(q, queued{e.From, w})
+		}
+	}
+	return nil, false
+}
+
+// route works out the amounts and fees along a path from src to dst,
+// backwards from dst.  It's false if an edge can't take what has to go
+// through it.
+func (s *search) route(path []int) (Route, bool) {
+	r := Route{Hops: make([]Hop, len(path))}
+	amt := s.amt
+	for i := len(path) - 1; i >= 0; i-- {
+		e := s.edges[path[i]]
+		w, ok := s.weight(e, amt)
+		if !ok {
+			return Route{}, false
+		}
+		send, ok := s.sendAmt(e, amt)
+		if !ok {
+			return Route{}, false
+		}
+		r.Hops[i] = Hop{Edge: e, Amt: amt, Fee: send - amt, idx: path[i]}
+		r.Weight += w
+		if e.From != s.src {
+			r.Delta += uint32(e.Delta)
+		}
+		amt = send
+	}
+	r.Amt = amt
+	r.Fee = amt - s.amt
+	return r, true
+}
+
+type queued struct {
+	node   [33]byte
+	weight float64
+}
+
+// nodeQueue is a heap of nodes, lowest weight first
+type nodeQueue []queued
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(i, j int) bool  { return q[i].weight < q[j].weight }
+func (q nodeQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(queued)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,216 @@
+package routing
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/wire"
+)
+
+// test graph:
+//
+//	  b
+//	 / \
+//	a   d
+//	 \ /
+//	  c
+//
+// b is cheaper than c, but its channel to d is smaller.
+var (
+	nodeA = [33]byte{2, 'a'}
+	nodeB = [33]byte{2, 'b'}
+	nodeC = [33]byte{2, 'c'}
+	nodeD = [33]byte{2, 'd'}
+)
+
+func testEdges() []Edge {
+	chans := []struct {
+		a, b     [33]byte
+		capacity int64
+		feeBase  int64
+		feeRate  int64
+		delta    uint16
+	}{
+		{nodeA, nodeB, 1000000, 10, 1000, 10},
+		{nodeB, nodeD, 300000, 10, 1000, 10},
+		{nodeA, nodeC, 1000000, 500, 2000, 20},
+		{nodeC, nodeD, 1000000, 500, 2000, 20},
+	}
+	var edges []Edge
+	for i, c := range chans {
+		op := wire.OutPoint{Index: uint32(i)}
+		edges = append(edges,
+			Edge{op, c.a, c.b, c.capacity, c.feeBase, c.feeRate, c.delta},
+			Edge{op, c.b, c.a, c.capacity, c.feeBase, c.feeRate, c.delta})
+	}
+	return edges
+}
+
+func hops(r Route) [][33]byte {
+	nodes := [][33]byte{r.Hops[0].From}
+	for _, h := range r.Hops {
+		nodes = append(nodes, h.To)
+	}
+	return nodes
+}
+
+func samePath(r Route, nodes ...[33]byte) bool {
+	got := hops(r)
+	if len(got) != len(nodes) {
+		return false
+	}
+	for i := range got {
+		if got[i] != nodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFindRoutes(t *testing.T) {
+	r := NewRouter()
+	now := time.Now()
+
+	routes, err := r.FindRoutes(testEdges(), nodeA, nodeD, 100000, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("%d routes, expect 2", len(routes))
+	}
+	if !samePath(routes[0], nodeA, nodeB, nodeD) ||
+		!samePath(routes[1], nodeA, nodeC, nodeD) {
+		t.Fatalf("routes in wrong order")
+	}
+
+	// b charges 10 + 100000/1000; we don't charge ourselves
+	best := routes[0]
+	if best.Fee != 110 || best.Amt != 100110 || best.Delta != 10 {
+		t.Fatalf("fee %d amt %d delta %d, expect 110 100110 10",
+			best.Fee, best.Amt, best.Delta)
+	}
+	if best.Hops[0].Amt != 100110 || best.Hops[0].Fee != 0 ||
+		best.Hops[1].Amt != 100000 || best.Hops[1].Fee != 110 {
+		t.Fatalf("hops %+v", best.Hops)
+	}
+
+	// too big for b's channel to d
+	routes, err = r.FindRoutes(testEdges(), nodeA, nodeD, 400000, 3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || !samePath(routes[0], nodeA, nodeC, nodeD) {
+		t.Fatalf("big payment didn't go through c")
+	}
+
+	// too big for anything
+	_, err = r.FindRoutes(testEdges(), nodeA, nodeD, 2000000, 3, now)
+	if err == nil {
+		t.Fatalf("found a route bigger than the channels")
+	}
+}
+
+func TestRouteFailures(t *testing.T) {
+	r := NewRouter()
+	now := time.Now()
+
+	r.ReportFailure(wire.OutPoint{Index: 1}, nodeB, now)
+	routes, err := r.FindRoutes(testEdges(), nodeA, nodeD, 100000, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePath(routes[0], nodeA, nodeC, nodeD) {
+		t.Fatalf("went through b right after it failed")
+	}
+
+	// it's forgotten after a while
+	later := now.Add(r.Weights.FailureMemory)
+	routes, err = r.FindRoutes(testEdges(), nodeA, nodeD, 100000, 1, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePath(routes[0], nodeA, nodeB, nodeD) {
+		t.Fatalf("still avoiding b after FailureMemory")
+	}
+
+	r.ReportFailure(wire.OutPoint{Index: 1}, nodeB, now)
+	r.ReportSuccess(wire.OutPoint{Index: 1}, nodeB)
+	routes, err = r.FindRoutes(testEdges(), nodeA, nodeD, 100000, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePath(routes[0], nodeA, nodeB, nodeD) {
+		t.Fatalf("still avoiding b after it worked")
+	}
+}
+
+// TestMoreRoutes has three ways from a to d; each one after the first needs
+// more than one edge left out to find.
+func TestMoreRoutes(t *testing.T) {
+	nodeE := [33]byte{2, 'e'}
+	edges := testEdges()
+	for i, c := range [][2][33]byte{{nodeA, nodeE}, {nodeE, nodeD}} {
+		op := wire.OutPoint{Index: uint32(10 + i)}
+		edges = append(edges,
+			Edge{op, c[0], c[1], 1000000, 1000, 3000, 30},
+			Edge{op, c[1], c[0], 1000000, 1000, 3000, 30})
+	}
+
+	routes, err := NewRouter().FindRoutes(edges, nodeA, nodeD, 100000, 5, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("%d routes, expect 3", len(routes))
+	}
+	if !samePath(routes[0], nodeA, nodeB, nodeD) ||
+		!samePath(routes[1], nodeA, nodeC, nodeD) ||
+		!samePath(routes[2], nodeA, nodeE, nodeD) {
+		t.Fatalf("routes in wrong order")
+	}
+	for i := 1; i < len(routes); i++ {
+		if routes[i].Weight < routes[i-1].Weight {
+			t.Fatalf("route %d weight %f less than route %d's %f",
+				i, routes[i].Weight, i-1, routes[i-1].Weight)
+		}
+	}
+}
+
+func TestFeeOverflow(t *testing.T) {
+	e := Edge{FeeBase: 1, FeeRate: math.MaxInt64}
+	_, ok := e.Fee(1000)
+	if ok {
+		t.Fatalf("fee rate overflow not caught")
+	}
+	e = Edge{FeeBase: math.MaxInt64, FeeRate: 1000000}
+	_, ok = e.Fee(1)
+	if ok {
+		t.Fatalf("fee base overflow not caught")
+	}
+	e = Edge{FeeBase: -1000}
+	_, ok = e.Fee(1)
+	if ok {
+		t.Fatalf("negative fee allowed")
+	}
+
+	// b's huge fee means going through c; c's negative one doesn't help
+	edges := testEdges()
+	edges[2].FeeRate = math.MaxInt64 / 10
+	routes, err := NewRouter().FindRoutes(edges, nodeA, nodeD, 100000, 3, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || !samePath(routes[0], nodeA, nodeC, nodeD) {
+		t.Fatalf("went through b with a fee that overflows")
+	}
+	edges = testEdges()
+	edges[6].FeeBase = -1000000
+	routes, err = NewRouter().FindRoutes(edges, nodeA, nodeD, 100000, 3, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || !samePath(routes[0], nodeA, nodeB, nodeD) {
+		t.Fatalf("went through c with a negative fee")
+	}
+}
@@ -63,7 +63,7 @@ class TestBasic(LitTest):
         self.log.info("Send funds from bitcoind node to litnode0")
         balance = self.litnodes[0].get_balance(BC_REGTEST)
         self.log_balances(BC_REGTEST)
-        addr = self.litnodes[0].rpc.new_address()
+        addr = self.litnodes[0].Address(NumToMake=1, Legacy=True)
         self.bcnodes[0].sendtoaddress(address=addr["result"]["LegacyAddresses"][0], amount=12.34)
         self.bcnodes[0].generate(nblocks=1).text
 
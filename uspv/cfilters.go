@@ -0,0 +1,564 @@
+package uspv
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+Compact filter mode (BIP157/158).  After headers are synced, instead of
+asking for merkle blocks or every full block, get the filter headers for the
+blocks we need, check them against other nodes, then get the filters, and
+only download the blocks whose filters match something we're watching.
+The remote node never finds out what we're looking for.
+
+Filters are of scripts, not outpoints, so watched outpoints are found by
+their scripts.  Those are either our addresses, registered script hashes,
+or scripts picked up from txs we've seen.
+*/
+
+const (
+	// CFilterPrefix on a host means use compact filters.  After the prefix
+	// is a comma separated list of nodes; the first is synced from, and the
+	// rest are only used to check the first one's filter headers.
+	CFilterPrefix = "cf+"
+
+	// how long to wait for filter messages
+	cfTimeout = time.Second * 30
+)
+
+// CFilterHost makes a host string for Start which turns on compact filter
+// mode.  Nodes without a port get the network's default port.
+func CFilterHost(nodes []string, p *chaincfg.Params) string {
+	var hosts []string
+	// any of them could be a list already
+	for _, node := range strings.Split(strings.Join(nodes, ","), ",") {
+		if node == "" {
+			continue
+		}
+		hosts = append(hosts, hostPort(node, p))
+	}
+	return CFilterPrefix + strings.Join(hosts, ",")
+}
+
+// CFSync gets filters for the blocks after syncHeight up to headerTip from
+// sync peer p, and downloads the blocks that match.  When it's done it asks
+// for headers again, which ends up in the wait state if nothing new came in.
+func (s *SPVCon) CFSync(p *peer, headerTip int32) error {
+	if len(s.cfCheckers) == 0 && len(s.cfCheckHosts) != 0 {
+		s.connectCFCheckers()
+	}
+	if len(s.cfCheckers) == 0 {
+		log.Printf("WARNING no other nodes to check filter headers against\n")
+	}
+
+	for start := s.getSyncHeight() + 1; start <= headerTip; start += MaxGetCFilters {
+		end := start + MaxGetCFilters - 1
+		if end > headerTip {
+			end = headerTip
+		}
+		err := s.getCFHeaders(p, start, end)
+		if err != nil {
+			return err
+		}
+		err = s.getCFilters(p, start, end)
+		if err != nil {
+			return err
+		}
+	}
+	return s.askForHeaders(p)
+}
+
+// blockHashAt reads the block hash at a height from the header file
+func (s *SPVCon) blockHashAt(height int32) (chainhash.Hash, error) {
+	var hdr wire.BlockHeader
+	if height < s.firstHeaderHeight {
+		return chainhash.Hash{}, fmt.Errorf("no header at %d, headers start at %d",
+			height, s.firstHeaderHeight)
+	}
+	s.headerMutex.Lock()
+	defer s.headerMutex.Unlock()
+	_, err := s.headerFile.Seek(
+		int64((height-s.headerStartHeight)*80), os.SEEK_SET)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	err = hdr.Deserialize(s.headerFile)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return hdr.BlockHash(), nil
+}
+
+// getCFHeaders gets the filter headers for blocks start to end, checks them
+// against the other nodes, and keeps them in cfHeaders.
+func (s *SPVCon) getCFHeaders(p *peer, start, end int32) error {
+	stopHash, err := s.blockHashAt(end)
+	if err != nil {
+		return err
+	}
+	p.send(&MsgGetCFHeaders{
+		FilterType: FilterTypeBasic, StartHeight: uint32(start), StopHash: stopHash})
+
+	var m *MsgCFHeaders
+	select {
+	case m = <-s.cfHeadersChan:
+	case <-p.quit:
+		return fmt.Errorf("lost connection to %s", p.addr)
+	case <-time.After(cfTimeout):
+		return fmt.Errorf("timed out waiting for filter headers %d to %d", start, end)
+	}
+	err = checkCFHeaders(m, stopHash, start, end)
+	if err != nil {
+		return err
+	}
+	headers := m.FilterHeaders()
+
+	// the header before start has to fit on to what we already have
+	prev, ok := s.cfHeaders[start-1]
+	if ok && !prev.IsEqual(&m.PrevFilterHeader) {
+		return fmt.Errorf("filter header %d doesn't fit: %s, expect %s",
+			start-1, m.PrevFilterHeader.String(), prev.String())
+	}
+
+	// see if everyone else agrees
+	for i := 0; i < len(s.cfCheckers); i++ {
+		c := s.cfCheckers[i]
+		cm, err := c.GetCFHeaders(start, stopHash)
+		if err == nil {
+			err = checkCFHeaders(cm, stopHash, start, end)
+		}
+		if err != nil {
+			log.Printf("dropping filter header checker %s: %s\n", c.host, err.Error())
+			c.Close()
+			s.cfCheckers = append(s.cfCheckers[:i], s.cfCheckers[i+1:]...)
+			i--
+			continue
+		}
+		theirs := cm.FilterHeaders()
+		if cm.PrevFilterHeader.IsEqual(&m.PrevFilterHeader) &&
+			theirs[len(theirs)-1].IsEqual(&headers[len(headers)-1]) {
+			continue // agree
+		}
+
+		primaryOK, err := s.cfDispute(p, c, start, m, cm, ok)
+		if err != nil {
+			return err
+		}
+		if !primaryOK {
+			s.misbehaving(p, banThreshold, "bad filter headers")
+			return fmt.Errorf("%s gave bad filter headers from %d, not syncing",
+				p.addr, start)
+		}
+		log.Printf("dropping filter header checker %s: bad filter headers\n", c.host)
+		c.Close()
+		s.cfCheckers = append(s.cfCheckers[:i], s.cfCheckers[i+1:]...)
+		i--
+	}
+
+	s.cfHeaders[start-1] = m.PrevFilterHeader
+	for i, h := range headers {
+		s.cfHeaders[start+int32(i)] = h
+	}
+	return nil
+}
+
+// checkCFHeaders makes sure a cfheaders message is the one we asked for
+func checkCFHeaders(m *MsgCFHeaders, stopHash chainhash.Hash, start, end int32) error {
+	if m.FilterType != FilterTypeBasic || !m.StopHash.IsEqual(&stopHash) {
+		return fmt.Errorf("got filter headers to %s, asked for %s",
+			m.StopHash.String(), stopHash.String())
+	}
+	if len(m.FilterHashes) != int(end-start+1) {
+		return fmt.Errorf("got %d filter headers, asked for %d",
+			len(m.FilterHashes), end-start+1)
+	}
+	return nil
+}
+
+// cfDispute figures out who's lying when the main node and a checker give
+// different filter headers.  Find the first block they disagree on, get its
+// filter from both, and get the block.  Every output script in the block
+// has to be in the filter; if one of them leaves something out, that one's
+// lying.  Returns true if the main node p is OK and the checker isn't.
+// Errors if it can't tell.
+func (s *SPVCon) cfDispute(p *peer, c *cfPeer, start int32,
+	ours, theirs *MsgCFHeaders, prevKnown bool) (bool, error) {
+
+	if !ours.PrevFilterHeader.IsEqual(&theirs.PrevFilterHeader) {
+		// before this range; whoever doesn't match what we have is wrong
+		if prevKnown {
+			return true, nil
+		}
+		return false, fmt.Errorf("nodes disagree on filter header %d, can't tell who's right",
+			start-1)
+	}
+
+	height := start
+	for i, fh := range ours.FilterHashes {
+		if !fh.IsEqual(&theirs.FilterHashes[i]) {
+			height = start + int32(i)
+			break
+		}
+	}
+	log.Printf("nodes disagree on filter for block %d\n", height)
+
+	hash, err := s.blockHashAt(height)
+	if err != nil {
+		return false, err
+	}
+	blk, err := c.GetBlock(hash)
+	if err != nil {
+		return false, err
+	}
+	bHash := blk.BlockHash()
+	if !bHash.IsEqual(&hash) || !BlockOK(*blk) {
+		return false, fmt.Errorf("checker %s gave bad block %d", c.host, height)
+	}
+	scripts := BasicFilterScripts(blk, nil)
+	key := BasicFilterKey(&hash)
+
+	// their filter
+	theirFilter, err := c.GetCFilter(height, hash)
+	if err != nil {
+		return false, err
+	}
+	theirHash := FilterHash(theirFilter.Data)
+	theirsOK := theirHash.IsEqual(&theirs.FilterHashes[height-start]) &&
+		filterHasAll(key, theirFilter.Data, scripts)
+
+	// our filter
+	p.send(&MsgGetCFilters{
+		FilterType: FilterTypeBasic, StartHeight: uint32(height), StopHash: hash})
+	var ourFilter *MsgCFilter
+	select {
+	case ourFilter = <-s.cfilterChan:
+	case <-p.quit:
+		return false, fmt.Errorf("lost connection to %s", p.addr)
+	case <-time.After(cfTimeout):
+		return false, fmt.Errorf("timed out waiting for filter %d", height)
+	}
+	ourHash := FilterHash(ourFilter.Data)
+	oursOK := ourFilter.BlockHash.IsEqual(&hash) &&
+		ourHash.IsEqual(&ours.FilterHashes[height-start]) &&
+		filterHasAll(key, ourFilter.Data, scripts)
+
+	if oursOK == theirsOK {
+		return false, fmt.Errorf("nodes disagree on filter %d, can't tell who's right",
+			height)
+	}
+	return oursOK, nil
+}
+
+// filterHasAll is true if every item is in the filter
+func filterHasAll(key [16]byte, filter []byte, items [][]byte) bool {
+	for _, item := range items {
+		match, err := MatchFilter(key, filter, [][]byte{item})
+		if err != nil || !match {
+			return false
+		}
+	}
+	return true
+}
+
+// getCFilters gets the filters for blocks start to end, checks them against
+// the filter headers, and asks for the blocks that match.  Heights go up to
+// the wallit as we go.
+func (s *SPVCon) getCFilters(p *peer, start, end int32) error {
+	stopHash, err := s.blockHashAt(end)
+	if err != nil {
+		return err
+	}
+	q := s.syncQueue(p)
+	if q == nil {
+		return fmt.Errorf("%s isn't the sync peer any more", p.addr)
+	}
+	p.send(&MsgGetCFilters{
+		FilterType: FilterTypeBasic, StartHeight: uint32(start), StopHash: stopHash})
+
+	scripts := s.watchScripts()
+	for height := start; height <= end; height++ {
+		var m *MsgCFilter
+		select {
+		case m = <-s.cfilterChan:
+		case <-p.quit:
+			return fmt.Errorf("lost connection to %s", p.addr)
+		case <-time.After(cfTimeout):
+			return fmt.Errorf("timed out waiting for filter %d", height)
+		}
+
+		hash, err := s.blockHashAt(height)
+		if err != nil {
+			return err
+		}
+		if m.FilterType != FilterTypeBasic || !m.BlockHash.IsEqual(&hash) {
+			return fmt.Errorf("got filter for %s, expect %s at height %d",
+				m.BlockHash.String(), hash.String(), height)
+		}
+		prev := s.cfHeaders[height-1]
+		want := s.cfHeaders[height]
+		got := NextFilterHeader(FilterHash(m.Data), prev)
+		if !got.IsEqual(&want) {
+			s.misbehaving(p, banThreshold, "filter doesn't match filter header")
+			return fmt.Errorf("filter %d doesn't match filter header", height)
+		}
+		delete(s.cfHeaders, height-1)
+
+		match, err := MatchFilter(BasicFilterKey(&hash), m.Data, scripts)
+		if err != nil {
+			return err
+		}
+		if !match {
+			s.setSyncHeight(height)
+			s.CurrentHeightChan <- height
+			continue
+		}
+
+		// get the whole block; IngestBlock does the rest
+		log.Printf("filter match at height %d, getting block %s\n",
+			height, hash.String())
+		gdataMsg := wire.NewMsgGetData()
+		err = gdataMsg.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash))
+		if err != nil {
+			return err
+		}
+		select {
+		case q <- NewRootAndHeight(hash, height):
+		case <-p.quit:
+			return fmt.Errorf("lost connection to %s", p.addr)
+		}
+		p.send(gdataMsg)
+		select {
+		case <-s.cfBlockDone:
+		case <-p.quit:
+			return fmt.Errorf("lost connection to %s", p.addr)
+		case <-time.After(cfTimeout):
+			select { // take it back off the queue
+			case <-q:
+			default:
+			}
+			return fmt.Errorf("timed out waiting for block %d", height)
+		}
+		// the block may have given us new things to watch
+		scripts = s.watchScripts()
+	}
+	return nil
+}
+
+// watchScripts returns the output scripts of everything we're watching.
+// Addresses could be p2wpkh or p2pkh, so both go in.  Outpoints whose
+// scripts we don't know are left out; they're ours, and paid to an address
+// or script hash that's already here.
+func (s *SPVCon) watchScripts() [][]byte {
+	var scripts [][]byte
+
+	s.TrackingAdrsMtx.Lock()
+	for adr, _ := range s.TrackingAdrs {
+		scripts = append(scripts,
+			append([]byte{0x00, 0x14}, adr[:]...),
+			append(append([]byte{0x76, 0xa9, 0x14}, adr[:]...), 0x88, 0xac))
+	}
+	for sh, _ := range s.TrackingScripts {
+		scripts = append(scripts, append([]byte{0x00, 0x20}, sh[:]...))
+	}
+	s.TrackingAdrsMtx.Unlock()
+
+	s.TrackingOPsMtx.Lock()
+	for op, _ := range s.TrackingOPs {
+		script, ok := s.opScripts[op]
+		if !ok {
+			// maybe it's from a tx we sent
+			tx, ok := s.TxMap[op.Hash]
+			if !ok || int(op.Index) >= len(tx.TxOut) {
+				continue
+			}
+			script = tx.TxOut[op.Index].PkScript
+			s.opScripts[op] = script
+		}
+		scripts = append(scripts, script)
+	}
+	s.TrackingOPsMtx.Unlock()
+
+	return scripts
+}
+
+// connectCFCheckers connects to the other nodes to check filter headers with.
+// Ones that don't work are skipped.
+func (s *SPVCon) connectCFCheckers() {
+	for _, host := range s.cfCheckHosts {
+		c, err := dialCFPeer(s.Dialer, host, s.Param)
+		if err != nil {
+			log.Printf("can't check filter headers with %s: %s\n", host, err.Error())
+			continue
+		}
+		log.Printf("checking filter headers with %s\n", host)
+		s.cfCheckers = append(s.cfCheckers, c)
+	}
+}
+
+// cfPeer is a connection to another node, just for checking filter headers.
+// It doesn't have a message handler; it sends a request and reads until the
+// reply shows up.
+type cfPeer struct {
+	host  string
+	con   net.Conn
+	param *chaincfg.Params
+}
+
+// dialCFPeer connects and does the version handshake.  The node has to
+// serve compact filters.  d can be nil to dial directly.
+func dialCFPeer(d lnutil.Dialer, host string, p *chaincfg.Params) (
+	*cfPeer, error) {
+	con, err := lnutil.DialTimeout(d, host, cfTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &cfPeer{host: host, con: con, param: p}
+
+	myMsgVer, err := wire.NewMsgVersionFromConn(con, 0, 0)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	err = myMsgVer.AddUserAgent("lit", "v0.1")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	myMsgVer.AddService(wire.SFNodeWitness)
+	err = c.write(myMsgVer)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for {
+		m, err := c.read()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		mv, ok := m.(*wire.MsgVersion)
+		if !ok {
+			continue
+		}
+		if mv.Services&SFNodeCompactFilters == 0 {
+			c.Close()
+			return nil, fmt.Errorf("%s doesn't serve compact filters", host)
+		}
+		break
+	}
+	err = c.write(wire.NewMsgVerAck())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *cfPeer) Close() {
+	c.con.Close()
+}
+
+func (c *cfPeer) write(msg wire.Message) error {
+	c.con.SetWriteDeadline(time.Now().Add(cfTimeout))
+	_, err := wire.WriteMessageWithEncodingN(
+		c.con, msg, VERSION, c.param.Net, wire.LatestEncoding)
+	return err
+}
+
+// read returns the next message, answering pings on the way
+func (c *cfPeer) read() (wire.Message, error) {
+	for {
+		c.con.SetReadDeadline(time.Now().Add(cfTimeout))
+		_, m, err := readMessage(c.con, VERSION, c.param.Net)
+		if err != nil {
+			return nil, err
+		}
+		if ping, ok := m.(*wire.MsgPing); ok {
+			err = c.write(wire.NewMsgPong(ping.Nonce))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if m != nil {
+			return m, nil
+		}
+	}
+}
+
+// GetCFHeaders asks for filter headers from start to stopHash
+func (c *cfPeer) GetCFHeaders(start int32, stopHash chainhash.Hash) (
+	*MsgCFHeaders, error) {
+
+	err := c.write(&MsgGetCFHeaders{
+		FilterType: FilterTypeBasic, StartHeight: uint32(start), StopHash: stopHash})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if cfh, ok := m.(*MsgCFHeaders); ok && cfh.StopHash.IsEqual(&stopHash) {
+			return cfh, nil
+		}
+	}
+}
+
+// GetCFilter asks for the filter of one block
+func (c *cfPeer) GetCFilter(height int32, hash chainhash.Hash) (*MsgCFilter, error) {
+	err := c.write(&MsgGetCFilters{
+		FilterType: FilterTypeBasic, StartHeight: uint32(height), StopHash: hash})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if cf, ok := m.(*MsgCFilter); ok && cf.BlockHash.IsEqual(&hash) {
+			return cf, nil
+		}
+	}
+}
+
+// GetBlock asks for a full block with witnesses
+func (c *cfPeer) GetBlock(hash chainhash.Hash) (*wire.MsgBlock, error) {
+	gdataMsg := wire.NewMsgGetData()
+	err := gdataMsg.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &hash))
+	if err != nil {
+		return nil, err
+	}
+	err = c.write(gdataMsg)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if blk, ok := m.(*wire.MsgBlock); ok {
+			bHash := blk.BlockHash()
+			if bHash.IsEqual(&hash) {
+				return blk, nil
+			}
+		}
+		if nf, ok := m.(*wire.MsgNotFound); ok && len(nf.InvList) != 0 {
+			return nil, fmt.Errorf("%s doesn't have block %s", c.host, hash.String())
+		}
+	}
+}
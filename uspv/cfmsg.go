@@ -0,0 +1,256 @@
+package uspv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// BIP157 compact filter messages.  The wire package doesn't know about these,
+// so they get read off the connection by readMessage here, and everything
+// else gets handed to the wire package.
+
+const (
+	CmdGetCFilters  = "getcfilters"
+	CmdCFilter      = "cfilter"
+	CmdGetCFHeaders = "getcfheaders"
+	CmdCFHeaders    = "cfheaders"
+
+	// most filters / filter headers one request can ask for
+	MaxGetCFilters  = 1000
+	MaxGetCFHeaders = 2000
+
+	// SFNodeCompactFilters is the service bit for nodes which serve filters
+	SFNodeCompactFilters wire.ServiceFlag = 1 << 6
+
+	// 4 byte magic, 12 byte command, 4 byte length, 4 byte checksum
+	msgHeaderSize = 24
+)
+
+// MsgGetCFilters asks for the filters of blocks StartHeight to StopHash.
+type MsgGetCFilters struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    chainhash.Hash
+}
+
+func (m *MsgGetCFilters) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	return readElements(r, &m.FilterType, &m.StartHeight, &m.StopHash)
+}
+
+func (m *MsgGetCFilters) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	return writeElements(w, m.FilterType, m.StartHeight, &m.StopHash)
+}
+
+func (m *MsgGetCFilters) Command() string { return CmdGetCFilters }
+
+func (m *MsgGetCFilters) MaxPayloadLength(pver uint32) uint32 { return 1 + 4 + 32 }
+
+// MsgCFilter is one block's filter.
+type MsgCFilter struct {
+	FilterType uint8
+	BlockHash  chainhash.Hash
+	Data       []byte
+}
+
+func (m *MsgCFilter) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	err := readElements(r, &m.FilterType, &m.BlockHash)
+	if err != nil {
+		return err
+	}
+	m.Data, err = wire.ReadVarBytes(r, pver, wire.MaxMessagePayload, "cfilter data")
+	return err
+}
+
+func (m *MsgCFilter) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	err := writeElements(w, m.FilterType, &m.BlockHash)
+	if err != nil {
+		return err
+	}
+	return wire.WriteVarBytes(w, pver, m.Data)
+}
+
+func (m *MsgCFilter) Command() string { return CmdCFilter }
+
+func (m *MsgCFilter) MaxPayloadLength(pver uint32) uint32 { return wire.MaxMessagePayload }
+
+// MsgGetCFHeaders asks for the filter hashes of blocks StartHeight to StopHash,
+// and the filter header before StartHeight.
+type MsgGetCFHeaders struct {
+	FilterType  uint8
+	StartHeight uint32
+	StopHash    chainhash.Hash
+}
+
+func (m *MsgGetCFHeaders) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	return readElements(r, &m.FilterType, &m.StartHeight, &m.StopHash)
+}
+
+func (m *MsgGetCFHeaders) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	return writeElements(w, m.FilterType, m.StartHeight, &m.StopHash)
+}
+
+func (m *MsgGetCFHeaders) Command() string { return CmdGetCFHeaders }
+
+func (m *MsgGetCFHeaders) MaxPayloadLength(pver uint32) uint32 { return 1 + 4 + 32 }
+
+// MsgCFHeaders has filter hashes up to StopHash, which chain onto
+// PrevFilterHeader to make the filter headers.
+type MsgCFHeaders struct {
+	FilterType       uint8
+	StopHash         chainhash.Hash
+	PrevFilterHeader chainhash.Hash
+	FilterHashes     []chainhash.Hash
+}
+
+func (m *MsgCFHeaders) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	err := readElements(r, &m.FilterType, &m.StopHash, &m.PrevFilterHeader)
+	if err != nil {
+		return err
+	}
+	count, err := wire.ReadVarInt(r, pver)
+	if err != nil {
+		return err
+	}
+	if count > MaxGetCFHeaders {
+		return fmt.Errorf("cfheaders has %d hashes, max %d", count, MaxGetCFHeaders)
+	}
+	m.FilterHashes = make([]chainhash.Hash, count)
+	for i, _ := range m.FilterHashes {
+		_, err = io.ReadFull(r, m.FilterHashes[i][:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MsgCFHeaders) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	err := writeElements(w, m.FilterType, &m.StopHash, &m.PrevFilterHeader)
+	if err != nil {
+		return err
+	}
+	err = wire.WriteVarInt(w, pver, uint64(len(m.FilterHashes)))
+	if err != nil {
+		return err
+	}
+	for _, h := range m.FilterHashes {
+		_, err = w.Write(h[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MsgCFHeaders) Command() string { return CmdCFHeaders }
+
+func (m *MsgCFHeaders) MaxPayloadLength(pver uint32) uint32 {
+	return 1 + 32 + 32 + 3 + 32*MaxGetCFHeaders
+}
+
+// FilterHeaders chains the filter hashes onto the previous header, returning
+// the filter header for each block.
+func (m *MsgCFHeaders) FilterHeaders() []chainhash.Hash {
+	headers := make([]chainhash.Hash, len(m.FilterHashes))
+	prev := m.PrevFilterHeader
+	for i, fh := range m.FilterHashes {
+		headers[i] = NextFilterHeader(fh, prev)
+		prev = headers[i]
+	}
+	return headers
+}
+
+func readElements(r io.Reader, elements ...interface{}) error {
+	for _, e := range elements {
+		var err error
+		switch e := e.(type) {
+		case *chainhash.Hash:
+			_, err = io.ReadFull(r, e[:])
+		default:
+			err = binary.Read(r, binary.LittleEndian, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeElements(w io.Writer, elements ...interface{}) error {
+	for _, e := range elements {
+		var err error
+		switch e := e.(type) {
+		case *chainhash.Hash:
+			_, err = w.Write(e[:])
+		default:
+			err = binary.Write(w, binary.LittleEndian, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessage reads one message from the remote node.  Compact filter
+// messages are decoded here, and everything else by the wire package.
+// Messages that can't be decoded are skipped, returning a nil message but
+// no error; only connection problems are errors.
+func readMessage(r io.Reader, pver uint32, net wire.BitcoinNet) (
+	int, wire.Message, error) {
+
+	var hdr [msgHeaderSize]byte
+	n, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return n, nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:4]) != uint32(net) {
+		return n, nil, fmt.Errorf("message from wrong network %x",
+			binary.LittleEndian.Uint32(hdr[:4]))
+	}
+	command := string(bytes.TrimRight(hdr[4:16], "\x00"))
+	length := binary.LittleEndian.Uint32(hdr[16:20])
+	if length > wire.MaxMessagePayload {
+		return n, nil, fmt.Errorf("%s message %d bytes long, max %d",
+			command, length, wire.MaxMessagePayload)
+	}
+	payload := make([]byte, length)
+	m, err := io.ReadFull(r, payload)
+	n += m
+	if err != nil {
+		return n, nil, err
+	}
+	if !bytes.Equal(chainhash.DoubleHashB(payload)[:4], hdr[20:24]) {
+		log.Printf("bad checksum on %s message, ignoring\n", command)
+		return n, nil, nil
+	}
+
+	var msg wire.Message
+	switch command {
+	case CmdCFilter:
+		msg = new(MsgCFilter)
+	case CmdCFHeaders:
+		msg = new(MsgCFHeaders)
+	default:
+		_, msg, _, err = wire.ReadMessageWithEncodingN(
+			bytes.NewReader(append(hdr[:], payload...)), pver, net,
+			wire.LatestEncoding)
+		if err != nil {
+			log.Printf("ignoring %s message: %s\n", command, err.Error())
+			return n, nil, nil
+		}
+		return n, msg, nil
+	}
+	err = msg.BtcDecode(bytes.NewReader(payload), pver, wire.LatestEncoding)
+	if err != nil {
+		log.Printf("ignoring %s message: %s\n", command, err.Error())
+		return n, nil, nil
+	}
+	return n, msg, nil
+}
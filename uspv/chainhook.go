@@ -1,7 +1,11 @@
 package uspv
 
 import (
+	"fmt"
+	"log"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/adiabat/btcd/chaincfg"
 	"github.com/adiabat/btcd/chaincfg/chainhash"
@@ -14,10 +18,12 @@ type ChainHook interface {
 
 	Start() chan lnutil.TxAndHeight
 	RegisterAddress(address [20]byte) error
+	RegisterScriptHash(scriptHash [32]byte) error
 	RegisterOutPoint(wire.OutPoint) error
 	SetHeight(startHeight int32) chan int32
 	PushTx(tx *wire.MsgTx) error
 	RawBlocks() chan *wire.MsgBlock
+	BlockDisconnects() chan lnutil.BlockDisconnect
 }
 */
 
@@ -33,15 +39,42 @@ func (s *SPVCon) Start(
 
 	s.Param = params
 
+	// compact filter hosts look like cf+node1:port,node2:port
+	if strings.HasPrefix(host, CFilterPrefix) {
+		nodes := strings.Split(strings.TrimPrefix(host, CFilterPrefix), ",")
+		host = nodes[0]
+		s.cfCheckHosts = nodes[1:]
+		s.CFilters = true
+		s.HardMode = false
+	}
+
+	// otherwise hosts are a comma separated list of nodes to connect to
+	// before finding others.
+	for _, h := range strings.Split(host, ",") {
+		if h != "" {
+			s.peerHosts = append(s.peerHosts, hostPort(h, params))
+		}
+	}
+	s.peers = make(map[string]*peer)
+	s.knownAddrs = make(map[string]bool)
+	s.banned = make(map[string]time.Time)
+	s.needPeers = make(chan bool, 1)
+
 	s.TrackingAdrs = make(map[[20]byte]bool)
+	s.TrackingScripts = make(map[[32]byte]bool)
 	s.TrackingOPs = make(map[wire.OutPoint]bool)
+	s.opScripts = make(map[wire.OutPoint][]byte)
 
 	s.TxMap = make(map[chainhash.Hash]*wire.MsgTx)
+	s.mempool = newMempool()
 
 	s.OKTxids = make(map[chainhash.Hash]int32)
+	s.pendingProofs = make(map[chainhash.Hash]lnutil.TxProof)
 
 	s.TxUpToWallit = make(chan lnutil.TxAndHeight, 1)
 	s.CurrentHeightChan = make(chan int32, 1)
+	s.DisconnectChan = make(chan lnutil.BlockDisconnect)
+	s.ConflictChan = make(chan lnutil.TxConflict, 32)
 
 	s.syncHeight = startHeight
 
@@ -51,16 +84,42 @@ func (s *SPVCon) Start(
 	if err != nil {
 		return nil, nil, err
 	}
-
-	err = s.Connect(host)
+	err = s.openProofDB(filepath.Join(path, "txproof.db"))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = s.AskForHeaders()
-	if err != nil {
-		return nil, nil, err
+	// assign version bits for local node
+	s.localVersion = VERSION
+	s.inMsgQueue = make(chan peerMsg)
+	go s.incomingMessageHandler()
+
+	if s.HardMode {
+		s.blockQueue = make(chan HashAndHeight, 32) // queue depth 32 for hardmode.
+	} else {
+		// for SPV, concurrent in-flight merkleblocks makes us miss txs.
+		// The BloomUpdateAll setting seems like it should prevent it, but it
+		// doesn't; occasionally it misses transactions, seems like with low
+		// block index.  Could be a bug somewhere.  1 at a time merkleblock
+		// seems OK.
+		s.blockQueue = make(chan HashAndHeight, 1) // queue depth 1 for spv
 	}
+	s.fPositives = make(chan int32, 4000) // a block full, approx
+	s.inWaitState = make(chan bool, 1)
+	if s.CFilters {
+		s.cfHeaders = make(map[int32]chainhash.Hash)
+		s.cfHeadersChan = make(chan *MsgCFHeaders, 1)
+		s.cfilterChan = make(chan *MsgCFilter, MaxGetCFilters)
+		s.cfBlockDone = make(chan int32, 1)
+	}
+	go s.fPositiveHandler()
+
+	// get one node to start syncing from; the peer manager finds the rest
+	s.fillPool(1)
+	if s.numPeers() == 0 {
+		return nil, nil, fmt.Errorf("couldn't connect to any %s nodes", params.Name)
+	}
+	go s.peerManager()
 
 	return s.TxUpToWallit, s.CurrentHeightChan, nil
 }
@@ -72,6 +131,13 @@ func (s *SPVCon) RegisterAddress(adr160 [20]byte) error {
 	return nil
 }
 
+func (s *SPVCon) RegisterScriptHash(scriptHash [32]byte) error {
+	s.TrackingAdrsMtx.Lock()
+	s.TrackingScripts[scriptHash] = true
+	s.TrackingAdrsMtx.Unlock()
+	return nil
+}
+
 func (s *SPVCon) RegisterOutPoint(op wire.OutPoint) error {
 	s.TrackingOPsMtx.Lock()
 	s.TrackingOPs[op] = true
@@ -79,6 +145,32 @@ func (s *SPVCon) RegisterOutPoint(op wire.OutPoint) error {
 	return nil
 }
 
+// Rescan goes back and requests all the blocks from fromHeight again.
+// Only works once synced; if it's in the middle of syncing, returns an error.
+func (s *SPVCon) Rescan(fromHeight int32) error {
+	if fromHeight < s.firstHeaderHeight {
+		return fmt.Errorf("Can't rescan from %d, headers start at %d",
+			fromHeight, s.firstHeaderHeight)
+	}
+
+	select {
+	case <-s.inWaitState:
+		// synced, ok to go back
+	default:
+		return fmt.Errorf("Can't rescan while syncing, try again later")
+	}
+
+	log.Printf("rescanning from height %d\n", fromHeight)
+	s.setSyncHeight(fromHeight - 1)
+	go func() {
+		err := s.AskForBlocks()
+		if err != nil {
+			log.Printf("Rescan AskForBlocks error: %s", err.Error())
+		}
+	}()
+	return nil
+}
+
 // PushTx sends a tx out to the global network
 func (s *SPVCon) PushTx(tx *wire.MsgTx) error {
 	// store tx in the RAM map for when other nodes ask for it
@@ -92,8 +184,15 @@ func (s *SPVCon) PushTx(tx *wire.MsgTx) error {
 	if err != nil {
 		return err
 	}
-	// broadcast inv message
-	s.outMsgQueue <- invMsg
+	// broadcast inv message to everyone
+	s.broadcast(invMsg)
+
+	// if it spends something another unconfirmed tx does, one of them is
+	// going to lose
+	conflicts := s.mempool.add(tx, true)
+	if len(conflicts) > 0 {
+		go s.sendConflicts(conflicts)
+	}
 
 	return nil
 }
@@ -101,3 +200,12 @@ func (s *SPVCon) PushTx(tx *wire.MsgTx) error {
 func (s *SPVCon) RawBlocks() chan *wire.MsgBlock {
 	return s.RawBlockSender
 }
+
+func (s *SPVCon) BlockDisconnects() chan lnutil.BlockDisconnect {
+	return s.DisconnectChan
+}
+
+// TxConflicts gives the channel where double spent unconfirmed txs come up
+func (s *SPVCon) TxConflicts() chan lnutil.TxConflict {
+	return s.ConflictChan
+}
@@ -0,0 +1,121 @@
+package uspv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+/*
+Checkpoints.  Headers at a checkpoint's height have to hash to the
+checkpoint, so nobody can feed us a different chain from before it no matter
+how much work it has.  Checkpoints come from the network's chaincfg params
+(just hashes) and from HeaderCheckpoints (whole headers, built in).
+
+A new header file doesn't have to start at genesis; it can start from a
+built in header instead.  Those have to be at the start of a difficulty
+epoch, so the headers after them can be checked without any before.
+*/
+
+// HeaderCheckpoint is a block header we know is in the chain, and its
+// height.  Header is the hex of the 80 byte header.
+type HeaderCheckpoint struct {
+	Height int32
+	Header string
+}
+
+// HeaderCheckpoints are the headers we ship with, by network name.  Oldest
+// first.  litetest4 and litereg start from their genesis blocks since
+// chaincfg's don't work for them.  New ones come from
+// testdata/checkpoints.go, and checkpoints_test.go has to know their hashes.
+var HeaderCheckpoints = map[string][]HeaderCheckpoint{
+	"mainnet": {
+		// 000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f
+		{0, "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c"},
+	},
+	"testnet3": {
+		// 0000000000000b954713945f45fdfab79489755f7e32a3be931f487b811d063c
+		{1032192, "00000020da33925b1f7a55e9fa8e6c955a20ea094148b60c5c88f69a4f500000000000003673b7b6ce8157d3cfcaf415b6740918df7610a8769d70334aa9abd9c941b25e7621215880ba371a85bf9646"},
+	},
+	"litetest4": {
+		// 4966625a4b2851d9fdee139e56211a0d88575f59ed816ff5e6a63deb4e3e29a0
+		{0, "010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97f60ba158f0ff0f1ee1790400"},
+	},
+	"litereg": {
+		// 530827f38f93b43ed12af0b3ad25a288dc02ed74d6d7857862df51fc56c416f9
+		{0, "010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97dae5494dffff7f2000000000"},
+	},
+}
+
+// BlockHeader decodes the checkpoint's header
+func (c HeaderCheckpoint) BlockHeader() (wire.BlockHeader, error) {
+	var hdr wire.BlockHeader
+	b, err := hex.DecodeString(c.Header)
+	if err != nil {
+		return hdr, err
+	}
+	if len(b) != 80 {
+		return hdr, fmt.Errorf("checkpoint %d header is %d bytes", c.Height, len(b))
+	}
+	err = hdr.Deserialize(bytes.NewReader(b))
+	return hdr, err
+}
+
+// checkpointHash returns the hash the header at height has to have, if
+// there's a checkpoint there.
+func checkpointHash(height int32, p *chaincfg.Params) (chainhash.Hash, bool) {
+	for _, c := range p.Checkpoints {
+		if c.Height == height && c.Hash != nil {
+			return *c.Hash, true
+		}
+	}
+	for _, c := range HeaderCheckpoints[p.Name] {
+		if c.Height != height {
+			continue
+		}
+		hdr, err := c.BlockHeader()
+		if err != nil {
+			// can't match a broken checkpoint
+			return chainhash.Hash{}, true
+		}
+		return hdr.BlockHash(), true
+	}
+	return chainhash.Hash{}, false
+}
+
+// bootstrapCheckpoint picks the built in header a new header file starts
+// from: the newest one at or below height.  False if there isn't one, so
+// start from genesis.
+func bootstrapCheckpoint(height int32, p *chaincfg.Params) (
+	HeaderCheckpoint, bool) {
+
+	epochLength := int32(p.TargetTimespan / p.TargetTimePerBlock)
+	var best HeaderCheckpoint
+	found := false
+	for _, c := range HeaderCheckpoints[p.Name] {
+		if c.Height%epochLength != 0 || c.Height > height {
+			continue
+		}
+		if !found || c.Height > best.Height {
+			best = c
+			found = true
+		}
+	}
+	return best, found
+}
+
+// CheckpointHeight is the height of the newest built in header a header
+// file can start from, or 0 if there aren't any.  A wallet with keys made
+// after that can start syncing there.
+func CheckpointHeight(p *chaincfg.Params) int32 {
+	cp, ok := bootstrapCheckpoint(math.MaxInt32, p)
+	if !ok {
+		return 0
+	}
+	return cp.Height
+}
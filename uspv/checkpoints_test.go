@@ -0,0 +1,221 @@
+package uspv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/wire"
+)
+
+func headerHex(t *testing.T, hdr *wire.BlockHeader) string {
+	var b bytes.Buffer
+	err := hdr.Serialize(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b.Bytes())
+}
+
+// TestCheckpoints starts a header file from a checkpoint, syncs past it, and
+// makes sure forks that don't match checkpoints get refused.
+func TestCheckpoints(t *testing.T) {
+	s, done := testSPVCon(t)
+	defer done()
+	dir, err := ioutil.TempDir("", "uspvtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// regtest doesn't have any, so make some up.  2016 can be started
+	// from, 2018 can't since it's not the start of an epoch.
+	hdrs := mineHeaders(s.Param.GenesisBlock.Header, 2020, 'a')
+	HeaderCheckpoints[s.Param.Name] = []HeaderCheckpoint{
+		{2016, headerHex(t, hdrs[2015])},
+		{2018, headerHex(t, hdrs[2017])},
+	}
+	defer delete(HeaderCheckpoints, s.Param.Name)
+
+	if CheckpointHeight(s.Param) != 2016 {
+		t.Fatalf("checkpoint height %d, expect 2016", CheckpointHeight(s.Param))
+	}
+
+	// new header file starts from the checkpoint below the birth height
+	s.headerFile.Close()
+	hfn := filepath.Join(dir, "header.bin")
+	s.syncHeight = 2010
+	err = s.openHeaderFile(hfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.firstHeaderHeight != 0 {
+		t.Fatalf("birth 2010 header file starts at %d", s.firstHeaderHeight)
+	}
+	s.headerFile.Close()
+	os.Remove(hfn)
+
+	s.syncHeight = 2017
+	err = s.openHeaderFile(hfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.headerStartHeight != 2015 || s.firstHeaderHeight != 2016 {
+		t.Fatalf("header file starts at %d, first header %d",
+			s.headerStartHeight, s.firstHeaderHeight)
+	}
+	checkTip(t, s, 2016, hdrs[2015])
+
+	moar, err := s.IngestHeaders(headersMsg(hdrs[2016:]))
+	if err != nil || !moar {
+		t.Fatalf("IngestHeaders after checkpoint %v %v", moar, err)
+	}
+	checkTip(t, s, 2020, hdrs[2019])
+
+	// the locator stops at the checkpoint, not the empty header
+	err = s.AskForHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ghdr := (<-s.syncPeer.out).(*wire.MsgGetHeaders)
+	last := ghdr.BlockLocatorHashes[len(ghdr.BlockLocatorHashes)-1]
+	if *last != hdrs[2015].BlockHash() {
+		t.Fatalf("locator ends with %s, expect checkpoint", last.String())
+	}
+
+	// more work, but forks off before the checkpoint at 2018
+	b := mineHeaders(*hdrs[2016], 5, 'b')
+	_, err = s.IngestHeaders(headersMsg(b))
+	if err == nil {
+		t.Fatalf("took headers not matching checkpoint")
+	}
+	// and before the start of the file
+	_, err = s.IngestHeaders(headersMsg(mineHeaders(*hdrs[100], 10, 'c')))
+	if err == nil {
+		t.Fatalf("took headers forking before the header file")
+	}
+	checkTip(t, s, 2020, hdrs[2019])
+
+	// opens again the same
+	s.headerFile.Close()
+	s.syncHeight = 0
+	err = s.openHeaderFile(hfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.headerStartHeight != 2015 || s.syncHeight != 2016 {
+		t.Fatalf("reopened at %d, sync height %d",
+			s.headerStartHeight, s.syncHeight)
+	}
+	checkTip(t, s, 2020, hdrs[2019])
+	s.headerFile.Close()
+
+	// old style file that starts with the checkpoint header
+	raw, _ := hex.DecodeString(headerHex(t, hdrs[2015]))
+	err = ioutil.WriteFile(hfn, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.openHeaderFile(hfn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.headerStartHeight != 2016 || s.firstHeaderHeight != 2016 {
+		t.Fatalf("old style file starts at %d", s.headerStartHeight)
+	}
+	checkTip(t, s, 2016, hdrs[2015])
+	s.headerFile.Close()
+
+	// but not with any old header
+	raw, _ = hex.DecodeString(headerHex(t, hdrs[5]))
+	err = ioutil.WriteFile(hfn, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.openHeaderFile(hfn)
+	if err == nil {
+		t.Fatalf("opened header file starting with unknown header")
+	}
+	// leave something for done() to close
+	err = s.openHeaderFile(filepath.Join(dir, "last.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkpointHashes are the block hashes the built in checkpoints have to
+// have, looked up separately from the headers.
+var checkpointHashes = map[string]map[int32]string{
+	"mainnet": {
+		0: "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+	},
+	"testnet3": {
+		1032192: "0000000000000b954713945f45fdfab79489755f7e32a3be931f487b811d063c",
+	},
+	"litetest4": {
+		0: "4966625a4b2851d9fdee139e56211a0d88575f59ed816ff5e6a63deb4e3e29a0",
+	},
+	"litereg": {
+		0: "530827f38f93b43ed12af0b3ad25a288dc02ed74d6d7857862df51fc56c416f9",
+	},
+}
+
+// TestHeaderCheckpoints checks the built in headers are the blocks we think
+// they are, and that they can be started from.
+func TestHeaderCheckpoints(t *testing.T) {
+	params := map[string]*chaincfg.Params{
+		"mainnet":   &chaincfg.MainNetParams,
+		"testnet3":  &chaincfg.TestNet3Params,
+		"litetest4": &chaincfg.LiteCoinTestNet4Params,
+		"litereg":   &chaincfg.LiteRegNetParams,
+	}
+	for name, p := range params {
+		if len(HeaderCheckpoints[name]) == 0 {
+			t.Errorf("%s has no checkpoints", name)
+		}
+		if _, ok := bootstrapCheckpoint(math.MaxInt32, p); !ok {
+			t.Errorf("%s has nothing to start a header file from", name)
+		}
+	}
+	for name, cps := range HeaderCheckpoints {
+		p, ok := params[name]
+		if !ok {
+			t.Errorf("checkpoints for unknown network %s", name)
+			continue
+		}
+		epochLength := int32(p.TargetTimespan / p.TargetTimePerBlock)
+		for _, cp := range cps {
+			hdr, err := cp.BlockHeader()
+			if err != nil {
+				t.Errorf("%s %d: %s", name, cp.Height, err.Error())
+				continue
+			}
+			if cp.Height%epochLength != 0 {
+				t.Errorf("%s %d isn't the start of an epoch", name, cp.Height)
+			}
+			hash := hdr.BlockHash()
+			if hash.String() != checkpointHashes[name][cp.Height] {
+				t.Errorf("%s %d hashes to %s, expect %s", name, cp.Height,
+					hash.String(), checkpointHashes[name][cp.Height])
+			}
+			// litecoin work is scrypt, so only check bitcoin's
+			if p.Net != wire.MainNet && p.Net != wire.TestNet3 {
+				continue
+			}
+			if blockchain.HashToBig(&hash).Cmp(
+				blockchain.CompactToBig(hdr.Bits)) > 0 {
+				t.Errorf("%s %d %s doesn't meet its target", name, cp.Height,
+					hash.String())
+			}
+			if cp.Height == 0 && hash != *p.GenesisHash {
+				t.Errorf("%s 0 isn't genesis", name)
+			}
+		}
+	}
+}
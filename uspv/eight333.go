@@ -3,8 +3,10 @@ package uspv
 import (
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 
+	"github.com/adiabat/btcd/blockchain"
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil/bloom"
@@ -19,6 +21,10 @@ const (
 	// version hardcoded for now, probably ok...?
 	// 70012 is for segnet... make this a init var?
 	VERSION = 70012
+
+	// maxReorgDepth is how far back from the tip IngestHeaders looks for
+	// where new headers fork off
+	maxReorgDepth = 2016
 )
 
 // GimmeFilter ... or I'm gonna fade away
@@ -29,7 +35,8 @@ func (s *SPVCon) GimmeFilter() (*bloom.Filter, error) {
 	s.TrackingOPsMtx.Lock()
 	defer s.TrackingOPsMtx.Unlock()
 
-	filterElements := uint32(len(s.TrackingAdrs) + (len(s.TrackingOPs)))
+	filterElements := uint32(len(s.TrackingAdrs) + len(s.TrackingScripts) +
+		len(s.TrackingOPs))
 
 	f := bloom.NewFilter(filterElements, 0, 0.000001, wire.BloomUpdateAll)
 
@@ -39,6 +46,9 @@ func (s *SPVCon) GimmeFilter() (*bloom.Filter, error) {
 		//		fmt.Printf("adding address hash %x\n", a160)
 		f.Add(a160[:])
 	}
+	for sh, _ := range s.TrackingScripts { // add 32-byte witness script hash
+		f.Add(sh[:])
+	}
 	//	for _, u := range allUtxos {
 	//		f.AddOutPoint(&u.Op)
 	//	}
@@ -73,14 +83,24 @@ func (s *SPVCon) MatchTx(tx *wire.MsgTx) bool {
 		// create outpoint of what we're looking at
 		op := wire.NewOutPoint(&txid, uint32(i))
 
-		// 20 byte pubkey hash of this txout (if any)
-		var adr20 [20]byte
-		copy(adr20[:], lnutil.KeyHashFromPkScript(out.PkScript))
+		// 20 byte pubkey hash or 32 byte script hash of this txout (if any)
+		var tracked bool
+		hash := lnutil.KeyHashFromPkScript(out.PkScript)
+		switch len(hash) {
+		case 20:
+			var adr20 [20]byte
+			copy(adr20[:], hash)
+			tracked = s.TrackingAdrs[adr20]
+		case 32:
+			var sh [32]byte
+			copy(sh[:], hash)
+			tracked = s.TrackingScripts[sh]
+		}
 		// when we gain utxo, set as gain so we can return a match, but
 		// also go through all gained utxos and register to track them
 
 		//		fmt.Printf("got output key %x ", adr20)
-		if s.TrackingAdrs[adr20] {
+		if tracked {
 			gain = true
 			s.TrackingOPs[*op] = true
 		} else {
@@ -91,6 +111,8 @@ func (s *SPVCon) MatchTx(tx *wire.MsgTx) bool {
 		if s.TrackingOPs[*op] {
 			// not quite "gain", more like confirm, but same idea.
 			gain = true
+			// keep the script so compact filters can see it get spent
+			s.opScripts[*op] = out.PkScript
 		}
 
 	}
@@ -124,10 +146,10 @@ func (s *SPVCon) OKTxid(txid *chainhash.Hash, height int32) error {
 	return nil
 }
 
-// AskForTx requests a tx we heard about from an inv message.
+// askForTx requests a tx we heard about from an inv message.
 // It's one at a time but should be fast enough.
 // I don't like this function because SPV shouldn't even ask...
-func (s *SPVCon) AskForTx(txid chainhash.Hash) {
+func (s *SPVCon) askForTx(p *peer, txid chainhash.Hash) {
 	gdata := wire.NewMsgGetData()
 	inv := wire.NewInvVect(wire.InvTypeTx, &txid)
 	// no longer get wit txs if in hardmode... don't need to, right?
@@ -135,8 +157,8 @@ func (s *SPVCon) AskForTx(txid chainhash.Hash) {
 	//		inv.Type = wire.InvTypeWitnessTx
 	//	}
 	gdata.AddInvVect(inv)
-	log.Printf("asking for tx %s\n", txid.String())
-	s.outMsgQueue <- gdata
+	log.Printf("asking %s for tx %s\n", p.addr, txid.String())
+	p.send(gdata)
 }
 
 // HashAndHeight is needed instead of just height in case a fullnode
@@ -170,19 +192,25 @@ func (s *SPVCon) RemoveHeaders(r int32) error {
 	return nil
 }
 
-func (s *SPVCon) IngestMerkleBlock(m *wire.MsgMerkleBlock) {
+func (s *SPVCon) IngestMerkleBlock(p *peer, m *wire.MsgMerkleBlock) {
 
+	// proofs first; checkMBlock eats the hashes and flags
+	proofs, err := mBlockProofs(m)
+	if err != nil {
+		log.Printf("Merkle block error: %s\n", err.Error())
+		s.misbehaving(p, banThreshold, "bad merkle block: "+err.Error())
+		return
+	}
 	txids, err := checkMBlock(m) // check self-consistency
 	if err != nil {
 		log.Printf("Merkle block error: %s\n", err.Error())
+		s.misbehaving(p, banThreshold, "bad merkle block: "+err.Error())
 		return
 	}
-	var hah HashAndHeight
-	select { // select here so we don't block on an unrequested mblock
-	case hah = <-s.blockQueue: // pop height off mblock queue
-		break
-	default:
-		log.Printf("Unrequested merkle block")
+	// pop height off mblock queue; doesn't block on an unrequested mblock
+	hah, ok := s.popBlock(p)
+	if !ok {
+		log.Printf("Unrequested merkle block from %s", p.addr)
 		return
 	}
 
@@ -197,6 +225,7 @@ func (s *SPVCon) IngestMerkleBlock(m *wire.MsgMerkleBlock) {
 		return
 	}
 
+	s.addMBlockProofs(proofs, hah.height)
 	for _, txid := range txids {
 		err := s.OKTxid(txid, hah.height)
 		if err != nil {
@@ -212,7 +241,7 @@ func (s *SPVCon) IngestMerkleBlock(m *wire.MsgMerkleBlock) {
 		// this way the only thing that triggers waitstate is asking for headers,
 		// getting 0, calling AskForMerkBlocks(), and seeing you don't need any.
 		// that way you are pretty sure you're synced up.
-		err = s.AskForHeaders()
+		err = s.askForHeaders(p)
 		if err != nil {
 			log.Printf("Merkle block error: %s\n", err.Error())
 			return
@@ -225,6 +254,9 @@ func (s *SPVCon) IngestMerkleBlock(m *wire.MsgMerkleBlock) {
 // local header file, checking that they fit.  If there's no headers,
 // it assumes we're done and returns false.  If it worked it assumes there's
 // more to request and returns true.
+// Headers which fork off below our tip are a reorg.  If the new branch has
+// more work than ours, it replaces ours, and the blocks that got taken out
+// are sent up to the wallit as BlockDisconnects.
 func (s *SPVCon) IngestHeaders(m *wire.MsgHeaders) (bool, error) {
 	gotNum := int64(len(m.Headers))
 	if gotNum > 0 {
@@ -236,85 +268,228 @@ func (s *SPVCon) IngestHeaders(m *wire.MsgHeaders) (bool, error) {
 		return false, nil
 	}
 
+	hdrs := make([]wire.BlockHeader, len(m.Headers))
+	for i, hdr := range m.Headers {
+		hdrs[i] = *hdr
+	}
+
 	s.headerMutex.Lock()
-	defer s.headerMutex.Unlock()
+	gone, moar, err := s.connectHeaders(hdrs)
+	// blocks above syncHeight were never sent up, so skip those.
+	var sendUp []lnutil.BlockDisconnect
+	for _, d := range gone {
+		if d.Height <= s.syncHeight {
+			sendUp = append(sendUp, d)
+		}
+	}
+	if len(gone) != 0 && s.syncHeight >= gone[len(gone)-1].Height {
+		s.syncHeight = gone[len(gone)-1].Height - 1
+	}
+	s.headerMutex.Unlock()
 
-	var err error
-	// seek to last header
-	_, err = s.headerFile.Seek(-80, os.SEEK_END)
-	if err != nil {
-		return false, err
+	// tell the wallit what's gone before asking for any blocks from the
+	// new branch.
+	for _, d := range sendUp {
+		s.DisconnectChan <- d
 	}
-	var last wire.BlockHeader
-	err = last.Deserialize(s.headerFile)
+	return moar, err
+}
+
+// connectHeaders finds where the headers attach to the header file, and
+// adds them on if they make the best chain.  Returns the blocks that got
+// reorged out, tip first.  Call with headerMutex held.
+func (s *SPVCon) connectHeaders(hdrs []wire.BlockHeader) (
+	[]lnutil.BlockDisconnect, bool, error) {
+
+	tip, err := s.headerTip()
 	if err != nil {
-		return false, err
+		return nil, false, err
 	}
-	prevHash := last.BlockHash()
 
-	endPos, err := s.headerFile.Seek(0, os.SEEK_END)
+	// find the header the first new one points to, usually the tip
+	fork := tip
+	for ; ; fork-- {
+		if fork < s.firstHeaderHeight || tip-fork > maxReorgDepth {
+			return nil, false, misbehavior(20,
+				"header msg doesn't connect; %s not in last %d headers",
+				hdrs[0].PrevBlock.String(), tip-fork)
+		}
+		hdr, err := s.readHeader(fork)
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr.BlockHash() == hdrs[0].PrevBlock {
+			break
+		}
+	}
+
+	// skip over headers we already have
+	for len(hdrs) > 0 && fork < tip {
+		ours, err := s.readHeader(fork + 1)
+		if err != nil {
+			return nil, false, err
+		}
+		if ours.BlockHash() != hdrs[0].BlockHash() {
+			break
+		}
+		fork++
+		hdrs = hdrs[1:]
+	}
+	if len(hdrs) == 0 {
+		log.Printf("already have all those headers")
+		return nil, false, nil
+	}
+
+	// normal case, the new headers go on the end
+	if fork == tip {
+		err = s.appendHeaders(tip, hdrs)
+		if err != nil {
+			// invalid headers; appendHeaders says it's their fault, so
+			// whoever sent them gets disconnected.
+			return nil, false, err
+		}
+		log.Printf("Headers to height %d OK.", tip+int32(len(hdrs)))
+		return nil, true, nil
+	}
+
+	// reorg.  Most cumulative work wins; ties go to what we have.
+	old := make([]wire.BlockHeader, 0, tip-fork)
+	oldWork := new(big.Int)
+	for h := fork + 1; h <= tip; h++ {
+		hdr, err := s.readHeader(h)
+		if err != nil {
+			return nil, false, err
+		}
+		old = append(old, hdr)
+		oldWork.Add(oldWork, blockchain.CalcWork(hdr.Bits))
+	}
+	newWork := new(big.Int)
+	for _, hdr := range hdrs {
+		newWork.Add(newWork, blockchain.CalcWork(hdr.Bits))
+	}
+	if newWork.Cmp(oldWork) <= 0 {
+		log.Printf("ignoring fork at %d; %d new headers have less work "+
+			"than our %d\n", fork, len(hdrs), len(old))
+		return nil, false, nil
+	}
+
+	log.Printf("reorg: fork at %d, replacing headers %d - %d with %d new ones\n",
+		fork, fork+1, tip, len(hdrs))
+	err = s.appendHeaders(fork, hdrs)
 	if err != nil {
-		return false, err
-	}
-	tip := int32(endPos/80) + (s.headerStartHeight - 1) // move back 1 header length to read
-
-	// check first header returned to make sure it fits on the end
-	// of our header file
-	if !m.Headers[0].PrevBlock.IsEqual(&prevHash) {
-		// delete 100 headers if this happens!  Dumb reorg.
-		log.Printf("reorg? header msg doesn't fit. points to %s, expect %s",
-			m.Headers[0].PrevBlock.String(), prevHash.String())
-		if endPos < 8160 {
-			// jeez I give up, back to genesis
-			s.headerFile.Truncate(160)
-		} else {
-			err = s.headerFile.Truncate(endPos - 8000)
-			if err != nil {
-				return false, fmt.Errorf("couldn't truncate header file")
-			}
+		// new branch is no good; put ours back
+		err2 := s.appendHeaders(fork, old)
+		if err2 != nil {
+			log.Printf("couldn't restore headers after bad reorg: %s\n",
+				err2.Error())
+		}
+		return nil, false, err
+	}
+
+	gone := make([]lnutil.BlockDisconnect, 0, len(old))
+	for i := len(old) - 1; i >= 0; i-- {
+		gone = append(gone, lnutil.BlockDisconnect{
+			Height: fork + 1 + int32(i),
+			Hash:   old[i].BlockHash(),
+		})
+	}
+
+	// forget what we'd heard about the old branch
+	s.OKMutex.Lock()
+	for txid, h := range s.OKTxids {
+		if h > fork {
+			delete(s.OKTxids, txid)
+		}
+	}
+	for txid, p := range s.pendingProofs {
+		if p.Height > fork {
+			delete(s.pendingProofs, txid)
+		}
+	}
+	s.OKMutex.Unlock()
+	for h, _ := range s.cfHeaders {
+		if h > fork {
+			delete(s.cfHeaders, h)
 		}
-		return true, fmt.Errorf("Truncated header file to try again")
 	}
 
-	for _, resphdr := range m.Headers {
-		// write to end of file
-		err = resphdr.Serialize(s.headerFile)
+	return gone, true, nil
+}
+
+// appendHeaders truncates the header file after height, then writes and
+// checks the headers.  If any are bad, truncates back to height and returns
+// an error.  Call with headerMutex held.
+func (s *SPVCon) appendHeaders(height int32, hdrs []wire.BlockHeader) error {
+	size := int64(height-s.headerStartHeight+1) * 80
+	err := s.headerFile.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("couldn't truncate header file")
+	}
+	for i, hdr := range hdrs {
+		_, err = s.headerFile.Seek(0, os.SEEK_END)
 		if err != nil {
-			return false, err
-		}
-		// advance chain tip
-		tip++
-		// check last header
-		worked := CheckHeader(s.headerFile, tip, s.headerStartHeight, s.Param)
-		if !worked {
-			if endPos < 8160 {
-				// jeez I give up, back to genesis
-				s.headerFile.Truncate(160)
-			} else {
-				err = s.headerFile.Truncate(endPos - 8000)
-				if err != nil {
-					return false, fmt.Errorf("couldn't truncate header file")
-				}
-			}
-			// probably should disconnect from spv node at this point,
-			// since they're giving us invalid headers.
-			return true, fmt.Errorf(
-				"Header %d - %s doesn't fit, dropping 100 headers.",
-				tip, resphdr.BlockHash().String())
-		}
-	}
-	log.Printf("Headers to height %d OK.", tip)
-	return true, nil
+			return err
+		}
+		err = hdr.Serialize(s.headerFile)
+		if err != nil {
+			return err
+		}
+		h := height + 1 + int32(i)
+		if !CheckHeader(s.headerFile, h, s.headerStartHeight, s.Param) {
+			s.headerFile.Truncate(size)
+			return misbehavior(banThreshold,
+				"Header %d - %s doesn't fit, dropping %d headers",
+				h, hdr.BlockHash().String(), len(hdrs))
+		}
+	}
+	return nil
 }
 
-func (s *SPVCon) AskForHeaders() error {
+// headerTip returns the height of the last header in the header file.
+// Call with headerMutex held.
+func (s *SPVCon) headerTip() (int32, error) {
+	endPos, err := s.headerFile.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	// move back 1 header length to read
+	return int32(endPos/80) + (s.headerStartHeight - 1), nil
+}
+
+// readHeader reads the header at a height from the header file.
+// Call with headerMutex held.
+func (s *SPVCon) readHeader(height int32) (wire.BlockHeader, error) {
 	var hdr wire.BlockHeader
+	_, err := s.headerFile.Seek(
+		int64((height-s.headerStartHeight)*80), os.SEEK_SET)
+	if err != nil {
+		return hdr, err
+	}
+	err = hdr.Deserialize(s.headerFile)
+	return hdr, err
+}
+
+// AskForHeaders asks the sync peer for headers.
+func (s *SPVCon) AskForHeaders() error {
+	p := s.getSyncPeer()
+	if p == nil {
+		return fmt.Errorf("not connected to any nodes")
+	}
+	return s.askForHeaders(p)
+}
+
+// askForHeaders sends a getheaders message with a block locator: the last
+// 10 headers, then twice as far back each time down to the first header we
+// have.  That way if we're on a different branch than the remote node, it
+// can find where we fork and send the headers from there.
+func (s *SPVCon) askForHeaders(p *peer) error {
 	ghdr := wire.NewMsgGetHeaders()
 	ghdr.ProtocolVersion = s.localVersion
 
 	s.headerMutex.Lock() // start header file ops
 	info, err := s.headerFile.Stat()
 	if err != nil {
+		s.headerMutex.Unlock()
 		return err
 	}
 	headerFileSize := info.Size()
@@ -324,59 +499,99 @@ func (s *SPVCon) AskForHeaders() error {
 		log.Printf("ERROR: Header file not a multiple of 80 bytes. Truncating")
 	}
 
-	// seek to 80 bytes from end of file
-	ns, err := s.headerFile.Seek(-80, os.SEEK_END)
+	tip, err := s.headerTip()
 	if err != nil {
-		log.Printf("can't seek\n")
+		s.headerMutex.Unlock()
 		return err
 	}
-
-	log.Printf("sought to offset %d (should be near the end\n", ns)
-
-	// get header from last 80 bytes of file
-	err = hdr.Deserialize(s.headerFile)
-	if err != nil {
-		log.Printf("can't Deserialize")
-		return err
+	step := int32(1)
+	for h := tip; ; h -= step {
+		if h < s.firstHeaderHeight {
+			h = s.firstHeaderHeight
+		}
+		hdr, err := s.readHeader(h)
+		if err != nil {
+			s.headerMutex.Unlock()
+			log.Printf("can't read header %d\n", h)
+			return err
+		}
+		cHash := hdr.BlockHash()
+		err = ghdr.AddBlockLocatorHash(&cHash)
+		if err != nil {
+			s.headerMutex.Unlock()
+			return err
+		}
+		if h == s.firstHeaderHeight {
+			break
+		}
+		if len(ghdr.BlockLocatorHashes) >= 10 {
+			step *= 2
+		}
 	}
 	s.headerMutex.Unlock() // done with header file
 
-	cHash := hdr.BlockHash()
-	err = ghdr.AddBlockLocatorHash(&cHash)
-	if err != nil {
-		return err
+	log.Printf("get headers message to %s has %d header hashes, first one is %s\n",
+		p.addr, len(ghdr.BlockLocatorHashes), ghdr.BlockLocatorHashes[0].String())
+
+	p.send(ghdr)
+	return nil
+}
+
+// AskForBlocks asks the sync peer for blocks.
+func (s *SPVCon) AskForBlocks() error {
+	p := s.getSyncPeer()
+	if p == nil {
+		return fmt.Errorf("not connected to any nodes")
 	}
+	return s.askForBlocks(p)
+}
 
-	log.Printf("get headers message has %d header hashes, first one is %s\n",
-		len(ghdr.BlockLocatorHashes), ghdr.BlockLocatorHashes[0].String())
+// getSyncHeight is how far blocks have been ingested
+func (s *SPVCon) getSyncHeight() int32 {
+	s.headerMutex.Lock()
+	defer s.headerMutex.Unlock()
+	return s.syncHeight
+}
 
-	s.outMsgQueue <- ghdr
-	return nil
+// setSyncHeight sets how far blocks have been ingested.  Rescans set it
+// back.
+func (s *SPVCon) setSyncHeight(height int32) {
+	s.headerMutex.Lock()
+	s.syncHeight = height
+	s.headerMutex.Unlock()
 }
 
-// AskForMerkBlocks requests blocks from current to last
+// askForBlocks requests blocks from current to last
 // right now this asks for 1 block per getData message.
 // Maybe it's faster to ask for many in a each message?
-func (s *SPVCon) AskForBlocks() error {
+// If p stops being the sync peer part way through, it gives up; the new
+// sync peer starts over.
+func (s *SPVCon) askForBlocks(p *peer) error {
 	var hdr wire.BlockHeader
 
-	s.headerMutex.Lock() // lock just to check filesize
+	s.headerMutex.Lock() // lock just to check filesize and sync height
 	stat, err := os.Stat(s.headerFile.Name())
+	syncHeight := s.syncHeight
 	s.headerMutex.Unlock() // checked, unlock
 	endPos := stat.Size()
 
 	// move back 1 header length to read
 	headerTip := int32(endPos/80) + (s.headerStartHeight - 1)
 
-	log.Printf("blockTip to %d headerTip %d\n", s.syncHeight, headerTip)
-	if s.syncHeight > headerTip {
+	log.Printf("blockTip to %d headerTip %d\n", syncHeight, headerTip)
+	if syncHeight > headerTip {
 		return fmt.Errorf("error- db longer than headers! shouldn't happen.")
 	}
-	if s.syncHeight == headerTip {
+	if syncHeight == headerTip {
 		// nothing to ask for; set wait state and return
 		log.Printf("no blocks to request, entering wait state\n")
 		log.Printf("%d bytes received\n", s.RBytes)
-		s.inWaitState <- true
+		select { // could be there already if the sync peer just changed
+		case s.inWaitState <- true:
+		default:
+		}
+		// see if anyone knows about blocks the sync peer doesn't
+		go s.crossCheck()
 
 		// check if we can grab outputs
 		// Do this on wallit level instead
@@ -394,8 +609,18 @@ func (s *SPVCon) AskForBlocks() error {
 		return nil
 	}
 
-	log.Printf("will request blocks %d to %d\n", s.syncHeight+1, headerTip)
-	reqHeight := s.syncHeight
+	// with compact filters, get filters first, then only the blocks that match
+	if s.CFilters {
+		return s.CFSync(p, headerTip)
+	}
+
+	q := s.syncQueue(p)
+	if q == nil {
+		return fmt.Errorf("%s isn't the sync peer any more", p.addr)
+	}
+	log.Printf("will request blocks %d to %d from %s\n",
+		syncHeight+1, headerTip, p.addr)
+	reqHeight := syncHeight
 
 	// loop through all heights where we want merkleblocks.
 	for reqHeight < headerTip {
@@ -437,8 +662,12 @@ func (s *SPVCon) AskForBlocks() error {
 			hah.final = true
 		}
 		// waits here most of the time for the queue to empty out
-		s.blockQueue <- hah // push height and mroot of requested block on queue
-		s.outMsgQueue <- gdataMsg
+		select { // push height and mroot of requested block on queue
+		case q <- hah:
+		case <-p.quit:
+			return fmt.Errorf("lost connection to %s", p.addr)
+		}
+		p.send(gdataMsg)
 	}
 	return nil
 }
@@ -0,0 +1,305 @@
+package uspv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+/*
+BIP158 basic block filters.  A filter is a golomb-coded set of every output
+script in a block, and every script spent by the block's inputs.  Items get
+hashed with siphash, keyed by the block hash, into the range [0, N*M), then
+sorted, and the differences between them golomb-rice coded with P bits of
+remainder.  Serialized as a compact size N, then the bits.
+
+Matching means hashing our scripts the same way and seeing if any of them
+show up in the filter.  False positive rate is 1/M, so about 1 in 784931
+per script we're looking for.
+*/
+
+const (
+	// FilterTypeBasic is the only filter type there is
+	FilterTypeBasic = 0x00
+
+	// golomb-rice parameters for basic filters
+	filterP = 19
+	filterM = 784931
+)
+
+// BasicFilterKey is the siphash key for a block's filter; the first 16 bytes
+// of the block hash.
+func BasicFilterKey(blockHash *chainhash.Hash) (key [16]byte) {
+	copy(key[:], blockHash[:16])
+	return
+}
+
+// BasicFilterScripts returns the scripts that go into a block's basic filter.
+// prevScripts are the scripts spent by the block's inputs, which aren't in the
+// block so need to come from somewhere else; can be nil for outputs only.
+func BasicFilterScripts(blk *wire.MsgBlock, prevScripts [][]byte) [][]byte {
+	var scripts [][]byte
+	for _, tx := range blk.Transactions {
+		for _, out := range tx.TxOut {
+			// skip empty and OP_RETURN outputs
+			if len(out.PkScript) == 0 || out.PkScript[0] == 0x6a {
+				continue
+			}
+			scripts = append(scripts, out.PkScript)
+		}
+	}
+	for _, s := range prevScripts {
+		if len(s) != 0 {
+			scripts = append(scripts, s)
+		}
+	}
+	return scripts
+}
+
+// BuildFilter makes a serialized golomb-coded set out of the items.
+// Duplicate items only go in once.
+func BuildFilter(key [16]byte, items [][]byte) ([]byte, error) {
+	uniq := make(map[string]bool)
+	for _, item := range items {
+		uniq[string(item)] = true
+	}
+	n := uint64(len(uniq))
+
+	values := make([]uint64, 0, n)
+	for item, _ := range uniq {
+		values = append(values, hashToRange(key, []byte(item), n*filterM))
+	}
+	sort.Sort(uint64s(values))
+
+	var buf bytes.Buffer
+	err := wire.WriteVarInt(&buf, 0, n)
+	if err != nil {
+		return nil, err
+	}
+	var bw bitWriter
+	var last uint64
+	for _, v := range values {
+		delta := v - last
+		last = v
+		// quotient in unary, then remainder in P bits
+		for q := delta >> filterP; q > 0; q-- {
+			bw.writeBit(true)
+		}
+		bw.writeBit(false)
+		bw.writeBits(delta, filterP)
+	}
+	buf.Write(bw.bytes)
+	return buf.Bytes(), nil
+}
+
+// MatchFilter returns true if any of the items are in the filter.
+// Could be a false positive, but never a false negative.
+func MatchFilter(key [16]byte, filter []byte, items [][]byte) (bool, error) {
+	r := bytes.NewReader(filter)
+	n, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return false, err
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	if n > uint64(len(filter))*8 {
+		return false, fmt.Errorf("filter claims %d items in %d bytes", n, len(filter))
+	}
+	br := newBitReader(filter[len(filter)-r.Len():])
+
+	want := make([]uint64, len(items))
+	for i, item := range items {
+		want[i] = hashToRange(key, item, n*filterM)
+	}
+	sort.Sort(uint64s(want))
+
+	// walk both sorted lists
+	var value uint64
+	for i := uint64(0); i < n; i++ {
+		var q uint64
+		for {
+			bit, err := br.readBit()
+			if err != nil {
+				return false, err
+			}
+			if !bit {
+				break
+			}
+			q++
+		}
+		rem, err := br.readBits(filterP)
+		if err != nil {
+			return false, err
+		}
+		value += q<<filterP + rem
+
+		for len(want) > 0 && want[0] < value {
+			want = want[1:]
+		}
+		if len(want) == 0 {
+			return false, nil
+		}
+		if want[0] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// FilterHash is the double sha256 of a serialized filter
+func FilterHash(filter []byte) chainhash.Hash {
+	return chainhash.DoubleHashH(filter)
+}
+
+// NextFilterHeader chains a filter hash onto the previous filter header.
+// The header before the genesis block's filter is all zeros.
+func NextFilterHeader(filterHash, prevHeader chainhash.Hash) chainhash.Hash {
+	return chainhash.DoubleHashH(append(filterHash[:], prevHeader[:]...))
+}
+
+// hashToRange maps an item to [0, f) using siphash then the multiply-and-
+// shift trick instead of a modulo.
+func hashToRange(key [16]byte, item []byte, f uint64) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	return mulHi64(sipHash24(k0, k1, item), f)
+}
+
+// mulHi64 returns the high 64 bits of the 128 bit product a*b
+func mulHi64(a, b uint64) uint64 {
+	aHi, aLo := a>>32, a&0xffffffff
+	bHi, bLo := b>>32, b&0xffffffff
+	mid1 := aHi*bLo + (aLo*bLo)>>32
+	mid2 := aLo*bHi + mid1&0xffffffff
+	return aHi*bHi + mid1>>32 + mid2>>32
+}
+
+func rotl(x uint64, b uint) uint64 {
+	return x<<b | x>>(64-b)
+}
+
+// sipHash24 is SipHash-2-4, from https://131002.net/siphash/
+func sipHash24(k0, k1 uint64, msg []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = rotl(v1, 13)
+		v1 ^= v0
+		v0 = rotl(v0, 32)
+		v2 += v3
+		v3 = rotl(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = rotl(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = rotl(v1, 17)
+		v1 ^= v2
+		v2 = rotl(v2, 32)
+	}
+
+	// last block has the length in the top byte
+	last := uint64(len(msg)) << 56
+	for ; len(msg) >= 8; msg = msg[8:] {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	for i, c := range msg {
+		last |= uint64(c) << (8 * uint(i))
+	}
+	v3 ^= last
+	round()
+	round()
+	v0 ^= last
+
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// bitWriter writes bits most significant first
+type bitWriter struct {
+	bytes []byte
+	n     uint // bits used in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.n == 0 {
+		w.bytes = append(w.bytes, 0)
+		w.n = 8
+	}
+	w.n--
+	if bit {
+		w.bytes[len(w.bytes)-1] |= 1 << w.n
+	}
+}
+
+// writeBits writes the low nbits of x
+func (w *bitWriter) writeBits(x uint64, nbits uint) {
+	for nbits > 0 {
+		nbits--
+		w.writeBit(x&(1<<nbits) != 0)
+	}
+}
+
+// bitReader reads bits most significant first
+type bitReader struct {
+	bytes []byte
+	n     uint // bits left in the first byte
+}
+
+func newBitReader(b []byte) *bitReader {
+	r := &bitReader{bytes: b}
+	if len(b) != 0 {
+		r.n = 8
+	}
+	return r
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.n == 0 {
+		if len(r.bytes) < 2 {
+			return false, fmt.Errorf("filter ran out of bits")
+		}
+		r.bytes = r.bytes[1:]
+		r.n = 8
+	}
+	r.n--
+	return r.bytes[0]&(1<<r.n) != 0, nil
+}
+
+func (r *bitReader) readBits(nbits uint) (uint64, error) {
+	var x uint64
+	for ; nbits > 0; nbits-- {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		x <<= 1
+		if bit {
+			x |= 1
+		}
+	}
+	return x, nil
+}
@@ -0,0 +1,206 @@
+package uspv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// test vector from the siphash paper
+func TestSipHash24(t *testing.T) {
+	msg := make([]byte, 15)
+	for i, _ := range msg {
+		msg[i] = byte(i)
+	}
+	h := sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, msg)
+	if h != 0xa129ca6149be45e5 {
+		t.Fatalf("siphash %x, expect a129ca6149be45e5", h)
+	}
+}
+
+// TestBasicFilterGenesis checks the testnet3 genesis block's filter and
+// filter header against the BIP158 test vectors.
+func TestBasicFilterGenesis(t *testing.T) {
+	blk := chaincfg.TestNet3Params.GenesisBlock
+	hash := blk.BlockHash()
+
+	filter, err := BuildFilter(BasicFilterKey(&hash), BasicFilterScripts(blk, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(filter) != "019dfca8" {
+		t.Fatalf("genesis filter %x, expect 019dfca8", filter)
+	}
+
+	header := NextFilterHeader(FilterHash(filter), chainhash.Hash{})
+	want, _ := chainhash.NewHashFromStr(
+		"21584579b7eb08997773e5aeff3a7f932700042d0ed2a6129012b7d7ae81b750")
+	if !header.IsEqual(want) {
+		t.Fatalf("genesis filter header %s, expect %s", header.String(), want.String())
+	}
+
+	match, err := MatchFilter(BasicFilterKey(&hash), filter,
+		[][]byte{{0x51}, blk.Transactions[0].TxOut[0].PkScript})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match {
+		t.Fatalf("genesis output script didn't match genesis filter")
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	key := BasicFilterKey(&chainhash.Hash{1, 2, 3})
+
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		items = append(items, []byte(fmt.Sprintf("script %d", i)))
+	}
+	// dupes only go in once
+	filter, err := BuildFilter(key, append(items, items[0], items[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter[0] != 0xfd || filter[1] != 0xe8 || filter[2] != 0x03 {
+		t.Fatalf("filter should start with 1000 items, got %x", filter[:3])
+	}
+
+	for _, item := range items {
+		match, err := MatchFilter(key, filter, [][]byte{item})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !match {
+			t.Fatalf("%s in filter but didn't match", item)
+		}
+	}
+	if !filterHasAll(key, filter, items) {
+		t.Fatalf("filterHasAll false")
+	}
+
+	// 1 in 784931 false positive rate, so 10000 shouldn't give more than 1
+	var others [][]byte
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		other := []byte(fmt.Sprintf("other %d", i))
+		others = append(others, other)
+		match, err := MatchFilter(key, filter, [][]byte{other})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match {
+			falsePositives++
+		}
+	}
+	if falsePositives > 1 {
+		t.Fatalf("%d false positives", falsePositives)
+	}
+	// one real one in with lots of others
+	match, err := MatchFilter(key, filter, append(others, items[500]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match {
+		t.Fatalf("didn't match with many items")
+	}
+	if filterHasAll(key, filter, append(items, []byte("nope"))) {
+		t.Fatalf("filterHasAll true with item not in filter")
+	}
+
+	// empty filter matches nothing
+	empty, err := BuildFilter(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(empty, []byte{0x00}) {
+		t.Fatalf("empty filter %x", empty)
+	}
+	match, err = MatchFilter(key, empty, items)
+	if err != nil || match {
+		t.Fatalf("empty filter matched (err %v)", err)
+	}
+
+	// truncated filter doesn't have everything
+	if filterHasAll(key, filter[:len(filter)/2], items) {
+		t.Fatalf("truncated filter has everything")
+	}
+}
+
+// lolwut is a message nobody knows about
+type lolwut struct{}
+
+func (m *lolwut) BtcDecode(r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+	return nil
+}
+
+func (m *lolwut) BtcEncode(w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+	_, err := w.Write([]byte("lol"))
+	return err
+}
+
+func (m *lolwut) Command() string { return "lolwut" }
+
+func (m *lolwut) MaxPayloadLength(pver uint32) uint32 { return 3 }
+
+// TestReadMessage sends messages through readMessage
+func TestReadMessage(t *testing.T) {
+	net := chaincfg.TestNet3Params.Net
+	var buf bytes.Buffer
+
+	cfh := &MsgCFHeaders{
+		FilterType:       FilterTypeBasic,
+		StopHash:         chainhash.Hash{9},
+		PrevFilterHeader: chainhash.Hash{8},
+		FilterHashes:     []chainhash.Hash{{1}, {2}, {3}},
+	}
+	cf := &MsgCFilter{
+		FilterType: FilterTypeBasic,
+		BlockHash:  chainhash.Hash{7},
+		Data:       []byte{0x01, 0x9d, 0xfc, 0xa8},
+	}
+	ping := wire.NewMsgPing(55)
+
+	for _, msg := range []wire.Message{cfh, new(lolwut), cf, ping} {
+		_, err := wire.WriteMessageWithEncodingN(
+			&buf, msg, VERSION, net, wire.LatestEncoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// cfheaders and cfilter come back the same, and unknown messages
+	// are skipped
+	for _, want := range []wire.Message{cfh, nil, cf, ping} {
+		_, got, err := readMessage(&buf, VERSION, net)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, expect %v", got, want)
+		}
+	}
+
+	// other networks are errors
+	_, err := wire.WriteMessageWithEncodingN(
+		&buf, ping, VERSION, chaincfg.MainNetParams.Net, wire.LatestEncoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = readMessage(&buf, VERSION, net)
+	if err == nil {
+		t.Fatalf("no error reading message from other network")
+	}
+
+	headers := cfh.FilterHeaders()
+	if headers[0] != NextFilterHeader(chainhash.Hash{1}, chainhash.Hash{8}) ||
+		headers[2] != NextFilterHeader(chainhash.Hash{3}, headers[1]) {
+		t.Fatalf("filter headers don't chain")
+	}
+}
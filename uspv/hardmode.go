@@ -7,7 +7,6 @@ import (
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil/bloom"
-	"github.com/mit-dci/lit/lnutil"
 )
 
 var (
@@ -18,9 +17,15 @@ var (
 // If the block has no wintess txs, and no coinbase witness commitment,
 // it only checks the tx merkle root.  If either a witness commitment or
 // any witnesses are detected, it also checks that as well.
+// Blocks need to be requested as witness blocks (InvTypeWitnessBlock) or
+// the coinbase witness nonce doesn't come, and blocks with a commitment fail.
 // Returns false if anything goes wrong, true if everything is fine.
 func BlockOK(blk wire.MsgBlock) bool {
-	var txids, wtxids []*chainhash.Hash // txids and wtxids
+	if len(blk.Transactions) == 0 {
+		log.Printf("block %s has no txs", blk.BlockHash().String())
+		return false
+	}
+	var txids []*chainhash.Hash // txids
 	// witMode true if any tx has a wintess OR coinbase has wit commit
 	witMode := false
 
@@ -31,15 +36,10 @@ func BlockOK(blk wire.MsgBlock) bool {
 			witMode = true
 		}
 	}
-	if witMode {
-		for _, wtx := range blk.Transactions {
-			wtxid := wtx.WitnessHash()
-			wtxids = append(wtxids, &wtxid)
-		}
-	}
 
 	var commitBytes []byte
 	// try to extract coinbase witness commitment (even if !witMode)
+	// if there's more than one, the one with the highest index counts
 	cb := blk.Transactions[0]                 // get coinbase tx
 	for i := len(cb.TxOut) - 1; i >= 0; i-- { // start at the last txout
 		if bytes.HasPrefix(cb.TxOut[i].PkScript, WitMagicBytes) &&
@@ -47,6 +47,7 @@ func BlockOK(blk wire.MsgBlock) bool {
 			// 38 bytes or more, and starts with WitMagicBytes is a hit
 			commitBytes = cb.TxOut[i].PkScript[6:38]
 			witMode = true // it there is a wit commit it must be valid
+			break
 		}
 	}
 
@@ -63,51 +64,42 @@ func BlockOK(blk wire.MsgBlock) bool {
 				blk.BlockHash().String(), len(cb.TxIn))
 			return false
 		}
-		// something weird here with regtest, disable for now
-		// The op_return is there but I'm not getting the 0000 witness.
-		// maybe because I'm not getting a witness block..?
-		/*
-			if len(cb.TxIn[0].Witness) != 1 {
-				log.Printf("block %s coinbase has %d witnesses (must be 1)",
-					blk.BlockHash().String(), len(cb.TxIn[0].Witness))
-				return false
-			}
-
-			if len(cb.TxIn[0].Witness[0]) != 32 {
-				log.Printf("block %s coinbase has %d byte witness nonce (not 32)",
-					blk.BlockHash().String(), len(cb.TxIn[0].Witness[0]))
-				return false
-			}
-			// witness nonce is the cb's witness, subject to above constraints
-			witNonce, err := chainhash.NewHash(cb.TxIn[0].Witness[0])
-			if err != nil {
-				log.Printf("Witness nonce error: %s", err.Error())
-				return false // not sure why that'd happen but fail
-			}
-
-			var empty [32]byte
-			wtxids[0].SetBytes(empty[:]) // coinbase wtxid is 0x00...00
-
-			// witness root calculated from wtixds
-			witRoot := calcRoot(wtxids)
-
-			calcWitCommit := chainhash.DoubleHashH(
-				append(witRoot.CloneBytes(), witNonce.CloneBytes()...))
-
-			// witness root given in coinbase op_return
-			givenWitCommit, err := chainhash.NewHash(commitBytes)
-			if err != nil {
-				log.Printf("Witness root error: %s", err.Error())
-				return false // not sure why that'd happen but fail
-			}
-			// they should be the same.  If not, fail.
-			if !calcWitCommit.IsEqual(givenWitCommit) {
-				log.Printf("Block %s witRoot error: calc %s given %s",
-					blk.BlockHash().String(),
-					calcWitCommit.String(), givenWitCommit.String())
-				return false
-			}
-		*/
+		if len(cb.TxIn[0].Witness) != 1 {
+			log.Printf("block %s coinbase has %d witnesses (must be 1)",
+				blk.BlockHash().String(), len(cb.TxIn[0].Witness))
+			return false
+		}
+		if len(cb.TxIn[0].Witness[0]) != 32 {
+			log.Printf("block %s coinbase has %d byte witness nonce (not 32)",
+				blk.BlockHash().String(), len(cb.TxIn[0].Witness[0]))
+			return false
+		}
+		// witness nonce is the cb's witness, subject to above constraints
+		witNonce := cb.TxIn[0].Witness[0]
+
+		// coinbase wtxid is 0x00...00
+		wtxids := []*chainhash.Hash{new(chainhash.Hash)}
+		for _, wtx := range blk.Transactions[1:] {
+			wtxid := wtx.WitnessHash()
+			wtxids = append(wtxids, &wtxid)
+		}
+
+		// witness root calculated from wtixds
+		witRoot := calcRoot(wtxids)
+		if witRoot == nil {
+			log.Printf("block %s has duplicate wtxids", blk.BlockHash().String())
+			return false
+		}
+
+		calcWitCommit := chainhash.DoubleHashH(
+			append(witRoot.CloneBytes(), witNonce...))
+
+		// they should be the same.  If not, fail.
+		if !bytes.Equal(calcWitCommit[:], commitBytes) {
+			log.Printf("Block %s witRoot error: calc %x given %x",
+				blk.BlockHash().String(), calcWitCommit[:], commitBytes)
+			return false
+		}
 	}
 
 	// got through witMode check so that should be OK;
@@ -136,7 +128,7 @@ func (s *SPVCon) Refilter(f *bloom.Filter) {
 
 // IngestBlock is like IngestMerkleBlock but aralphic
 // different enough that it's better to have 2 separate functions
-func (s *SPVCon) IngestBlock(m *wire.MsgBlock) {
+func (s *SPVCon) IngestBlock(p *peer, m *wire.MsgBlock) {
 	var err error
 
 	// hand block over to the watchtower via the RawBlockSender chan
@@ -151,15 +143,14 @@ func (s *SPVCon) IngestBlock(m *wire.MsgBlock) {
 	ok := BlockOK(*m) // check block self-consistency
 	if !ok {
 		log.Printf("block %s not OK!!11\n", m.BlockHash().String())
+		s.misbehaving(p, banThreshold, "bad block "+m.BlockHash().String())
 		return
 	}
 
-	var hah HashAndHeight
-	select { // select here so we don't block on an unrequested mblock
-	case hah = <-s.blockQueue: // pop height off mblock queue
-		break
-	default:
-		log.Printf("Unrequested full block")
+	// pop height off block queue; doesn't block on an unrequested block
+	hah, ok := s.popBlock(p)
+	if !ok {
+		log.Printf("Unrequested full block from %s", p.addr)
 		return
 	}
 
@@ -169,28 +160,38 @@ func (s *SPVCon) IngestBlock(m *wire.MsgBlock) {
 		return
 	}
 
-	// iterate through all txs in the block, looking for matches.
+	// iterate through all txs in the block, looking for matches.  All of
+	// them go past the mempool, since any could double spend something.
 	for _, tx := range m.Transactions {
-		if s.MatchTx(tx) {
+		match := s.MatchTx(tx)
+		if match {
 			log.Printf("found matching tx %s\n", tx.TxHash().String())
-			s.TxUpToWallit <- lnutil.TxAndHeight{tx, hah.height}
+			// before it goes up, so it's there if anyone asks
+			s.saveBlockTxProof(m, tx.TxHash(), hah.height)
 		}
+		s.txUp(tx, hah.height, match)
 	}
 
 	// tell upper level height has been reached
 	s.CurrentHeightChan <- hah.height
 	// track our internal height
-	s.syncHeight = hah.height
+	s.setSyncHeight(hah.height)
 
 	log.Printf("ingested full block %s height %d OK\n",
 		m.Header.BlockHash().String(), hah.height)
 
+	if s.CFilters {
+		// CFSync is waiting for this block, and keeps going from here
+		s.cfBlockDone <- hah.height
+		return
+	}
+
 	if hah.final { // check sync end
 		// don't set waitstate; instead, ask for headers again!
 		// this way the only thing that triggers waitstate is asking for headers,
 		// getting 0, calling AskForMerkBlocks(), and seeing you don't need any.
 		// that way you are pretty sure you're synced up.
-		err = s.AskForHeaders()
+		err = s.askForHeaders(p)
 		if err != nil {
 			log.Printf("Merkle block error: %s\n", err.Error())
 			return
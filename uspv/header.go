@@ -192,6 +192,14 @@ func CheckHeader(r io.ReadSeeker, height, startheight int32, p *chaincfg.Params)
 		}
 	}
 
+	// if there's a checkpoint here, it has to be this header
+	cpHash, ok := checkpointHash(height, p)
+	if ok && cur.BlockHash() != cpHash {
+		log.Printf("Block %d %s doesn't match checkpoint %s\n",
+			height, cur.BlockHash().String(), cpHash.String())
+		return false
+	}
+
 	// check if there's a valid proof of work.  That whole "Bitcoin" thing.
 	if !checkProofOfWork(cur, p) {
 		log.Printf("Block %d Bad proof of work.\n", height)
@@ -202,7 +210,8 @@ func CheckHeader(r io.ReadSeeker, height, startheight int32, p *chaincfg.Params)
 }
 
 /* checkrange verifies a range of headers.  it checks their proof of work,
-difficulty adjustments, and that they all link in to each other properly.
+difficulty adjustments, checkpoints, and that they all link in to each other
+properly.
 This is the only blockchain technology in the whole code base.
 Returns false if anything bad happens.  Returns true if the range checks
 out with no errors. */
@@ -2,178 +2,144 @@ package uspv
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 
 	"github.com/adiabat/btcd/wire"
 )
 
-// Connect dials out and connects to full nodes.
-func (s *SPVCon) Connect(remoteNode string) error {
-	var err error
-	// open TCP connection
-	s.con, err = net.Dial("tcp", remoteNode)
-	if err != nil {
-		return err
-	}
-	// assign version bits for local node
-	s.localVersion = VERSION
-	myMsgVer, err := wire.NewMsgVersionFromConn(s.con, 0, 0)
+/*
+Truncated header files
+Like a regular header but the first 80 bytes is mostly empty.
+The very first 4 bytes (big endian) says what height the empty 80 bytes
+replace.  The next header, starting at offset 80, needs to be valid.
+
+New header files start from a built in checkpoint (see checkpoints.go) if
+there's one at or below the height we're syncing from.  The checkpoint
+header goes at offset 80, and the empty 80 bytes replace the height before
+it.  Networks without checkpoints start at genesis, with no empty header.
+
+Older header files may start with a checkpoint header at offset 0, no empty
+header; those still open, as long as the checkpoint is built in.
+*/
+//
+
+// openHeaderFile opens the header file, making it if it isn't there, and
+// figures out what height it starts at.
+func (s *SPVCon) openHeaderFile(hfn string) error {
+	_, err := os.Stat(hfn)
 	if err != nil {
-		return err
+		if !os.IsNotExist(err) {
+			return err
+		}
+		err = s.newHeaderFile(hfn)
+		if err != nil {
+			return err
+		}
 	}
-	err = myMsgVer.AddUserAgent("lit", "v0.1")
+
+	s.headerFile, err = os.OpenFile(hfn, os.O_RDWR, 0600)
 	if err != nil {
 		return err
 	}
-	// must set this to enable SPV stuff
-	myMsgVer.AddService(wire.SFNodeBloom)
-	// set this to enable segWit
-	myMsgVer.AddService(wire.SFNodeWitness)
-	// this actually sends
-	n, err := wire.WriteMessageWithEncodingN(
-		s.con, myMsgVer, s.localVersion, s.Param.Net, wire.LatestEncoding)
+	err = s.readHeaderStart()
 	if err != nil {
+		s.headerFile.Close()
 		return err
 	}
-	s.WBytes += uint64(n)
-	log.Printf("wrote %d byte version message to %s\n",
-		n, s.con.RemoteAddr().String())
-	n, m, b, err := wire.ReadMessageWithEncodingN(
-		s.con, s.localVersion, s.Param.Net, wire.LatestEncoding)
-	if err != nil {
-		return err
+	log.Printf("opened header file %s, headers from %d\n",
+		s.headerFile.Name(), s.firstHeaderHeight)
+
+	// can't get blocks we don't have headers for
+	if s.syncHeight < s.firstHeaderHeight {
+		log.Printf("sync height %d below first header, starting at %d\n",
+			s.syncHeight, s.firstHeaderHeight)
+		s.syncHeight = s.firstHeaderHeight
 	}
-	s.RBytes += uint64(n)
-	log.Printf("got %d byte response %x\n command: %s\n", n, b, m.Command())
+	return nil
+}
 
-	mv, ok := m.(*wire.MsgVersion)
+// newHeaderFile writes a header file with just a checkpoint, or genesis.
+func (s *SPVCon) newHeaderFile(hfn string) error {
+	var b bytes.Buffer
+	cp, ok := bootstrapCheckpoint(s.syncHeight, s.Param)
 	if ok {
-		log.Printf("connected to %s", mv.UserAgent)
+		hdr, err := cp.BlockHeader()
+		if err != nil {
+			return err
+		}
+		if cp.Height > 0 {
+			// empty header standing in for the one before the checkpoint
+			var empty [80]byte
+			binary.BigEndian.PutUint32(empty[:4], uint32(cp.Height-1))
+			b.Write(empty[:])
+		}
+		err = hdr.Serialize(&b)
+		if err != nil {
+			return err
+		}
+		log.Printf("starting headers from checkpoint %d %s\n",
+			cp.Height, hdr.BlockHash().String())
+	} else {
+		// no checkpoints, start from the beginning.
+		err := s.Param.GenesisBlock.Header.Serialize(&b)
+		if err != nil {
+			return err
+		}
+		log.Printf("starting headers from genesis %s\n",
+			s.Param.GenesisHash.String())
 	}
-	log.Printf("remote reports version %x (dec %d)\n",
-		mv.ProtocolVersion, mv.ProtocolVersion)
-
-	// set remote height
-	s.remoteHeight = mv.LastBlock
-	mva := wire.NewMsgVerAck()
-	n, err = wire.WriteMessageWithEncodingN(
-		s.con, mva, s.localVersion, s.Param.Net, wire.LatestEncoding)
+	err := ioutil.WriteFile(hfn, b.Bytes(), 0600)
 	if err != nil {
 		return err
 	}
-	s.WBytes += uint64(n)
-
-	s.inMsgQueue = make(chan wire.Message)
-	go s.incomingMessageHandler()
-	s.outMsgQueue = make(chan wire.Message)
-	go s.outgoingMessageHandler()
-
-	if s.HardMode {
-		s.blockQueue = make(chan HashAndHeight, 32) // queue depth 32 for hardmode.
-	} else {
-		// for SPV, concurrent in-flight merkleblocks makes us miss txs.
-		// The BloomUpdateAll setting seems like it should prevent it, but it
-		// doesn't; occasionally it misses transactions, seems like with low
-		// block index.  Could be a bug somewhere.  1 at a time merkleblock
-		// seems OK.
-		s.blockQueue = make(chan HashAndHeight, 1) // queue depth 1 for spv
-	}
-	s.fPositives = make(chan int32, 4000) // a block full, approx
-	s.inWaitState = make(chan bool, 1)
-	go s.fPositiveHandler()
-
-	if s.HardMode { // what about for non-hard?  send filter?
-		/*
-			Ignore filters now; switch to filters fed to SPVcon from TS
-				filt, err := s.TS.GimmeFilter()
-				if err != nil {
-					return err
-				}
-				s.localFilter = filt
-				//		s.Refilter(filt)
-		*/
-	}
-
+	log.Printf("created header file at %s\n", hfn)
 	return nil
 }
 
-/*
-Truncated header files
-Like a regular header but the first 80 bytes is mostly empty.
-The very first 4 bytes (big endian) says what height the empty 80 bytes
-replace.  The next header, starting at offset 80, needs to be valid.
-*/
-//
-
-func (s *SPVCon) openHeaderFile(hfn string) error {
-	_, err := os.Stat(hfn)
+// readHeaderStart looks at the start of the header file to see what height
+// it starts at.  Sets headerStartHeight, the height at offset 0, and
+// firstHeaderHeight, the first real header.
+func (s *SPVCon) readHeaderStart() error {
+	var first [80]byte
+	_, err := s.headerFile.Seek(0, os.SEEK_SET)
 	if err != nil {
-		if os.IsNotExist(err) {
-			var b bytes.Buffer
-			// if testnet, start with hardcoded height
-			if s.Param.Name == "testnet3" {
-				// hard-coded millionth block header (actually 1032192)
-				hdr, err := hex.DecodeString("00000020da33925b1f7a55e9fa8e6c955a20ea094148b60c5c88f69a4f500000000000003673b7b6ce8157d3cfcaf415b6740918df7610a8769d70334aa9abd9c941b25e7621215880ba371a85bf9646")
-				if err != nil {
-					return err
-				}
-				_, err = b.Write(hdr)
-				if err != nil {
-					return err
-				}
-				// TODO remove these hacks and get params to work
-			} else if s.Param.Name == "litetest4" {
-				// hard-coded litecoin block header
-				// because I don't want to deal with the different genesis block
-				hdr, err := hex.DecodeString("010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97f60ba158f0ff0f1ee1790400")
-				if err != nil {
-					return err
-				}
-				_, err = b.Write(hdr)
-				if err != nil {
-					return err
-				}
-
-			} else if s.Param.Name == "litereg" {
-				hdr, err := hex.DecodeString("010000000000000000000000000000000000000000000000000000000000000000000000d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97dae5494dffff7f2000000000")
-
-				if err != nil {
-					return err
-				}
-				_, err = b.Write(hdr)
-				if err != nil {
-					return err
-				}
-
-			} else {
-
-				// not testnet3, start from beginning.
-				err = s.Param.GenesisBlock.Header.Serialize(&b)
-				if err != nil {
-					return err
-				}
-			}
-			err = ioutil.WriteFile(hfn, b.Bytes(), 0600)
-			if err != nil {
-				return err
-			}
-			log.Printf("made genesis header %x\n", b.Bytes())
-			log.Printf("made genesis hash %s\n", s.Param.GenesisHash.String())
-			log.Printf("created hardcoded genesis header at %s\n", hfn)
-		}
+		return err
 	}
-	if s.Param.Name == "testnet3" {
-		s.headerStartHeight = 1032192
+	_, err = io.ReadFull(s.headerFile, first[:])
+	if err != nil {
+		return fmt.Errorf("can't read first header: %s", err.Error())
 	}
 
-	s.headerFile, err = os.OpenFile(hfn, os.O_RDWR, 0600)
+	// truncated file
+	if bytes.Equal(first[4:], make([]byte, 76)) {
+		s.headerStartHeight = int32(binary.BigEndian.Uint32(first[:4]))
+		s.firstHeaderHeight = s.headerStartHeight + 1
+		return nil
+	}
+
+	// starts with a real header; genesis, or an old style checkpoint start
+	var hdr wire.BlockHeader
+	err = hdr.Deserialize(bytes.NewReader(first[:]))
 	if err != nil {
 		return err
 	}
-	log.Printf("opened header file %s\n", s.headerFile.Name())
-	return nil
+	hash := hdr.BlockHash()
+	if hash == s.Param.GenesisBlock.Header.BlockHash() {
+		s.headerStartHeight, s.firstHeaderHeight = 0, 0
+		return nil
+	}
+	for _, cp := range HeaderCheckpoints[s.Param.Name] {
+		cpHdr, err := cp.BlockHeader()
+		if err == nil && cpHdr.BlockHash() == hash {
+			s.headerStartHeight, s.firstHeaderHeight = cp.Height, cp.Height
+			return nil
+		}
+	}
+	return fmt.Errorf("header file starts with %s, which isn't %s genesis "+
+		"or a checkpoint", hash.String(), s.Param.Name)
 }
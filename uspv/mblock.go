@@ -6,6 +6,7 @@ import (
 
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
 )
 
 func MakeMerkleParent(left, right *chainhash.Hash) *chainhash.Hash {
@@ -167,3 +168,120 @@ func checkMBlock(m *wire.MsgMerkleBlock) ([]*chainhash.Hash, error) {
 	}
 	return nil, fmt.Errorf("ran out of things to do?")
 }
+
+// mBlockProofs makes proofs for the matched txs in a merkle block, walking
+// the partial merkle tree the way BIP37 lays it out.  Unlike checkMBlock it
+// keeps every hash it sees, since the proofs need the siblings.  Proofs
+// come back with height 0; the caller knows the height.
+func mBlockProofs(m *wire.MsgMerkleBlock) (map[chainhash.Hash]lnutil.TxProof, error) {
+	if m.Transactions == 0 {
+		return nil, fmt.Errorf("No transactions in merkleblock")
+	}
+	pt := partialTree{
+		n:     m.Transactions,
+		m:     m,
+		nodes: make(map[treePos]chainhash.Hash),
+	}
+	var height uint32
+	for pt.width(height) > 1 {
+		height++
+	}
+	root, err := pt.walk(height, 0)
+	if err != nil {
+		return nil, err
+	}
+	if root != m.Header.MerkleRoot {
+		return nil, fmt.Errorf("computed root %s but expect %s",
+			root.String(), m.Header.MerkleRoot.String())
+	}
+	if pt.hashIdx != len(m.Hashes) {
+		return nil, fmt.Errorf("used %d of %d hashes", pt.hashIdx, len(m.Hashes))
+	}
+	if (pt.bitIdx+7)/8 != len(m.Flags) {
+		return nil, fmt.Errorf("used %d flag bits of %d bytes",
+			pt.bitIdx, len(m.Flags))
+	}
+
+	proofs := make(map[chainhash.Hash]lnutil.TxProof)
+	for _, pos := range pt.matched {
+		p := lnutil.TxProof{Pos: pos}
+		for h := uint32(0); h < height; h++ {
+			sib := pos ^ 1
+			if sib >= pt.width(h) { // odd levels repeat their last hash
+				sib = pos
+			}
+			hash, ok := pt.nodes[treePos{h, sib}]
+			if !ok {
+				return nil, fmt.Errorf("no hash at height %d pos %d", h, sib)
+			}
+			p.Branch = append(p.Branch, hash)
+			pos >>= 1
+		}
+		proofs[pt.nodes[treePos{0, p.Pos}]] = p
+	}
+	return proofs, nil
+}
+
+// treePos is a node in a merkle tree; height 0 is the txids
+type treePos struct {
+	height, pos uint32
+}
+
+// partialTree is the state of a walk through a merkle block's tree
+type partialTree struct {
+	n       uint32 // number of txs
+	m       *wire.MsgMerkleBlock
+	hashIdx int
+	bitIdx  int
+	nodes   map[treePos]chainhash.Hash
+	matched []uint32 // positions of matched txids
+}
+
+// width is how many nodes are at a height
+func (pt *partialTree) width(height uint32) uint32 {
+	return (pt.n + (1 << height) - 1) >> height
+}
+
+// walk gets the hash of a node, descending if its flag bit says to
+func (pt *partialTree) walk(height, pos uint32) (chainhash.Hash, error) {
+	var hash chainhash.Hash
+	if pt.bitIdx >= len(pt.m.Flags)*8 {
+		return hash, fmt.Errorf("Ran out of flag bits.")
+	}
+	flag := pt.m.Flags[pt.bitIdx/8]&(1<<uint(pt.bitIdx%8)) != 0
+	pt.bitIdx++
+
+	if height == 0 || !flag {
+		if pt.hashIdx >= len(pt.m.Hashes) {
+			return hash, fmt.Errorf("Ran out of hashes at height %d pos %d",
+				height, pos)
+		}
+		hash = *pt.m.Hashes[pt.hashIdx]
+		pt.hashIdx++
+		if height == 0 && flag {
+			pt.matched = append(pt.matched, pos)
+		}
+	} else {
+		left, err := pt.walk(height-1, pos*2)
+		if err != nil {
+			return hash, err
+		}
+		// no right child means hash the left with itself
+		var right *chainhash.Hash
+		if pos*2+1 < pt.width(height-1) {
+			r, err := pt.walk(height-1, pos*2+1)
+			if err != nil {
+				return hash, err
+			}
+			right = &r
+		}
+		parent := MakeMerkleParent(&left, right)
+		if parent == nil { // CVE-2012-2459 again
+			return hash, fmt.Errorf("duplicate hash at height %d pos %d",
+				height-1, pos*2)
+		}
+		hash = *parent
+	}
+	pt.nodes[treePos{height, pos}] = hash
+	return hash, nil
+}
@@ -0,0 +1,167 @@
+package uspv
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+The mempool is the unconfirmed txs we know about: the ones we broadcast, and
+the ones our nodes told us about that match our filters.  Nothing here is
+validated; it's just so we notice when 2 txs spend the same outpoint.
+
+When a new tx spends something an unconfirmed tx already spends, the old one
+(and anything spending its outputs) gets evicted, and each evicted tx comes
+back as a TxConflict.  Except if the old one is ours and the new one isn't
+yet confirmed; then we don't take the new one, but still say there's a
+conflict, since ours probably isn't going to make it.  Txs leave when they
+confirm, or after mempoolExpiry.
+*/
+
+// mempoolExpiry is how long an unconfirmed tx stays in the mempool.  Full
+// nodes forget txs after 2 weeks, so we do too.
+const mempoolExpiry = 14 * 24 * time.Hour
+
+type memTx struct {
+	tx   *wire.MsgTx
+	ours bool // we broadcast it
+	seen time.Time
+}
+
+type mempool struct {
+	mtx    sync.Mutex
+	txs    map[chainhash.Hash]*memTx
+	spends map[wire.OutPoint]chainhash.Hash // outpoint to the tx spending it
+}
+
+func newMempool() *mempool {
+	return &mempool{
+		txs:    make(map[chainhash.Hash]*memTx),
+		spends: make(map[wire.OutPoint]chainhash.Hash),
+	}
+}
+
+// add puts an unconfirmed tx in the mempool.  ours is set for txs we
+// broadcast.  Returns the txs that conflict with it.
+func (m *mempool) add(tx *wire.MsgTx, ours bool) []lnutil.TxConflict {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.expire(time.Now())
+
+	txid := tx.TxHash()
+	if mt, ok := m.txs[txid]; ok {
+		// already have it; but if we just broadcast it, it's ours
+		mt.ours = mt.ours || ours
+		return nil
+	}
+
+	// if it conflicts with any of ours, leave everything as it is
+	var conflicts []lnutil.TxConflict
+	if !ours {
+		for _, in := range tx.TxIn {
+			otherid, ok := m.spends[in.PreviousOutPoint]
+			if ok && m.txs[otherid].ours {
+				conflicts = append(conflicts, lnutil.TxConflict{
+					Tx: m.txs[otherid].tx, ByTx: tx,
+					Op: in.PreviousOutPoint, Ours: true})
+			}
+		}
+		if len(conflicts) > 0 {
+			return conflicts
+		}
+	}
+
+	for _, in := range tx.TxIn {
+		otherid, ok := m.spends[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		conflicts = append(conflicts,
+			m.evict(otherid, tx, in.PreviousOutPoint, 0)...)
+	}
+
+	m.txs[txid] = &memTx{tx: tx, ours: ours, seen: time.Now()}
+	for _, in := range tx.TxIn {
+		m.spends[in.PreviousOutPoint] = txid
+	}
+	return conflicts
+}
+
+// confirm takes out a tx that got into a block at height, and evicts any
+// txs spending the same outpoints.  Works for txs that were never in the
+// mempool too.
+func (m *mempool) confirm(tx *wire.MsgTx, height int32) []lnutil.TxConflict {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	txid := tx.TxHash()
+	m.remove(txid)
+	var conflicts []lnutil.TxConflict
+	for _, in := range tx.TxIn {
+		otherid, ok := m.spends[in.PreviousOutPoint]
+		if !ok {
+			continue
+		}
+		conflicts = append(conflicts,
+			m.evict(otherid, tx, in.PreviousOutPoint, height)...)
+	}
+	return conflicts
+}
+
+// evict takes out txid, which lost op to byTx, and everything spending its
+// outputs.  Returns a conflict for each tx taken out.  Call with mtx held.
+func (m *mempool) evict(txid chainhash.Hash, byTx *wire.MsgTx,
+	op wire.OutPoint, height int32) []lnutil.TxConflict {
+
+	mt, ok := m.txs[txid]
+	if !ok {
+		return nil
+	}
+	m.remove(txid)
+	conflicts := []lnutil.TxConflict{{
+		Tx: mt.tx, ByTx: byTx, Op: op, Height: height, Ours: mt.ours}}
+
+	for i := range mt.tx.TxOut {
+		childid, ok := m.spends[wire.OutPoint{Hash: txid, Index: uint32(i)}]
+		if ok {
+			conflicts = append(conflicts, m.evict(childid, byTx, op, height)...)
+		}
+	}
+	return conflicts
+}
+
+// remove takes a tx out of the mempool.  Call with mtx held.
+func (m *mempool) remove(txid chainhash.Hash) {
+	mt, ok := m.txs[txid]
+	if !ok {
+		return
+	}
+	for _, in := range mt.tx.TxIn {
+		if m.spends[in.PreviousOutPoint] == txid {
+			delete(m.spends, in.PreviousOutPoint)
+		}
+	}
+	delete(m.txs, txid)
+}
+
+// expire takes out txs that have been around too long.  Call with mtx held.
+func (m *mempool) expire(now time.Time) {
+	for txid, mt := range m.txs {
+		if now.Sub(mt.seen) > mempoolExpiry {
+			log.Printf("unconfirmed tx %s expired from mempool\n", txid.String())
+			m.remove(txid)
+		}
+	}
+}
+
+// size is how many unconfirmed txs there are
+func (m *mempool) size() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return len(m.txs)
+}
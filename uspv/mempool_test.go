@@ -0,0 +1,102 @@
+package uspv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+)
+
+// spendTx spends a made up outpoint.  With wit, it's a segwit spend.
+func spendTx(id byte, wit bool) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	in := wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{id}, 0), nil, nil)
+	if wit {
+		in.Witness = wire.TxWitness{{0x30, id, 0x01}, {0x02, id}}
+	} else {
+		in.SignatureScript = []byte{0x01, id}
+	}
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(1e8, []byte{0x00, 0x14, id}))
+	return tx
+}
+
+// childTx spends output 0 of parent
+func childTx(parent *wire.MsgTx) *wire.MsgTx {
+	txid := parent.TxHash()
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&txid, 0), []byte{0x01, 0x01}, nil))
+	tx.AddTxOut(wire.NewTxOut(5e7, []byte{0x00, 0x14, 0x01}))
+	return tx
+}
+
+// TestMempool double spends txs in and out of blocks, and makes sure the
+// right ones get evicted and reported.
+func TestMempool(t *testing.T) {
+	m := newMempool()
+
+	a := spendTx(1, true)
+	achild := childTx(a)
+	if len(m.add(a, false)) != 0 || len(m.add(achild, false)) != 0 {
+		t.Fatalf("conflicts adding unrelated txs")
+	}
+	if len(m.add(a, false)) != 0 || m.size() != 2 {
+		t.Fatalf("adding a tx twice: %d txs", m.size())
+	}
+
+	// b spends the same outpoint as a; a and its child go
+	b := spendTx(1, false)
+	cs := m.add(b, false)
+	if len(cs) != 2 || cs[0].Tx != a || cs[1].Tx != achild {
+		t.Fatalf("got %d conflicts, expect a and its child", len(cs))
+	}
+	for _, c := range cs {
+		if c.ByTx != b || c.Op != a.TxIn[0].PreviousOutPoint ||
+			c.Height != 0 || c.Ours {
+			t.Fatalf("conflict %+v", c)
+		}
+	}
+	if m.size() != 1 {
+		t.Fatalf("%d txs after eviction, expect 1", m.size())
+	}
+
+	// ours stays, and the other one doesn't get in
+	ours := spendTx(2, true)
+	m.add(ours, true)
+	theirs := spendTx(2, false)
+	cs = m.add(theirs, false)
+	if len(cs) != 1 || cs[0].Tx != ours || cs[0].ByTx != theirs || !cs[0].Ours {
+		t.Fatalf("got %d conflicts, expect ours", len(cs))
+	}
+	if m.txs[ours.TxHash()] == nil || m.txs[theirs.TxHash()] != nil {
+		t.Fatalf("replaced our tx")
+	}
+
+	// but if theirs gets mined, ours is out
+	cs = m.confirm(theirs, 100)
+	if len(cs) != 1 || cs[0].Tx != ours || cs[0].Height != 100 || !cs[0].Ours {
+		t.Fatalf("got %d conflicts confirming theirs", len(cs))
+	}
+
+	// confirming b just takes it out
+	cs = m.confirm(b, 101)
+	if len(cs) != 0 || m.size() != 0 {
+		t.Fatalf("%d conflicts, %d txs after confirming", len(cs), m.size())
+	}
+	if len(m.spends) != 0 {
+		t.Fatalf("%d spends left in empty mempool", len(m.spends))
+	}
+
+	// old txs go away
+	m.add(spendTx(3, true), false)
+	m.add(spendTx(4, true), false)
+	m.txs[spendTx(3, true).TxHash()].seen = time.Now().Add(-mempoolExpiry - time.Hour)
+	m.add(childTx(spendTx(4, true)), false)
+	_, ok := m.spends[wire.OutPoint{Hash: chainhash.Hash{3}}]
+	if m.size() != 2 || ok {
+		t.Fatalf("%d txs, old one still there", m.size())
+	}
+}
@@ -2,76 +2,81 @@ package uspv
 
 import (
 	"log"
+	"sync/atomic"
 
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil/bloom"
 	"github.com/mit-dci/lit/lnutil"
 )
 
+// incomingMessageHandler takes messages from all the peers, one at a time.
 func (s *SPVCon) incomingMessageHandler() {
 	for {
-		n, xm, _, err := wire.ReadMessageWithEncodingN(
-			s.con, s.localVersion, s.Param.Net, wire.LatestEncoding)
-		if err != nil {
-			log.Printf("ReadMessageWithEncodingN error.  Disconnecting: %s\n", err.Error())
-			return
-		}
-		s.RBytes += uint64(n)
-		//		log.Printf("Got %d byte %s message\n", n, xm.Command())
-		switch m := xm.(type) {
+		pm := <-s.inMsgQueue
+		p := pm.p
+		//		log.Printf("Got %s message from %s\n", pm.msg.Command(), p.addr)
+		switch m := pm.msg.(type) {
 		case *wire.MsgVersion:
 			log.Printf("Got version message.  Agent %s, version %d, at height %d\n",
 				m.UserAgent, m.ProtocolVersion, m.LastBlock)
-			s.remoteVersion = uint32(m.ProtocolVersion) // weird cast! bug?
 		case *wire.MsgVerAck:
 			log.Printf("Got verack.  Whatever.\n")
 		case *wire.MsgAddr:
-			log.Printf("got %d addresses.\n", len(m.AddrList))
+			s.AddrHandler(p, m)
 		case *wire.MsgPing:
 			// log.Printf("Got a ping message.  We should pong back or they will kick us off.")
-			go s.PongBack(m.Nonce)
+			s.PongBack(p, m.Nonce)
 		case *wire.MsgPong:
 			log.Printf("Got a pong response. OK.\n")
 		case *wire.MsgBlock:
-			s.IngestBlock(m)
+			s.IngestBlock(p, m)
 		case *wire.MsgMerkleBlock:
-			s.IngestMerkleBlock(m)
+			s.IngestMerkleBlock(p, m)
 		case *wire.MsgHeaders: // concurrent because we keep asking for blocks
-			go s.HeaderHandler(m)
+			if s.isCheck(p) {
+				go s.checkHeaders(p, m)
+			} else {
+				go s.HeaderHandler(p, m)
+			}
 		case *wire.MsgTx: // not concurrent! txs must be in order
-			s.TxHandler(m)
+			s.TxHandler(p, m)
 		case *wire.MsgReject:
-			log.Printf("Rejected! cmd: %s code: %s tx: %s reason: %s",
-				m.Cmd, m.Code.String(), m.Hash.String(), m.Reason)
+			log.Printf("Rejected by %s! cmd: %s code: %s tx: %s reason: %s",
+				p.addr, m.Cmd, m.Code.String(), m.Hash.String(), m.Reason)
 		case *wire.MsgInv:
-			s.InvHandler(m)
+			s.InvHandler(p, m)
 		case *wire.MsgNotFound:
-			log.Printf("Got not found response from remote:")
+			log.Printf("Got not found response from %s:", p.addr)
 			for i, thing := range m.InvList {
-				log.Printf("\t$d) %s: %s", i, thing.Type, thing.Hash)
+				log.Printf("\t%d) %s: %s", i, thing.Type, thing.Hash)
 			}
 		case *wire.MsgGetData:
-			s.GetDataHandler(m)
+			s.GetDataHandler(p, m)
+		case *MsgCFHeaders:
+			if !s.isSyncPeer(p) {
+				log.Printf("Unrequested cfheaders from %s", p.addr)
+				continue
+			}
+			select {
+			case s.cfHeadersChan <- m:
+			default:
+				log.Printf("Unrequested cfheaders")
+			}
+		case *MsgCFilter:
+			if !s.isSyncPeer(p) {
+				log.Printf("Unrequested cfilter from %s", p.addr)
+				continue
+			}
+			select {
+			case s.cfilterChan <- m:
+			default:
+				log.Printf("Unrequested cfilter")
+			}
 
 		default:
 			log.Printf("Got unknown message type %s\n", m.Command())
 		}
 	}
-	return
-}
-
-// this one seems kindof pointless?  could get ridf of it and let
-// functions call WriteMessageWithEncodingN themselves...
-func (s *SPVCon) outgoingMessageHandler() {
-	for {
-		msg := <-s.outMsgQueue
-		n, err := wire.WriteMessageWithEncodingN(s.con, msg, s.localVersion, s.Param.Net, wire.LatestEncoding)
-		if err != nil {
-			log.Printf("Write message error: %s", err.Error())
-		}
-		s.WBytes += uint64(n)
-	}
-	return
 }
 
 // fPositiveHandler monitors false positives and when it gets enough of them,
@@ -108,84 +113,150 @@ func (s *SPVCon) fPositiveHandler() {
 	}
 }
 
-func (s *SPVCon) HeaderHandler(m *wire.MsgHeaders) {
+// HeaderHandler deals with headers from the sync peer, and keeps the sync
+// going.
+func (s *SPVCon) HeaderHandler(p *peer, m *wire.MsgHeaders) {
+	if !s.isSyncPeer(p) {
+		log.Printf("Unrequested headers from %s\n", p.addr)
+		return
+	}
 	moar, err := s.IngestHeaders(m)
 	if err != nil {
-		log.Printf("Header error: %s\n", err.Error())
+		log.Printf("Header error from %s: %s\n", p.addr, err.Error())
+		s.peerError(p, err)
 		return
 	}
 	// more to get? if so, ask for them and return
 	if moar {
-		err = s.AskForHeaders()
+		err = s.askForHeaders(p)
 		if err != nil {
 			log.Printf("AskForHeaders error: %s", err.Error())
 		}
 		return
 	}
 	// no moar, done w/ headers, send filter and get blocks
-	if !s.HardMode { // don't send this in hardmode! that's the whole point
+	// don't send this in hardmode or with compact filters! that's the whole point
+	if !s.HardMode && !s.CFilters {
 		filt, err := s.GimmeFilter()
 		if err != nil {
 			log.Printf("AskForBlocks error: %s", err.Error())
 			return
 		}
 		// send filter
-		s.SendFilter(filt)
+		p.send(filt.MsgFilterLoad())
 		log.Printf("sent filter %x\n", filt.MsgFilterLoad().Filter)
 	}
 
-	err = s.AskForBlocks()
+	err = s.askForBlocks(p)
 	if err != nil {
 		log.Printf("AskForBlocks error: %s", err.Error())
 		return
 	}
 }
 
+// checkHeaders takes headers from checkPeer.  They only get looked at when
+// we're synced; if they add to our chain, that peer has blocks the sync peer
+// doesn't, so it becomes the sync peer.
+func (s *SPVCon) checkHeaders(p *peer, m *wire.MsgHeaders) {
+	if len(m.Headers) == 0 {
+		return // agrees with us, or is behind
+	}
+	select {
+	case <-s.inWaitState:
+	default:
+		log.Printf("ignoring headers from %s while syncing\n", p.addr)
+		return
+	}
+	stillSynced := func() {
+		select {
+		case s.inWaitState <- true:
+		default:
+		}
+	}
+
+	moar, err := s.IngestHeaders(m)
+	if err != nil {
+		log.Printf("Header error from %s: %s\n", p.addr, err.Error())
+		s.peerError(p, err)
+		stillSynced()
+		return
+	}
+	if !moar {
+		stillSynced()
+		return
+	}
+
+	log.Printf("%s has headers our sync peer didn't give us\n", p.addr)
+	if !s.switchSyncPeer(p) {
+		// it's gone already; keep going with whoever's there
+		p = s.getSyncPeer()
+		if p == nil {
+			return
+		}
+	}
+	err = s.askForHeaders(p)
+	if err != nil {
+		log.Printf("AskForHeaders error: %s", err.Error())
+	}
+}
+
 // TxHandler takes in transaction messages that come in from either a request
 // after an inv message or after a merkle block message.
-func (s *SPVCon) TxHandler(tx *wire.MsgTx) {
-	log.Printf("received msgtx %s\n", tx.TxHash().String())
+func (s *SPVCon) TxHandler(p *peer, tx *wire.MsgTx) {
+	log.Printf("received msgtx %s from %s\n", tx.TxHash().String(), p.addr)
 	// check if we have a height for this tx.
 	s.OKMutex.Lock()
 	height, ok := s.OKTxids[tx.TxHash()]
 	s.OKMutex.Unlock()
 	// if we don't have a height for this / it's not in the map, discard.
-	// currently CRASHES when this happens because I want to see if it ever does.
-	// it shouldn't if things are working properly.
+	// This used to crash, but with lots of peers (and reorgs forgetting
+	// txids) it can happen.
 	if !ok {
 		log.Printf("Tx %s unknown, will not ingest\n", tx.TxHash().String())
-		panic("unknown tx")
 		return
 	}
 
-	// check for double spends ...?
-	//	allTxs, err := s.TS.GetAllTxs()
-	//	if err != nil {
-	//		log.Printf("Can't get txs from db: %s", err.Error())
-	//		return
-	//	}
-	//	dubs, err := CheckDoubleSpends(m, allTxs)
-	//	if err != nil {
-	//		log.Printf("CheckDoubleSpends error: %s", err.Error())
-	//		return
-	//	}
-	//	if len(dubs) > 0 {
-	//		for i, dub := range dubs {
-	//			fmt.Printf("dub %d known tx %s and new tx %s are exclusive!!!\n",
-	//				i, dub.String(), m.TxSha().String())
-	//		}
-	//	}
-
-	// send txs up to wallit
-	if s.MatchTx(tx) {
+	match := s.MatchTx(tx)
+	// keep its proof if it came in a merkle block, before it goes up
+	if height != 0 {
+		s.popMBlockProof(tx, height, match)
+	}
+	// send txs up to wallit, and check for double spends
+	s.txUp(tx, height, match)
+}
+
+// txUp puts a tx in the mempool, or takes it out if it's confirmed, and
+// sends it up to the wallit if it matched.  Any txs it double spends go up
+// after it.
+func (s *SPVCon) txUp(tx *wire.MsgTx, height int32, match bool) {
+	var conflicts []lnutil.TxConflict
+	if height == 0 {
+		conflicts = s.mempool.add(tx, false)
+	} else {
+		conflicts = s.mempool.confirm(tx, height)
+	}
+	if match {
 		s.TxUpToWallit <- lnutil.TxAndHeight{tx, height}
 	}
+	s.sendConflicts(conflicts)
+}
+
+// sendConflicts tells the wallit about double spent txs
+func (s *SPVCon) sendConflicts(conflicts []lnutil.TxConflict) {
+	for _, c := range conflicts {
+		log.Printf("tx %s double spent by %s (outpoint %s, height %d)\n",
+			c.Tx.TxHash().String(), c.ByTx.TxHash().String(),
+			c.Op.String(), c.Height)
+		if cap(s.ConflictChan) != 0 {
+			s.ConflictChan <- c
+		}
+	}
 }
 
 // GetDataHandler responds to requests for tx data, which happen after
 // advertising our txs via an inv message
-func (s *SPVCon) GetDataHandler(m *wire.MsgGetData) {
-	log.Printf("got GetData.  Contains:\n")
+func (s *SPVCon) GetDataHandler(p *peer, m *wire.MsgGetData) {
+	log.Printf("got GetData from %s.  Contains:\n", p.addr)
 	var sent int32
 	for i, thing := range m.InvList {
 		log.Printf("\t%d)%s : %s",
@@ -198,8 +269,9 @@ func (s *SPVCon) GetDataHandler(m *wire.MsgGetData) {
 			if !ok {
 				log.Printf("tx %s requested by we don't have it\n",
 					thing.Hash.String())
+				continue
 			}
-			s.outMsgQueue <- tx
+			p.send(tx)
 			sent++
 			continue
 		}
@@ -209,27 +281,39 @@ func (s *SPVCon) GetDataHandler(m *wire.MsgGetData) {
 	log.Printf("sent %d of %d requested items", sent, len(m.InvList))
 }
 
-func (s *SPVCon) InvHandler(m *wire.MsgInv) {
-	log.Printf("got inv.  Contains:\n")
+// InvHandler deals with inv messages.  Txs are only asked for from the sync
+// peer, since everyone else will tell us about the same ones.  New blocks
+// from anyone else get their headers checked, in case the sync peer is
+// behind.
+func (s *SPVCon) InvHandler(p *peer, m *wire.MsgInv) {
+	log.Printf("got inv from %s.  Contains:\n", p.addr)
 	for i, thing := range m.InvList {
 		log.Printf("\t%d)%s : %s",
 			i, thing.Type.String(), thing.Hash.String())
 		if thing.Type == wire.InvTypeTx {
 			// ignore tx invs in ironman mode, or if we already have it
-			if !s.Ironman {
+			if !s.Ironman && s.isSyncPeer(p) {
 				// new tx, OK it at 0 and request
 				// also request if we already have it; might have new witness?
 				// needed for confirmed channels...
 				s.OKTxid(&thing.Hash, 0) // unconfirmed
-				s.AskForTx(thing.Hash)
+				s.askForTx(p, thing.Hash)
 			}
 		}
 		if thing.Type == wire.InvTypeBlock { // new block what to do?
+			if !s.isSyncPeer(p) {
+				// someone else has a new block; if we're synced, see if
+				// they have headers the sync peer doesn't
+				if len(s.inWaitState) != 0 && atomic.LoadInt32(&p.checks) == 0 {
+					s.checkPeer(p)
+				}
+				continue
+			}
 			select {
 			case <-s.inWaitState:
 				// start getting headers
 				log.Printf("asking for headers due to inv block\n")
-				err := s.AskForHeaders()
+				err := s.askForHeaders(p)
 				if err != nil {
 					log.Printf("AskForHeaders error: %s", err.Error())
 				}
@@ -241,15 +325,16 @@ func (s *SPVCon) InvHandler(m *wire.MsgInv) {
 	}
 }
 
-func (s *SPVCon) PongBack(nonce uint64) {
+func (s *SPVCon) PongBack(p *peer, nonce uint64) {
 	mpong := wire.NewMsgPong(nonce)
 
-	s.outMsgQueue <- mpong
+	p.send(mpong)
 	return
 }
 
+// SendFilter sends a bloom filter to the sync peer
 func (s *SPVCon) SendFilter(f *bloom.Filter) {
-	s.outMsgQueue <- f.MsgFilterLoad()
+	s.send(f.MsgFilterLoad())
 
 	return
 }
@@ -0,0 +1,798 @@
+package uspv
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+/*
+Peer pool.  SPVCon stays connected to a few full nodes at once.  One of them
+is the sync peer; headers, blocks and filters all come from it.  The others:
+ - get asked for headers past our tip whenever we're synced, or when they
+   announce a block.  If one of them has headers that add to our chain (or
+   a fork with more work), it becomes the sync peer.
+ - take over if the sync peer disconnects or gets banned.  Syncing starts
+   over from headers with the new one.
+ - relay our txs.
+
+Nodes to connect to come from the hosts given to Start, then addr messages
+from other nodes, then DNS seeds (unless going through a proxy, since the
+lookups would get around it).  Nodes which send bad headers, merkle blocks
+or blocks get disconnected and banned for a day.
+
+If every node goes away, the peer manager keeps redialing, waiting longer
+each time it fails.  Whoever connects first becomes the sync peer and
+syncing picks up where it left off: headers from our tip, then the filter
+is sent again (not in hard mode), then blocks from syncHeight.
+*/
+
+const (
+	// DefaultMaxPeers is how many nodes to stay connected to if MaxPeers
+	// isn't set
+	DefaultMaxPeers = 4
+
+	// banThreshold is the ban score where a peer gets disconnected and
+	// banned, and banDuration is how long it stays banned
+	banThreshold = 100
+	banDuration  = time.Hour * 24
+
+	// most addresses from addr messages to remember
+	maxKnownAddrs = 1000
+
+	peerDialTimeout = time.Second * 10
+	// how often the peer manager checks if it needs more peers
+	peerCheckInterval = time.Minute
+
+	// with no nodes left, the peer manager waits minRedialWait before
+	// redialing, twice as long each time that doesn't work, up to
+	// maxRedialWait.  The wait only goes back down after staying connected
+	// for stableConnTime, so nodes that take us and drop us right away
+	// don't get redialed in a tight loop.
+	minRedialWait  = time.Second
+	maxRedialWait  = time.Minute * 5
+	stableConnTime = time.Minute
+)
+
+// dnsSeeds are looked up when there's nothing else to connect to.  Keyed by
+// network name; networks without seeds only use the hosts they're given.
+var dnsSeeds = map[string][]string{
+	"mainnet": {
+		"seed.bitcoin.sipa.be",
+		"dnsseed.bluematt.me",
+		"dnsseed.bitcoin.dashjr.org",
+		"seed.bitcoinstats.com",
+		"seed.bitcoin.jonasschnelli.ch",
+		"seed.btc.petertodd.org",
+	},
+	"testnet3": {
+		"testnet-seed.bitcoin.jonasschnelli.ch",
+		"seed.tbtc.petertodd.org",
+		"testnet-seed.bluematt.me",
+	},
+	"litetest4": {
+		"testnet-seed.litecointools.com",
+		"seed-b.litecoin.loshan.co.uk",
+		"dnsseed-testnet.thrasher.io",
+	},
+}
+
+// MisbehaviorError is an error caused by something a peer shouldn't have
+// sent.  Score gets added to the peer's ban score.
+type MisbehaviorError struct {
+	Score  int32
+	Reason string
+}
+
+func (e *MisbehaviorError) Error() string {
+	return e.Reason
+}
+
+func misbehavior(score int32, format string, a ...interface{}) error {
+	return &MisbehaviorError{Score: score, Reason: fmt.Sprintf(format, a...)}
+}
+
+// peer is a full node we're connected to
+type peer struct {
+	addr string
+	con  net.Conn
+
+	out       chan wire.Message // messages waiting to be written
+	quit      chan struct{}     // closed when disconnected
+	closeOnce sync.Once
+
+	// from its version message
+	version   int32
+	userAgent string
+	services  wire.ServiceFlag
+	height    int32
+
+	connTime time.Time
+	banScore int32 // uses SPVCon.peerMtx
+
+	// checks is how many getheaders we've sent to check the sync peer
+	// against, and haven't heard back from.  atomic.
+	checks int32
+
+	rBytes uint64 // atomic
+	wBytes uint64 // atomic
+}
+
+// peerMsg is a message from a peer, on its way to the message handler
+type peerMsg struct {
+	p   *peer
+	msg wire.Message
+}
+
+// send queues a message for the peer.  If the peer's gone, it's dropped.
+func (p *peer) send(msg wire.Message) {
+	select {
+	case p.out <- msg:
+	case <-p.quit:
+	}
+}
+
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.con.Close()
+	})
+}
+
+// hostPort adds the network's default port to a host that doesn't have one
+func hostPort(host string, p *chaincfg.Params) string {
+	_, _, err := net.SplitHostPort(host)
+	if err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, p.DefaultPort)
+}
+
+// banKey is what bans are by; the IP, so coming back on another port
+// doesn't help.
+func banKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// connectPeer dials out to a full node, does the version handshake, and adds
+// it to the pool.
+func (s *SPVCon) connectPeer(addr string) (*peer, error) {
+	if s.isBanned(addr) {
+		return nil, fmt.Errorf("%s is banned", addr)
+	}
+	con, err := lnutil.DialTimeout(s.Dialer, addr, peerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{
+		addr:     addr,
+		con:      con,
+		out:      make(chan wire.Message, 32),
+		quit:     make(chan struct{}),
+		connTime: time.Now(),
+	}
+	err = s.handshake(p)
+	if err != nil {
+		con.Close()
+		return nil, err
+	}
+
+	s.peerMtx.Lock()
+	if s.peers[addr] != nil {
+		s.peerMtx.Unlock()
+		con.Close()
+		return nil, fmt.Errorf("already connected to %s", addr)
+	}
+	if len(s.peers) == 0 {
+		s.upSince = time.Now()
+		s.lastConnErr = ""
+	}
+	s.peers[addr] = p
+	delete(s.knownAddrs, addr)
+	s.peerMtx.Unlock()
+
+	go s.peerReader(p)
+	go s.peerWriter(p)
+
+	// find out about more nodes
+	p.send(wire.NewMsgGetAddr())
+	return p, nil
+}
+
+// handshake swaps version messages with a node we just connected to, and
+// makes sure it can give us what we need.
+func (s *SPVCon) handshake(p *peer) error {
+	p.con.SetDeadline(time.Now().Add(peerDialTimeout))
+	defer p.con.SetDeadline(time.Time{})
+
+	myMsgVer, err := wire.NewMsgVersionFromConn(p.con, 0, 0)
+	if err != nil {
+		return err
+	}
+	err = myMsgVer.AddUserAgent("lit", "v0.1")
+	if err != nil {
+		return err
+	}
+	// must set this to enable SPV stuff
+	myMsgVer.AddService(wire.SFNodeBloom)
+	// set this to enable segWit
+	myMsgVer.AddService(wire.SFNodeWitness)
+	// this actually sends
+	n, err := wire.WriteMessageWithEncodingN(
+		p.con, myMsgVer, s.localVersion, s.Param.Net, wire.LatestEncoding)
+	if err != nil {
+		return err
+	}
+	p.wBytes += uint64(n)
+	log.Printf("wrote %d byte version message to %s\n", n, p.addr)
+
+	n, m, err := readMessage(p.con, s.localVersion, s.Param.Net)
+	if err != nil {
+		return err
+	}
+	p.rBytes += uint64(n)
+
+	mv, ok := m.(*wire.MsgVersion)
+	if !ok {
+		return fmt.Errorf("%s didn't start with a version message", p.addr)
+	}
+	log.Printf("connected to %s at %s\n", mv.UserAgent, p.addr)
+	log.Printf("remote reports version %x (dec %d)\n",
+		mv.ProtocolVersion, mv.ProtocolVersion)
+
+	if mv.Services&wire.SFNodeWitness == 0 {
+		return fmt.Errorf("%s doesn't do segwit", p.addr)
+	}
+	if s.CFilters && mv.Services&SFNodeCompactFilters == 0 {
+		return fmt.Errorf("%s doesn't serve compact filters", p.addr)
+	}
+	p.version = mv.ProtocolVersion
+	p.userAgent = mv.UserAgent
+	p.services = mv.Services
+	p.height = mv.LastBlock
+
+	n, err = wire.WriteMessageWithEncodingN(
+		p.con, wire.NewMsgVerAck(), s.localVersion, s.Param.Net,
+		wire.LatestEncoding)
+	if err != nil {
+		return err
+	}
+	p.wBytes += uint64(n)
+	return nil
+}
+
+// peerReader reads messages from a peer and hands them to the message
+// handler, until the connection breaks.
+func (s *SPVCon) peerReader(p *peer) {
+	for {
+		n, m, err := readMessage(p.con, s.localVersion, s.Param.Net)
+		if err != nil {
+			s.dropPeer(p, err.Error())
+			return
+		}
+		atomic.AddUint64(&p.rBytes, uint64(n))
+		atomic.AddUint64(&s.RBytes, uint64(n))
+		if m == nil { // skipped
+			continue
+		}
+		select {
+		case s.inMsgQueue <- peerMsg{p, m}:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// peerWriter writes queued messages to a peer
+func (s *SPVCon) peerWriter(p *peer) {
+	for {
+		select {
+		case msg := <-p.out:
+			n, err := wire.WriteMessageWithEncodingN(
+				p.con, msg, s.localVersion, s.Param.Net, wire.LatestEncoding)
+			atomic.AddUint64(&p.wBytes, uint64(n))
+			atomic.AddUint64(&s.WBytes, uint64(n))
+			if err != nil {
+				s.dropPeer(p, err.Error())
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// dropPeer disconnects from a peer and takes it out of the pool.  If it was
+// the sync peer, the best one left takes over.
+func (s *SPVCon) dropPeer(p *peer, why string) {
+	p.close()
+
+	s.peerMtx.Lock()
+	if s.peers[p.addr] != p {
+		s.peerMtx.Unlock()
+		return
+	}
+	delete(s.peers, p.addr)
+	if len(s.peers) == 0 {
+		s.downSince = time.Now()
+		s.lastConnErr = why
+	}
+	wasSync := s.syncPeer == p
+	var next *peer
+	if wasSync {
+		next = s.bestPeer()
+		s.setSyncPeer(next)
+	}
+	s.peerMtx.Unlock()
+
+	log.Printf("disconnected from %s: %s\n", p.addr, why)
+	s.wantPeers()
+
+	if !wasSync {
+		return
+	}
+	if next == nil {
+		log.Printf("no nodes left to sync from\n")
+		return
+	}
+	log.Printf("sync peer now %s\n", next.addr)
+	s.restartSync(next)
+}
+
+// newPeer starts using a peer that just connected.  If there's no sync peer
+// it becomes the sync peer.  Otherwise if we're synced, it gets asked for
+// headers to check against ours.
+func (s *SPVCon) newPeer(p *peer) {
+	s.peerMtx.Lock()
+	isSync := s.syncPeer == nil
+	if isSync {
+		s.setSyncPeer(p)
+	}
+	s.peerMtx.Unlock()
+
+	if isSync {
+		log.Printf("sync peer now %s\n", p.addr)
+		s.restartSync(p)
+		return
+	}
+	if len(s.inWaitState) != 0 {
+		s.checkPeer(p)
+	}
+}
+
+// restartSync starts syncing from the top with a new sync peer.  Whatever
+// was asked of the old one is forgotten.
+func (s *SPVCon) restartSync(p *peer) {
+	select { // not waiting any more
+	case <-s.inWaitState:
+	default:
+	}
+	err := s.askForHeaders(p)
+	if err != nil {
+		log.Printf("AskForHeaders error: %s", err.Error())
+	}
+}
+
+// setSyncPeer makes p the sync peer.  Blocks asked of the old one aren't
+// coming, so the block queue starts over, and any filters it sent are
+// thrown out.  Call with peerMtx held.
+func (s *SPVCon) setSyncPeer(p *peer) {
+	if s.syncPeer == p {
+		return
+	}
+	s.syncPeer = p
+	s.blockQueue = make(chan HashAndHeight, cap(s.blockQueue))
+	for {
+		select {
+		case <-s.cfHeadersChan:
+		case <-s.cfilterChan:
+		default:
+			return
+		}
+	}
+}
+
+// switchSyncPeer makes p the sync peer if it's still connected.
+func (s *SPVCon) switchSyncPeer(p *peer) bool {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	if s.peers[p.addr] != p {
+		return false
+	}
+	if s.syncPeer != p {
+		log.Printf("sync peer now %s\n", p.addr)
+		s.setSyncPeer(p)
+	}
+	return true
+}
+
+// bestPeer is the peer that said it had the most blocks.  Call with peerMtx
+// held.
+func (s *SPVCon) bestPeer() *peer {
+	var best *peer
+	for _, p := range s.peers {
+		if best == nil || p.height > best.height {
+			best = p
+		}
+	}
+	return best
+}
+
+func (s *SPVCon) getSyncPeer() *peer {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	return s.syncPeer
+}
+
+func (s *SPVCon) isSyncPeer(p *peer) bool {
+	return s.getSyncPeer() == p
+}
+
+// otherPeers is everyone but the sync peer
+func (s *SPVCon) otherPeers() []*peer {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	var others []*peer
+	for _, p := range s.peers {
+		if p != s.syncPeer {
+			others = append(others, p)
+		}
+	}
+	return others
+}
+
+// syncQueue returns the block queue, if p is still the sync peer.
+func (s *SPVCon) syncQueue(p *peer) chan HashAndHeight {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	if p != s.syncPeer {
+		return nil
+	}
+	return s.blockQueue
+}
+
+// popBlock takes the next requested block off the queue, if p is the sync
+// peer.  Blocks from anyone else weren't asked for.
+func (s *SPVCon) popBlock(p *peer) (HashAndHeight, bool) {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	if p != s.syncPeer {
+		return HashAndHeight{}, false
+	}
+	select {
+	case hah := <-s.blockQueue:
+		return hah, true
+	default:
+		return HashAndHeight{}, false
+	}
+}
+
+// send queues a message for the sync peer.  If there isn't one, it's
+// dropped; syncing starts over when a node connects.
+func (s *SPVCon) send(msg wire.Message) {
+	p := s.getSyncPeer()
+	if p == nil {
+		log.Printf("no node to send %s message to\n", msg.Command())
+		return
+	}
+	p.send(msg)
+}
+
+// broadcast sends a message to every peer
+func (s *SPVCon) broadcast(msg wire.Message) {
+	s.peerMtx.Lock()
+	peers := make([]*peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.peerMtx.Unlock()
+	for _, p := range peers {
+		p.send(msg)
+	}
+}
+
+// crossCheck asks the peers we aren't syncing from for headers past our
+// tip.  If one has headers we don't, checkHeaders switches to it.
+func (s *SPVCon) crossCheck() {
+	for _, p := range s.otherPeers() {
+		s.checkPeer(p)
+	}
+}
+
+// checkPeer asks a peer for headers past our tip, to check the sync peer
+// against.  The reply goes to checkHeaders, not HeaderHandler, even if p
+// has become the sync peer by then; nodes reply in order, so the first
+// headers messages from p are the replies to these.
+func (s *SPVCon) checkPeer(p *peer) {
+	atomic.AddInt32(&p.checks, 1)
+	err := s.askForHeaders(p)
+	if err != nil {
+		atomic.AddInt32(&p.checks, -1)
+		log.Printf("AskForHeaders error: %s", err.Error())
+	}
+}
+
+// isCheck says whether a headers message from p is the reply to a
+// checkPeer.  Only the message handler calls this, so it's the only one
+// taking away from p.checks.
+func (s *SPVCon) isCheck(p *peer) bool {
+	if atomic.LoadInt32(&p.checks) > 0 {
+		atomic.AddInt32(&p.checks, -1)
+		return true
+	}
+	return false
+}
+
+// misbehaving adds to a peer's ban score.  At banThreshold it gets
+// disconnected, and its IP banned for banDuration.
+func (s *SPVCon) misbehaving(p *peer, score int32, why string) {
+	s.peerMtx.Lock()
+	p.banScore += score
+	total := p.banScore
+	ban := total >= banThreshold
+	if ban {
+		s.banned[banKey(p.addr)] = time.Now().Add(banDuration)
+	}
+	s.peerMtx.Unlock()
+
+	log.Printf("%s misbehaving, ban score %d: %s\n", p.addr, total, why)
+	if ban {
+		s.dropPeer(p, "banned")
+	}
+}
+
+// peerError deals with an error from handling something a peer sent.  If
+// it's the peer's fault, it counts against the peer.
+func (s *SPVCon) peerError(p *peer, err error) {
+	mb, ok := err.(*MisbehaviorError)
+	if ok {
+		s.misbehaving(p, mb.Score, mb.Reason)
+	}
+}
+
+func (s *SPVCon) isBanned(addr string) bool {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	return s.isBannedLocked(addr)
+}
+
+// isBannedLocked is isBanned with peerMtx held.  Old bans get cleared out.
+func (s *SPVCon) isBannedLocked(addr string) bool {
+	until, ok := s.banned[banKey(addr)]
+	if ok && time.Now().After(until) {
+		delete(s.banned, banKey(addr))
+		return false
+	}
+	return ok
+}
+
+// AddrHandler remembers nodes we hear about, to connect to later.
+func (s *SPVCon) AddrHandler(p *peer, m *wire.MsgAddr) {
+	var added int
+	s.peerMtx.Lock()
+	for _, na := range m.AddrList {
+		if !na.HasService(wire.SFNodeNetwork) ||
+			!na.HasService(wire.SFNodeWitness) ||
+			(s.CFilters && !na.HasService(SFNodeCompactFilters)) {
+			continue
+		}
+		if s.addKnownAddr(
+			net.JoinHostPort(na.IP.String(), strconv.Itoa(int(na.Port)))) {
+			added++
+		}
+	}
+	s.peerMtx.Unlock()
+	log.Printf("got %d addresses from %s, %d new\n",
+		len(m.AddrList), p.addr, added)
+}
+
+// addKnownAddr adds an address to try later.  Returns false if we already
+// have it, or have enough.  Call with peerMtx held.
+func (s *SPVCon) addKnownAddr(addr string) bool {
+	if len(s.knownAddrs) >= maxKnownAddrs || s.knownAddrs[addr] ||
+		s.peers[addr] != nil {
+		return false
+	}
+	s.knownAddrs[addr] = true
+	return true
+}
+
+// lookupSeeds gets addresses from the network's DNS seeds.  Not through a
+// proxy, since the lookups would go around it.
+func (s *SPVCon) lookupSeeds() {
+	if s.Dialer != nil {
+		return
+	}
+	for _, seed := range dnsSeeds[s.Param.Name] {
+		ips, err := net.LookupHost(seed)
+		if err != nil {
+			log.Printf("DNS seed %s: %s\n", seed, err.Error())
+			continue
+		}
+		log.Printf("%d addresses from DNS seed %s\n", len(ips), seed)
+		s.peerMtx.Lock()
+		for _, ip := range ips {
+			s.addKnownAddr(net.JoinHostPort(ip, s.Param.DefaultPort))
+		}
+		s.peerMtx.Unlock()
+	}
+}
+
+// nextAddr picks the next node to try.  Hosts from Start go first, then a
+// random one of the addresses we've heard about.
+func (s *SPVCon) nextAddr(tried map[string]bool) (string, bool) {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	for _, addr := range s.peerHosts {
+		if !tried[addr] && s.peers[addr] == nil && !s.isBannedLocked(addr) {
+			tried[addr] = true
+			return addr, true
+		}
+	}
+	for addr, _ := range s.knownAddrs {
+		delete(s.knownAddrs, addr)
+		if !tried[addr] && s.peers[addr] == nil && !s.isBannedLocked(addr) {
+			tried[addr] = true
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+func (s *SPVCon) numPeers() int {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	return len(s.peers)
+}
+
+func (s *SPVCon) maxPeers() int {
+	if s.MaxPeers > 0 {
+		return s.MaxPeers
+	}
+	return DefaultMaxPeers
+}
+
+// fillPool connects to nodes until there are want of them, or there's
+// nothing left to try.  DNS seeds only get looked up if we run out of
+// other addresses.
+func (s *SPVCon) fillPool(want int) {
+	tried := make(map[string]bool)
+	seeded := false
+	for s.numPeers() < want {
+		addr, ok := s.nextAddr(tried)
+		if !ok {
+			if seeded {
+				return
+			}
+			seeded = true
+			s.lookupSeeds()
+			continue
+		}
+		p, err := s.connectPeer(addr)
+		if err != nil {
+			log.Printf("can't connect to %s: %s\n", addr, err.Error())
+			s.peerMtx.Lock()
+			if len(s.peers) == 0 {
+				s.lastConnErr = err.Error()
+			}
+			s.peerMtx.Unlock()
+			continue
+		}
+		s.newPeer(p)
+	}
+}
+
+// wantPeers pokes the peer manager to go find more peers
+func (s *SPVCon) wantPeers() {
+	select {
+	case s.needPeers <- true:
+	default:
+	}
+}
+
+// peerManager keeps the pool full.  It checks every so often, and whenever
+// a peer disconnects.  When there's nobody left, it backs off between tries.
+func (s *SPVCon) peerManager() {
+	wait := minRedialWait
+	for {
+		s.fillPool(s.maxPeers())
+		if s.numPeers() != 0 {
+			select {
+			case <-s.needPeers:
+			case <-time.After(peerCheckInterval):
+			}
+			up, lasted := s.uptime()
+			if up || lasted >= stableConnTime {
+				wait = minRedialWait
+				continue
+			}
+			// lost everyone right after connecting; don't go straight back
+		}
+		s.peerMtx.Lock()
+		s.nextDial = time.Now().Add(wait)
+		s.peerMtx.Unlock()
+		log.Printf("no nodes to sync from, trying again in %s\n", wait.String())
+		time.Sleep(wait)
+
+		wait *= 2
+		if wait > maxRedialWait {
+			wait = maxRedialWait
+		}
+	}
+}
+
+// uptime says whether we're connected to anyone, and how long we've been
+// connected; if we aren't, how long the last connection lasted.
+func (s *SPVCon) uptime() (bool, time.Duration) {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	if len(s.peers) != 0 {
+		return true, time.Since(s.upSince)
+	}
+	return false, s.downSince.Sub(s.upSince)
+}
+
+// ConnState says whether we're connected to any nodes.  If we aren't, it's
+// got when the last one went away, why, and when we'll try again.
+func (s *SPVCon) ConnState() lnutil.ChainConnState {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	cs := lnutil.ChainConnState{
+		Connected: len(s.peers) != 0,
+		Peers:     len(s.peers),
+	}
+	if cs.Connected {
+		cs.Since = s.upSince.Unix()
+		return cs
+	}
+	if !s.downSince.IsZero() {
+		cs.Since = s.downSince.Unix()
+	}
+	if s.nextDial.After(time.Now()) {
+		cs.NextTry = s.nextDial.Unix()
+	}
+	cs.LastError = s.lastConnErr
+	return cs
+}
+
+// Peers returns info about the nodes we're connected to
+func (s *SPVCon) Peers() []lnutil.ChainPeerInfo {
+	s.peerMtx.Lock()
+	defer s.peerMtx.Unlock()
+	infos := make([]lnutil.ChainPeerInfo, 0, len(s.peers))
+	for _, p := range s.peers {
+		infos = append(infos, lnutil.ChainPeerInfo{
+			Addr:      p.addr,
+			UserAgent: p.userAgent,
+			Version:   p.version,
+			Services:  uint64(p.services),
+			Height:    p.height,
+			Sync:      p == s.syncPeer,
+			BanScore:  p.banScore,
+			BytesSent: atomic.LoadUint64(&p.wBytes),
+			BytesRecv: atomic.LoadUint64(&p.rBytes),
+			ConnTime:  p.connTime.Unix(),
+		})
+	}
+	sort.Sort(peersByAddr(infos))
+	return infos
+}
+
+type peersByAddr []lnutil.ChainPeerInfo
+
+func (s peersByAddr) Len() int           { return len(s) }
+func (s peersByAddr) Less(i, j int) bool { return s[i].Addr < s[j].Addr }
+func (s peersByAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
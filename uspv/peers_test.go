@@ -0,0 +1,281 @@
+package uspv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/wire"
+)
+
+// fakeNode is a full node on localhost.  It does the version handshake, then
+// passes along whatever it gets sent.
+type fakeNode struct {
+	addr string
+	l    net.Listener
+	cons chan net.Conn
+	msgs chan wire.Message
+}
+
+func newFakeNode(t *testing.T, bnet wire.BitcoinNet,
+	services wire.ServiceFlag, height int32) *fakeNode {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{
+		addr: l.Addr().String(),
+		l:    l,
+		cons: make(chan net.Conn, 10),
+		msgs: make(chan wire.Message, 100),
+	}
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			n.cons <- con
+			go n.serve(con, bnet, services, height)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNode) serve(con net.Conn, bnet wire.BitcoinNet,
+	services wire.ServiceFlag, height int32) {
+
+	_, _, err := readMessage(con, VERSION, bnet)
+	if err != nil {
+		con.Close()
+		return
+	}
+	mv, err := wire.NewMsgVersionFromConn(con, 1, height)
+	if err != nil {
+		con.Close()
+		return
+	}
+	mv.Services = services
+	_, err = wire.WriteMessageWithEncodingN(
+		con, mv, VERSION, bnet, wire.LatestEncoding)
+	if err != nil {
+		con.Close()
+		return
+	}
+	for {
+		_, m, err := readMessage(con, VERSION, bnet)
+		if err != nil {
+			return
+		}
+		if m != nil {
+			n.msgs <- m
+		}
+	}
+}
+
+// next waits for the node to get a cmd message, skipping anything else
+func (n *fakeNode) next(t *testing.T, cmd string) wire.Message {
+	for {
+		select {
+		case m := <-n.msgs:
+			if m.Command() == cmd {
+				return m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s never got %s", n.addr, cmd)
+		}
+	}
+}
+
+// testPool is testSPVCon with an empty peer pool and a message handler
+func testPool(t *testing.T) (*SPVCon, func()) {
+	s, done := testSPVCon(t)
+	s.syncPeer = nil
+	s.peers = make(map[string]*peer)
+	s.knownAddrs = make(map[string]bool)
+	s.banned = make(map[string]time.Time)
+	s.needPeers = make(chan bool, 1)
+	s.inMsgQueue = make(chan peerMsg)
+	s.inWaitState = make(chan bool, 1)
+	s.blockQueue = make(chan HashAndHeight, 32)
+	go s.incomingMessageHandler()
+	return s, done
+}
+
+// TestPeerFailover connects to 2 nodes, and makes sure the second takes over
+// syncing when the first goes away, and gets banned when it misbehaves.
+func TestPeerFailover(t *testing.T) {
+	s, done := testPool(t)
+	defer done()
+
+	good := wire.SFNodeNetwork | wire.SFNodeWitness
+	a := newFakeNode(t, s.Param.Net, good, 100)
+	defer a.l.Close()
+	b := newFakeNode(t, s.Param.Net, good, 200)
+	defer b.l.Close()
+	c := newFakeNode(t, s.Param.Net, wire.SFNodeNetwork, 300)
+	defer c.l.Close()
+
+	// no segwit, no connection
+	_, err := s.connectPeer(c.addr)
+	if err == nil {
+		t.Fatalf("connected to node without segwit")
+	}
+
+	pa, err := s.connectPeer(a.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.newPeer(pa)
+	a.next(t, "getheaders")
+
+	pb, err := s.connectPeer(b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.newPeer(pb)
+	if s.getSyncPeer() != pa {
+		t.Fatalf("sync peer changed when second node connected")
+	}
+
+	infos := s.Peers()
+	if len(infos) != 2 {
+		t.Fatalf("%d peers, expect 2", len(infos))
+	}
+	for _, info := range infos {
+		if info.Sync != (info.Addr == a.addr) {
+			t.Fatalf("%s sync %v", info.Addr, info.Sync)
+		}
+		if info.Addr == b.addr && info.Height != 200 {
+			t.Fatalf("%s height %d, expect 200", info.Addr, info.Height)
+		}
+	}
+
+	// a goes away, so b takes over and starts from headers
+	(<-a.cons).Close()
+	b.next(t, "getheaders")
+	if s.getSyncPeer() != pb || s.numPeers() != 1 {
+		t.Fatalf("b didn't take over syncing")
+	}
+
+	// b misbehaves a bit, then too much
+	s.misbehaving(pb, 50, "test")
+	if s.numPeers() != 1 || s.Peers()[0].BanScore != 50 {
+		t.Fatalf("dropped peer before ban threshold")
+	}
+	s.misbehaving(pb, 50, "test")
+	if s.numPeers() != 0 || s.getSyncPeer() != nil {
+		t.Fatalf("banned peer still connected")
+	}
+	if !s.isBanned(b.addr) {
+		t.Fatalf("%s not banned", b.addr)
+	}
+	_, err = s.connectPeer(b.addr)
+	if err == nil {
+		t.Fatalf("connected to banned node")
+	}
+}
+
+// TestAddrs checks which addresses get remembered, what order they're tried
+// in, and that bans run out.
+func TestAddrs(t *testing.T) {
+	s, done := testPool(t)
+	defer done()
+	s.peerHosts = []string{"10.0.0.1:18444"}
+
+	m := wire.NewMsgAddr()
+	good := wire.SFNodeNetwork | wire.SFNodeWitness
+	m.AddAddress(wire.NewNetAddressIPPort(net.ParseIP("1.2.3.4"), 18444, good))
+	m.AddAddress(wire.NewNetAddressIPPort(
+		net.ParseIP("5.6.7.8"), 18444, wire.SFNodeNetwork))
+	m.AddAddress(wire.NewNetAddressIPPort(net.ParseIP("9.9.9.9"), 18444, good))
+	s.AddrHandler(&peer{addr: "test"}, m)
+
+	if len(s.knownAddrs) != 2 || !s.knownAddrs["1.2.3.4:18444"] ||
+		!s.knownAddrs["9.9.9.9:18444"] {
+		t.Fatalf("known addresses %v", s.knownAddrs)
+	}
+
+	s.banned["9.9.9.9"] = time.Now().Add(time.Hour)
+	s.banned["10.0.0.1"] = time.Now().Add(-time.Second)
+
+	// host from Start first, since its ban is over
+	tried := make(map[string]bool)
+	addr, ok := s.nextAddr(tried)
+	if !ok || addr != "10.0.0.1:18444" {
+		t.Fatalf("first address %s, expect 10.0.0.1:18444", addr)
+	}
+	addr, ok = s.nextAddr(tried)
+	if !ok || addr != "1.2.3.4:18444" {
+		t.Fatalf("second address %s, expect 1.2.3.4:18444", addr)
+	}
+	addr, ok = s.nextAddr(tried)
+	if ok {
+		t.Fatalf("got banned address %s", addr)
+	}
+	if len(s.knownAddrs) != 0 {
+		t.Fatalf("tried addresses still known")
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for host, want := range map[string]string{
+		"node.example":      "node.example:18444",
+		"node.example:1234": "node.example:1234",
+		"10.1.2.3":          "10.1.2.3:18444",
+		"::1":               "[::1]:18444",
+		"[::1]:8333":        "[::1]:8333",
+	} {
+		got := hostPort(host, &chaincfg.RegressionNetParams)
+		if got != want {
+			t.Fatalf("hostPort(%s) %s, expect %s", host, got, want)
+		}
+	}
+}
+
+// TestRedial makes sure the peer manager reconnects when the only node goes
+// away, and starts syncing with it again.
+func TestRedial(t *testing.T) {
+	s, done := testPool(t)
+	defer done()
+
+	good := wire.SFNodeNetwork | wire.SFNodeWitness
+	a := newFakeNode(t, s.Param.Net, good, 100)
+	defer a.l.Close()
+	s.peerHosts = []string{a.addr}
+	s.MaxPeers = 1
+
+	cs := s.ConnState()
+	if cs.Connected {
+		t.Fatalf("connected before dialing anyone")
+	}
+	go s.peerManager()
+	a.next(t, "getheaders")
+	cs = s.ConnState()
+	if !cs.Connected || cs.Peers != 1 {
+		t.Fatalf("not connected after dialing: %v", cs)
+	}
+
+	// a hangs up.  It's redialed after a bit, and gets asked for headers
+	// again.
+	(<-a.cons).Close()
+	for i := 0; ; i++ {
+		cs = s.ConnState()
+		if !cs.Connected {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("still connected after node hung up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cs.LastError == "" || cs.Peers != 0 {
+		t.Fatalf("disconnected state %v", cs)
+	}
+	a.next(t, "getheaders")
+	if !s.ConnState().Connected || s.getSyncPeer() == nil {
+		t.Fatalf("didn't resume syncing after redialing")
+	}
+}
@@ -0,0 +1,222 @@
+package uspv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// mineHeaders makes n regtest headers on top of prev, grinding nonces until
+// the proof of work is good.  id makes branches different from each other.
+func mineHeaders(prev wire.BlockHeader, n int, id byte) []*wire.BlockHeader {
+	var hdrs []*wire.BlockHeader
+	target := blockchain.CompactToBig(prev.Bits)
+	for i := 0; i < n; i++ {
+		hdr := &wire.BlockHeader{
+			Version:    4,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: chainhash.Hash{id, byte(i)},
+			Timestamp:  prev.Timestamp.Add(time.Minute),
+			Bits:       prev.Bits,
+		}
+		for {
+			hash := hdr.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			hdr.Nonce++
+		}
+		hdrs = append(hdrs, hdr)
+		prev = *hdr
+	}
+	return hdrs
+}
+
+func headersMsg(hdrs ...[]*wire.BlockHeader) *wire.MsgHeaders {
+	m := wire.NewMsgHeaders()
+	for _, h := range hdrs {
+		m.Headers = append(m.Headers, h...)
+	}
+	return m
+}
+
+// testSPVCon makes an SPVCon with a fresh regtest header file, and a sync
+// peer that isn't connected to anything.  What's sent to it shows up on
+// s.syncPeer.out.
+func testSPVCon(t *testing.T) (*SPVCon, func()) {
+	dir, err := ioutil.TempDir("", "uspvtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(SPVCon)
+	s.Param = &chaincfg.RegressionNetParams
+	s.OKTxids = make(map[chainhash.Hash]int32)
+	s.cfHeaders = make(map[int32]chainhash.Hash)
+	s.DisconnectChan = make(chan lnutil.BlockDisconnect, 100)
+	s.mempool = newMempool()
+	s.localVersion = VERSION
+	s.syncPeer = &peer{
+		addr: "test", out: make(chan wire.Message, 1), quit: make(chan struct{})}
+	s.pendingProofs = make(map[chainhash.Hash]lnutil.TxProof)
+	err = s.openHeaderFile(filepath.Join(dir, "header.bin"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	err = s.openProofDB(filepath.Join(dir, "txproof.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.headerFile.Close()
+		s.proofDB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func checkTip(t *testing.T, s *SPVCon, height int32, hdr *wire.BlockHeader) {
+	s.headerMutex.Lock()
+	defer s.headerMutex.Unlock()
+	tip, err := s.headerTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip != height {
+		t.Fatalf("header tip %d, expect %d", tip, height)
+	}
+	got, err := s.readHeader(tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BlockHash() != hdr.BlockHash() {
+		t.Fatalf("header %d is %s, expect %s",
+			tip, got.BlockHash().String(), hdr.BlockHash().String())
+	}
+}
+
+// TestReorg feeds forks of the header chain to IngestHeaders, and makes sure
+// the one with the most work wins and the right blocks get disconnected.
+func TestReorg(t *testing.T) {
+	s, done := testSPVCon(t)
+	defer done()
+
+	genesis := s.Param.GenesisBlock.Header
+	a := mineHeaders(genesis, 5, 'a')
+	moar, err := s.IngestHeaders(headersMsg(a))
+	if err != nil || !moar {
+		t.Fatalf("IngestHeaders %v %v", moar, err)
+	}
+	checkTip(t, s, 5, a[4])
+	s.syncHeight = 5
+
+	// same headers again don't do anything
+	moar, err = s.IngestHeaders(headersMsg(a[2:]))
+	if err != nil || moar {
+		t.Fatalf("IngestHeaders repeat %v %v", moar, err)
+	}
+	checkTip(t, s, 5, a[4])
+
+	// b forks off after a[1] (height 2) and goes to 6, so wins
+	s.OKTxids[chainhash.Hash{1}] = 2
+	s.OKTxids[chainhash.Hash{2}] = 4
+	b := mineHeaders(*a[1], 4, 'b')
+	moar, err = s.IngestHeaders(headersMsg(a[:2], b))
+	if err != nil || !moar {
+		t.Fatalf("IngestHeaders reorg %v %v", moar, err)
+	}
+	checkTip(t, s, 6, b[3])
+	for _, h := range []int32{5, 4, 3} {
+		d := <-s.DisconnectChan
+		if d.Height != h || d.Hash != a[h-1].BlockHash() {
+			t.Fatalf("disconnected %d %s, expect %d %s", d.Height,
+				d.Hash.String(), h, a[h-1].BlockHash().String())
+		}
+	}
+	if len(s.DisconnectChan) != 0 {
+		t.Fatalf("%d extra disconnects", len(s.DisconnectChan))
+	}
+	if s.syncHeight != 2 {
+		t.Fatalf("sync height %d after reorg, expect 2", s.syncHeight)
+	}
+	if _, ok := s.OKTxids[chainhash.Hash{2}]; ok {
+		t.Fatalf("kept txid from the old branch")
+	}
+	if _, ok := s.OKTxids[chainhash.Hash{1}]; !ok {
+		t.Fatalf("lost txid from below the fork")
+	}
+	s.syncHeight = 6
+
+	// c forks off after b[1] (height 4) but only goes to 5, so loses
+	c := mineHeaders(*b[1], 1, 'c')
+	moar, err = s.IngestHeaders(headersMsg(c))
+	if err != nil || moar {
+		t.Fatalf("IngestHeaders short fork %v %v", moar, err)
+	}
+	checkTip(t, s, 6, b[3])
+
+	// d forks off after b[0] and would win, but has a bad header
+	d := mineHeaders(*b[0], 5, 'd')
+	d[3].Bits = 0x1d00ffff
+	_, err = s.IngestHeaders(headersMsg(d))
+	if err == nil {
+		t.Fatalf("no error ingesting bad header")
+	}
+	checkTip(t, s, 6, b[3])
+
+	// headers that don't connect to anything
+	_, err = s.IngestHeaders(headersMsg(mineHeaders(*c[0], 3, 'e')[1:]))
+	if err == nil {
+		t.Fatalf("no error ingesting headers that don't connect")
+	}
+	checkTip(t, s, 6, b[3])
+
+	if len(s.DisconnectChan) != 0 || s.syncHeight != 6 {
+		t.Fatalf("failed reorgs disconnected blocks")
+	}
+}
+
+// TestBlockLocator makes sure AskForHeaders sends the last 10 headers, then
+// backs off exponentially to the first header.
+func TestBlockLocator(t *testing.T) {
+	s, done := testSPVCon(t)
+	defer done()
+
+	genesis := s.Param.GenesisBlock.Header
+	hdrs := mineHeaders(genesis, 26, 'a')
+	_, err := s.IngestHeaders(headersMsg(hdrs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.AskForHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ghdr := (<-s.syncPeer.out).(*wire.MsgGetHeaders)
+
+	var want []chainhash.Hash
+	for _, h := range []int32{26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 15, 11, 3} {
+		want = append(want, hdrs[h-1].BlockHash())
+	}
+	want = append(want, genesis.BlockHash())
+
+	if len(ghdr.BlockLocatorHashes) != len(want) {
+		t.Fatalf("%d locator hashes, expect %d",
+			len(ghdr.BlockLocatorHashes), len(want))
+	}
+	for i, hash := range ghdr.BlockLocatorHashes {
+		if *hash != want[i] {
+			t.Fatalf("locator hash %d is %s, expect %s",
+				i, hash.String(), want[i].String())
+		}
+	}
+}
@@ -1,53 +1,98 @@
 package uspv
 
 import (
-	"net"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/adiabat/btcd/chaincfg"
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
+	"github.com/boltdb/bolt"
 	"github.com/mit-dci/lit/lnutil"
 )
 
 type SPVCon struct {
-	con net.Conn // the (probably tcp) connection to the node
+	// peers are the full nodes we're connected to, by address.  syncPeer is
+	// the one headers and blocks come from.  See peers.go.
+	peerMtx    sync.Mutex
+	peers      map[string]*peer
+	syncPeer   *peer
+	peerHosts  []string             // nodes given to Start, tried first
+	knownAddrs map[string]bool      // nodes we've heard about
+	banned     map[string]time.Time // banned IPs and when the bans end
+	needPeers  chan bool            // pokes the peer manager
+
+	// connection state, for ConnState.  upSince is when the pool last went
+	// from empty to not, downSince when it last went empty.  nextDial is
+	// when the peer manager tries again if it's empty.  peerMtx.
+	upSince     time.Time
+	downSince   time.Time
+	nextDial    time.Time
+	lastConnErr string
+
+	// MaxPeers is how many nodes to stay connected to; DefaultMaxPeers if 0
+	MaxPeers int
+
+	// Dialer connects to nodes, maybe through a proxy.  nil dials directly.
+	Dialer lnutil.Dialer
 
 	// Enhanced SPV modes for users who have outgrown easy mode SPV
 	// but have not yet graduated to full nodes.
 	HardMode bool // hard mode doesn't use filters.
 	Ironman  bool // ironman only gets blocks, never requests txs.
+	// CFilters uses BIP157/158 compact filters, and only gets matching blocks.
+	CFilters bool
 
 	headerMutex       sync.Mutex
 	headerFile        *os.File // file for SPV headers
 	headerStartHeight int32    // first header on disk is nth header in chain
+	// firstHeaderHeight is the first real header; in a truncated header
+	// file, the one after headerStartHeight.  See init.go.
+	firstHeaderHeight int32
 
-	syncHeight int32 // internal, in memory synchronization height
+	// syncHeight is the internal, in memory synchronization height.
+	// Uses headerMutex.
+	syncHeight int32
 
 	OKTxids map[chainhash.Hash]int32 // known good txids and their heights
 	OKMutex sync.Mutex
 
+	// proofDB has matching txs, with proofs they're in their block, for
+	// TxProof.  Proofs from merkle blocks wait in pendingProofs until
+	// their tx comes; that uses OKMutex.
+	proofDB       *bolt.DB
+	pendingProofs map[chainhash.Hash]lnutil.TxProof
+
 	// TrackingAdrs and OPs are slices of addresses and outpoints to watch for.
 	// Using struct{} saves a byte of RAM but is ugly so I'll use bool.
 	TrackingAdrs    map[[20]byte]bool
 	TrackingAdrsMtx sync.Mutex
 
+	// TrackingScripts are 32 byte p2wsh script hashes to watch for.
+	// Also uses TrackingAdrsMtx.
+	TrackingScripts map[[32]byte]bool
+
 	TrackingOPs    map[wire.OutPoint]bool
 	TrackingOPsMtx sync.Mutex
 
+	// opScripts are the output scripts of tracked outpoints, if we've seen
+	// them.  Compact filters match scripts, not outpoints.
+	// Also uses TrackingOPsMtx.
+	opScripts map[wire.OutPoint][]byte
+
 	// TxMap is an in-memory map of all the Txs the SPVCon knows about
 	TxMap map[chainhash.Hash]*wire.MsgTx
 
+	// mempool is the unconfirmed txs we've seen or sent.  See mempool.go.
+	mempool *mempool
+
 	//[doesn't work without fancy mutexes, nevermind, just use header file]
 	// localHeight   int32  // block height we're on
-	remoteHeight  int32  // block height they're on
-	localVersion  uint32 // version we report
-	remoteVersion uint32 // version remote node
+	localVersion uint32 // version we report
 
-	// what's the point of the input queue? remove? leave for now...
-	inMsgQueue  chan wire.Message // Messages coming in from remote node
-	outMsgQueue chan wire.Message // Messages going out to remote node
+	// messages from all the peers go through here to the message handler
+	inMsgQueue chan peerMsg
 
 	WBytes uint64 // total bytes written
 	RBytes uint64 // total bytes read
@@ -58,6 +103,11 @@ type SPVCon struct {
 	TxUpToWallit chan lnutil.TxAndHeight
 	// CurrentHeightChan is how we tell the wallit when blocks come in
 	CurrentHeightChan chan int32
+	// DisconnectChan gets the headers a longer chain replaced, tip first
+	DisconnectChan chan lnutil.BlockDisconnect
+	// ConflictChan tells the wallit about unconfirmed txs that got double
+	// spent.  Nothing's sent if it's nil.
+	ConflictChan chan lnutil.TxConflict
 
 	// RawBlockSender is a channel to send full blocks up to the qln / watchtower
 	// only kicks in when requested from upper layer
@@ -66,6 +116,7 @@ type SPVCon struct {
 	// for internal use -------------------------
 
 	// mBlockQueue is for keeping track of what height we've requested.
+	// Starts over when the sync peer changes; uses peerMtx.
 	blockQueue chan HashAndHeight
 	// fPositives is a channel to keep track of bloom filter false positives.
 	fPositives chan int32
@@ -73,4 +124,13 @@ type SPVCon struct {
 	// waitState is a channel that is empty while in the header and block
 	// sync modes, but when in the idle state has a "true" in it.
 	inWaitState chan bool
+
+	// compact filter mode stuff.  cfCheckHosts are other nodes to check
+	// filter headers with, and cfCheckers the ones we're connected to.
+	cfCheckHosts  []string
+	cfCheckers    []*cfPeer
+	cfHeaders     map[int32]chainhash.Hash // filter headers by height
+	cfHeadersChan chan *MsgCFHeaders
+	cfilterChan   chan *MsgCFilter
+	cfBlockDone   chan int32 // IngestBlock says it's done with a block
 }
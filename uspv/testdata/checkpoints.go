@@ -0,0 +1,101 @@
+//go:build ignore
+// +build ignore
+
+// checkpoints gets the header at the start of the difficulty epoch at or
+// below a height from an esplora server, checks it, and prints it as a
+// HeaderCheckpoint.  Run it from uspv with
+//
+//	go run testdata/checkpoints.go -net testnet3 -height 1400000
+//
+// then add the line to HeaderCheckpoints and the hash to checkpointHashes in
+// checkpoints_test.go.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/wire"
+)
+
+var apis = map[string]string{
+	"mainnet":  "https://blockstream.info/api",
+	"testnet3": "https://blockstream.info/testnet/api",
+}
+
+var nets = map[string]*chaincfg.Params{
+	"mainnet":  &chaincfg.MainNetParams,
+	"testnet3": &chaincfg.TestNet3Params,
+}
+
+func get(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s %s", url, resp.Status, b)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func main() {
+	net := flag.String("net", "testnet3", "mainnet or testnet3")
+	height := flag.Int("height", 0, "height to round down to an epoch start")
+	api := flag.String("api", "", "esplora api url, if not the default")
+	flag.Parse()
+
+	p, ok := nets[*net]
+	if !ok {
+		log.Fatalf("unknown network %s", *net)
+	}
+	if *api == "" {
+		*api = apis[*net]
+	}
+	epochLength := int(p.TargetTimespan / p.TargetTimePerBlock)
+	h := *height - *height%epochLength
+
+	hash, err := get(fmt.Sprintf("%s/block-height/%d", *api, h))
+	if err != nil {
+		log.Fatal(err)
+	}
+	hdrHex, err := get(fmt.Sprintf("%s/block/%s/header", *api, hash))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// don't take the server's word for it
+	b, err := hex.DecodeString(hdrHex)
+	if err != nil || len(b) != 80 {
+		log.Fatalf("bad header %s", hdrHex)
+	}
+	var hdr wire.BlockHeader
+	err = hdr.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		log.Fatal(err)
+	}
+	blockHash := hdr.BlockHash()
+	if blockHash.String() != hash {
+		log.Fatalf("header hashes to %s, not %s", blockHash.String(), hash)
+	}
+	if blockchain.HashToBig(&blockHash).Cmp(
+		blockchain.CompactToBig(hdr.Bits)) > 0 {
+		log.Fatalf("header %s doesn't meet its target", hash)
+	}
+
+	fmt.Printf("\t\t// %s\n", hash)
+	fmt.Printf("\t\t{%d, \"%s\"},\n", h, hdrHex)
+}
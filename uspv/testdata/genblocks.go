@@ -0,0 +1,208 @@
+//go:build ignore
+// +build ignore
+
+// genblocks mines a short regtest chain with segwit and legacy spends, checks
+// it with btcd's consensus code, and writes some of its blocks out for
+// TestBlockOK.  Run it from uspv with
+//
+//	go run testdata/genblocks.go > testdata/regtest_blocks.hex
+//
+// Lines are height, block hash, and the block with witnesses, in hex.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/txscript"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil"
+)
+
+var (
+	params    = &chaincfg.RegressionNetParams
+	witMagic  = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+	priv, pub = btcec.PrivKeyFromBytes(btcec.S256(),
+		chainhash.DoubleHashB([]byte("lit uspv testdata")))
+	pkh = btcutil.Hash160(pub.SerializeCompressed())
+
+	// the witness script is <pub> CHECKSIG
+	wsc = append(append([]byte{33}, pub.SerializeCompressed()...), txscript.OP_CHECKSIG)
+	wsh = chainhash.HashB(wsc)
+
+	p2wpkh = append([]byte{0x00, 0x14}, pkh...)
+	p2pkh  = append(append([]byte{txscript.OP_DUP, txscript.OP_HASH160, 0x14},
+		pkh...), txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG)
+	p2wsh = append([]byte{0x00, 0x20}, wsh...)
+
+	// everything we can spend
+	utxos = make(map[wire.OutPoint]*wire.TxOut)
+)
+
+// coinbase pays 50 coins plus fees to us, and commits to the witnesses of
+// txs if any have them
+func coinbase(height int32, fees int64, txs []*wire.MsgTx) *wire.MsgTx {
+	cb := wire.NewMsgTx()
+	cb.Version = 2
+	sigScript, err := txscript.NewScriptBuilder().AddInt64(int64(height)).
+		AddData([]byte("lit")).Script()
+	if err != nil {
+		log.Fatal(err)
+	}
+	in := wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		sigScript, nil)
+	cb.AddTxIn(in)
+	cb.AddTxOut(wire.NewTxOut(50e8+fees, p2wpkh))
+
+	// like bitcoind, always commit once segwit's on
+	nonce := make([]byte, 32)
+	in.Witness = wire.TxWitness{nonce}
+	all := []*btcutil.Tx{btcutil.NewTx(cb)}
+	for _, tx := range txs {
+		all = append(all, btcutil.NewTx(tx))
+	}
+	store := blockchain.BuildMerkleTreeStore(all, true)
+	commit := chainhash.DoubleHashB(append(store[len(store)-1][:], nonce...))
+	cb.AddTxOut(wire.NewTxOut(0, append(append([]byte{}, witMagic...), commit...)))
+	return cb
+}
+
+// spend sends an output we have to a script, paying a 1000 satoshi fee
+func spend(op wire.OutPoint, to []byte) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	prev := utxos[op]
+	tx.AddTxOut(wire.NewTxOut(prev.Value-1000, to))
+
+	hc := txscript.NewTxSigHashes(tx)
+	var err error
+	switch {
+	case bytes.Equal(prev.PkScript, p2wpkh):
+		tx.TxIn[0].Witness, err = txscript.WitnessSignature(tx, hc, 0,
+			prev.Value, p2wpkh, txscript.SigHashAll, priv, true)
+	case bytes.Equal(prev.PkScript, p2pkh):
+		tx.TxIn[0].SignatureScript, err = txscript.SignatureScript(tx, 0,
+			p2pkh, txscript.SigHashAll, priv, true)
+	case bytes.Equal(prev.PkScript, p2wsh):
+		var sig []byte
+		sig, err = txscript.RawTxInWitnessSignature(tx, hc, 0, prev.Value,
+			wsc, txscript.SigHashAll, priv)
+		tx.TxIn[0].Witness = wire.TxWitness{sig, wsc}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// can be spent in the same block
+	txid := tx.TxHash()
+	utxos[*wire.NewOutPoint(&txid, 0)] = tx.TxOut[0]
+	return tx
+}
+
+// mine makes the next block out of txs, checks it, and spends its outputs
+func mine(prev *wire.MsgBlock, height int32, txs []*wire.MsgTx) *wire.MsgBlock {
+	cb := coinbase(height, int64(len(txs))*1000, txs)
+	prevHash := prev.BlockHash()
+	blk := wire.NewMsgBlock(wire.NewBlockHeader(0x20000000,
+		&prevHash, new(chainhash.Hash), params.PowLimitBits, 0))
+	blk.Header.Timestamp = prev.Header.Timestamp.Add(10 * time.Minute)
+	blk.AddTransaction(cb)
+	for _, tx := range txs {
+		blk.AddTransaction(tx)
+	}
+	all := []*btcutil.Tx{}
+	for _, tx := range blk.Transactions {
+		all = append(all, btcutil.NewTx(tx))
+	}
+	store := blockchain.BuildMerkleTreeStore(all, false)
+	blk.Header.MerkleRoot = *store[len(store)-1]
+
+	for ; ; blk.Header.Nonce++ {
+		if blockchain.CheckProofOfWork(btcutil.NewBlock(blk), params.PowLimit) == nil {
+			break
+		}
+	}
+
+	ublk := btcutil.NewBlock(blk)
+	ublk.SetHeight(height)
+	err := blockchain.CheckBlockSanity(ublk, params.PowLimit, blockchain.NewMedianTime())
+	if err != nil {
+		log.Fatalf("block %d: %s", height, err.Error())
+	}
+	err = blockchain.ValidateWitnessCommitment(ublk)
+	if err != nil {
+		log.Fatalf("block %d: %s", height, err.Error())
+	}
+	for _, tx := range txs {
+		for i, in := range tx.TxIn {
+			prev := utxos[in.PreviousOutPoint]
+			vm, err := txscript.NewEngine(prev.PkScript, tx, i,
+				txscript.StandardVerifyFlags, nil, txscript.NewTxSigHashes(tx),
+				prev.Value)
+			if err == nil {
+				err = vm.Execute()
+			}
+			if err != nil {
+				log.Fatalf("block %d tx %s: %s", height, tx.TxHash(), err.Error())
+			}
+			delete(utxos, in.PreviousOutPoint)
+		}
+	}
+	for _, tx := range blk.Transactions {
+		txid := tx.TxHash()
+		for i, out := range tx.TxOut {
+			if out.Value > 0 {
+				utxos[*wire.NewOutPoint(&txid, uint32(i))] = out
+			}
+		}
+	}
+	return blk
+}
+
+func write(height int32, blk *wire.MsgBlock) {
+	var buf bytes.Buffer
+	err := blk.Serialize(&buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d %s %s\n", height, blk.BlockHash().String(),
+		hex.EncodeToString(buf.Bytes()))
+}
+
+func main() {
+	blk := params.GenesisBlock
+	var first *wire.MsgBlock
+	// coinbases take 100 blocks to mature
+	for h := int32(1); h <= 101; h++ {
+		blk = mine(blk, h, nil)
+		if h == 1 {
+			first = blk
+			write(h, blk)
+		}
+	}
+
+	// spend the first coinbase to each kind of script
+	cbid := first.Transactions[0].TxHash()
+	a := spend(*wire.NewOutPoint(&cbid, 0), p2wpkh)
+	aid := a.TxHash()
+	b := spend(*wire.NewOutPoint(&aid, 0), p2pkh)
+	bid := b.TxHash()
+	c := spend(*wire.NewOutPoint(&bid, 0), p2wsh)
+	blk = mine(blk, 102, []*wire.MsgTx{a, b, c})
+	write(102, blk)
+
+	// then spend those; one legacy and one witness tx
+	cid := c.TxHash()
+	d := spend(*wire.NewOutPoint(&cid, 0), p2pkh)
+	did := d.TxHash()
+	e := spend(*wire.NewOutPoint(&did, 0), p2wpkh)
+	blk = mine(blk, 103, []*wire.MsgTx{d, e})
+	write(103, blk)
+}
@@ -0,0 +1,149 @@
+package uspv
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// BKTProofs has proofs for matching txs, by txid.  Each is the proof's
+// bytes, then the tx.
+var BKTProofs = []byte("TxProofs")
+
+// openProofDB opens (or makes) the db proofs are kept in
+func (s *SPVCon) openProofDB(filename string) error {
+	var err error
+	s.proofDB, err = bolt.Open(filename, 0644, nil)
+	if err != nil {
+		return err
+	}
+	return s.proofDB.Update(func(btx *bolt.Tx) error {
+		_, err := btx.CreateBucketIfNotExists(BKTProofs)
+		return err
+	})
+}
+
+// saveBlockTxProof keeps a proof for a matching tx in a full block
+func (s *SPVCon) saveBlockTxProof(m *wire.MsgBlock, txid chainhash.Hash, height int32) {
+	tx, p, err := lnutil.BlockTxProof(m, txid, height)
+	if err != nil {
+		log.Printf("saveBlockTxProof error: %s\n", err.Error())
+		return
+	}
+	s.saveTxProof(tx, p)
+}
+
+// addMBlockProofs holds on to proofs from a merkle block until their txs
+// come in after it.
+func (s *SPVCon) addMBlockProofs(
+	proofs map[chainhash.Hash]lnutil.TxProof, height int32) {
+	s.OKMutex.Lock()
+	for txid, p := range proofs {
+		p.Height = height
+		s.pendingProofs[txid] = p
+	}
+	s.OKMutex.Unlock()
+}
+
+// popMBlockProof takes the waiting merkle block proof for a tx, and saves
+// it if the tx matched; false positives aren't worth keeping.
+func (s *SPVCon) popMBlockProof(tx *wire.MsgTx, height int32, match bool) {
+	txid := tx.TxHash()
+	s.OKMutex.Lock()
+	p, ok := s.pendingProofs[txid]
+	delete(s.pendingProofs, txid)
+	s.OKMutex.Unlock()
+	if ok && match && p.Height == height {
+		s.saveTxProof(tx, p)
+	}
+}
+
+// saveTxProof writes a tx and its proof to the proof db
+func (s *SPVCon) saveTxProof(tx *wire.MsgTx, p lnutil.TxProof) {
+	if s.proofDB == nil {
+		return
+	}
+	var buf bytes.Buffer
+	buf.Write(p.Bytes())
+	err := tx.Serialize(&buf)
+	if err != nil {
+		log.Printf("saveTxProof error: %s\n", err.Error())
+		return
+	}
+	txid := tx.TxHash()
+	err = s.proofDB.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKTProofs).Put(txid[:], buf.Bytes())
+	})
+	if err != nil {
+		log.Printf("saveTxProof error: %s\n", err.Error())
+	}
+}
+
+// TxProof gives a tx that matched in a block at height, and its proof.
+// Proofs are kept for blocks synced (merkle or full) since they started
+// being kept; rescan to get ones from before.
+func (s *SPVCon) TxProof(txid chainhash.Hash, height int32) (
+	*wire.MsgTx, lnutil.TxProof, error) {
+	var tx *wire.MsgTx
+	var p lnutil.TxProof
+	noProof := fmt.Errorf(
+		"no proof for tx %s at height %d; rescan from there to get one",
+		txid.String(), height)
+	if s.proofDB == nil {
+		return nil, p, noProof
+	}
+	err := s.proofDB.View(func(btx *bolt.Tx) error {
+		v := btx.Bucket(BKTProofs).Get(txid[:])
+		if v == nil {
+			return noProof
+		}
+		var n int
+		var err error
+		p, n, err = lnutil.TxProofFromBytes(v)
+		if err != nil {
+			return err
+		}
+		tx = wire.NewMsgTx()
+		return tx.Deserialize(bytes.NewReader(v[n:]))
+	})
+	if err != nil {
+		return nil, lnutil.TxProof{}, err
+	}
+	if p.Height != height {
+		return nil, lnutil.TxProof{}, noProof
+	}
+	// it might have been reorged out since
+	err = s.CheckTxProof(txid, p)
+	if err != nil {
+		return nil, lnutil.TxProof{}, err
+	}
+	return tx, p, nil
+}
+
+// CheckTxProof checks a proof against our header at its height.
+func (s *SPVCon) CheckTxProof(txid chainhash.Hash, p lnutil.TxProof) error {
+	s.headerMutex.Lock()
+	defer s.headerMutex.Unlock()
+
+	tip, err := s.headerTip()
+	if err != nil {
+		return err
+	}
+	if p.Height < s.firstHeaderHeight || p.Height > tip {
+		return fmt.Errorf("tx %s proof for height %d; have headers %d to %d",
+			txid.String(), p.Height, s.firstHeaderHeight, tip)
+	}
+	hdr, err := s.readHeader(p.Height)
+	if err != nil {
+		return err
+	}
+	if p.Root(txid) != hdr.MerkleRoot {
+		return fmt.Errorf("tx %s not in block %d", txid.String(), p.Height)
+	}
+	return nil
+}
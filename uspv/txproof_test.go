@@ -0,0 +1,144 @@
+package uspv
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adiabat/btcd/blockchain"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil"
+	"github.com/adiabat/btcutil/bloom"
+	"github.com/mit-dci/lit/lnutil"
+)
+
+// testMBlock makes a block of n made up txs, and a merkle block of it
+// matching the txs at positions match.
+func testMBlock(t *testing.T, n int, match ...int) (
+	*wire.MsgBlock, *wire.MsgMerkleBlock, []chainhash.Hash) {
+	blk := new(wire.MsgBlock)
+	var txids []chainhash.Hash
+	var hashes []*chainhash.Hash
+	for i := 0; i < n; i++ {
+		tx := spendTx(byte(i), false)
+		blk.AddTransaction(tx)
+		txid := tx.TxHash()
+		txids = append(txids, txid)
+		hashes = append(hashes, &txid)
+	}
+	blk.Header.MerkleRoot = *calcRoot(hashes)
+
+	f := bloom.NewFilter(uint32(len(match)+1), 0, 0.000001, wire.BloomUpdateNone)
+	for _, i := range match {
+		f.AddHash(&txids[i])
+	}
+	mb, _ := bloom.NewMerkleBlock(btcutil.NewBlock(blk), f)
+	return blk, mb, txids
+}
+
+// TestMBlockProofs checks proofs from merkle blocks are the same as ones
+// made with all the txids, for trees with odd levels and not.
+func TestMBlockProofs(t *testing.T) {
+	for n := 1; n <= 13; n++ {
+		var matches [][]int
+		if n > 1 {
+			matches = append(matches, []int{0, n - 1})
+		}
+		for i := 0; i < n; i++ {
+			matches = append(matches, []int{i})
+		}
+		for _, match := range matches {
+			_, mb, txids := testMBlock(t, n, match...)
+			proofs, err := mBlockProofs(mb)
+			if err != nil {
+				t.Fatalf("%d txs, match %v: %s", n, match, err.Error())
+			}
+			if len(proofs) != len(match) {
+				t.Fatalf("%d txs, match %v: %d proofs", n, match, len(proofs))
+			}
+			for _, i := range match {
+				expect, err := lnutil.NewTxProof(txids, uint32(i), 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p, ok := proofs[txids[i]]
+				if !ok || !reflect.DeepEqual(p, expect) {
+					t.Fatalf("%d txs, tx %d: proof %v, expect %v", n, i, p, expect)
+				}
+			}
+			// checkMBlock should think it's fine too
+			_, err = checkMBlock(mb)
+			if err != nil {
+				t.Fatalf("%d txs, match %v: checkMBlock %s", n, match, err.Error())
+			}
+		}
+	}
+
+	// a duplicated last pair, as in CVE-2012-2459, doesn't get a proof
+	_, mb, _ := testMBlock(t, 6, 5)
+	mb.Hashes = append(mb.Hashes[:len(mb.Hashes)-1], mb.Hashes[len(mb.Hashes)-2])
+	if _, err := mBlockProofs(mb); err == nil {
+		t.Fatalf("proofs from merkle block with duplicate hashes")
+	}
+
+	// extra hashes aren't ok either
+	_, mb, _ = testMBlock(t, 6, 2)
+	mb.Hashes = append(mb.Hashes, mb.Hashes[0])
+	if _, err := mBlockProofs(mb); err == nil {
+		t.Fatalf("proofs from merkle block with extra hashes")
+	}
+}
+
+// TestTxProofDB saves a proof from a merkle block when its tx comes, and
+// gets it back after the db is reopened.
+func TestTxProofDB(t *testing.T) {
+	s, done := testSPVCon(t)
+	defer done()
+
+	blk, mb, _ := testMBlock(t, 7, 3, 6)
+	hdr := mineHeaders(s.Param.GenesisBlock.Header, 1, 'p')[0]
+	hdr.MerkleRoot = blk.Header.MerkleRoot
+	target := blockchain.CompactToBig(hdr.Bits)
+	for hash := hdr.BlockHash(); blockchain.HashToBig(&hash).Cmp(target) > 0; hash = hdr.BlockHash() {
+		hdr.Nonce++
+	}
+	_, err := s.IngestHeaders(headersMsg([]*wire.BlockHeader{hdr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proofs, err := mBlockProofs(mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addMBlockProofs(proofs, 1)
+
+	// tx 3 matched, tx 6 was a false positive
+	s.popMBlockProof(blk.Transactions[3], 1, true)
+	s.popMBlockProof(blk.Transactions[6], 1, false)
+	if len(s.pendingProofs) != 0 {
+		t.Fatalf("%d proofs still pending", len(s.pendingProofs))
+	}
+
+	dbPath := s.proofDB.Path()
+	s.proofDB.Close()
+	err = s.openProofDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txid := blk.Transactions[3].TxHash()
+	tx, p, err := s.TxProof(txid, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TxHash() != txid || p.Height != 1 || p.Root(txid) != blk.Header.MerkleRoot {
+		t.Fatalf("got tx %s proof %v", tx.TxHash().String(), p)
+	}
+	if _, _, err := s.TxProof(txid, 2); err == nil {
+		t.Fatalf("got proof at wrong height")
+	}
+	if _, _, err := s.TxProof(blk.Transactions[6].TxHash(), 1); err == nil {
+		t.Fatalf("kept proof for false positive")
+	}
+}
@@ -0,0 +1,221 @@
+package wallit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/adiabat/btcutil/base58"
+	"github.com/adiabat/btcutil/hdkeychain"
+	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+/*
+Accounts are the account' level of BIP44: m/44'/coin'/account'/0/idx.
+Each account has its own address chain, and sends from one account only
+spend that account's utxos, with change going back to the same account.
+The account xpub (see AccountXpub) covers the whole chain, so a watch-only
+wallit made from it sees the same addresses.
+
+Wallets from before that used m/44'/coin'/account'/0'/idx'.  On opening,
+those addresses are kept as legacy addresses which are still watched and
+spendable, and the account starts over at index 0 on the new chain.  Keyed
+wallits also watch GapLimit legacy addresses past the last one used, so a
+wallet restored from its key onto a new DB still finds its old funds.  No
+new legacy addresses get handed out.
+
+Account 0 is the original wallit.  It keeps the old NumKeys / NextAdr keys
+in the state bucket, so existing wallets don't need any migration.  Other
+accounts have their number appended to those keys.  An account exists once
+it has a NumKeys entry.
+
+Like BIP44 account discovery, account n+1 gets its addresses watched once
+account n has a tx, up to MaxAccounts.  A restored wallet rescanning from
+its birth finds its accounts in order, as long as each account got its
+first tx after the one before it did.  Otherwise, rescan again.
+
+Utxos which didn't come from a wallet address (channel closes and such)
+are in the account they were exported to; qln exports a channel's close
+outputs to the account that funded it.  Otherwise they're in account 0.
+*/
+
+// MaxAccounts is how many accounts a wallit can have.  The account' step is
+// also where qln puts its use constants (20' and up) so accounts need to stay
+// below those.
+const MaxAccounts = 16
+
+// acctKey returns the state bucket key for an account.  Account 0 uses the
+// plain key.
+func acctKey(base []byte, account uint32) []byte {
+	if account == 0 {
+		return base
+	}
+	k := make([]byte, len(base), len(base)+4)
+	copy(k, base)
+	return append(k, lnutil.U32tB(account)...)
+}
+
+// KeyGenAccount returns the account a keygen belongs to.  Anything that's
+// not a wallet address is in the account it was exported to, or account 0.
+func (w *Wallit) KeyGenAccount(kg portxo.KeyGen) (uint32, error) {
+	account, ok := walletAdrAccount(kg)
+	if ok {
+		return account, nil
+	}
+	err := w.StateDB.View(func(btx *bolt.Tx) error {
+		kab := btx.Bucket(BKTKeyAccts)
+		if kab == nil {
+			return fmt.Errorf("no key account bucket")
+		}
+		v := kab.Get(keyPath(kg))
+		if v != nil {
+			account = lnutil.BtU32(v)
+		}
+		return nil
+	})
+	return account, err
+}
+
+// setKeyGenAccount says which account an exported keygen's in
+func (w *Wallit) setKeyGenAccount(kg portxo.KeyGen, account uint32) error {
+	err := w.checkAccount(account)
+	if err != nil {
+		return err
+	}
+	return w.StateDB.Update(func(btx *bolt.Tx) error {
+		kab := btx.Bucket(BKTKeyAccts)
+		if kab == nil {
+			return fmt.Errorf("no key account bucket")
+		}
+		return kab.Put(keyPath(kg), lnutil.U32tB(account))
+	})
+}
+
+// keyPath is the depth and steps of a keygen, without any private key
+func keyPath(kg portxo.KeyGen) []byte {
+	kg.PrivKey = [32]byte{}
+	b := kg.Bytes()
+	return b[:21]
+}
+
+// checkAccount errors if the wallit can't use that account.  Watch-only
+// wallits only have the one account their xpub is for.
+func (w *Wallit) checkAccount(account uint32) error {
+	if account >= MaxAccounts {
+		return fmt.Errorf("account %d invalid, max %d", account, MaxAccounts-1)
+	}
+	if account != w.watchAccount && w.WatchOnly() {
+		return fmt.Errorf("watch-only wallet only has account %d", w.watchAccount)
+	}
+	return nil
+}
+
+// xpubAccount returns which account an account xpub is for.  It has to be
+// at m/44'/coin'/account'; the serialized key has the depth and the last step.
+func xpubAccount(acctPub *hdkeychain.ExtendedKey) (uint32, error) {
+	b := base58.Decode(acctPub.String())
+	if len(b) != 82 || b[4] != 3 {
+		return 0, fmt.Errorf("%s isn't an account xpub", acctPub.String())
+	}
+	step := binary.BigEndian.Uint32(b[9:13])
+	if step&(1<<31) == 0 || step&0x7fffffff >= MaxAccounts {
+		return 0, fmt.Errorf("xpub is for account %x, expect %d' or less",
+			step, MaxAccounts-1)
+	}
+	return step & 0x7fffffff, nil
+}
+
+// activeAccounts returns all the accounts which have been used.  Account 0
+// is always there, except in watch-only wallits, which only have their one.
+func (w *Wallit) activeAccounts() ([]uint32, error) {
+	if w.WatchOnly() {
+		return []uint32{w.watchAccount}, nil
+	}
+	accounts := []uint32{0}
+	err := w.StateDB.View(func(btx *bolt.Tx) error {
+		sta := btx.Bucket(BKTState)
+		if sta == nil {
+			return fmt.Errorf("no state bucket")
+		}
+		for i := uint32(1); i < MaxAccounts; i++ {
+			if sta.Get(acctKey(KEYNumKeys, i)) != nil {
+				accounts = append(accounts, i)
+			}
+		}
+		return nil
+	})
+	return accounts, err
+}
+
+// discoverAccount starts the account after kg's one, if kg is a wallet
+// address and the next account hasn't been started yet.  Says if it did;
+// the new account's addresses still need a FillGap.
+func (w *Wallit) discoverAccount(sta *bolt.Bucket, kg portxo.KeyGen) (bool, error) {
+	account, ok := walletAdrAccount(kg)
+	if !ok || w.WatchOnly() || account+1 >= MaxAccounts {
+		return false, nil
+	}
+	k := acctKey(KEYNumKeys, account+1)
+	if sta.Get(k) != nil {
+		return false, nil
+	}
+	log.Printf("account %d has history, watching account %d\n",
+		account, account+1)
+	return true, sta.Put(k, lnutil.U32tB(0))
+}
+
+// NewAccountAdr returns a new address from an account.
+func (w *Wallit) NewAccountAdr(account uint32) ([20]byte, error) {
+	return w.NewAccountAdr160(account)
+}
+
+// AccountUtxoDump returns the utxos belonging to one account.
+func (w *Wallit) AccountUtxoDump(account uint32) ([]*portxo.PorTxo, error) {
+	err := w.checkAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	allUtxos, err := w.GetAllUtxos()
+	if err != nil {
+		return nil, err
+	}
+	var utxos []*portxo.PorTxo
+	for _, u := range allUtxos {
+		uAccount, err := w.KeyGenAccount(u.KeyGen)
+		if err != nil {
+			return nil, err
+		}
+		if uAccount == account {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos, nil
+}
+
+// AccountXpub returns the extended public key of an account,
+// m/44'/coin'/account'.  A watch-only wallit made from it sees that
+// account's addresses.
+func (w *Wallit) AccountXpub(account uint32) (string, error) {
+	err := w.checkAccount(account)
+	if err != nil {
+		return "", err
+	}
+	if w.WatchOnly() {
+		return w.acctPubKey.String(), nil
+	}
+	key := w.rootPrivKey
+	for _, step := range []uint32{
+		44 | 1<<31, w.Param.HDCoinType | 1<<31, account | 1<<31} {
+		key, err = key.Child(step)
+		if err != nil {
+			return "", err
+		}
+	}
+	pub, err := key.Neuter()
+	if err != nil {
+		return "", err
+	}
+	return pub.String(), nil
+}
@@ -0,0 +1,152 @@
+package wallit
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/fastsha256"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// TestAccountDiscovery checks each account starts being watched once the
+// one before it gets a tx, and not before.
+func TestAccountDiscovery(t *testing.T) {
+	w, hook, done := testDBWallit(t)
+	defer done()
+
+	err := w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccounts := func(expect ...uint32) {
+		accounts, err := w.activeAccounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(accounts, expect) {
+			t.Fatalf("active accounts %v, expect %v", accounts, expect)
+		}
+	}
+	checkAccounts(0)
+
+	// account 1 isn't watched yet
+	hits, err := w.IngestMany([]*wire.MsgTx{payTx(w, "x", 1, 0, 50000)}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 0 {
+		t.Fatalf("tx to account 1 hit before account 0 had any")
+	}
+	checkAccounts(0)
+
+	_, err = w.IngestMany([]*wire.MsgTx{payTx(w, "a", 0, 3, 50000)}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccounts(0, 1)
+	next, numKeys, err := w.adrCounts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != 0 || numKeys != GapLimit {
+		t.Fatalf("account 1 next %d numkeys %d, expect 0, %d",
+			next, numKeys, GapLimit)
+	}
+	for _, adr := range w.adrRange(1, 0, GapLimit) {
+		if !hook.adrs[adr] {
+			t.Fatalf("account 1 adr %x not registered", adr)
+		}
+	}
+
+	// more account 0 history doesn't start account 2
+	_, err = w.IngestMany([]*wire.MsgTx{payTx(w, "b", 0, 4, 50000)}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccounts(0, 1)
+
+	// account 1 history does
+	_, err = w.IngestMany([]*wire.MsgTx{payTx(w, "c", 1, 7, 20000)}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccounts(0, 1, 2)
+	utxos, err := w.AccountUtxoDump(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Value != 20000 {
+		t.Fatalf("account 1 utxos %v, expect one of 20000", utxos)
+	}
+
+	// no account past the last one
+	found, err := w.discoverAccount(nil, w.walletKeygen(MaxAccounts-1, 0))
+	if err != nil || found {
+		t.Fatalf("discovered account %d", MaxAccounts)
+	}
+}
+
+// TestExportAccount has channel close outputs exported to account 2 stay in
+// account 2, also when a rescan finds them again.
+func TestExportAccount(t *testing.T) {
+	w, _, done := testDBWallit(t)
+	defer done()
+
+	script := []byte{0x51, 0xb2, 0x75, 0x21, 0x02, 0xbb} // made up
+	wsh := fastsha256.Sum256(script)
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{'c'}, 0), []byte{0x51}, nil))
+	tx.AddTxOut(wire.NewTxOut(70000, append([]byte{0x00, 0x20}, wsh[:]...)))
+
+	// like a qln timeout output: coin, use, peer, channel
+	var kg portxo.KeyGen
+	kg.Depth = 5
+	kg.Step[0] = 44 | 1<<31
+	kg.Step[1] = w.Param.HDCoinType | 1<<31
+	kg.Step[2] = 21 | 1<<31
+	kg.Step[3] = 1 | 1<<31
+	kg.Step[4] = 1 | 1<<31
+	u := portxo.PorTxo{
+		Op:       wire.OutPoint{Hash: tx.TxHash()},
+		Value:    70000,
+		Height:   8,
+		Seq:      5,
+		Mode:     portxo.TxoP2WSHComp,
+		KeyGen:   kg,
+		PkScript: script,
+	}
+	w.ExportUtxo(&u, 2)
+
+	checkAccount := func(account uint32, n int) {
+		utxos, err := w.AccountUtxoDump(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(utxos) != n {
+			t.Fatalf("%d utxos in account %d, expect %d", len(utxos), account, n)
+		}
+	}
+	checkAccount(0, 0)
+	checkAccount(2, 1)
+
+	opArr := lnutil.OutPointToBytes(u.Op)
+	err := w.StateDB.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKToutpoint).Delete(opArr[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccount(2, 0)
+	_, err = w.IngestMany([]*wire.MsgTx{tx}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAccount(0, 0)
+	checkAccount(2, 1)
+}
@@ -1,6 +1,7 @@
 package wallit
 
 import (
+	"fmt"
 	"log"
 	"sort"
 
@@ -8,6 +9,7 @@ import (
 	"github.com/adiabat/btcd/chaincfg"
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
+	"github.com/btcsuite/fastsha256"
 	"github.com/mit-dci/lit/lnutil"
 	"github.com/mit-dci/lit/portxo"
 )
@@ -19,11 +21,11 @@ type UWallet interface {
 	GetPriv(k portxo.KeyGen) *btcec.PrivateKey
 
 	PushTx(tx *wire.MsgTx) error
-	ExportUtxo(txo *portxo.PorTxo)
+	ExportUtxo(txo *portxo.PorTxo, account uint32)
 	MaybeSend(txos []*wire.TxOut) ([]*wire.OutPoint, error)
 	ReallySend(txid *chainhash.Hash) error
 	NahDontSend(txid *chainhash.Hash) error
-	WatchThis(wire.OutPoint) error
+	WatchThis(op wire.OutPoint, pkScript []byte) error
 	LetMeKnow() chan lnutil.OutPointEvent
 	BlockMonitor() chan *wire.MsgBlock
 
@@ -67,17 +69,83 @@ func (w *Wallit) CurrentHeight() int32 {
 	return h
 }
 
+// ChainPeers returns the full nodes the ChainHook is connected to, or nil
+// if it doesn't use full nodes that way.
+func (w *Wallit) ChainPeers() []lnutil.ChainPeerInfo {
+	pl, ok := w.Hook.(PeerLister)
+	if !ok {
+		return nil
+	}
+	return pl.Peers()
+}
+
+// ChainConnState says whether the ChainHook is connected to the blockchain.
+// ChainHooks that can't tell are taken to be connected.
+func (w *Wallit) ChainConnState() lnutil.ChainConnState {
+	cs, ok := w.Hook.(ConnStater)
+	if !ok {
+		return lnutil.ChainConnState{Connected: true}
+	}
+	return cs.ConnState()
+}
+
+// TxProof gets a tx that confirmed at height, and proof it's in the block,
+// if the ChainHook can make them.
+func (w *Wallit) TxProof(txid chainhash.Hash, height int32) (
+	*wire.MsgTx, lnutil.TxProof, error) {
+	tp, ok := w.Hook.(TxProver)
+	if !ok {
+		return nil, lnutil.TxProof{}, fmt.Errorf("chainhook can't make tx proofs")
+	}
+	return tp.TxProof(txid, height)
+}
+
+// CheckTxProof checks a proof that a tx is in a block, if the ChainHook can.
+func (w *Wallit) CheckTxProof(txid chainhash.Hash, p lnutil.TxProof) error {
+	tp, ok := w.Hook.(TxProver)
+	if !ok {
+		return fmt.Errorf("chainhook can't check tx proofs")
+	}
+	return tp.CheckTxProof(txid, p)
+}
+
+// IsUnspent says if op is unspent.  ok is false if the ChainHook can't
+// tell, in which case only spends seen after a WatchThis show up.
+func (w *Wallit) IsUnspent(op wire.OutPoint) (unspent, ok bool, err error) {
+	uc, ok := w.Hook.(UnspentChecker)
+	if !ok {
+		return false, false, nil
+	}
+	unspent, err = uc.IsUnspent(op)
+	return unspent, true, err
+}
+
 func (w *Wallit) NewAdr() ([20]byte, error) {
 	return w.NewAdr160()
 }
 
-// ExportUtxo is really *IM*port utxo on this side.
-// Not implemented yet.  Fix "ingest many" at the same time eh?
-func (w *Wallit) ExportUtxo(u *portxo.PorTxo) {
+// ExportUtxo is really *IM*port utxo on this side.  It goes in account, as
+// does anything else with its keygen.
+// A p2wsh output's script goes in the db too, so if it's seen again, like in
+// a rescan, IngestMany picks it up.
+func (w *Wallit) ExportUtxo(u *portxo.PorTxo, account uint32) {
+	if account != 0 {
+		err := w.setKeyGenAccount(u.KeyGen, account)
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+		}
+	}
+
+	shTxo := u.Mode == portxo.TxoP2WSHComp && len(u.PkScript) != 0
 
 	// zero value utxo counts as an address exort, not utxo export.
 	if u.Value == 0 {
-		err := w.AddPorTxoAdr(u.KeyGen)
+		var err error
+		if shTxo {
+			err = w.AddScriptHash(*u)
+		} else {
+			err = w.AddPorTxoAdr(u.KeyGen)
+		}
 		if err != nil {
 			log.Printf(err.Error())
 		}
@@ -86,6 +154,21 @@ func (w *Wallit) ExportUtxo(u *portxo.PorTxo) {
 		if err != nil {
 			log.Printf(err.Error())
 		}
+		if shTxo {
+			err = w.AddScriptHash(*u)
+			if err != nil {
+				log.Printf(err.Error())
+			}
+		}
+	}
+
+	// script hash outputs get registered by their 32 byte script hash
+	if shTxo {
+		err := w.Hook.RegisterScriptHash(fastsha256.Sum256(u.PkScript))
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+		}
+		return
 	}
 
 	// Register new address with chainhook
@@ -97,14 +180,23 @@ func (w *Wallit) ExportUtxo(u *portxo.PorTxo) {
 }
 
 // WatchThis registers an outpoint to watch.  Register as watched OP, and
-// passes to chainhook.
-func (w *Wallit) WatchThis(op wire.OutPoint) error {
+// passes to chainhook.  If it's p2wsh, the script hash goes to the chainhook
+// too, so that compact filters can find it being spent.
+func (w *Wallit) WatchThis(op wire.OutPoint, pkScript []byte) error {
 
 	// first, tell the chainhook
 	err := w.Hook.RegisterOutPoint(op)
 	if err != nil {
 		return err
 	}
+	if len(pkScript) == 34 && lnutil.IsWitnessV0Script(pkScript) {
+		var sh [32]byte
+		copy(sh[:], pkScript[2:])
+		err = w.Hook.RegisterScriptHash(sh)
+		if err != nil {
+			return err
+		}
+	}
 
 	// then register in the wallit
 	err = w.RegisterWatchOP(op)
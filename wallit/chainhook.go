@@ -2,13 +2,14 @@ package wallit
 
 import (
 	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/wire"
 	"github.com/mit-dci/lit/lnutil"
 )
 
 // ChainHook is an interface which provides access to a blockchain for the
-// wallit.  Right now the USPV package conforms to this interface, but it
-// should also be possible to plug in things like fullnode-rpc clients, and
+// wallit.  The USPV package conforms to this interface, as does corerpc,
+// which talks to a full node's RPC interface, and powless, which talks to
 // (yuck) trusted block explorers.
 
 /*  The model here is that the wallit has lots of state on disk about
@@ -37,12 +38,20 @@ type ChainHook interface {
 	// RegisterAddress tells the ChainHook about an address of interest.
 	// Give it an array; Currently needs to be 20 bytes.  Only p2pkh / p2wpkh
 	// are supported.
-	// Later could add a separate function for script hashes (20/32)
 	RegisterAddress(address [20]byte) error
 
+	// RegisterScriptHash tells the ChainHook about a 32 byte witness script
+	// hash of interest; outputs paying to the p2wsh script get returned.
+	RegisterScriptHash(scriptHash [32]byte) error
+
 	// RegisterOutPoint tells the ChainHook about an outpoint of interest.
 	RegisterOutPoint(wire.OutPoint) error
 
+	// Rescan tells the ChainHook to go back and look through everything
+	// starting at (and including) block fromHeight again.  Txs and heights come
+	// back up through the same channels as from Start().
+	Rescan(fromHeight int32) error
+
 	// SetHeight sets the height ChainHook needs to look above.
 	// Returns a channel which tells the wallit what height the ChainHook has
 	// sync'd up to.  This chan should push int32s *after* the TxAndHeights
@@ -60,5 +69,46 @@ type ChainHook interface {
 	// then the undelying hook package doesn't need to get full blocks.
 	// Currently you always call it with uspv...
 	RawBlocks() chan *wire.MsgBlock
-	// TODO -- reorgs.  Oh and doublespends and stuff.
+
+	// BlockDisconnects gives the channel where the ChainHook says which blocks
+	// got reorged out.  A reorg sends a BlockDisconnect for each block no
+	// longer in the chain, tip first, before any txs or heights from the new
+	// branch come up.  Made in Start(); the wallit has to keep reading it.
+	BlockDisconnects() chan lnutil.BlockDisconnect
+}
+
+// PeerLister is a ChainHook that's connected to full nodes, and can say
+// which ones.  Not all ChainHooks are.
+type PeerLister interface {
+	Peers() []lnutil.ChainPeerInfo
+}
+
+// ConnStater is a ChainHook that keeps its own connection to the blockchain
+// going, reconnecting when it drops, and can say how that's going.
+type ConnStater interface {
+	ConnState() lnutil.ChainConnState
+}
+
+// TxProver is a ChainHook that can prove a tx is in a block, and check
+// such proofs against the chain.  Channel announcements need it.
+type TxProver interface {
+	// TxProof gives back a tx that confirmed at height, and its proof.
+	TxProof(txid chainhash.Hash, height int32) (*wire.MsgTx, lnutil.TxProof, error)
+
+	// CheckTxProof returns an error unless the proof shows txid is in the
+	// block at the proof's height.
+	CheckTxProof(txid chainhash.Hash, p lnutil.TxProof) error
+}
+
+// UnspentChecker is a ChainHook that can say if an outpoint is unspent
+// without having watched it.  SPV can't; it only sees spends it's filtering
+// for.
+type UnspentChecker interface {
+	IsUnspent(op wire.OutPoint) (bool, error)
+}
+
+// ConflictWatcher is a ChainHook that keeps track of unconfirmed txs, and
+// says when one gets double spent.
+type ConflictWatcher interface {
+	TxConflicts() chan lnutil.TxConflict
 }
@@ -11,10 +11,15 @@ import (
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil"
 	"github.com/boltdb/bolt"
+	"github.com/btcsuite/fastsha256"
 	"github.com/mit-dci/lit/lnutil"
 	"github.com/mit-dci/lit/portxo"
 )
 
+// GapLimit is how many unused addresses to keep watching past the last
+// address handed out or seen used.
+const GapLimit = 20
+
 // const strings for db usage
 var (
 	// storage of all utxos. top level is outpoints.
@@ -26,17 +31,30 @@ var (
 	BKTTxns  = []byte("Txns")      // all txs we care about, for replays
 	BKTState = []byte("MiscState") // misc states of DB
 
+	// accounts of exported keygens that aren't wallet addresses, like
+	// channel close outputs.  Key is the keygen's path.
+	BKTKeyAccts = []byte("KeyAccounts")
+
 	//	BKTWatch = []byte("watch") // outpoints we're watching for someone else
 	// these are in the state bucket
 	KEYNumKeys = []byte("NumKeys") // number of p2pkh keys used
+	KEYNextAdr = []byte("NextAdr") // index of next address to hand out
+
+	// number of hardened addresses from before the receive chain was
+	// unhardened, the index past the last one used, and the marker that the
+	// DB's been migrated
+	KEYLegacyAdrs = []byte("LegacyAdrs")
+	KEYLegacyNext = []byte("LegacyNext")
+	KEYAdrChain   = []byte("AdrChain")
 
 	KEYTipHeight = []byte("TipHeight") // height synced to
 )
 
 // make a new change output.  I guess this is supposed to be on a different
-// branch than regular addresses...
-func (w *Wallit) NewChangeOut(amt int64) (*wire.TxOut, error) {
-	change160, err := w.NewAdr160() // change is always witnessy
+// branch than regular addresses...  Change goes back to the account the
+// inputs came from.
+func (w *Wallit) NewChangeOut(account uint32, amt int64) (*wire.TxOut, error) {
+	change160, err := w.NewAccountAdr160(account) // change is always witnessy
 	if err != nil {
 		return nil, err
 	}
@@ -64,82 +82,326 @@ func (w *Wallit) AddPorTxoAdr(kg portxo.KeyGen) error {
 	})
 }
 
-// AdrDump returns all the addresses in the wallit.
+// AddScriptHash adds a p2wsh output's script to the db, under its 32 byte
+// hash, so IngestMany finds outputs paying to it.  What's stored is the
+// portxo without an outpoint or value: the script and keygen, and the mode and
+// sequence it's spent with.
+func (w *Wallit) AddScriptHash(u portxo.PorTxo) error {
+	if u.Mode != portxo.TxoP2WSHComp || len(u.PkScript) == 0 {
+		return fmt.Errorf("%s txo with %d byte script isn't p2wsh",
+			u.Mode.String(), len(u.PkScript))
+	}
+	u.Op = wire.OutPoint{}
+	u.Value = 0
+	u.Height = 0
+	txoBytes, err := u.Bytes()
+	if err != nil {
+		return err
+	}
+	sh := fastsha256.Sum256(u.PkScript)
+
+	return w.StateDB.Update(func(btx *bolt.Tx) error {
+		adrb := btx.Bucket(BKTadr)
+		if adrb == nil {
+			return fmt.Errorf("no adr bucket")
+		}
+		return adrb.Put(sh[:], txoBytes)
+	})
+}
+
+// AdrDump returns all the addresses in the wallit which have been handed out,
+// in all accounts.
 // currently returns 20 byte arrays, which
 // can then be converted somewhere else into bech32 addresses (or old base58)
 func (w *Wallit) AdrDump() ([][20]byte, error) {
-	var i, last uint32 // number of addresses made so far
+	accounts, err := w.activeAccounts()
+	if err != nil {
+		return nil, err
+	}
 	var adrSlice [][20]byte
+	for _, account := range accounts {
+		adrs, err := w.AccountAdrDump(account)
+		if err != nil {
+			return nil, err
+		}
+		adrSlice = append(adrSlice, adrs...)
+	}
+	return adrSlice, nil
+}
+
+// AccountAdrDump returns the addresses handed out from one account,
+// including legacy ones.
+func (w *Wallit) AccountAdrDump(account uint32) ([][20]byte, error) {
+	err := w.checkAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	next, _, err := w.adrCounts(account)
+	if err != nil {
+		return nil, err
+	}
+	adrs, err := w.legacyAdrs(account)
+	if err != nil {
+		return nil, err
+	}
+	return append(adrs, w.adrRange(account, 0, next)...), nil
+}
 
+// legacyAdrs returns the hardened addresses derived for an account: the
+// ones from before the DB was migrated to the unhardened receive chain, and
+// the legacy lookahead window.  They're in the adr bucket and get watched,
+// but none get handed out.
+func (w *Wallit) legacyAdrs(account uint32) ([][20]byte, error) {
+	var numLegacy uint32
 	err := w.StateDB.View(func(btx *bolt.Tx) error {
 		sta := btx.Bucket(BKTState)
 		if sta == nil {
 			return fmt.Errorf("no state bucket")
 		}
-
-		oldNBytes := sta.Get(KEYNumKeys)
-		last = lnutil.BtU32(oldNBytes)
-		// update the db with number of created keys
+		_, numLegacy = legacyCounts(sta, account)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	if numLegacy > 1<<20 {
+		return nil, fmt.Errorf("Got %d legacy keys stored, expect something reasonable",
+			numLegacy)
+	}
+	adrs := make([][20]byte, numLegacy)
+	for i := range adrs {
+		adrs[i] = w.PathPubHash160(w.legacyKeygen(account, uint32(i)))
+	}
+	return adrs, nil
+}
 
-	if last > 1<<20 {
-		return nil, fmt.Errorf("Got %d keys stored, expect something reasonable", last)
+// migrateAdrChain moves the addresses of a wallet from before the receive
+// chain was unhardened over to the legacy counters, so the new chain starts
+// from 0.  Accounts stay active with 0 keys; FillGap derives the new ones.
+func migrateAdrChain(sta *bolt.Bucket) error {
+	for account := uint32(0); account < MaxAccounts; account++ {
+		next, numKeys := acctCounts(sta, account)
+		if numKeys == 0 {
+			continue
+		}
+		log.Printf("account %d: %d legacy addresses, starting new chain\n",
+			account, numKeys)
+		err := sta.Put(acctKey(KEYLegacyAdrs, account), lnutil.U32tB(numKeys))
+		if err != nil {
+			return err
+		}
+		err = sta.Put(acctKey(KEYLegacyNext, account), lnutil.U32tB(next))
+		if err != nil {
+			return err
+		}
+		err = sta.Put(acctKey(KEYNumKeys, account), lnutil.U32tB(0))
+		if err != nil {
+			return err
+		}
+		err = sta.Delete(acctKey(KEYNextAdr, account))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adrCounts returns the index of the next address to hand out, and the number
+// of addresses derived and in the db, for an account.  The ones in between
+// are the lookahead window.  DBs from before the gap limit don't have NextAdr;
+// for those, it's the same as NumKeys.  Accounts which haven't been used yet
+// return 0, 0.
+func (w *Wallit) adrCounts(account uint32) (next, numKeys uint32, err error) {
+	err = w.StateDB.View(func(btx *bolt.Tx) error {
+		sta := btx.Bucket(BKTState)
+		if sta == nil {
+			return fmt.Errorf("no state bucket")
+		}
+		next, numKeys = acctCounts(sta, account)
+		return nil
+	})
+	if err != nil {
+		return
 	}
+	if numKeys > 1<<20 || next > 1<<20 {
+		err = fmt.Errorf("Got %d keys stored, expect something reasonable",
+			numKeys)
+	}
+	return
+}
 
-	for i = 0; i < last; i++ {
-		nKg := GetWalletKeygen(i, w.Param.HDCoinType)
+// acctCounts reads the next and numkeys counters for an account from
+// the state bucket
+func acctCounts(sta *bolt.Bucket, account uint32) (next, numKeys uint32) {
+	numKeysBytes := sta.Get(acctKey(KEYNumKeys, account))
+	if numKeysBytes == nil { // unused account
+		return 0, 0
+	}
+	numKeys = lnutil.BtU32(numKeysBytes)
+	next = numKeys
+	nextBytes := sta.Get(acctKey(KEYNextAdr, account))
+	if nextBytes != nil {
+		next = lnutil.BtU32(nextBytes)
+	}
+	return
+}
+
+// legacyCounts reads the legacy counters for an account: the index past the
+// last legacy address used, and how many are derived.  DBs migrated before
+// there was a legacy window count them all as used.
+func legacyCounts(sta *bolt.Bucket, account uint32) (next, numKeys uint32) {
+	numKeysBytes := sta.Get(acctKey(KEYLegacyAdrs, account))
+	if numKeysBytes != nil {
+		numKeys = lnutil.BtU32(numKeysBytes)
+	}
+	next = numKeys
+	nextBytes := sta.Get(acctKey(KEYLegacyNext, account))
+	if nextBytes != nil {
+		next = lnutil.BtU32(nextBytes)
+	}
+	return
+}
+
+// adrRange derives an account's addresses from start up to (not including) end
+func (w *Wallit) adrRange(account, start, end uint32) [][20]byte {
+	var adrSlice [][20]byte
+	for i := start; i < end; i++ {
+		nKg := w.walletKeygen(account, i)
 		nAdr160 := w.PathPubHash160(nKg)
 
 		adrSlice = append(adrSlice, nAdr160)
 	}
-	return adrSlice, nil
+	return adrSlice
 }
 
-// NewAdr creates a new, never before seen address, and increments the
-// DB counter, and returns the hash160 of the pubkey.
-func (w *Wallit) NewAdr160() ([20]byte, error) {
-	var err error
-	var empty160 [20]byte
-	if w.Param == nil {
-		return empty160, fmt.Errorf("NewAdr error: nil param")
+// walletAdrIdx returns the account and address index of a keygen, if it's a
+// regular wallet address keygen.  Legacy (hardened) addresses aren't; nothing
+// new gets handed out from those.
+func walletAdrIdx(kg portxo.KeyGen) (uint32, uint32, bool) {
+	account, ok := walletAdrAccount(kg)
+	if !ok || kg.Step[3] != 0 || kg.Step[4]&(1<<31) != 0 {
+		return 0, 0, false
 	}
+	return account, kg.Step[4], true
+}
 
-	var n uint32 // number of addresses made so far
+// legacyAdrIdx returns the account and address index of a keygen, if it's a
+// legacy (hardened) wallet address keygen.
+func legacyAdrIdx(kg portxo.KeyGen) (uint32, uint32, bool) {
+	account, ok := walletAdrAccount(kg)
+	if !ok || kg.Step[3] != 1<<31 || kg.Step[4]&(1<<31) == 0 {
+		return 0, 0, false
+	}
+	return account, kg.Step[4] & 0x7fffffff, true
+}
 
-	err = w.StateDB.View(func(btx *bolt.Tx) error {
+// walletAdrAccount returns the account of a keygen, if it's a regular or
+// legacy wallet address keygen.
+func walletAdrAccount(kg portxo.KeyGen) (uint32, bool) {
+	if kg.Depth != 5 || kg.Step[0] != 44|1<<31 || kg.Step[2]&(1<<31) == 0 ||
+		kg.Step[2]&0x7fffffff >= MaxAccounts || kg.Step[3]&0x7fffffff != 0 {
+		return 0, false
+	}
+	return kg.Step[2] & 0x7fffffff, true
+}
+
+// FillGap makes sure there are GapLimit unused addresses after the last one
+// handed out or seen used, in every account, derives any that are missing,
+// and registers them with the chainhook.  That way funds sent to addresses we
+// haven't given out yet (like from a restored wallet) still get found.
+func (w *Wallit) FillGap() error {
+	accounts, err := w.activeAccounts()
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		err = w.fillGap(account)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillGap fills the address windows for a single account: the receive
+// chain's, and for keyed wallits, the legacy chain's.
+func (w *Wallit) fillGap(account uint32) error {
+	err := w.fillChainGap(account)
+	if err != nil || w.WatchOnly() {
+		return err
+	}
+	return w.fillLegacyGap(account)
+}
+
+// fillChainGap fills the receive chain's address window for an account.
+func (w *Wallit) fillChainGap(account uint32) error {
+	var empty160 [20]byte
+
+	next, numKeys, err := w.adrCounts(account)
+	if err != nil {
+		return err
+	}
+	target := next + GapLimit
+	if numKeys >= target {
+		return nil // window's already full
+	}
+
+	newAdrs := make([][20]byte, 0, target-numKeys)
+	err = w.StateDB.Update(func(btx *bolt.Tx) error {
+		adrb := btx.Bucket(BKTadr)
+		if adrb == nil {
+			return fmt.Errorf("no adr bucket")
+		}
 		sta := btx.Bucket(BKTState)
 		if sta == nil {
 			return fmt.Errorf("no state bucket")
 		}
 
-		oldNBytes := sta.Get(KEYNumKeys)
-		n = lnutil.BtU32(oldNBytes)
+		for i := numKeys; i < target; i++ {
+			nKg := w.walletKeygen(account, i)
+			nAdr160 := w.PathPubHash160(nKg)
+			if nAdr160 == empty160 {
+				return fmt.Errorf("FillGap error: got nil h160 for %d", i)
+			}
+			// add the 20-byte key-hash into the db
+			err := adrb.Put(nAdr160[:], nKg.Bytes())
+			if err != nil {
+				return err
+			}
+			newAdrs = append(newAdrs, nAdr160)
+		}
+
 		// update the db with number of created keys
-		return nil
+		err := sta.Put(acctKey(KEYNumKeys, account), lnutil.U32tB(target))
+		if err != nil {
+			return err
+		}
+		// write next as well, so old DBs get it
+		return sta.Put(acctKey(KEYNextAdr, account), lnutil.U32tB(next))
 	})
-	if n > 1<<30 {
-		return empty160, fmt.Errorf("Got %d keys stored, expect something reasonable", n)
+	if err != nil {
+		return err
 	}
+	log.Printf("account %d derived addresses %d to %d, %d handed out\n",
+		account, numKeys, target-1, next)
 
-	nKg := GetWalletKeygen(n, w.Param.HDCoinType)
-	nAdr160 := w.PathPubHash160(nKg)
-
-	if nAdr160 == empty160 {
-		return empty160, fmt.Errorf("NewAdr error: got nil h160")
+	for _, a := range newAdrs {
+		err = w.Hook.RegisterAddress(a)
+		if err != nil {
+			return err
+		}
 	}
-	log.Printf("adr %d hash is %x\n", n, nAdr160)
-
-	kgBytes := nKg.Bytes()
-
-	// total number of keys (now +1) into 4 bytes
-	nKeyNumBytes := lnutil.U32tB(n + 1)
+	return nil
+}
 
-	// write to db file
-	err = w.StateDB.Update(func(btx *bolt.Tx) error {
+// fillLegacyGap keeps GapLimit legacy addresses past the last one used
+// derived and watched.  A wallet restored from its key onto a new DB has no
+// legacy addresses, and this is how funds on them get found.
+func (w *Wallit) fillLegacyGap(account uint32) error {
+	var empty160 [20]byte
+	var newAdrs [][20]byte
+	var numKeys, target uint32
+	err := w.StateDB.Update(func(btx *bolt.Tx) error {
 		adrb := btx.Bucket(BKTadr)
 		if adrb == nil {
 			return fmt.Errorf("no adr bucket")
@@ -148,28 +410,353 @@ func (w *Wallit) NewAdr160() ([20]byte, error) {
 		if sta == nil {
 			return fmt.Errorf("no state bucket")
 		}
+		var next uint32
+		next, numKeys = legacyCounts(sta, account)
+		target = next + GapLimit
+		// write next, so it doesn't move up with the window
+		err := sta.Put(acctKey(KEYLegacyNext, account), lnutil.U32tB(next))
+		if err != nil || numKeys >= target {
+			return err
+		}
 
-		// add the 20-byte key-hash into the db
-		err = adrb.Put(nAdr160[:], kgBytes)
+		for i := numKeys; i < target; i++ {
+			nKg := w.legacyKeygen(account, i)
+			nAdr160 := w.PathPubHash160(nKg)
+			if nAdr160 == empty160 {
+				return fmt.Errorf("FillGap error: got nil h160 for legacy %d", i)
+			}
+			err = adrb.Put(nAdr160[:], nKg.Bytes())
+			if err != nil {
+				return err
+			}
+			newAdrs = append(newAdrs, nAdr160)
+		}
+		return sta.Put(acctKey(KEYLegacyAdrs, account), lnutil.U32tB(target))
+	})
+	if err != nil || len(newAdrs) == 0 {
+		return err
+	}
+	log.Printf("account %d derived legacy addresses %d to %d\n",
+		account, numKeys, target-1)
+
+	for _, a := range newAdrs {
+		err = w.Hook.RegisterAddress(a)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// update the db with number of created keys
-		return sta.Put(KEYNumKeys, nKeyNumBytes)
+// NewAdr creates a new, never before seen address in account 0, and
+// increments the DB counter, and returns the hash160 of the pubkey.
+func (w *Wallit) NewAdr160() ([20]byte, error) {
+	return w.NewAccountAdr160(w.defaultAccount())
+}
+
+// NewAccountAdr160 hands out the next address in an account.  If the account
+// hasn't been used before, this starts it.
+func (w *Wallit) NewAccountAdr160(account uint32) ([20]byte, error) {
+	var err error
+	var empty160 [20]byte
+	if w.Param == nil {
+		return empty160, fmt.Errorf("NewAdr error: nil param")
+	}
+	err = w.checkAccount(account)
+	if err != nil {
+		return empty160, err
+	}
+
+	var n uint32 // index of address to hand out
+
+	// bump the next address counter
+	err = w.StateDB.Update(func(btx *bolt.Tx) error {
+		sta := btx.Bucket(BKTState)
+		if sta == nil {
+			return fmt.Errorf("no state bucket")
+		}
+		n, _ = acctCounts(sta, account)
+		if n > 1<<30 {
+			return fmt.Errorf("Got %d keys stored, expect something reasonable", n)
+		}
+		return sta.Put(acctKey(KEYNextAdr, account), lnutil.U32tB(n+1))
 	})
 	if err != nil {
 		return empty160, err
 	}
 
-	err = w.Hook.RegisterAddress(nAdr160)
+	// derives and registers this address if it wasn't already in the window
+	err = w.fillGap(account)
 	if err != nil {
 		return empty160, err
 	}
 
+	nAdr160 := w.PathPubHash160(w.walletKeygen(account, n))
+	if nAdr160 == empty160 {
+		return empty160, fmt.Errorf("NewAdr error: got nil h160")
+	}
+	log.Printf("account %d adr %d hash is %x\n", account, n, nAdr160)
+
 	return nAdr160, nil
 }
 
+// Rescan sets the db sync height back to just before fromHeight, and has the
+// chainhook go through all the blocks again starting at fromHeight.
+func (w *Wallit) Rescan(fromHeight int32) error {
+	if fromHeight < 1 {
+		return fmt.Errorf("Can't rescan from height %d", fromHeight)
+	}
+	curHeight := w.CurrentHeight()
+	if fromHeight > curHeight {
+		return fmt.Errorf("Can't rescan from %d, only synced to %d",
+			fromHeight, curHeight)
+	}
+
+	// make sure the whole window is registered before going back
+	err := w.FillGap()
+	if err != nil {
+		return err
+	}
+
+	// go back before the hook does, so the blocks it sends aren't ahead
+	err = w.SetDBSyncHeight(fromHeight - 1)
+	if err != nil {
+		return err
+	}
+	err = w.Hook.Rescan(fromHeight)
+	if err != nil {
+		// hook didn't go back, so neither do we
+		w.SetDBSyncHeight(curHeight)
+		return err
+	}
+	return nil
+}
+
+// Rollback undoes the blocks from height up, after they got reorged out.
+// Utxos created and stxos spent in those blocks go back to unconfirmed, as
+// the txs are probably back in the mempool, and will get their heights again
+// if they're in the new branch.  The sync height goes back to just below,
+// and the watch only outpoints get a Disconnect event so the channels
+// can un-confirm or un-close.
+func (w *Wallit) Rollback(height int32) error {
+	if height < 1 {
+		return fmt.Errorf("Can't roll back to height %d", height)
+	}
+	log.Printf("rolling back blocks %d and up\n", height)
+
+	var watched []wire.OutPoint
+	err := w.StateDB.Update(func(btx *bolt.Tx) error {
+		dufb := btx.Bucket(BKToutpoint)
+		old := btx.Bucket(BKTStxos)
+
+		// can't Put while in a ForEach, so collect what changes first
+		var utxos []*portxo.PorTxo
+		err := dufb.ForEach(func(k, v []byte) error {
+			if len(v) == 0 {
+				var opArr [36]byte
+				copy(opArr[:], k)
+				watched = append(watched, *lnutil.OutPointFromBytes(opArr))
+				return nil
+			}
+			x := make([]byte, len(k)+len(v))
+			copy(x, k)
+			copy(x[len(k):], v)
+			u, err := portxo.PorTxoFromBytes(x)
+			if err != nil {
+				return err
+			}
+			if u.Height >= height {
+				u.Height = 0
+				utxos = append(utxos, u)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var stxos []Stxo
+		err = old.ForEach(func(k, v []byte) error {
+			st, err := StxoFromBytes(append(k[:36:36], v...))
+			if err != nil {
+				return err
+			}
+			if st.Height >= height || st.SpendHeight >= height {
+				if st.Height >= height {
+					st.Height = 0
+				}
+				if st.SpendHeight >= height {
+					st.SpendHeight = 0
+				}
+				stxos = append(stxos, st)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, u := range utxos {
+			b, err := u.Bytes()
+			if err != nil {
+				return err
+			}
+			err = dufb.Put(b[:36], b[36:])
+			if err != nil {
+				return err
+			}
+		}
+		for _, st := range stxos {
+			b, err := st.ToBytes()
+			if err != nil {
+				return err
+			}
+			err = old.Put(b[:36], b[36:])
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("rolled back %d utxos, %d stxos\n", len(utxos), len(stxos))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	synced, err := w.GetDBSyncHeight()
+	if err != nil {
+		return err
+	}
+	if synced >= height {
+		err = w.SetDBSyncHeight(height - 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only do this if OPEventChan has been initialized
+	if cap(w.OPEventChan) != 0 {
+		for _, op := range watched {
+			w.OPEventChan <- lnutil.OutPointEvent{
+				Op: op, Height: height, Disconnect: true}
+		}
+	}
+	return nil
+}
+
+// DoubleSpent undoes an unconfirmed tx which isn't going to confirm, since
+// c.ByTx spent some of the same outpoints.  Utxos it made go away, and ones
+// it spent come back, unless c.ByTx spent those too.  Watch only outpoints
+// it made (like channel funding outputs) get a DoubleSpent event.
+func (w *Wallit) DoubleSpent(c lnutil.TxConflict) error {
+	txid := c.Tx.TxHash()
+	byTxid := c.ByTx.TxHash()
+	log.Printf("DOUBLE SPEND: tx %s lost outpoint %s to tx %s (height %d)\n",
+		txid.String(), c.Op.String(), byTxid.String(), c.Height)
+
+	bySpends := make(map[wire.OutPoint]bool)
+	for _, in := range c.ByTx.TxIn {
+		bySpends[in.PreviousOutPoint] = true
+	}
+
+	var watched []wire.OutPoint
+	err := w.StateDB.Update(func(btx *bolt.Tx) error {
+		dufb := btx.Bucket(BKToutpoint)
+		old := btx.Bucket(BKTStxos)
+
+		var lost, back int
+		// outputs of the tx never happened.  If some other unconfirmed
+		// tx spent them, it's getting double spent too, and shouldn't
+		// bring them back.
+		for i := range c.Tx.TxOut {
+			k := lnutil.OutPointToBytes(wire.OutPoint{Hash: txid, Index: uint32(i)})
+			v := dufb.Get(k[:])
+			if v != nil && len(v) == 0 {
+				watched = append(watched, *lnutil.OutPointFromBytes(k))
+				continue
+			}
+			if v != nil {
+				u, err := portxo.PorTxoFromBytes(append(k[:], v...))
+				if err != nil {
+					return err
+				}
+				if u.Height != 0 {
+					// confirmed after all?  leave it.
+					continue
+				}
+				err = dufb.Delete(k[:])
+				if err != nil {
+					return err
+				}
+				lost++
+			}
+			if old.Get(k[:]) != nil {
+				err := old.Delete(k[:])
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// inputs go back to unspent, or spent by the double spend
+		for _, in := range c.Tx.TxIn {
+			k := lnutil.OutPointToBytes(in.PreviousOutPoint)
+			stxb := old.Get(k[:])
+			if stxb == nil {
+				continue
+			}
+			st, err := StxoFromBytes(append(k[:36:36], stxb...))
+			if err != nil {
+				return err
+			}
+			if !st.SpendTxid.IsEqual(&txid) {
+				continue
+			}
+			if bySpends[in.PreviousOutPoint] {
+				st.SpendTxid = byTxid
+				st.SpendHeight = c.Height
+				b, err := st.ToBytes()
+				if err != nil {
+					return err
+				}
+				err = old.Put(b[:36], b[36:])
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			b, err := st.PorTxo.Bytes()
+			if err != nil {
+				return err
+			}
+			err = old.Delete(k[:])
+			if err != nil {
+				return err
+			}
+			err = dufb.Put(b[:36], b[36:])
+			if err != nil {
+				return err
+			}
+			back++
+		}
+		log.Printf("double spend removed %d utxos, %d unspent again\n",
+			lost, back)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// only do this if OPEventChan has been initialized
+	if cap(w.OPEventChan) != 0 {
+		for _, op := range watched {
+			w.OPEventChan <- lnutil.OutPointEvent{Op: op, Height: c.Height,
+				Tx: c.ByTx, DoubleSpent: true}
+		}
+	}
+	return nil
+}
+
 // SetDBSyncHeight sets sync height of the db, indicated the latest block
 // of which it has ingested all the transactions.
 func (w *Wallit) SetDBSyncHeight(n int32) error {
@@ -225,6 +812,26 @@ func (w *Wallit) SaveTx(tx *wire.MsgTx) error {
 	})
 }
 
+// GetTx returns a tx the wallet has saved, from the txs bucket.
+func (w *Wallit) GetTx(txid *chainhash.Hash) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx()
+	err := w.StateDB.View(func(btx *bolt.Tx) error {
+		txbkt := btx.Bucket(BKTTxns)
+		if txbkt == nil {
+			return fmt.Errorf("tx bucket not in db")
+		}
+		txBytes := txbkt.Get(txid[:])
+		if txBytes == nil {
+			return fmt.Errorf("tx %s not in db", txid.String())
+		}
+		return tx.Deserialize(bytes.NewReader(txBytes))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
 func (w *Wallit) UtxoDump() ([]*portxo.PorTxo, error) {
 	return w.GetAllUtxos()
 }
@@ -319,25 +926,29 @@ func NewPorTxo(tx *wire.MsgTx, idx uint32, height int32,
 	return ptxo, nil
 }
 
-// NewPorTxoBytesFromKGBytes just calls NewPorTxo() and de/serializes
-// quick shortcut for ingest()
-func NewPorTxoBytesFromKGBytes(
-	tx *wire.MsgTx, idx uint32, height int32, kgb []byte) ([]byte, error) {
+// NewPorTxoFromAdrBytes makes the portxo for an output that matched the adr
+// bucket.  Key hashes have just a keygen there; script hashes have the
+// portxo AddScriptHash stored.
+func NewPorTxoFromAdrBytes(
+	tx *wire.MsgTx, idx uint32, height int32, adrBytes []byte) (*portxo.PorTxo, error) {
 
-	if len(kgb) != 53 {
-		return nil, fmt.Errorf("keygen %d bytes, expect 53", len(kgb))
+	if len(adrBytes) == 53 {
+		var kgarr [53]byte
+		copy(kgarr[:], adrBytes)
+		return NewPorTxo(tx, idx, height, portxo.KeyGenFromBytes(kgarr))
 	}
 
-	var kgarr [53]byte
-	copy(kgarr[:], kgb)
-
-	kg := portxo.KeyGenFromBytes(kgarr)
-
-	ptxo, err := NewPorTxo(tx, idx, height, kg)
+	u, err := portxo.PorTxoFromBytes(adrBytes)
 	if err != nil {
 		return nil, err
 	}
-	return ptxo.Bytes()
+	if int(idx) >= len(tx.TxOut) {
+		return nil, fmt.Errorf("txo %d but tx has %d outputs", idx, len(tx.TxOut))
+	}
+	u.Op = wire.OutPoint{Hash: tx.TxHash(), Index: idx}
+	u.Value = tx.TxOut[idx].Value
+	u.Height = height
+	return u, nil
 }
 
 // Ingest -- take in a tx from the ChainHook
@@ -360,6 +971,7 @@ func (w *Wallit) IngestMany(txs []*wire.MsgTx, height int32) (uint32, error) {
 
 	cachedShas := make([]*chainhash.Hash, len(txs)) // cache every txid
 	hitTxs := make([]bool, len(txs))                // keep track of which txs to store
+	usedNew := false                                // used an address past NextAdr, or found an account
 
 	// not worth making a struct but these 2 go together
 
@@ -410,7 +1022,11 @@ func (w *Wallit) IngestMany(txs []*wire.MsgTx, height int32) (uint32, error) {
 					// fmt.Printf("txout script:%x matched kg: %x\n", out.PkScript, keygenBytes)
 
 					// build new portxo
-					txob, err := NewPorTxoBytesFromKGBytes(tx, uint32(j), height, keygenBytes)
+					txo, err := NewPorTxoFromAdrBytes(tx, uint32(j), height, keygenBytes)
+					if err != nil {
+						return err
+					}
+					txob, err := txo.Bytes()
 					if err != nil {
 						return err
 					}
@@ -428,6 +1044,43 @@ func (w *Wallit) IngestMany(txs []*wire.MsgTx, height int32) (uint32, error) {
 						return err
 					}
 
+					// if it's a wallet address past the ones handed out,
+					// move up the window so it doesn't get handed out again
+					kg := txo.KeyGen
+					sta := btx.Bucket(BKTState)
+					account, idx, ok := walletAdrIdx(kg)
+					if ok {
+						next, _ := acctCounts(sta, account)
+						if idx >= next {
+							err = sta.Put(acctKey(KEYNextAdr, account),
+								lnutil.U32tB(idx+1))
+							if err != nil {
+								return err
+							}
+							usedNew = true
+						}
+					}
+					// same for the legacy window
+					account, idx, ok = legacyAdrIdx(kg)
+					if ok {
+						next, _ := legacyCounts(sta, account)
+						if idx >= next {
+							err = sta.Put(acctKey(KEYLegacyNext, account),
+								lnutil.U32tB(idx+1))
+							if err != nil {
+								return err
+							}
+							usedNew = true
+						}
+					}
+
+					// this account has history, so look at the next one
+					found, err := w.discoverAccount(sta, kg)
+					if err != nil {
+						return err
+					}
+					usedNew = usedNew || found
+
 					// add hits now though
 					hits++
 					hitTxs[i] = true
@@ -488,6 +1141,31 @@ func (w *Wallit) IngestMany(txs []*wire.MsgTx, height int32) (uint32, error) {
 				ev.Tx = txs[spentTxIdx[i]]
 				w.OPEventChan <- ev
 			}
+			if v == nil {
+				// already spent.  If it's by this same tx, which got reorged
+				// out and has now come back in, update the spend height.
+				stxb := old.Get(curOP[:])
+				if stxb == nil {
+					continue
+				}
+				st, err := StxoFromBytes(append(curOP[:], stxb...))
+				if err != nil {
+					return err
+				}
+				if st.SpendHeight == height ||
+					!st.SpendTxid.IsEqual(cachedShas[spentTxIdx[i]]) {
+					continue
+				}
+				st.SpendHeight = height
+				stxb, err = st.ToBytes()
+				if err != nil {
+					return err
+				}
+				err = old.Put(stxb[:36], stxb[36:])
+				if err != nil {
+					return err
+				}
+			}
 			if v != nil && len(v) > 0 {
 				hitTxs[spentTxIdx[i]] = true
 				// do all this just to figure out value we lost
@@ -536,6 +1214,15 @@ func (w *Wallit) IngestMany(txs []*wire.MsgTx, height int32) (uint32, error) {
 		}
 		return nil
 	})
+	if err != nil {
+		return hits, err
+	}
+
+	// slide the address window up if we saw new addresses used, and fill
+	// the windows of new accounts
+	if usedNew {
+		err = w.FillGap()
+	}
 
 	log.Printf("ingest %d txs, %d hits\n", len(txs), hits)
 	return hits, err
@@ -0,0 +1,443 @@
+package wallit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/wire"
+	"github.com/boltdb/bolt"
+	"github.com/btcsuite/fastsha256"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// testHook is a ChainHook that remembers what it's told to watch
+type testHook struct {
+	w          *Wallit
+	adrs       map[[20]byte]bool
+	ops        map[wire.OutPoint]bool
+	rescanErr  error
+	rescanFrom int32
+	dbHeight   int32 // the wallit's db height when Rescan was called
+}
+
+func (h *testHook) Start(height int32, host, path string, params *chaincfg.Params) (
+	chan lnutil.TxAndHeight, chan int32, error) {
+	return nil, nil, nil
+}
+
+func (h *testHook) RegisterAddress(adr [20]byte) error {
+	h.adrs[adr] = true
+	return nil
+}
+
+func (h *testHook) RegisterScriptHash(sh [32]byte) error { return nil }
+
+func (h *testHook) RegisterOutPoint(op wire.OutPoint) error {
+	h.ops[op] = true
+	return nil
+}
+
+func (h *testHook) Rescan(fromHeight int32) error {
+	h.rescanFrom = fromHeight
+	h.dbHeight = h.w.CurrentHeight()
+	return h.rescanErr
+}
+
+func (h *testHook) PushTx(tx *wire.MsgTx) error                   { return nil }
+func (h *testHook) RawBlocks() chan *wire.MsgBlock                { return nil }
+func (h *testHook) BlockDisconnects() chan lnutil.BlockDisconnect { return nil }
+
+// testDBWallit makes a keyed wallit with a fresh db and a testHook.
+// Call the func it gives back when done.
+func testDBWallit(t *testing.T) (*Wallit, *testHook, func()) {
+	dir, err := ioutil.TempDir("", "wallit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := testWallit(t)
+	hook := &testHook{w: w,
+		adrs: make(map[[20]byte]bool), ops: make(map[wire.OutPoint]bool)}
+	w.Hook = hook
+	err = w.OpenDB(filepath.Join(dir, "utxo.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return w, hook, func() {
+		w.StateDB.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// payTx pays value to an account's address idx, from a made up outpoint
+func payTx(w *Wallit, id string, account, idx uint32, value int64) *wire.MsgTx {
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{id[0]}, 0), []byte{0x51}, nil))
+	tx.AddTxOut(wire.NewTxOut(value,
+		lnutil.DirectWPKHScriptFromPKH(w.PathPubHash160(w.walletKeygen(account, idx)))))
+	return tx
+}
+
+func checkCounts(t *testing.T, w *Wallit, next, numKeys uint32) {
+	n, k, err := w.adrCounts(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != next || k != numKeys {
+		t.Fatalf("next %d numkeys %d, expect %d, %d", n, k, next, numKeys)
+	}
+}
+
+// TestFillGap checks there are always GapLimit addresses watched past the
+// last one handed out, and GapLimit legacy ones past the last one used.
+func TestFillGap(t *testing.T) {
+	w, hook, done := testDBWallit(t)
+	defer done()
+
+	err := w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, w, 0, GapLimit)
+	if len(hook.adrs) != 2*GapLimit {
+		t.Fatalf("%d adrs registered, expect %d", len(hook.adrs), 2*GapLimit)
+	}
+	legacy, err := w.legacyAdrs(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != GapLimit {
+		t.Fatalf("%d legacy adrs, expect %d", len(legacy), GapLimit)
+	}
+	for _, adr := range append(legacy, w.adrRange(0, 0, GapLimit)...) {
+		if !hook.adrs[adr] {
+			t.Fatalf("adr %x in window not registered", adr)
+		}
+	}
+
+	// again does nothing
+	err = w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(t, w, 0, GapLimit)
+
+	adr, err := w.NewAdr160()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adr != w.PathPubHash160(w.walletKeygen(0, 0)) {
+		t.Fatalf("first adr handed out isn't adr 0")
+	}
+	checkCounts(t, w, 1, GapLimit+1)
+	if len(hook.adrs) != 2*GapLimit+1 {
+		t.Fatalf("%d adrs registered, expect %d", len(hook.adrs), 2*GapLimit+1)
+	}
+}
+
+// TestIngestManyGap gets paid to an address in the window, which moves the
+// window up past it, and to one past the window, which isn't seen.
+func TestIngestManyGap(t *testing.T) {
+	w, hook, done := testDBWallit(t)
+	defer done()
+
+	err := w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := payTx(w, "a", 0, 15, 50000)
+	hits, err := w.IngestMany([]*wire.MsgTx{tx}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits == 0 {
+		t.Fatalf("tx to adr 15 didn't hit")
+	}
+	checkCounts(t, w, 16, 16+GapLimit)
+	// and account 1's window, now that account 0 has a tx, and both
+	// accounts' legacy windows
+	if len(hook.adrs) != 16+4*GapLimit {
+		t.Fatalf("%d adrs registered, expect %d", len(hook.adrs), 16+4*GapLimit)
+	}
+	for _, adr := range w.adrRange(0, 0, 16+GapLimit) {
+		if !hook.adrs[adr] {
+			t.Fatalf("adr %x in window not registered", adr)
+		}
+	}
+	op := wire.OutPoint{Hash: tx.TxHash()}
+	if !hook.ops[op] {
+		t.Fatalf("utxo %s not registered", op.String())
+	}
+	utxos, err := w.UtxoDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Op != op || utxos[0].Height != 5 ||
+		utxos[0].Value != 50000 || utxos[0].KeyGen != w.walletKeygen(0, 15) {
+		t.Fatalf("utxos %v, expect %s at height 5", utxos, op.String())
+	}
+
+	// past the window; nobody's watching
+	hits, err = w.IngestMany([]*wire.MsgTx{payTx(w, "b", 0, 16+GapLimit, 1000)}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 0 {
+		t.Fatalf("tx past the window hit")
+	}
+	checkCounts(t, w, 16, 16+GapLimit)
+
+	// spend it
+	spend := wire.NewMsgTx()
+	spend.Version = 2
+	spend.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	spend.AddTxOut(wire.NewTxOut(40000, []byte{0x51}))
+	_, err = w.IngestMany([]*wire.MsgTx{spend}, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos, err = w.UtxoDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 {
+		t.Fatalf("%d utxos after spend, expect 0", len(utxos))
+	}
+}
+
+// TestIngestScriptHash has a p2wsh output exported to the wallit get found
+// again by IngestMany, like in a rescan, with what it takes to spend it.
+func TestIngestScriptHash(t *testing.T) {
+	w, _, done := testDBWallit(t)
+	defer done()
+
+	script := []byte{0x51, 0xb2, 0x75, 0x21, 0x02, 0xaa} // made up
+	wsh := fastsha256.Sum256(script)
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{'s'}, 0), []byte{0x51}, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{0x51}))
+	tx.AddTxOut(wire.NewTxOut(70000, append([]byte{0x00, 0x20}, wsh[:]...)))
+
+	u := portxo.PorTxo{
+		Op:       wire.OutPoint{Hash: tx.TxHash(), Index: 1},
+		Value:    70000,
+		Height:   8,
+		Seq:      5,
+		Mode:     portxo.TxoP2WSHComp,
+		KeyGen:   w.walletKeygen(7, 3),
+		PkScript: script,
+	}
+	w.ExportUtxo(&u, 0)
+
+	// the utxo's gone, like on a fresh db
+	opArr := lnutil.OutPointToBytes(u.Op)
+	err := w.StateDB.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(BKToutpoint).Delete(opArr[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := w.IngestMany([]*wire.MsgTx{tx}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits == 0 {
+		t.Fatalf("p2wsh output didn't hit")
+	}
+	utxos, err := w.UtxoDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || !utxos[0].Equal(&u) {
+		t.Fatalf("got utxos %v, expect %s", utxos, u.String())
+	}
+}
+
+// TestLegacyRestore has a wallet restored onto a new DB find funds on the
+// legacy hardened chain, and move the legacy window up past them.
+func TestLegacyRestore(t *testing.T) {
+	w, hook, done := testDBWallit(t)
+	defer done()
+
+	err := w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyTx := func(id string, idx uint32) *wire.MsgTx {
+		tx := payTx(w, id, 0, 0, 30000)
+		tx.TxOut[0].PkScript = lnutil.DirectWPKHScriptFromPKH(
+			w.PathPubHash160(w.legacyKeygen(0, idx)))
+		return tx
+	}
+
+	for i, idx := range []uint32{GapLimit - 1, 2*GapLimit - 1} {
+		tx := legacyTx(string(rune('a'+i)), idx)
+		hits, err := w.IngestMany([]*wire.MsgTx{tx}, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hits == 0 {
+			t.Fatalf("tx to legacy adr %d didn't hit", idx)
+		}
+		legacy, err := w.legacyAdrs(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(legacy) != int(idx+1+GapLimit) {
+			t.Fatalf("%d legacy adrs, expect %d", len(legacy), idx+1+GapLimit)
+		}
+		if !hook.adrs[legacy[len(legacy)-1]] {
+			t.Fatalf("last legacy adr not registered")
+		}
+	}
+
+	// past the window; nobody's watching
+	hits, err := w.IngestMany([]*wire.MsgTx{legacyTx("z", 3*GapLimit)}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hits != 0 {
+		t.Fatalf("tx past the legacy window hit")
+	}
+	// nothing new handed out on the receive chain
+	checkCounts(t, w, 0, GapLimit)
+
+	utxos, err := w.AccountUtxoDump(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Fatalf("%d utxos, expect 2", len(utxos))
+	}
+}
+
+// TestRescan checks the db height goes back before the hook starts sending
+// blocks, and stays put if the hook can't rescan.
+func TestRescan(t *testing.T) {
+	w, hook, done := testDBWallit(t)
+	defer done()
+
+	err := w.SetDBSyncHeight(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Rescan(101) == nil || w.Rescan(0) == nil {
+		t.Fatalf("rescan out of range worked")
+	}
+
+	err = w.Rescan(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.rescanFrom != 50 || hook.dbHeight != 49 {
+		t.Fatalf("hook rescanned from %d with db at %d, expect 50, 49",
+			hook.rescanFrom, hook.dbHeight)
+	}
+	if w.CurrentHeight() != 49 {
+		t.Fatalf("db height %d after rescan, expect 49", w.CurrentHeight())
+	}
+	if len(hook.adrs) != 2*GapLimit {
+		t.Fatalf("%d adrs registered for rescan, expect %d",
+			len(hook.adrs), 2*GapLimit)
+	}
+
+	err = w.SetDBSyncHeight(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.rescanErr = fmt.Errorf("busy")
+	if w.Rescan(50) == nil {
+		t.Fatalf("rescan worked with hook error")
+	}
+	if w.CurrentHeight() != 100 {
+		t.Fatalf("db height %d after failed rescan, expect 100",
+			w.CurrentHeight())
+	}
+}
+
+// TestDoubleSpent has an unconfirmed tx spending 2 utxos get double spent
+// by one spending only the first.  The tx's change goes away, the first
+// utxo stays spent by the double spend, and the second comes back.
+func TestDoubleSpent(t *testing.T) {
+	w, _, done := testDBWallit(t)
+	defer done()
+
+	err := w.FillGap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fund := payTx(w, "a", 0, 0, 50000)
+	fund.AddTxOut(fund.TxOut[0])
+	_, err = w.IngestMany([]*wire.MsgTx{fund}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op0 := wire.OutPoint{Hash: fund.TxHash(), Index: 0}
+	op1 := wire.OutPoint{Hash: fund.TxHash(), Index: 1}
+
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(&op0, nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&op1, nil, nil))
+	tx.AddTxOut(payTx(w, "x", 0, 1, 90000).TxOut[0])
+	_, err = w.IngestMany([]*wire.MsgTx{tx}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos, err := w.UtxoDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Op.Hash != tx.TxHash() {
+		t.Fatalf("utxos %v, expect just the change", utxos)
+	}
+
+	byTx := wire.NewMsgTx()
+	byTx.Version = 2
+	byTx.AddTxIn(wire.NewTxIn(&op0, nil, nil))
+	byTx.AddTxOut(wire.NewTxOut(45000, []byte{0x51}))
+	err = w.DoubleSpent(lnutil.TxConflict{
+		Tx: tx, ByTx: byTx, Op: op0, Height: 6, Ours: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos, err = w.UtxoDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Op != op1 {
+		t.Fatalf("utxos %v, expect just %s", utxos, op1.String())
+	}
+	err = w.StateDB.View(func(btx *bolt.Tx) error {
+		k := lnutil.OutPointToBytes(op0)
+		stxb := btx.Bucket(BKTStxos).Get(k[:])
+		if stxb == nil {
+			return fmt.Errorf("%s not spent", op0.String())
+		}
+		st, err := StxoFromBytes(append(k[:], stxb...))
+		if err != nil {
+			return err
+		}
+		if st.SpendTxid != byTx.TxHash() || st.SpendHeight != 6 {
+			return fmt.Errorf("%s spent by %s at %d, expect %s at 6",
+				op0.String(), st.SpendTxid.String(), st.SpendHeight,
+				byTx.TxHash().String())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package wallit
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -9,16 +10,62 @@ import (
 	"github.com/adiabat/btcd/wire"
 	"github.com/adiabat/btcutil/hdkeychain"
 	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/corerpc"
 	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/powless"
 	"github.com/mit-dci/lit/uspv"
 )
 
 func NewWallit(
 	rootkey *hdkeychain.ExtendedKey, birthHeight int32, resync bool,
-	spvhost, path string, p *chaincfg.Params) *Wallit {
+	spvhost, path string, p *chaincfg.Params, dialer lnutil.Dialer) *Wallit {
 
 	var w Wallit
 	w.rootPrivKey = rootkey
+	w.startWallit(birthHeight, resync, spvhost, path, "utxo.db", p, dialer)
+	return &w
+}
+
+// NewWatchOnlyWallit makes a wallit with no private keys, from the account
+// level (m/44'/coin'/account') extended public key.  It tracks addresses and utxos
+// and can build unsigned txs, but refuses to sign anything.
+// It uses its own db file, since a keyed wallit's db may also have legacy
+// hardened addresses that can't be derived from the xpub.
+func NewWatchOnlyWallit(
+	acctPub *hdkeychain.ExtendedKey, birthHeight int32, resync bool,
+	spvhost, path string, p *chaincfg.Params, dialer lnutil.Dialer) (
+	*Wallit, error) {
+
+	if acctPub == nil {
+		return nil, fmt.Errorf("NewWatchOnlyWallit: nil xpub")
+	}
+	if !acctPub.IsForNet(p) {
+		return nil, fmt.Errorf("NewWatchOnlyWallit: xpub is not for %s", p.Name)
+	}
+	// don't keep private keys around, even if we were given one
+	acctPub, err := acctPub.Neuter()
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := xpubAccount(acctPub)
+	if err != nil {
+		return nil, err
+	}
+
+	var w Wallit
+	w.acctPubKey = acctPub
+	w.watchAccount = account
+	w.startWallit(birthHeight, resync, spvhost, path, "watch.db", p, dialer)
+	return &w, nil
+}
+
+// startWallit opens the db, starts up the chainhook and tells it about
+// all the addresses and outpoints.  Keys need to be set already.  p2p
+// connections to full nodes go through dialer, if it's not nil.
+func (w *Wallit) startWallit(birthHeight int32, resync bool,
+	spvhost, path, dbname string, p *chaincfg.Params, dialer lnutil.Dialer) {
+
 	w.Param = p
 	w.FreezeSet = make(map[wire.OutPoint]*FrozenTx)
 
@@ -39,11 +86,18 @@ func NewWallit(
 	// so we have to open the db first, then turn on the chainhook, THEN tell
 	// chainhook about all our addresses.
 
-	u := new(uspv.SPVCon)
-	//	u := new(powless.APILink)
-	w.Hook = u
+	// http urls are full node RPC interfaces, insight+ / esplora+ urls are
+	// block explorers; anything else is a p2p node
+	switch {
+	case corerpc.IsNodeURL(spvhost):
+		w.Hook = &corerpc.CoreLink{Dialer: dialer}
+	case powless.IsExplorerURL(spvhost):
+		w.Hook = &powless.APILink{Dialer: dialer}
+	default:
+		w.Hook = &uspv.SPVCon{Dialer: dialer}
+	}
 
-	wallitdbname := filepath.Join(wallitpath, "utxo.db")
+	wallitdbname := filepath.Join(wallitpath, dbname)
 	err = w.OpenDB(wallitdbname)
 	if err != nil {
 		log.Printf("NewWallit crash  %s ", err.Error())
@@ -60,24 +114,47 @@ func NewWallit(
 		log.Printf("NewWallit crash  %s ", err.Error())
 	}
 
-	// check if there are any addresses.  If there aren't (initial wallet setup)
-	// then make an address.
-	adrs, err := w.AdrDump()
+	// make sure there are GapLimit addresses past the last one used.
+	// On a new DB (or an old one from before the gap limit) this derives them.
+	err = w.FillGap()
+	if err != nil {
+		log.Printf("NewWallit crash  %s ", err.Error())
+	}
+
+	// if none have been handed out (initial wallet setup), hand one out
+	next, _, err := w.adrCounts(w.defaultAccount())
 	if err != nil {
 		log.Printf("NewWallit crash  %s ", err.Error())
 	}
-	if len(adrs) == 0 {
+	if next == 0 {
 		_, err := w.NewAdr()
 		if err != nil {
 			log.Printf("NewWallit crash  %s ", err.Error())
 		}
 	}
 
-	// send all those adrs to the hook
-	for _, a := range adrs {
-		err = w.Hook.RegisterAddress(a)
+	// send all the adrs in all accounts, including the lookahead window,
+	// to the hook
+	accounts, err := w.activeAccounts()
+	if err != nil {
+		log.Printf("NewWallit crash  %s ", err.Error())
+	}
+	for _, account := range accounts {
+		_, numKeys, err := w.adrCounts(account)
 		if err != nil {
-			log.Printf("NewWallit RegisterAddress crash %s ", err.Error())
+			log.Printf("NewWallit crash  %s ", err.Error())
+			continue
+		}
+		adrs, err := w.legacyAdrs(account)
+		if err != nil {
+			log.Printf("NewWallit crash  %s ", err.Error())
+		}
+		adrs = append(adrs, w.adrRange(account, 0, numKeys)...)
+		for _, a := range adrs {
+			err = w.Hook.RegisterAddress(a)
+			if err != nil {
+				log.Printf("NewWallit RegisterAddress crash %s ", err.Error())
+			}
 		}
 	}
 
@@ -93,30 +170,49 @@ func NewWallit(
 		}
 	}
 
-	// deal with the incoming txs
-	go w.TxHandler(incomingTx)
-
-	// deal with incoming height
-	go w.HeightHandler(incomingBlockheight)
+	// double spends too, if the chainhook notices them
+	var conflicts chan lnutil.TxConflict
+	if cw, ok := w.Hook.(ConflictWatcher); ok {
+		conflicts = cw.TxConflicts()
+	}
 
-	return &w
+	// deal with incoming txs, heights and reorgs, one at a time so that
+	// a reorg is rolled back before anything from the new branch comes in
+	go w.ChainHandler(incomingTx, incomingBlockheight,
+		w.Hook.BlockDisconnects(), conflicts)
 }
 
-func (w *Wallit) TxHandler(incomingTxAndHeight chan lnutil.TxAndHeight) {
+// ChainHandler takes in everything coming up from the ChainHook: txs, the
+// heights synced to, blocks that got reorged out, and double spends.
+// conflicts can be nil.
+func (w *Wallit) ChainHandler(incomingTxAndHeight chan lnutil.TxAndHeight,
+	incomingHeight chan int32, disconnects chan lnutil.BlockDisconnect,
+	conflicts chan lnutil.TxConflict) {
 	for {
-		txah := <-incomingTxAndHeight
-		w.Ingest(txah.Tx, txah.Height)
-		log.Printf("got tx %s at height %d\n",
-			txah.Tx.TxHash().String(), txah.Height)
-	}
-}
+		select {
+		case txah := <-incomingTxAndHeight:
+			w.Ingest(txah.Tx, txah.Height)
+			log.Printf("got tx %s at height %d\n",
+				txah.Tx.TxHash().String(), txah.Height)
 
-func (w *Wallit) HeightHandler(incomingHeight chan int32) {
-	for {
-		h := <-incomingHeight
-		err := w.SetDBSyncHeight(h)
-		if err != nil {
-			log.Printf("HeightHandler crash  %s ", err.Error())
+		case h := <-incomingHeight:
+			err := w.SetDBSyncHeight(h)
+			if err != nil {
+				log.Printf("HeightHandler crash  %s ", err.Error())
+			}
+
+		case d := <-disconnects:
+			log.Printf("block %d %s disconnected\n", d.Height, d.Hash.String())
+			err := w.Rollback(d.Height)
+			if err != nil {
+				log.Printf("Rollback crash  %s ", err.Error())
+			}
+
+		case c := <-conflicts:
+			err := w.DoubleSpent(c)
+			if err != nil {
+				log.Printf("DoubleSpent crash  %s ", err.Error())
+			}
 		}
 	}
 }
@@ -147,6 +243,10 @@ func (w *Wallit) OpenDB(filename string) error {
 		if err != nil {
 			return err
 		}
+		_, err = btx.CreateBucketIfNotExists(BKTKeyAccts)
+		if err != nil {
+			return err
+		}
 
 		sta, err := btx.CreateBucketIfNotExists(BKTState)
 		if err != nil {
@@ -167,6 +267,21 @@ func (w *Wallit) OpenDB(filename string) error {
 			}
 		}
 
+		// wallets from before the receive chain was unhardened keep their
+		// addresses as legacy ones.  Watch-only ones were always unhardened.
+		if sta.Get(KEYAdrChain) == nil {
+			if !w.WatchOnly() {
+				err = migrateAdrChain(sta)
+				if err != nil {
+					return err
+				}
+			}
+			err = sta.Put(KEYAdrChain, lnutil.U32tB(1))
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
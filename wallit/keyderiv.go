@@ -2,6 +2,7 @@ package wallit
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/adiabat/btcd/btcec"
 	"github.com/adiabat/btcutil"
@@ -26,6 +27,10 @@ func (w *Wallit) PathPrivkey(kg portxo.KeyGen) *btcec.PrivateKey {
 	if kg.Depth != 5 {
 		return nil
 	}
+	if w.WatchOnly() {
+		log.Printf("PathPrivkey: watch-only wallet, no key for %s\n", kg.String())
+		return nil
+	}
 	priv, err := kg.DerivePrivateKey(w.rootPrivKey)
 	if err != nil {
 		fmt.Printf("PathPrivkey err %s", err.Error())
@@ -37,11 +42,43 @@ func (w *Wallit) PathPrivkey(kg portxo.KeyGen) *btcec.PrivateKey {
 // PathPubkey returns a public key by descending the given path.
 // Returns nil if there's an error.
 func (w *Wallit) PathPubkey(kg portxo.KeyGen) *btcec.PublicKey {
+	if w.WatchOnly() {
+		return w.watchPubkey(kg)
+	}
 	priv := w.PathPrivkey(kg)
 	if priv == nil {
 		return nil
 	}
-	return w.PathPrivkey(kg).PubKey()
+	return priv.PubKey()
+}
+
+// watchPubkey derives a pubkey from the account xpub.  Only works for
+// m/44'/coin'/account'/x/y paths in the xpub's account, where x and y are not
+// hardened.
+func (w *Wallit) watchPubkey(kg portxo.KeyGen) *btcec.PublicKey {
+	if w.acctPubKey == nil || kg.Depth != 5 ||
+		kg.Step[0] != 44|1<<31 || kg.Step[1] != w.Param.HDCoinType|1<<31 ||
+		kg.Step[2] != w.watchAccount|1<<31 ||
+		kg.Step[3]&(1<<31) != 0 || kg.Step[4]&(1<<31) != 0 {
+		log.Printf("watchPubkey: can't derive %s from xpub\n", kg.String())
+		return nil
+	}
+	branch, err := w.acctPubKey.Child(kg.Step[3])
+	if err != nil {
+		log.Printf("watchPubkey err %s", err.Error())
+		return nil
+	}
+	child, err := branch.Child(kg.Step[4])
+	if err != nil {
+		log.Printf("watchPubkey err %s", err.Error())
+		return nil
+	}
+	pub, err := child.ECPubKey()
+	if err != nil {
+		log.Printf("watchPubkey err %s", err.Error())
+		return nil
+	}
+	return pub
 }
 
 // PathPubHash160 returns a 20 byte pubkey hash for the given path
@@ -61,25 +98,39 @@ func (w *Wallit) PathPubHash160(kg portxo.KeyGen) [20]byte {
 
 // get a private key from the regular wallet
 func (w *Wallit) GetWalletPrivkey(idx uint32) *btcec.PrivateKey {
-	var kg portxo.KeyGen
-	kg.Depth = 5
-	kg.Step[0] = 44 | 1<<31
-	kg.Step[1] = w.Param.HDCoinType | 1<<31
-	kg.Step[2] = 0 | 1<<31
-	kg.Step[3] = 0 | 1<<31
-	kg.Step[4] = idx | 1<<31
-	return w.PathPrivkey(kg)
+	return w.PathPrivkey(GetWalletKeygen(idx, w.Param.HDCoinType))
 }
 
-// GetWalletKeygen returns the keygen for a standard wallet address
+// GetWalletKeygen returns the keygen for a standard wallet address,
+// m/44'/coin'/0'/0/idx.  The last two steps aren't hardened so the addresses
+// can be derived from the account xpub.
 func GetWalletKeygen(idx, cointype uint32) portxo.KeyGen {
 	var kg portxo.KeyGen
 	kg.Depth = 5
 	kg.Step[0] = 44 | 1<<31
 	kg.Step[1] = cointype | 1<<31
 	kg.Step[2] = 0 | 1<<31
-	kg.Step[3] = 0 | 1<<31
-	kg.Step[4] = idx | 1<<31
+	kg.Step[3] = 0
+	kg.Step[4] = idx
+	return kg
+}
+
+// walletKeygen returns the keygen for the idx'th address of an account,
+// m/44'/coin'/account'/0/idx.  Keyed and watch-only wallits both use this,
+// so a watch-only wallit from the account xpub sees the same addresses.
+func (w *Wallit) walletKeygen(account, idx uint32) portxo.KeyGen {
+	kg := GetWalletKeygen(idx, w.Param.HDCoinType)
+	kg.Step[2] = account | 1<<31
+	return kg
+}
+
+// legacyKeygen returns the keygen for the idx'th address of an account in
+// wallets from before the receive chain was unhardened,
+// m/44'/coin'/account'/0'/idx'.
+func (w *Wallit) legacyKeygen(account, idx uint32) portxo.KeyGen {
+	kg := w.walletKeygen(account, idx)
+	kg.Step[3] |= 1 << 31
+	kg.Step[4] |= 1 << 31
 	return kg
 }
 
@@ -92,7 +143,8 @@ func (w *Wallit) GetUsePriv(kg portxo.KeyGen, use uint32) *btcec.PrivateKey {
 // GetUsePub generates a pubkey for the given use case & keypath
 func (w *Wallit) GetUsePub(kg portxo.KeyGen, use uint32) [33]byte {
 	var b [33]byte
-	pub := w.GetUsePriv(kg, use).PubKey()
+	kg.Step[2] = use
+	pub := w.PathPubkey(kg)
 	if pub != nil {
 		copy(b[:], pub.SerializeCompressed())
 	}
@@ -0,0 +1,233 @@
+package wallit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg"
+	"github.com/adiabat/btcutil/hdkeychain"
+	"github.com/boltdb/bolt"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// testWallit makes a keyed wallit with no db or chainhook, enough for
+// deriving keys.
+func testWallit(t *testing.T) *Wallit {
+	var seed [32]byte
+	seed[0] = 0x11
+	root, err := hdkeychain.NewMaster(seed[:], &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Wallit{rootPrivKey: root, Param: &chaincfg.RegressionNetParams}
+}
+
+// TestWatchOnlyAdrs checks that a watch-only wallit made from a keyed
+// wallit's account xpub derives the same addresses.
+func TestWatchOnlyAdrs(t *testing.T) {
+	var empty160 [20]byte
+	w := testWallit(t)
+
+	xpub, err := w.AccountXpub(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acctPub, err := hdkeychain.NewKeyFromString(xpub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acctPub.IsPrivate() {
+		t.Fatalf("xpub %s is private", xpub)
+	}
+	watch := &Wallit{acctPubKey: acctPub, Param: w.Param}
+	wxpub, err := watch.AccountXpub(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wxpub != xpub {
+		t.Fatalf("watch-only xpub %s, expect %s", wxpub, xpub)
+	}
+
+	for i := uint32(0); i < 30; i++ {
+		kg := w.walletKeygen(0, i)
+		adr := w.PathPubHash160(kg)
+		wadr := watch.PathPubHash160(watch.walletKeygen(0, i))
+		if adr == empty160 || adr != wadr {
+			t.Fatalf("adr %d: keyed %x, watch-only %x", i, adr, wadr)
+		}
+		account, idx, ok := walletAdrIdx(kg)
+		if !ok || account != 0 || idx != i {
+			t.Fatalf("adr %d: walletAdrIdx gives %d, %d, %t", i, account, idx, ok)
+		}
+
+		// legacy addresses are a different chain, and can't come from the xpub
+		lkg := w.legacyKeygen(0, i)
+		if w.PathPubHash160(lkg) == adr {
+			t.Fatalf("adr %d: legacy adr same as new one", i)
+		}
+		if watch.PathPubHash160(lkg) != empty160 {
+			t.Fatalf("adr %d: watch-only derived legacy adr", i)
+		}
+		if _, _, ok := walletAdrIdx(lkg); ok {
+			t.Fatalf("adr %d: legacy keygen is a new wallet adr", i)
+		}
+	}
+
+	// other accounts have their own xpub and addresses
+	xpub1, err := w.AccountXpub(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xpub1 == xpub {
+		t.Fatalf("account 1 has account 0's xpub")
+	}
+	kg := w.walletKeygen(1, 0)
+	if w.PathPubHash160(kg) == w.PathPubHash160(w.walletKeygen(0, 0)) {
+		t.Fatalf("account 1 adr 0 same as account 0's")
+	}
+	for _, k := range []portxo.KeyGen{kg, w.legacyKeygen(1, 0)} {
+		account, err := w.KeyGenAccount(k)
+		if err != nil || account != 1 {
+			t.Fatalf("account 1 keygen in account %d: %v", account, err)
+		}
+	}
+	if _, err := watch.AccountXpub(1); err == nil {
+		t.Fatalf("watch-only wallit gave an xpub for account 1")
+	}
+
+	// a watch-only wallit from account 1's xpub sees account 1
+	acctPub1, err := hdkeychain.NewKeyFromString(xpub1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := xpubAccount(acctPub1)
+	if err != nil || account != 1 {
+		t.Fatalf("xpub for account %d, expect 1: %v", account, err)
+	}
+	watch1 := &Wallit{acctPubKey: acctPub1, Param: w.Param, watchAccount: account}
+	if watch1.checkAccount(0) == nil || watch1.checkAccount(1) != nil {
+		t.Fatalf("account 1 watch-only wallit doesn't only have account 1")
+	}
+	if watch1.defaultAccount() != 1 {
+		t.Fatalf("default account %d, expect 1", watch1.defaultAccount())
+	}
+	for i := uint32(0); i < 5; i++ {
+		adr := w.PathPubHash160(w.walletKeygen(1, i))
+		wadr := watch1.PathPubHash160(watch1.walletKeygen(1, i))
+		if adr == empty160 || adr != wadr {
+			t.Fatalf("account 1 adr %d: keyed %x, watch-only %x", i, adr, wadr)
+		}
+	}
+	if watch1.PathPubHash160(watch1.walletKeygen(0, 0)) != empty160 {
+		t.Fatalf("account 1 watch-only wallit derived an account 0 adr")
+	}
+
+	// only account level xpubs
+	rootPub, err := w.rootPrivKey.Neuter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xpubAccount(rootPub); err == nil {
+		t.Fatalf("root xpub taken as an account xpub")
+	}
+}
+
+// TestMigrateAdrChain opens a db from before the receive chain was unhardened
+// and checks the old addresses become legacy ones.
+func TestMigrateAdrChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wallit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbname := filepath.Join(dir, "utxo.db")
+
+	// old db: 5 addresses in account 0, 3 in account 2 with 2 handed out
+	db, err := bolt.Open(dbname, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(btx *bolt.Tx) error {
+		sta, err := btx.CreateBucket(BKTState)
+		if err != nil {
+			return err
+		}
+		err = sta.Put(KEYNumKeys, lnutil.U32tB(5))
+		if err != nil {
+			return err
+		}
+		err = sta.Put(acctKey(KEYNumKeys, 2), lnutil.U32tB(3))
+		if err != nil {
+			return err
+		}
+		return sta.Put(acctKey(KEYNextAdr, 2), lnutil.U32tB(2))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	w := testWallit(t)
+	// open it twice; the second time shouldn't migrate again
+	for i := 0; i < 2; i++ {
+		err = w.OpenDB(dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for account, numLegacy := range map[uint32]int{0: 5, 1: 0, 2: 3} {
+			legacy, err := w.legacyAdrs(account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(legacy) != numLegacy {
+				t.Fatalf("account %d: %d legacy adrs, expect %d",
+					account, len(legacy), numLegacy)
+			}
+			for j, adr := range legacy {
+				if adr != w.PathPubHash160(w.legacyKeygen(account, uint32(j))) {
+					t.Fatalf("account %d legacy adr %d wrong", account, j)
+				}
+			}
+			err = w.StateDB.View(func(btx *bolt.Tx) error {
+				next, _ := legacyCounts(btx.Bucket(BKTState), account)
+				if next != map[uint32]uint32{0: 5, 1: 0, 2: 2}[account] {
+					return fmt.Errorf("account %d: legacy next %d", account, next)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			next, numKeys, err := w.adrCounts(account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != 0 || numKeys != 0 {
+				t.Fatalf("account %d: next %d numkeys %d, expect 0, 0",
+					account, next, numKeys)
+			}
+			adrs, err := w.AccountAdrDump(account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(adrs) != numLegacy {
+				t.Fatalf("account %d: dumped %d adrs, expect %d",
+					account, len(adrs), numLegacy)
+			}
+		}
+
+		accounts, err := w.activeAccounts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(accounts) != 2 || accounts[0] != 0 || accounts[1] != 2 {
+			t.Fatalf("active accounts %v, expect [0 2]", accounts)
+		}
+		w.StateDB.Close()
+	}
+}
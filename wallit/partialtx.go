@@ -0,0 +1,181 @@
+package wallit
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/adiabat/btcd/btcec"
+	"github.com/adiabat/btcd/txscript"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// ExportUnsigned builds a tx the same way MaybeSend does, but instead of
+// holding it for ReallySend, returns it unsigned along with the portxos for
+// all the inputs (and the previous txs of non-witness ones), so it can be
+// signed somewhere else.  The utxos stay frozen
+// until the signed tx comes back via BroadcastPartial, or NahDontSend.
+// Inputs come from the given account.
+func (w *Wallit) ExportUnsigned(
+	account uint32, txos []*wire.TxOut) (*portxo.PartialTx, error) {
+	ops, err := w.MaybeSendFrom(account, txos, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) == 0 || ops[0] == nil {
+		return nil, fmt.Errorf("ExportUnsigned: MaybeSend gave no outpoints")
+	}
+
+	w.FreezeMutex.Lock()
+	defer w.FreezeMutex.Unlock()
+	frozenTx, err := w.FindFreezeTx(&ops[0].Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	allOuts := frozenTx.Outs
+	if frozenTx.ChangeOut != nil {
+		allOuts = append(frozenTx.Outs, frozenTx.ChangeOut)
+	}
+
+	sort.Sort(portxo.TxoSliceByBip69(frozenTx.Ins))
+	tx, err := w.BuildDontSign(frozenTx.Ins, allOuts)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := portxo.NewPartialTx(tx, frozenTx.Ins)
+	if err != nil {
+		return nil, err
+	}
+	for i, u := range p.Ins {
+		if u.NeedsPrevTx() {
+			p.PrevTxs[i], err = w.GetTx(&u.Op.Hash)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// SignPartial signs every input of a partial tx that this wallet can.
+// Inputs that are already signed, or for a different coin, are left alone.
+// Non-witness inputs have to come with their previous tx, so the input values
+// (and the fee) can be trusted.  Returns the number of inputs it signed.
+func (w *Wallit) SignPartial(p *portxo.PartialTx) (int, error) {
+	if w.WatchOnly() {
+		return 0, fmt.Errorf("SignPartial: watch-only wallet can't sign")
+	}
+	if p == nil || p.Tx == nil || len(p.Ins) != len(p.Tx.TxIn) {
+		return 0, fmt.Errorf("SignPartial: invalid partial tx")
+	}
+	err := p.CheckPrevTxs()
+	if err != nil {
+		return 0, fmt.Errorf("SignPartial: %s", err.Error())
+	}
+
+	hCache := txscript.NewTxSigHashes(p.Tx)
+	sigStash := make([][]byte, len(p.Ins))
+	witStash := make([][][]byte, len(p.Ins))
+
+	var signed int
+	for i, txin := range p.Tx.TxIn {
+		if len(txin.SignatureScript) != 0 || len(txin.Witness) != 0 {
+			continue // already signed
+		}
+		u := p.Ins[i]
+		if u.KeyGen.Step[1]&0x7fffffff != w.Param.HDCoinType {
+			continue // not our coin
+		}
+		priv := w.PathPrivkey(u.KeyGen)
+		if priv == nil {
+			continue // can't derive this one
+		}
+		if !keyMatches(u, priv.PubKey()) {
+			return 0, fmt.Errorf("SignPartial: input %d keygen %s isn't for its script",
+				i, u.KeyGen.String())
+		}
+
+		var err error
+		sigStash[i], witStash[i], err = signInput(p.Tx, hCache, i, u, priv)
+		if err != nil {
+			return 0, err
+		}
+		signed++
+	}
+
+	for i, txin := range p.Tx.TxIn {
+		if sigStash[i] != nil {
+			txin.SignatureScript = sigStash[i]
+		}
+		if witStash[i] != nil {
+			txin.Witness = witStash[i]
+			txin.SignatureScript = nil
+		}
+	}
+
+	log.Printf("SignPartial signed %d of %d inputs\n", signed, len(p.Ins))
+	return signed, nil
+}
+
+// keyMatches says if pub is the key an input's script pays to
+func keyMatches(u *portxo.PorTxo, pub *btcec.PublicKey) bool {
+	pubBytes := pub.SerializeCompressed()
+	switch u.Mode {
+	case portxo.TxoP2PKHComp, portxo.TxoP2WPKHComp:
+		return bytes.Equal(
+			lnutil.KeyHashFromPkScript(u.PkScript), btcutil.Hash160(pubBytes))
+	case portxo.TxoP2WSHComp:
+		// the portxo has the witness script, which has the key in it
+		return bytes.Contains(u.PkScript, pubBytes)
+	}
+	return false
+}
+
+// BroadcastPartial takes a fully signed partial tx, checks every input's
+// scripts and signatures, clears any freezes on its inputs, and sends it out.
+func (w *Wallit) BroadcastPartial(p *portxo.PartialTx) error {
+	if p == nil || p.Tx == nil {
+		return fmt.Errorf("BroadcastPartial: nil tx")
+	}
+	if !p.Complete() {
+		return fmt.Errorf("BroadcastPartial: only %d of %d inputs signed",
+			p.NumSigned(), len(p.Tx.TxIn))
+	}
+	err := p.CheckPrevTxs()
+	if err != nil {
+		return fmt.Errorf("BroadcastPartial: %s", err.Error())
+	}
+
+	hCache := txscript.NewTxSigHashes(p.Tx)
+	for i, u := range p.Ins {
+		prevScript := u.PkScript
+		if u.Mode == portxo.TxoP2WSHComp {
+			// the portxo has the witness script, not the output script
+			prevScript = lnutil.P2WSHify(u.PkScript)
+		}
+		vm, err := txscript.NewEngine(prevScript, p.Tx, i,
+			txscript.StandardVerifyFlags, nil, hCache, u.Value)
+		if err != nil {
+			return fmt.Errorf("BroadcastPartial: input %d: %s", i, err.Error())
+		}
+		err = vm.Execute()
+		if err != nil {
+			return fmt.Errorf("BroadcastPartial: input %d doesn't verify: %s",
+				i, err.Error())
+		}
+	}
+
+	w.FreezeMutex.Lock()
+	for _, txin := range p.Tx.TxIn {
+		delete(w.FreezeSet, txin.PreviousOutPoint)
+	}
+	w.FreezeMutex.Unlock()
+
+	return w.NewOutgoingTx(p.Tx)
+}
@@ -0,0 +1,151 @@
+package wallit
+
+import (
+	"testing"
+
+	"github.com/adiabat/btcd/chaincfg/chainhash"
+	"github.com/adiabat/btcd/txscript"
+	"github.com/adiabat/btcd/wire"
+	"github.com/adiabat/btcutil"
+	"github.com/mit-dci/lit/lnutil"
+	"github.com/mit-dci/lit/portxo"
+)
+
+// testPartialTx makes a partial tx spending a p2wpkh and a p2pkh utxo of the
+// wallit's first two addresses.  The p2pkh one comes from prev.
+func testPartialTx(t *testing.T, w *Wallit) (*portxo.PartialTx, *wire.MsgTx) {
+	prev := wire.NewMsgTx()
+	prev.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 0), nil, nil))
+	prev.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+
+	kg1 := w.walletKeygen(0, 1)
+	pkh := w.PathPubHash160(kg1)
+	adr, err := btcutil.NewAddressPubKeyHash(pkh[:], w.Param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkhScript, err := txscript.PayToAddrScript(adr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.AddTxOut(wire.NewTxOut(200000, pkhScript))
+
+	u1 := new(portxo.PorTxo)
+	u1.Op.Hash = chainhash.DoubleHashH([]byte("in1"))
+	u1.Value = 100000
+	u1.Mode = portxo.TxoP2WPKHComp
+	u1.KeyGen = w.walletKeygen(0, 0)
+	u1.PkScript = lnutil.DirectWPKHScriptFromPKH(w.PathPubHash160(u1.KeyGen))
+
+	u2 := new(portxo.PorTxo)
+	u2.Op.Hash = prev.TxHash()
+	u2.Op.Index = 1
+	u2.Value = 200000
+	u2.Mode = portxo.TxoP2PKHComp
+	u2.KeyGen = kg1
+	u2.PkScript = pkhScript
+
+	tx := wire.NewMsgTx()
+	tx.Version = 2
+	tx.AddTxIn(wire.NewTxIn(&u1.Op, nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&u2.Op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(290000, u1.PkScript))
+
+	p, err := portxo.NewPartialTx(tx, []*portxo.PorTxo{u1, u2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, prev
+}
+
+// TestSignPartial checks that non-witness inputs need their previous tx,
+// and that the signatures made verify.
+func TestSignPartial(t *testing.T) {
+	w := testWallit(t)
+	p, prev := testPartialTx(t, w)
+
+	_, err := w.SignPartial(p)
+	if err == nil {
+		t.Fatalf("signed p2pkh input without its previous tx")
+	}
+	if p.NumSigned() != 0 {
+		t.Fatalf("%d inputs signed after error", p.NumSigned())
+	}
+
+	// previous tx which doesn't match the portxo value
+	p.PrevTxs[1] = prev
+	p.Ins[1].Value = 250000
+	_, err = w.SignPartial(p)
+	if err == nil {
+		t.Fatalf("signed input with portxo value not matching previous tx")
+	}
+	p.Ins[1].Value = 200000
+
+	// keygen that isn't the one the script pays to
+	p.Ins[0].KeyGen = w.walletKeygen(0, 5)
+	_, err = w.SignPartial(p)
+	if err == nil {
+		t.Fatalf("signed input with a keygen not matching its script")
+	}
+	p.Ins[0].KeyGen = w.walletKeygen(0, 0)
+
+	signed, err := w.SignPartial(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed != 2 || !p.Complete() {
+		t.Fatalf("signed %d inputs, expect 2", signed)
+	}
+
+	hCache := txscript.NewTxSigHashes(p.Tx)
+	for i, u := range p.Ins {
+		vm, err := txscript.NewEngine(u.PkScript, p.Tx, i,
+			txscript.StandardVerifyFlags, nil, hCache, u.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = vm.Execute()
+		if err != nil {
+			t.Fatalf("input %d: %s", i, err.Error())
+		}
+	}
+}
+
+// TestBroadcastPartialBadSig makes sure a tx with a bad signature is
+// refused before anything is unfrozen.
+func TestBroadcastPartialBadSig(t *testing.T) {
+	w := testWallit(t)
+	p, prev := testPartialTx(t, w)
+	p.PrevTxs[1] = prev
+
+	_, err := w.SignPartial(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.FreezeSet = make(map[wire.OutPoint]*FrozenTx)
+	for _, u := range p.Ins {
+		w.FreezeSet[u.Op] = new(FrozenTx)
+	}
+
+	// more to the output than what was signed for
+	p.Tx.TxOut[0].Value++
+	err = w.BroadcastPartial(p)
+	if err == nil {
+		t.Fatalf("broadcast tx with bad signatures")
+	}
+	if len(w.FreezeSet) != 2 {
+		t.Fatalf("%d inputs frozen after refusing tx, expect 2", len(w.FreezeSet))
+	}
+
+	// witness which doesn't match
+	p.Tx.TxOut[0].Value--
+	p.Tx.TxIn[0].Witness[0][10] ^= 1
+	err = w.BroadcastPartial(p)
+	if err == nil {
+		t.Fatalf("broadcast tx with bad witness")
+	}
+	if len(w.FreezeSet) != 2 {
+		t.Fatalf("%d inputs frozen after refusing tx, expect 2", len(w.FreezeSet))
+	}
+}
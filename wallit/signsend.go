@@ -6,6 +6,7 @@ import (
 	"log"
 	"sort"
 
+	"github.com/adiabat/btcd/btcec"
 	"github.com/adiabat/btcd/chaincfg/chainhash"
 	"github.com/adiabat/btcd/txscript"
 	"github.com/adiabat/btcd/wire"
@@ -22,7 +23,17 @@ import (
 //NOTE this does not support multiple txouts with identical pkscripts in one tx.
 // The code would be trivial; it's not supported on purpose.  Use unique pkscripts.
 func (w *Wallit) MaybeSend(txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error) {
-	var err error
+	return w.MaybeSendFrom(w.defaultAccount(), txos, ow)
+}
+
+// MaybeSendFrom is MaybeSend, but only spends utxos from the given account,
+// and sends change back to that account.
+func (w *Wallit) MaybeSendFrom(
+	account uint32, txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error) {
+	err := w.checkAccount(account)
+	if err != nil {
+		return nil, err
+	}
 	var totalSend int64
 	dustCutoff := int64(20000) // below this amount, just give to miners
 
@@ -48,7 +59,7 @@ func (w *Wallit) MaybeSend(txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error
 	defer w.FreezeMutex.Unlock()
 	// get inputs for this tx.  Only segwit
 	// This might not be enough for the fee if the inputs line up right...
-	utxos, overshoot, err := w.PickUtxos(totalSend, feePerByte, ow)
+	utxos, overshoot, err := w.PickUtxos(account, totalSend, feePerByte, ow)
 	if err != nil {
 		return nil, err
 	}
@@ -61,7 +72,7 @@ func (w *Wallit) MaybeSend(txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error
 	// input sum is not enough, we need more inputs.
 	// keep doing this until fee is sufficient or PickUtxos errors out
 	for fee > overshoot {
-		utxos, overshoot, err = w.PickUtxos(totalSend+fee, feePerByte, ow)
+		utxos, overshoot, err = w.PickUtxos(account, totalSend+fee, feePerByte, ow)
 		if err != nil {
 			return nil, err
 		}
@@ -70,7 +81,7 @@ func (w *Wallit) MaybeSend(txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error
 
 	// add a change output if we have enough extra
 	if overshoot-fee > dustCutoff {
-		changeOut, err = w.NewChangeOut(overshoot - fee)
+		changeOut, err = w.NewChangeOut(account, overshoot-fee)
 		if err != nil {
 			return nil, err
 		}
@@ -117,6 +128,9 @@ func (w *Wallit) MaybeSend(txos []*wire.TxOut, ow bool) ([]*wire.OutPoint, error
 // on the utxos but they're not utxos anymore anyway.
 func (w *Wallit) ReallySend(txid *chainhash.Hash) error {
 	log.Printf("Reallysend %s\n", txid.String())
+	if w.WatchOnly() {
+		return fmt.Errorf("watch-only wallet can't sign; use ExportUnsigned")
+	}
 	// start frozen set access
 	w.FreezeMutex.Lock()
 	defer w.FreezeMutex.Unlock()
@@ -231,7 +245,8 @@ func (w *Wallit) NewOutgoingTx(tx *wire.MsgTx) error {
 // PickUtxos Picks Utxos for spending.  Tell it how much money you want.
 // It returns a tx-sortable utxoslice, and the overshoot amount.  Also errors.
 // if "ow" is true, only gives witness utxos (for channel funding)
-func (w *Wallit) PickUtxos(
+// Only utxos from the given account are used.
+func (w *Wallit) PickUtxos(account uint32,
 	amtWanted int64, feePerByte int64,
 	ow bool) (portxo.TxoSliceByBip69, int64, error) {
 
@@ -241,7 +256,7 @@ func (w *Wallit) PickUtxos(
 	}
 
 	var allUtxos portxo.TxoSliceByAmt
-	allUtxos, err = w.GetAllUtxos()
+	allUtxos, err = w.AccountUtxoDump(account)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -370,6 +385,9 @@ func (w *Wallit) BuildAndSign(
 	utxos []*portxo.PorTxo, txos []*wire.TxOut) (*wire.MsgTx, error) {
 	var err error
 
+	if w.WatchOnly() {
+		return nil, fmt.Errorf("BuildAndSign: watch-only wallet can't sign")
+	}
 	if len(utxos) == 0 || len(txos) == 0 {
 		return nil, fmt.Errorf("BuildAndSign args no utxos or txos")
 	}
@@ -410,48 +428,15 @@ func (w *Wallit) BuildAndSign(
 	for i, _ := range tx.TxIn {
 		// get key
 		priv := w.PathPrivkey(utxos[i].KeyGen)
-		log.Printf("signing with privkey pub %x\n", priv.PubKey().SerializeCompressed())
-
 		if priv == nil {
 			return nil, fmt.Errorf("SendCoins: nil privkey")
 		}
+		log.Printf("signing with privkey pub %x\n", priv.PubKey().SerializeCompressed())
 
-		// sign into stash.  3 possibilities:  legacy PKH, WPKH, WSH
-		if utxos[i].Mode == portxo.TxoP2PKHComp { // legacy PKH
-			sigStash[i], err = txscript.SignatureScript(tx, i,
-				utxos[i].PkScript, txscript.SigHashAll, priv, true)
-			if err != nil {
-				return nil, err
-			}
-		}
-		if utxos[i].Mode == portxo.TxoP2WPKHComp { // witness PKH
-			witStash[i], err = txscript.WitnessScript(tx, hCache, i,
-				utxos[i].Value, utxos[i].PkScript, txscript.SigHashAll, priv, true)
-			if err != nil {
-				return nil, err
-			}
-		}
-		if utxos[i].Mode == portxo.TxoP2WSHComp { // witness script hash
-			sig, err := txscript.RawTxInWitnessSignature(tx, hCache, i,
-				utxos[i].Value, utxos[i].PkScript, txscript.SigHashAll, priv)
-			if err != nil {
-				return nil, err
-			}
-			// witness stack has the signature, items, then the previous full script
-			witStash[i] = make([][]byte, 2+len(utxos[i].PreSigStack))
-
-			// sig comes first (pushed to stack last)
-			witStash[i][0] = sig
-
-			// after stack comes PostSigStack items
-			for j, element := range utxos[i].PreSigStack {
-				witStash[i][j+1] = element
-			}
-
-			// last stack item is the pkscript
-			witStash[i][len(witStash[i])-1] = utxos[i].PkScript
+		sigStash[i], witStash[i], err = signInput(tx, hCache, i, utxos[i], priv)
+		if err != nil {
+			return nil, err
 		}
-
 	}
 	// swap sigs into sigScripts in txins
 	for i, txin := range tx.TxIn {
@@ -497,3 +482,45 @@ func EstFee(txins []*portxo.PorTxo, txouts []*wire.TxOut, spB int64) int64 {
 	log.Printf("%d spB, est vsize %d, fee %d\n", spB, size, size*spB)
 	return size * spB
 }
+
+// signInput makes the sigScript or witness for one input.  3 possibilities:
+// legacy PKH, WPKH, WSH.  Doesn't modify the tx, so that it can be called for
+// each input before any of the signatures are put in.
+func signInput(tx *wire.MsgTx, hCache *txscript.TxSigHashes, i int,
+	u *portxo.PorTxo, priv *btcec.PrivateKey) ([]byte, [][]byte, error) {
+
+	switch u.Mode {
+	case portxo.TxoP2PKHComp: // legacy PKH
+		sigScript, err := txscript.SignatureScript(tx, i,
+			u.PkScript, txscript.SigHashAll, priv, true)
+		return sigScript, nil, err
+
+	case portxo.TxoP2WPKHComp: // witness PKH
+		wit, err := txscript.WitnessScript(tx, hCache, i,
+			u.Value, u.PkScript, txscript.SigHashAll, priv, true)
+		return nil, wit, err
+
+	case portxo.TxoP2WSHComp: // witness script hash
+		sig, err := txscript.RawTxInWitnessSignature(tx, hCache, i,
+			u.Value, u.PkScript, txscript.SigHashAll, priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		// witness stack has the signature, items, then the previous full script
+		wit := make([][]byte, 2+len(u.PreSigStack))
+
+		// sig comes first (pushed to stack last)
+		wit[0] = sig
+
+		// after stack comes PostSigStack items
+		for j, element := range u.PreSigStack {
+			wit[j+1] = element
+		}
+
+		// last stack item is the pkscript
+		wit[len(wit)-1] = u.PkScript
+		return nil, wit, nil
+	}
+	return nil, nil, fmt.Errorf("can't sign input %d, unknown mode %s",
+		i, u.Mode.String())
+}
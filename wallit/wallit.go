@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"sync"
 
 	"github.com/adiabat/btcd/blockchain"
@@ -43,6 +42,26 @@ type Wallit struct {
 
 	// From here, comes everything. It's a secret to everybody.
 	rootPrivKey *hdkeychain.ExtendedKey
+
+	// Watch-only wallits don't have a rootPrivKey; they have the account
+	// level (m/44'/coin'/account') public key instead, and which account
+	// it's for.  They can see everything but can't sign anything.
+	acctPubKey   *hdkeychain.ExtendedKey
+	watchAccount uint32
+}
+
+// WatchOnly is true when the wallit has no private keys.
+func (w *Wallit) WatchOnly() bool {
+	return w.rootPrivKey == nil
+}
+
+// defaultAccount is the account NewAdr and MaybeSend use: account 0, or a
+// watch-only wallit's only account.
+func (w *Wallit) defaultAccount() uint32 {
+	if w.WatchOnly() {
+		return w.watchAccount
+	}
+	return 0
 }
 
 type FrozenTx struct {
@@ -125,32 +144,31 @@ func (s *Stxo) ToBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Doesn't work
 // StxoFromBytes turns bytes into a Stxo.
-// first 36 bytes are how it's spent, after that is portxo
+// The portxo comes first, then 4 bytes of spend height and the 32 byte txid
+// it was spent in, same as ToBytes.
 func StxoFromBytes(b []byte) (Stxo, error) {
 	var s Stxo
 	if len(b) < 96 {
 		return s, fmt.Errorf("Got %d bytes for stxo, expect a bunch", len(b))
 	}
-	buf := bytes.NewBuffer(b)
-	// read 4 byte spend height
-	err := binary.Read(buf, binary.BigEndian, &s.SpendHeight)
+	u, err := portxo.PorTxoFromBytes(b[:len(b)-36])
 	if err != nil {
 		return s, err
 	}
-	// read 32 byte txid
-	err = s.SpendTxid.SetBytes(buf.Next(32))
+	s.PorTxo = *u // assign the utxo
+
+	buf := bytes.NewBuffer(b[len(b)-36:])
+	// read 4 byte spend height
+	err = binary.Read(buf, binary.BigEndian, &s.SpendHeight)
 	if err != nil {
 		return s, err
 	}
-
-	u, err := portxo.PorTxoFromBytes(buf.Bytes())
+	// read 32 byte txid
+	err = s.SpendTxid.SetBytes(buf.Next(32))
 	if err != nil {
-		log.Printf(" eof? ")
 		return s, err
 	}
-	s.PorTxo = *u // assign the utxo
 
 	return s, nil
 }